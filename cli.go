@@ -0,0 +1,502 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/factoids"
+	"github.com/obsproject/obscommits/internal/perms"
+	"github.com/obsproject/obscommits/internal/persist"
+	"golang.org/x/net/context"
+)
+
+// subcommand works with the files of the bot instead of running it, it is
+// run as obscommits [-config file] <name> [flags] [args]
+type subcommand struct {
+	Name        string
+	Args        string
+	Description string
+	// State is whether the command loads the state through the packages of
+	// the bot, which saves it, so it is refused while the bot is running
+	State bool
+	// ReadOnly is whether the command loads the state without ever saving
+	// or migrating it
+	ReadOnly bool
+	Run      func(ctx context.Context, args []string) error
+}
+
+var errUsage = fmt.Errorf("invalid arguments")
+
+// the address send-webhook sends to, the website address of the config if
+// empty
+var webhookAddr string
+
+var subcommands = []subcommand{
+	{
+		Name:        "state dump",
+		Description: "prints every state as json, without changing anything",
+		Run:         stateDump,
+	},
+	{
+		Name:        "state inspect",
+		Args:        "<file>",
+		Description: "prints the states in a gob, json or kv file as json, without changing it",
+		Run:         stateInspect,
+	},
+	{
+		Name:        "factoids list",
+		Description: "lists the factoids and their aliases",
+		ReadOnly:    true,
+		Run:         factoidsList,
+	},
+	{
+		Name:        "factoids get",
+		Args:        "<name>",
+		Description: "prints the factoid, names of aliases are resolved",
+		ReadOnly:    true,
+		Run:         factoidsGet,
+	},
+	{
+		Name:        "factoids set",
+		Args:        "<name> <text>",
+		Description: "adds or modifies the factoid",
+		State:       true,
+		Run:         factoidsSet,
+	},
+	{
+		Name:        "factoids import",
+		Args:        "<file>",
+		Description: "adds the factoids and aliases in the json file written by export, - is stdin",
+		State:       true,
+		Run:         factoidsImport,
+	},
+	{
+		Name:        "factoids export",
+		Args:        "[file]",
+		Description: "writes the factoids and aliases as json to the file or stdout",
+		ReadOnly:    true,
+		Run:         factoidsExport,
+	},
+	{
+		Name:        "admins list",
+		Description: "lists the roles granted to accounts and hosts",
+		ReadOnly:    true,
+		Run:         adminsList,
+	},
+	{
+		Name:        "admins add",
+		Args:        "<role> <account|host:mask> [#channel]",
+		Description: "grants the role, only in the channel if given",
+		State:       true,
+		Run:         adminsAdd,
+	},
+	{
+		Name:        "admins remove",
+		Args:        "<role> <account|host:mask> [#channel]",
+		Description: "revokes the role",
+		State:       true,
+		Run:         adminsRemove,
+	},
+	{
+		Name:        "config check",
+		Description: "checks the config file",
+		Run:         configCheck,
+	},
+	{
+		Name:        "send-webhook",
+		Args:        "<event> <payload.json>",
+		Description: "sends the payload to the webhook of the running bot, the event is a GitHub event like push or travis",
+		Run:         sendWebhook,
+	},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [flags] [command]\n\nWithout a command the bot is run. The flags are:\n", os.Args[0])
+	flag.PrintDefaults()
+
+	fmt.Fprintln(w, "\nThe commands are:")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, "  %s %s\n", cmd.Name, cmd.Args)
+		fmt.Fprintf(w, "    \t%s\n", cmd.Description)
+	}
+	fmt.Fprintln(w, "\nThe commands that use the state refuse to run while the bot is running\nunless -force is given after the command. send-webhook takes -addr to send\nto another address than the website address in the config.")
+}
+
+// runCommand runs the subcommand in the arguments and returns the exit code
+func runCommand(args []string) int {
+	var cmd *subcommand
+	for i := range subcommands {
+		words := strings.Fields(subcommands[i].Name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == subcommands[i].Name {
+			cmd = &subcommands[i]
+			args = args[len(words):]
+			break
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(args, " "))
+		usage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n", os.Args[0], cmd.Name, cmd.Args)
+		fs.PrintDefaults()
+	}
+	var force bool
+	if cmd.State {
+		fs.BoolVar(&force, "force", false, "run even if the bot seems to be running")
+	}
+	if cmd.Name == "send-webhook" {
+		fs.StringVar(&webhookAddr, "addr", "", "the address of the bot, like http://localhost:8080")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, err := config.Load(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if cmd.State {
+		if running(ctx) && !force {
+			fmt.Fprintln(os.Stderr, "The bot is running, it would overwrite the changes or lose its own, stop it or pass -force")
+			return 1
+		}
+		ctx = persist.Init(ctx)
+	}
+	if cmd.ReadOnly {
+		ctx = persist.InitReadOnly(ctx)
+	}
+
+	err = cmd.Run(ctx, fs.Args())
+	if cmd.State {
+		if cerr := persist.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	switch {
+	case err == errUsage:
+		fs.Usage()
+		return 2
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// localURL returns the url of the website of the bot on this machine
+func localURL(ctx context.Context) string {
+	addr := config.FromContext(ctx).Website.Addr
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// running returns whether the bot answers on its website
+func running(ctx context.Context) bool {
+	client := &http.Client{Timeout: time.Second}
+	res, err := client.Get(localURL(ctx) + "/healthz")
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+
+	return true
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Printf("%s\n", b)
+	return err
+}
+
+func stateDump(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	states, err := persist.Dump(persist.Location(ctx))
+	if err != nil {
+		return err
+	}
+	return printJSON(states)
+}
+
+func stateInspect(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	states, err := persist.Inspect(args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(states)
+}
+
+func loadFactoids() error {
+	if err := factoids.Load(); err != nil {
+		return fmt.Errorf("could not load the factoids: %v", err)
+	}
+	return nil
+}
+
+func printFactoid(f factoids.Factoid) {
+	fmt.Printf("%s: %s\n", f.Name, f.Text)
+	if len(f.Aliases) > 0 {
+		fmt.Printf("  aliases: %s\n", strings.Join(f.Aliases, ", "))
+	}
+}
+
+func factoidsList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if err := loadFactoids(); err != nil {
+		return err
+	}
+
+	for _, f := range factoids.All() {
+		printFactoid(f)
+	}
+	return nil
+}
+
+func factoidsGet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if err := loadFactoids(); err != nil {
+		return err
+	}
+
+	f, ok := factoids.Get(args[0])
+	if !ok {
+		return fmt.Errorf("no factoid with the name %s", args[0])
+	}
+	printFactoid(f)
+	return nil
+}
+
+func factoidsSet(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	if err := loadFactoids(); err != nil {
+		return err
+	}
+
+	return factoids.Set(args[0], strings.Join(args[1:], " "))
+}
+
+func factoidsImport(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if err := loadFactoids(); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := factoids.Import(r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d factoids and aliases\n", n)
+	return nil
+}
+
+func factoidsExport(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	if err := loadFactoids(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return factoids.Export(os.Stdout)
+	}
+
+	b := bytes.NewBuffer(nil)
+	if err := factoids.Export(b); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(args[0], b.Bytes(), 0660)
+}
+
+func adminsList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	perms.Init(ctx)
+
+	for _, l := range perms.Describe("") {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+// grantArgs parses the arguments of admins add and remove, they are the same
+// as the ones of .grant, superadmin can only be given in the config file
+func grantArgs(args []string) (name string, r perms.Role, channel string, err error) {
+	if len(args) < 2 || len(args) > 3 {
+		return "", 0, "", errUsage
+	}
+	if len(args) == 3 {
+		channel = args[2]
+	}
+
+	r, ok := perms.ParseRole(args[0])
+	if !ok || !perms.CanGrant(perms.SuperAdmin, r) {
+		return "", 0, "", fmt.Errorf("invalid role %q", args[0])
+	}
+
+	return args[1], r, channel, nil
+}
+
+func adminsAdd(ctx context.Context, args []string) error {
+	name, r, channel, err := grantArgs(args)
+	if err != nil {
+		return err
+	}
+	perms.Init(ctx)
+
+	perms.Give(name, r, channel)
+	for _, l := range perms.Describe(name) {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+func adminsRemove(ctx context.Context, args []string) error {
+	name, r, channel, err := grantArgs(args)
+	if err != nil {
+		return err
+	}
+	perms.Init(ctx)
+
+	if !perms.Take(name, r, channel) {
+		return fmt.Errorf("%s does not have the role %s", name, r)
+	}
+	return nil
+}
+
+func configCheck(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	fmt.Printf("%s is valid, the irc nick is %s\n", config.Path(), config.FromContext(ctx).IRC.Nick)
+	return nil
+}
+
+func sendWebhook(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	event := args[0]
+
+	payload, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	if !json.Valid(payload) {
+		return fmt.Errorf("%s is not valid json", args[1])
+	}
+
+	base := webhookAddr
+	if base == "" {
+		base = localURL(ctx)
+	}
+	cfg := config.FromContext(ctx)
+
+	// travis sends the payload as a form, github as json
+	var req *http.Request
+	if event == "travis" {
+		form := url.Values{"payload": {string(payload)}}
+		req, err = http.NewRequest("POST", base+cfg.Travis.HookPath, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequest("POST", base+cfg.Github.HookPath, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Github-Event", event)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	fmt.Printf("%s\n%s\n", res.Status, bytes.TrimSpace(body))
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("the bot did not accept the delivery")
+	}
+	return nil
+}
@@ -122,7 +122,7 @@
               <th class="factoid-aliases">Aliases</th>
               <th class="factoid-text">Text</th>
             </tr>
-            {{range .}}
+            {{range .Factoids}}
               <tr>
                 <td class="factoid-name" id="factoid-{{.Name}}">{{.Name}}</td>
                 <td class="factoid-aliases">
@@ -149,79 +149,21 @@
           </div>
           <table class="table">
             <tr>
-              <th colspan="3">Administer factoids</th>
-            </tr>
-            <tr>
-              <td class="command-name">.add</td>
-              <td class="command-arguments"><span class="nobr">&lt;factoid-trigger&gt;</span> <span class="nobr">&lt;factoid-text&gt;</span></td>
-              <td class="command-description">The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed.<br/>This command adds a new factoid.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.mod</td>
-              <td class="command-arguments"><span class="nobr">&lt;factoid-trigger&gt;</span> <span class="nobr">&lt;factoid-text&gt;</span></td>
-              <td class="command-description">The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed.<br/>This command modifies an existing factoid.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.del</td>
-              <td class="command-arguments"><span class="nobr">&lt;factoid-trigger&gt;</span></td>
-              <td class="command-description">This command deletes an existing factoid with the given trigger and all of its aliases.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.rename</td>
-              <td class="command-arguments"><span class="nobr">&lt;old-factoid-trigger&gt;</span> <span class="nobr">&lt;new-factoid-trigger&gt;</span></td>
-              <td class="command-description">This command renames an existing factoid to the new trigger, the new trigger must not exist beforehand. Also updates the aliases.</td>
-            </tr>
-
-            <tr>
-              <th colspan="3">Administer factoid aliases</th>
-            </tr>
-            <tr>
-              <td class="command-name">.addalias</td>
-              <td class="command-arguments"><span class="nobr">&lt;alias-trigger&gt;</span> <span class="nobr">&lt;factoid-trigger&gt;</span></td>
-              <td class="command-description">The alias-trigger will trigger the factoid-trigger.<br/>This command adds a new alias.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.modalias</td>
-              <td class="command-arguments"><span class="nobr">&lt;alias-trigger&gt;</span> <span class="nobr">&lt;factoid-trigger&gt;</span></td>
-              <td class="command-description">The alias-trigger will trigger the factoid-trigger.<br/>This command modifies an existing alias.</td>
-            </tr>
-            <tr>
-              <td class="command-name">.delalias</td>
-              <td class="command-arguments"><span class="nobr">&lt;alias-trigger&gt;</span></td>
-              <td class="command-description">This command deletes an existing alias with the given trigger.</td>
-            </tr>
-
-            <tr>
-              <th colspan="3">Administer administrators</th>
-            </tr>
-            <tr>
-              <td class="command-name">.addadmin</td>
-              <td class="command-arguments"><span class="nobr">&lt;host&gt;</span></td>
-              <td class="command-description">Adds an administrator identified by the given host (&quot;Jim.users.quakenet.org&quot;)<br/>Works because of QuakeNet's host-masking feature (and for static-ips of course)</td>
-            </tr>
-            <tr>
-              <td class="command-name">.deladmin</td>
-              <td class="command-arguments"><span class="nobr">&lt;host&gt;</span></td>
-              <td class="command-description">Deletes an administrator with the given host</td>
-            </tr>
-
-            <tr>
-              <th colspan="3">Raw irc protocol access</th>
-            </tr>
-            <tr>
-              <td class="command-name">.raw</td>
-              <td class="command-arguments"><span class="nobr">&lt;irc-protocol&gt;</span></td>
-              <td class="command-description">Send everything after the command as-is to the IRC server<br/>Example: &quot;.raw PRIVMSG #obsproject :needs the colons so that space-separated things are not seen as arguments&quot;</td>
-            </tr>
-
-            <tr>
-              <th colspan="3">Download backup</th>
-            </tr>
-            <tr>
-              <td class="command-name">.downloadstate</td>
-              <td class="command-arguments"></td>
-              <td class="command-description">Generates a link that automatically disables itself after accessing it or after 5 minutes. The link downloads a zip file that contains the bot configuration including factoids, aliases, etc.</td>
+              <td colspan="4">Roles from lowest to highest: {{range $i, $r := .Roles}}{{if $i}}, {{end}}{{$r}}{{end}}. Every role includes the ones below it, superadmins can only be set in the config file.</td>
             </tr>
+            {{range .Commands}}
+              <tr>
+                <th colspan="4">{{.Name}}</th>
+              </tr>
+              {{range .Commands}}
+                <tr>
+                  <td class="command-name">{{.Name}}</td>
+                  <td class="command-arguments">{{range args .Args}}<span class="nobr">{{.}}</span> {{end}}</td>
+                  <td class="command-role">{{if .Role}}{{.Role}}{{end}}</td>
+                  <td class="command-description">{{.Description}}</td>
+                </tr>
+              {{end}}
+            {{end}}
           </table>
         </div>
       </div>
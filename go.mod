@@ -9,7 +9,6 @@ require (
 	github.com/mvdan/xurls v1.1.0
 	github.com/pelletier/go-toml v1.1.0
 	github.com/stretchr/testify v1.2.1
-	github.com/sztanpet/sirc v0.0.0-20180513080057-87c489121012
 	golang.org/x/net v0.0.0-20180511174649-2491c5de3490
 	golang.org/x/text v0.3.0
 	gopkg.in/sorcix/irc.v1 v1.1.3
@@ -0,0 +1,100 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/metrics"
+	"github.com/obsproject/obscommits/internal/rss"
+	"golang.org/x/net/context"
+)
+
+// health is what /healthz replies with
+type health struct {
+	IRC struct {
+		Connected  bool `json:"connected"`
+		Reconnects int  `json:"reconnects"`
+		Queued     int  `json:"queued"`
+	} `json:"irc"`
+	Feeds map[string]feedHealth `json:"feeds"`
+}
+
+type feedHealth struct {
+	// LastSuccess is nil if the feed was not fetched yet
+	LastSuccess *time.Time `json:"last_success"`
+	// AgeSeconds is how long ago the feed was last fetched, -1 if it was not
+	// yet
+	AgeSeconds int64 `json:"age_seconds"`
+}
+
+// initMonitoring registers the metrics of the IRC connection and the
+// /metrics and /healthz endpoints
+func initMonitoring(ctx context.Context) {
+	c := ircconn.FromContext(ctx)
+	metrics.NewGaugeFunc("obscommits_irc_connected", "Whether the bot is connected to the IRC server.", func() float64 {
+		if c.Stats().Connected {
+			return 1
+		}
+		return 0
+	})
+	metrics.NewCounterFunc("obscommits_irc_reconnects_total", "Reconnections to the IRC server.", func() float64 {
+		return float64(c.Stats().Reconnects)
+	})
+	metrics.NewGaugeFunc("obscommits_irc_queue_depth", "Messages waiting to be sent to IRC.", func() float64 {
+		return float64(c.Stats().Queued)
+	})
+
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		handleHealth(w, c)
+	})
+}
+
+// handleHealth reports the state of the IRC connection and the feeds, the
+// status is 503 while IRC is not connected
+func handleHealth(w http.ResponseWriter, c *ircconn.IConn) {
+	var h health
+	stats := c.Stats()
+	h.IRC.Connected = stats.Connected
+	h.IRC.Reconnects = stats.Reconnects
+	h.IRC.Queued = stats.Queued
+
+	h.Feeds = map[string]feedHealth{}
+	for feed, t := range rss.LastPolls() {
+		fh := feedHealth{AgeSeconds: -1}
+		if !t.IsZero() {
+			t := t
+			fh.LastSuccess = &t
+			fh.AgeSeconds = int64(time.Since(t) / time.Second)
+		}
+		h.Feeds[feed] = fh
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !h.IRC.Connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&h)
+}
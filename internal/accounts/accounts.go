@@ -0,0 +1,275 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package accounts keeps track of which services account the users on IRC
+// are logged in as, it uses the IRCv3 account-tag, account-notify and
+// extended-join capabilities when the server supports them, and falls back to
+// WHOX lookups otherwise
+package accounts
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"gopkg.in/sorcix/irc.v1"
+)
+
+// Caps are the capabilities the tracker makes use of, they have to be requested
+// when connecting
+var Caps = []string{"account-tag", "account-notify", "extended-join"}
+
+const (
+	// an arbitrary number identifying our WHOX queries
+	whoxToken = "174"
+	// WHOX reply numeric
+	rplWhoSpcRpl = "354"
+	// how long a looked up account is trusted for
+	cacheTTL = 10 * time.Minute
+	// how long to wait for a WHOX reply before asking again
+	lookupTimeout = 30 * time.Second
+)
+
+// Conn is the part of the irc connection the tracker needs
+type Conn interface {
+	Write(*irc.Message)
+	HasCap(string) bool
+}
+
+type entry struct {
+	// mask is the user@host the account was seen with, the entry does not
+	// apply to anyone else using the nick
+	mask    string
+	account string
+	at      time.Time
+	// the channels the user was seen joining, the entry is dropped once the
+	// user left them, as the nick could then change hands unnoticed
+	channels map[string]bool
+}
+
+type lookup struct {
+	sent time.Time
+	fns  []func(account string)
+}
+
+// Tracker caches the accounts of nick!user@host masks and resolves unknown
+// ones
+type Tracker struct {
+	mu      sync.Mutex
+	cache   map[string]entry
+	pending map[string]*lookup
+}
+
+// NewTracker returns an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		cache:   map[string]entry{},
+		pending: map[string]*lookup{},
+	}
+}
+
+func key(nick string) string {
+	return strings.ToLower(nick)
+}
+
+func mask(user, host string) string {
+	return strings.ToLower(user + "@" + host)
+}
+
+// an asterisk or a zero means the user is not logged in
+func normalize(account string) string {
+	if account == "*" || account == "0" {
+		return ""
+	}
+
+	return account
+}
+
+func (t *Tracker) set(nick, mask, account string) {
+	e := t.cache[key(nick)]
+	if e.mask != mask {
+		e.channels = nil
+	}
+	e.mask, e.account, e.at = mask, normalize(account), time.Now()
+	t.cache[key(nick)] = e
+}
+
+// joined remembers that the user is in the channel
+func (t *Tracker) joined(p *irc.Prefix, channel string) {
+	e, ok := t.cache[key(p.Name)]
+	if !ok || e.mask != mask(p.User, p.Host) {
+		return
+	}
+	if e.channels == nil {
+		e.channels = map[string]bool{}
+	}
+	e.channels[strings.ToLower(channel)] = true
+	t.cache[key(p.Name)] = e
+}
+
+// left forgets the account of the user once there is no channel left where
+// the user is seen, the ones looked up are not known to be in any channel
+func (t *Tracker) left(nick, channel string) {
+	e, ok := t.cache[key(nick)]
+	if !ok {
+		return
+	}
+	delete(e.channels, strings.ToLower(channel))
+	if len(e.channels) == 0 {
+		delete(t.cache, key(nick))
+	}
+}
+
+// Observe updates the cache based on the message, returns true if the message
+// was a reply to a lookup and should not be handled any further
+func (t *Tracker) Observe(c Conn, m *ircconn.Message) bool {
+	t.mu.Lock()
+
+	switch m.Command {
+	case irc.JOIN:
+		// extended-join: :nick!user@host JOIN #channel account :realname
+		if m.Prefix == nil || len(m.Params) == 0 {
+			break
+		}
+		if len(m.Params) > 1 && c.HasCap("extended-join") {
+			t.set(m.Prefix.Name, mask(m.Prefix.User, m.Prefix.Host), m.Params[1])
+		}
+		t.joined(m.Prefix, m.Params[0])
+	case "ACCOUNT":
+		// account-notify: :nick!user@host ACCOUNT account
+		if m.Prefix != nil && len(m.Params) > 0 {
+			t.set(m.Prefix.Name, mask(m.Prefix.User, m.Prefix.Host), m.Params[0])
+		}
+	case irc.PART:
+		// :nick!user@host PART #channel[,#channel] :reason
+		if m.Prefix == nil || len(m.Params) == 0 {
+			break
+		}
+		for _, channel := range strings.Split(m.Params[0], ",") {
+			t.left(m.Prefix.Name, channel)
+		}
+	case irc.KICK:
+		// :op!user@host KICK #channel nick :reason
+		if len(m.Params) > 1 {
+			t.left(m.Params[1], m.Params[0])
+		}
+	case irc.NICK:
+		if m.Prefix == nil || len(m.Params) == 0 {
+			break
+		}
+		if e, ok := t.cache[key(m.Prefix.Name)]; ok {
+			delete(t.cache, key(m.Prefix.Name))
+			t.cache[key(m.Params[0])] = e
+		}
+	case irc.QUIT:
+		if m.Prefix != nil {
+			delete(t.cache, key(m.Prefix.Name))
+		}
+	case rplWhoSpcRpl:
+		// :server 354 ournick token user host nick account
+		if len(m.Params) < 6 || m.Params[1] != whoxToken {
+			break
+		}
+
+		t.set(m.Params[4], mask(m.Params[2], m.Params[3]), m.Params[5])
+		t.finish(m.Params[4])
+		return true
+	case irc.RPL_ENDOFWHO:
+		// :server 315 ournick nick :End of /WHO list.
+		if len(m.Params) < 2 {
+			break
+		}
+		if _, ok := t.pending[key(m.Params[1])]; !ok {
+			break
+		}
+
+		// no WHOX reply means the server does not support it or the user is
+		// gone, either way there is no account to be found, without a mask the
+		// entry is only used by the pending callbacks
+		if _, ok := t.cache[key(m.Params[1])]; !ok {
+			t.set(m.Params[1], "", "")
+		}
+		t.finish(m.Params[1])
+		return true
+	}
+
+	t.mu.Unlock()
+	return false
+}
+
+// finish unlocks the tracker and runs the callbacks waiting on the lookup of
+// the nick, the lock has to be held by the caller
+func (t *Tracker) finish(nick string) {
+	l, ok := t.pending[key(nick)]
+	delete(t.pending, key(nick))
+	account := t.cache[key(nick)].account
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, fn := range l.fns {
+		fn(account)
+	}
+}
+
+// Resolve calls fn with the account of the sender of the message, an empty
+// account means the user is not logged in. If the account is not known, a
+// WHOX lookup is sent and fn is called when the reply arrives
+func (t *Tracker) Resolve(c Conn, m *ircconn.Message, fn func(account string)) {
+	if m.Prefix == nil || m.Prefix.Name == "" {
+		fn("")
+		return
+	}
+
+	// the most reliable source, the server tells us with every message
+	if c.HasCap("account-tag") {
+		fn(m.Tag("account"))
+		return
+	}
+
+	nick := m.Prefix.Name
+	t.mu.Lock()
+	if e, ok := t.cache[key(nick)]; ok && e.mask != "" && e.mask == mask(m.Prefix.User, m.Prefix.Host) && time.Since(e.at) < cacheTTL {
+		t.mu.Unlock()
+		fn(e.account)
+		return
+	}
+
+	l, ok := t.pending[key(nick)]
+	if !ok {
+		l = &lookup{}
+		t.pending[key(nick)] = l
+	}
+	l.fns = append(l.fns, fn)
+	send := !ok || time.Since(l.sent) > lookupTimeout
+	if send {
+		l.sent = time.Now()
+	}
+	t.mu.Unlock()
+
+	if send {
+		c.Write(&irc.Message{
+			Command: irc.WHO,
+			Params:  []string{nick, "%tuhna," + whoxToken},
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package accounts
+
+import (
+	"testing"
+
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"gopkg.in/sorcix/irc.v1"
+)
+
+type fakeConn struct {
+	caps    map[string]bool
+	written []string
+}
+
+func (c *fakeConn) Write(m *irc.Message)    { c.written = append(c.written, m.String()) }
+func (c *fakeConn) HasCap(name string) bool { return c.caps[name] }
+
+func resolve(t *testing.T, tr *Tracker, c *fakeConn, line string) (account string, called bool) {
+	m := ircconn.ParseMessage(line)
+	if m == nil {
+		t.Fatalf("could not parse %q", line)
+	}
+
+	tr.Resolve(c, m, func(a string) {
+		account = a
+		called = true
+	})
+	return
+}
+
+func observe(tr *Tracker, c *fakeConn, line string) bool {
+	return tr.Observe(c, ircconn.ParseMessage(line))
+}
+
+func TestAccountTag(t *testing.T) {
+	tr := NewTracker()
+	c := &fakeConn{caps: map[string]bool{"account-tag": true}}
+
+	a, called := resolve(t, tr, c, "@account=Jim :jim!j@host PRIVMSG #obs :.raw")
+	if !called || a != "Jim" {
+		t.Fatalf("unexpected account %q %v", a, called)
+	}
+
+	a, called = resolve(t, tr, c, ":jim!j@host PRIVMSG #obs :.raw")
+	if !called || a != "" || len(c.written) != 0 {
+		t.Fatalf("unexpected account %q %v %v", a, called, c.written)
+	}
+}
+
+func TestExtendedJoinAndNotify(t *testing.T) {
+	tr := NewTracker()
+	c := &fakeConn{caps: map[string]bool{"extended-join": true, "account-notify": true}}
+
+	observe(tr, c, ":jim!j@host JOIN #obs Jim :Jim")
+	a, called := resolve(t, tr, c, ":jim!j@host PRIVMSG #obs :.raw")
+	if !called || a != "Jim" {
+		t.Fatalf("unexpected account %q %v", a, called)
+	}
+
+	observe(tr, c, ":jim!j@host NICK jim2")
+	a, called = resolve(t, tr, c, ":jim2!j@host PRIVMSG #obs :.raw")
+	if !called || a != "Jim" {
+		t.Fatalf("unexpected account after nick change %q %v", a, called)
+	}
+
+	observe(tr, c, ":jim2!j@host ACCOUNT *")
+	a, called = resolve(t, tr, c, ":jim2!j@host PRIVMSG #obs :.raw")
+	if !called || a != "" || len(c.written) != 0 {
+		t.Fatalf("unexpected account after logout %q %v %v", a, called, c.written)
+	}
+}
+
+func TestWHOX(t *testing.T) {
+	tr := NewTracker()
+	c := &fakeConn{}
+
+	a, called := resolve(t, tr, c, ":jim!j@host PRIVMSG #obs :.raw")
+	if called || len(c.written) != 1 || c.written[0] != "WHO jim %tuhna,174" {
+		t.Fatalf("expected a WHOX lookup, got %q %v %v", a, called, c.written)
+	}
+
+	// a second message while the lookup is pending must not send another one
+	var calls int
+	tr.Resolve(c, ircconn.ParseMessage(":jim!j@host PRIVMSG #obs :.del"), func(a string) {
+		if a == "Jim" {
+			calls++
+		}
+	})
+	if len(c.written) != 1 {
+		t.Fatalf("unexpected second lookup %v", c.written)
+	}
+
+	if !observe(tr, c, ":irc.test 354 bot 174 j host jim Jim") {
+		t.Fatal("the WHOX reply was not consumed")
+	}
+	if calls != 1 {
+		t.Fatalf("the pending callback was called %d times", calls)
+	}
+	observe(tr, c, ":irc.test 315 bot jim :End of /WHO list.")
+
+	a, called = resolve(t, tr, c, ":jim!j@host PRIVMSG #obs :.raw")
+	if !called || a != "Jim" || len(c.written) != 1 {
+		t.Fatalf("expected a cached account, got %q %v %v", a, called, c.written)
+	}
+
+	// a server without WHOX support only ends the WHO list
+	resolve(t, tr, c, ":bob!b@host PRIVMSG #obs :.raw")
+	a, called = "", false
+	tr.Resolve(c, ircconn.ParseMessage(":bob!b@host PRIVMSG #obs :.raw"), func(acc string) {
+		a, called = acc, true
+	})
+	if !observe(tr, c, ":irc.test 315 bot bob :End of /WHO list.") || !called || a != "" {
+		t.Fatalf("unexpected account %q %v", a, called)
+	}
+}
+
+func TestForget(t *testing.T) {
+	c := &fakeConn{caps: map[string]bool{"extended-join": true}}
+
+	for _, v := range []struct {
+		name, leave string
+		cached      bool
+	}{
+		{"part", ":jim!j@host PART #obs :bye", false},
+		{"part of several channels", ":jim!j@host PART #dev,#obs", false},
+		{"part of another channel", ":jim!j@host PART #dev", true},
+		{"kick", ":op!o@host KICK #obs jim :out", false},
+		{"kick of someone else", ":op!o@host KICK #obs bob :out", true},
+		{"quit", ":jim!j@host QUIT :bye", false},
+	} {
+		tr := NewTracker()
+		c.written = nil
+		observe(tr, c, ":jim!j@host JOIN #obs Jim :Jim")
+		observe(tr, c, v.leave)
+
+		// the forgotten account is looked up again
+		a, called := resolve(t, tr, c, ":jim!j@host PRIVMSG bot :.raw")
+		lookup := len(c.written) > 0
+		if called != v.cached || lookup == v.cached || (v.cached && a != "Jim") {
+			t.Errorf("%s: unexpected account %q %v %v", v.name, a, called, c.written)
+		}
+	}
+}
+
+func TestNickReuse(t *testing.T) {
+	tr := NewTracker()
+	c := &fakeConn{caps: map[string]bool{"extended-join": true}}
+
+	observe(tr, c, ":jim!j@host JOIN #obs Jim :Jim")
+	// someone else with the nick of jim does not get the account of jim
+	a, called := resolve(t, tr, c, ":jim!evil@elsewhere PRIVMSG bot :.raw")
+	if called || len(c.written) != 1 || c.written[0] != "WHO jim %tuhna,174" {
+		t.Fatalf("expected a WHOX lookup, got %q %v %v", a, called, c.written)
+	}
+
+	observe(tr, c, ":irc.test 354 bot 174 evil elsewhere jim 0")
+	a, called = resolve(t, tr, c, ":jim!evil@elsewhere PRIVMSG bot :.raw")
+	if !called || a != "" || len(c.written) != 1 {
+		t.Fatalf("unexpected account %q %v %v", a, called, c.written)
+	}
+}
@@ -26,26 +26,51 @@ import (
 	"net/url"
 	"regexp"
 	"sync"
+	"time"
 
 	"github.com/obsproject/obscommits/internal/config"
 	"github.com/obsproject/obscommits/internal/debug"
-	"github.com/sztanpet/sirc"
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/metrics"
+	"github.com/obsproject/obscommits/internal/recovery"
 	"golang.org/x/net/context"
-	"gopkg.in/sorcix/irc.v1"
 )
 
 var (
 	loglinkre  = regexp.MustCompile(`pastebin\.com/[a-zA-Z0-9]+|gist\.github\.com/(?:anonymous/)?([a-f0-9]+)`)
 	analyzerre = regexp.MustCompile(`id="analyzer\-summary" data\-major\-issues="(\d+)" data\-minor\-issues="(\d+)">`)
+	mu         sync.Mutex
 	anurl      string
+
+	requests = metrics.NewCounter("obscommits_analyzer_requests_total", "Log analyzer requests by outcome.", "outcome")
+	latency  = metrics.NewHistogram("obscommits_analyzer_request_duration_seconds", "How long the log analyzer took to reply.", metrics.DefBuckets)
 )
 
 func Init(ctx context.Context) context.Context {
-	anurl = config.FromContext(ctx).Analyzer.URL
+	setURL(config.FromContext(ctx).Analyzer.URL)
+	config.OnReload(config.Hook{
+		Name: "analyzer",
+		Apply: func(old, cfg *config.AppConfig) {
+			setURL(cfg.Analyzer.URL)
+		},
+	})
+
 	return ctx
 }
 
-func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
+func setURL(u string) {
+	mu.Lock()
+	anurl = u
+	mu.Unlock()
+}
+
+func getURL() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return anurl
+}
+
+func Handle(c ircconn.Conn, m *ircconn.Message) (abort bool) {
 	if !loglinkre.MatchString(m.Trailing) {
 		return
 	}
@@ -55,6 +80,7 @@ func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
 	linechan := make(chan string, len(links))
 	query := url.Values{}
 	seenlinks := make(map[string]bool)
+	base := getURL()
 
 	for _, v := range links {
 		if _, ok := seenlinks[v[0]]; ok {
@@ -66,7 +92,7 @@ func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
 		} else {
 			query.Set("url", v[0])
 		}
-		url := anurl + query.Encode()
+		url := base + query.Encode()
 		wg.Add(1)
 		go analyzePastebin(url, m.Prefix.Name, linechan, &wg)
 	}
@@ -91,25 +117,32 @@ func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
 
 func analyzePastebin(url, nick string, linechan chan string, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer recovery.Recover("analyzer")
 
+	start := time.Now()
 	resp, err := http.Get(url)
 	if err != nil {
+		requests.Inc("error")
 		d.D("error getting link:", err)
 		return
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	latency.Observe(time.Since(start).Seconds())
 	if err != nil {
+		requests.Inc("error")
 		d.D("could not ReadAll the response body", err)
 		return
 	}
 
 	issuecount := analyzerre.FindSubmatch(body)
 	if len(issuecount) <= 0 {
+		requests.Inc("no_summary")
 		d.D("did not find analyzer-summary, url was", url)
 		return
 	}
+	requests.Inc("ok")
 
 	majorcount := string(issuecount[1])
 	minorcount := string(issuecount[2])
@@ -118,23 +151,10 @@ func analyzePastebin(url, nick string, linechan chan string, wg *sync.WaitGroup)
 	linechan <- line
 }
 
-func writeLines(c *sirc.IConn, m *irc.Message, lines []string) {
-	l := len(lines)
-	t := c.Target(m)
-
-	if l == 0 {
+func writeLines(c ircconn.Conn, m *ircconn.Message, lines []string) {
+	if len(lines) == 0 {
 		return
 	}
 
-	if l > 5 {
-		lines = lines[:5]
-	}
-
-	for _, l := range lines {
-		c.Write(&irc.Message{
-			Command:  irc.PRIVMSG,
-			Params:   []string{t},
-			Trailing: l,
-		})
-	}
+	c.Queue(ircconn.Normal, c.Target(m), "analyzer results", lines...)
 }
@@ -0,0 +1,238 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package audit keeps an append-only log of the admin commands, who ran
+// them, where and what came of it, the log can be queried from IRC and on
+// the website and some of the commands are mirrored to a staff channel
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/sink"
+	"golang.org/x/net/context"
+)
+
+// the number of entries kept in memory for the queries
+const maxRecent = 1000
+
+// Entry is a single admin command
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Nick    string    `json:"nick"`
+	Host    string    `json:"host"`
+	Account string    `json:"account,omitempty"`
+	Channel string    `json:"channel,omitempty"`
+	Command string    `json:"command"`
+	Args    string    `json:"args,omitempty"`
+	Outcome string    `json:"outcome"`
+}
+
+// String returns the entry on a single line
+func (e Entry) String() string {
+	s := e.Time.UTC().Format("2006-01-02 15:04:05") + " " + e.Nick
+	if e.Account != "" {
+		s += " (" + e.Account + ")"
+	}
+	if e.Channel != "" {
+		s += " in " + e.Channel
+	}
+	s += ": " + e.Command
+	if e.Args != "" {
+		s += " " + e.Args
+	}
+
+	return s + " -> " + e.Outcome
+}
+
+// Log is the audit log
+type Log struct {
+	mu     sync.Mutex
+	f      *os.File
+	recent []Entry
+	mirror map[string]bool
+	out    *sink.Router
+}
+
+var current struct {
+	sync.RWMutex
+	l *Log
+}
+
+// Init opens the log file, the sinks have to be in the context already
+func Init(ctx context.Context) context.Context {
+	cfg := config.FromContext(ctx).Audit
+	l, err := Open(cfg.Path)
+	if err != nil {
+		d.F("Could not open the audit log: %v", err)
+	}
+	l.setMirror(cfg.Mirror)
+	l.out = sink.FromContext(ctx).MustRouter(sink.Routes(cfg.Routes, cfg.Channel))
+
+	reg := sink.FromContext(ctx)
+	config.OnReload(config.Hook{
+		Name: "audit",
+		Check: func(cfg *config.AppConfig) error {
+			return reg.Check(cfg, sink.Routes(cfg.Audit.Routes, cfg.Audit.Channel))
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			l.setMirror(cfg.Audit.Mirror)
+			if err := l.out.Reset(sink.Routes(cfg.Audit.Routes, cfg.Audit.Channel)); err != nil {
+				d.P("Could not reset the audit routes", err)
+			}
+		},
+	})
+
+	current.Lock()
+	current.l = l
+	current.Unlock()
+
+	registerCommands(ctx, l)
+	handle(l)
+
+	return ctx
+}
+
+// Open opens the log file, creating it if needed, the last entries are read
+// into memory
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{f: f}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			d.P("Invalid line in the audit log, skipping it", err)
+			continue
+		}
+		l.add(e)
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) setMirror(names []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.mirror = map[string]bool{}
+	for _, name := range names {
+		l.mirror[strings.ToLower(name)] = true
+	}
+}
+
+// add keeps the entry in memory, the lock needs to be held by the caller
+// unless the log is being opened
+func (l *Log) add(e Entry) {
+	if len(l.recent) == maxRecent {
+		copy(l.recent, l.recent[1:])
+		l.recent = l.recent[:maxRecent-1]
+	}
+	l.recent = append(l.recent, e)
+}
+
+// Record appends the entry to the log and mirrors it if needed
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.add(e)
+	mirror := l.mirror[strings.ToLower(e.Command)]
+	_, err = l.f.Write(append(b, '\n'))
+	l.mu.Unlock()
+
+	if mirror && l.out != nil {
+		l.out.Announce(sink.Announcement{
+			Text:   "[audit] " + e.String(),
+			Source: "Audit",
+			Title:  e.Command + " " + e.Args,
+			Author: e.Nick,
+			Kind:   "admin commands",
+		})
+	}
+
+	return err
+}
+
+// Query returns the last n entries of the nick or account, oldest first,
+// every entry matches an empty nick
+func (l *Log) Query(n int, nick string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ret []Entry
+	for i := len(l.recent) - 1; i >= 0 && len(ret) < n; i-- {
+		e := l.recent[i]
+		if nick != "" && !strings.EqualFold(e.Nick, nick) && !strings.EqualFold(e.Account, nick) {
+			continue
+		}
+		ret = append(ret, e)
+	}
+
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
+
+// Record appends the entry to the audit log, the entry is only logged if
+// the audit log was not initialized yet
+func Record(e Entry) {
+	current.RLock()
+	l := current.l
+	current.RUnlock()
+
+	if l == nil {
+		d.P("Audit log not open yet", e.String())
+		return
+	}
+	if err := l.Record(e); err != nil {
+		d.P("Could not write the audit log", err, e.String())
+	}
+}
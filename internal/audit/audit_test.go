@@ -0,0 +1,97 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, e := range []Entry{
+		{Time: now, Nick: "jp9000", Account: "jim", Channel: "#obs-dev", Command: ".grant", Args: "owner foo", Outcome: "Granted"},
+		{Time: now, Nick: "someone", Host: "some.host", Command: ".add", Args: "foo bar", Outcome: "Added/Modified successfully"},
+		{Time: now, Nick: "Jim2", Account: "jim", Command: ".raw", Args: "QUIT", Outcome: "sent"},
+	} {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// the entries are read back when the log is opened again
+	if l, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if es := l.Query(10, ""); len(es) != 3 || es[0].Command != ".grant" || es[2].Command != ".raw" {
+		t.Fatalf("unexpected entries %+v", es)
+	}
+	if es := l.Query(1, ""); len(es) != 1 || es[0].Command != ".raw" {
+		t.Fatalf("expected the last entry, got %+v", es)
+	}
+	if es := l.Query(10, "JIM"); len(es) != 2 || es[0].Nick != "jp9000" || es[1].Nick != "Jim2" {
+		t.Fatalf("unexpected entries of the account %+v", es)
+	}
+	if es := l.Query(10, "someone"); len(es) != 1 || es[0].Host != "some.host" {
+		t.Fatalf("unexpected entries of the nick %+v", es)
+	}
+
+	s := l.Query(1, "")[0].String()
+	if s != "2018-01-02 03:04:05 Jim2 (jim): .raw QUIT -> sent" {
+		t.Errorf("unexpected line %q", s)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines in the file, got %d", lines)
+	}
+}
+
+func TestRecent(t *testing.T) {
+	l := &Log{}
+	for i := 0; i < maxRecent+10; i++ {
+		l.add(Entry{Args: string(rune('a' + i%26))})
+	}
+
+	if len(l.recent) != maxRecent || l.recent[0].Args != string(rune('a'+10)) {
+		t.Errorf("unexpected recent entries, %d, first %+v", len(l.recent), l.recent[0])
+	}
+}
@@ -0,0 +1,174 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/commands"
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/perms"
+	"golang.org/x/net/context"
+)
+
+const (
+	webPath = "/audit/"
+	// the link to the page can be used until it expires, so that the page
+	// can be reloaded
+	webExpiry = 30 * time.Minute
+	// the most entries that are printed on IRC
+	maxQuery = 20
+)
+
+var page = template.Must(template.New("audit").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Audit log</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Audit log</h1>
+<form method="get"><input name="nick" placeholder="nick or account" value="{{.Nick}}"> <input type="submit" value="Filter"></form>
+<table>
+<tr><th>Time (UTC)</th><th>Nick</th><th>Account</th><th>Host</th><th>Channel</th><th>Command</th><th>Outcome</th></tr>
+{{range .Entries}}<tr><td>{{.Time.UTC.Format "2006-01-02 15:04:05"}}</td><td>{{.Nick}}</td><td>{{.Account}}</td><td>{{.Host}}</td><td>{{.Channel}}</td><td>{{.Command}} {{.Args}}</td><td>{{.Outcome}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// links are the tokens of the links to the page with their expiry
+var links = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+func newLink() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	links.Lock()
+	defer links.Unlock()
+	for t, expires := range links.m {
+		if time.Now().After(expires) {
+			delete(links.m, t)
+		}
+	}
+	links.m[token] = time.Now().Add(webExpiry)
+
+	return token, nil
+}
+
+func validLink(token string) bool {
+	links.Lock()
+	defer links.Unlock()
+
+	expires, ok := links.m[token]
+	return ok && time.Now().Before(expires)
+}
+
+func handle(l *Log) {
+	http.HandleFunc(webPath, func(w http.ResponseWriter, r *http.Request) {
+		if !validLink(strings.TrimPrefix(r.URL.Path, webPath)) {
+			http.NotFound(w, r)
+			return
+		}
+
+		nick := r.FormValue("nick")
+		entries := l.Query(maxRecent, nick)
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		page.Execute(w, struct {
+			Nick    string
+			Entries []Entry
+		}{nick, entries})
+	})
+}
+
+func registerCommands(ctx context.Context, l *Log) {
+	commands.Register(commands.Command{
+		Name:        ".audit",
+		Args:        "[count] [nick] | web",
+		Description: "Prints the last admin commands, 5 by default, optionally only the ones of a nick or account. web generates a link to the whole log that works for 30 minutes.",
+		Group:       "Audit log",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			handleAudit(ctx, l, r)
+		},
+	})
+}
+
+func handleAudit(ctx context.Context, l *Log, r *commands.Request) {
+	args := strings.Fields(r.Args)
+	if len(args) == 1 && args[0] == "web" {
+		token, err := newLink()
+		if err != nil {
+			r.Reply("Could not create the link: ", err.Error())
+			return
+		}
+
+		r.Reply("The audit log (the link expires in 30 minutes): ", config.FromContext(ctx).Website.BaseURL+webPath+token)
+		return
+	}
+
+	n := 5
+	if len(args) > 0 {
+		if i, err := strconv.Atoi(args[0]); err == nil {
+			n, args = i, args[1:]
+		}
+	}
+	if n < 1 || n > maxQuery || len(args) > 1 {
+		r.Reply("Usage: ", r.Name, " [count] [nick] | web, the count is at most ", strconv.Itoa(maxQuery))
+		return
+	}
+
+	var nick string
+	if len(args) == 1 {
+		nick = args[0]
+	}
+
+	entries := l.Query(n, nick)
+	if len(entries) == 0 {
+		r.Reply("No entries found")
+		return
+	}
+	for _, e := range entries {
+		r.Reply(e.String())
+	}
+}
@@ -0,0 +1,270 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package backup
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/persist"
+)
+
+const (
+	manifestName = "manifest.json"
+	// the config is in the backups but it is not restored, a broken config
+	// would keep the bot from starting
+	configName = "settings.cfg"
+	// the most a restored zip can contain once uncompressed
+	maxRestoreSize = 100 << 20
+)
+
+// Manifest describes the contents of a backup
+type Manifest struct {
+	Created time.Time `json:"created"`
+	// Backend is the kind of the storage backend the state files are from
+	Backend string `json:"backend"`
+	Files   []File `json:"files"`
+}
+
+// File is a file in the backup with its checksum
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// write writes a zip of the state files and the config to the path, the
+// states are saved first so that the files are up to date
+func write(path string) (*Manifest, error) {
+	if err := persist.SaveAll(); err != nil {
+		return nil, err
+	}
+
+	files := persist.Files()
+	// the config is left out if it does not exist, like in the tests
+	if _, err := os.Stat(config.Path()); err == nil {
+		files = append(files, config.Path())
+	}
+	man := &Manifest{
+		Created: time.Now().UTC(),
+		Backend: persist.Kind(),
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, p := range files {
+		name := filepath.Base(p)
+		if p == config.Path() {
+			name = configName
+		}
+
+		file, err := addFile(zw, name, p)
+		if err != nil {
+			return nil, err
+		}
+		man.Files = append(man.Files, file)
+	}
+
+	w, err := zw.Create(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(man); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return man, os.Rename(tmpPath, path)
+}
+
+func addFile(zw *zip.Writer, name, path string) (File, error) {
+	ret := File{Name: name}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ret, err
+	}
+	defer f.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return ret, err
+	}
+
+	h := sha256.New()
+	if ret.Size, err = io.Copy(io.MultiWriter(w, h), f); err != nil {
+		return ret, err
+	}
+	ret.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	return ret, nil
+}
+
+// extract checks the zip against its manifest and extracts the state files
+// into the directory
+func extract(path, dir string) (*Manifest, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("not a zip file: %v", err)
+	}
+	defer zr.Close()
+
+	files := map[string]*zip.File{}
+	var total uint64
+	for _, f := range zr.File {
+		if f.Name != filepath.Base(f.Name) || strings.ContainsAny(f.Name, `/\`) ||
+			f.Name == "." || f.Name == ".." {
+			return nil, fmt.Errorf("invalid file name %q", f.Name)
+		}
+		if _, ok := files[f.Name]; ok {
+			return nil, fmt.Errorf("%s is in the zip twice", f.Name)
+		}
+		if total += f.UncompressedSize64; total > maxRestoreSize {
+			return nil, fmt.Errorf("the contents are larger than %d bytes", maxRestoreSize)
+		}
+		files[f.Name] = f
+	}
+
+	mf, ok := files[manifestName]
+	if !ok {
+		return nil, fmt.Errorf("there is no %s", manifestName)
+	}
+	man := &Manifest{}
+	if err := readJSON(mf, man); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", manifestName, err)
+	}
+
+	listed := map[string]bool{manifestName: true}
+	for _, file := range man.Files {
+		f, ok := files[file.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is missing", file.Name)
+		}
+		listed[file.Name] = true
+
+		if err := extractFile(f, file, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range files {
+		if !listed[name] {
+			return nil, fmt.Errorf("%s is not in the manifest", name)
+		}
+	}
+
+	return man, nil
+}
+
+func readJSON(f *zip.File, v interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return json.NewDecoder(io.LimitReader(r, maxRestoreSize)).Decode(v)
+}
+
+// extractFile extracts the file into the directory and checks its checksum
+func extractFile(f *zip.File, file File, dir string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	var w io.Writer = h
+	if file.Name != configName {
+		out, err := os.OpenFile(filepath.Join(dir, file.Name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = io.MultiWriter(out, h)
+	}
+
+	n, err := io.Copy(w, io.LimitReader(r, maxRestoreSize))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file.Name, err)
+	}
+	if n != file.Size || hex.EncodeToString(h.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("the checksum of %s does not match", file.Name)
+	}
+
+	return nil
+}
+
+// restore validates the zip and replaces the state with the one in it,
+// before is called once the zip was found to be valid
+func restore(path string, before func() error) (*Manifest, error) {
+	dir, err := ioutil.TempDir("", "obscommits-restore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	man, err := extract(path, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := before(); err != nil {
+		return nil, err
+	}
+
+	src, err := persist.Open(man.Backend, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	return man, persist.Restore(src)
+}
@@ -0,0 +1,361 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package backup takes snapshots of the state on a schedule, creates the
+// zips of .downloadstate and restores the state from either of them, every
+// backup has a manifest with the checksums of the files that is checked
+// before anything is restored
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/commands"
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/perms"
+	"github.com/obsproject/obscommits/internal/recovery"
+	"golang.org/x/net/context"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	// the milliseconds keep a snapshot taken right after another one, like
+	// the one .restore takes, from replacing it
+	snapshotFormat = "20060102-150405.000"
+	// the names are parsed without them, so that the older snapshots that
+	// do not have them are parsed too
+	snapshotParse = "20060102-150405"
+)
+
+var snapshotRE = regexp.MustCompile(`^snapshot-\d{8}-\d{6}(\.\d{3})?\.zip$`)
+
+type backups struct {
+	mu  sync.Mutex
+	cfg config.Backup
+	// reset wakes up the scheduler when the interval changes
+	reset chan struct{}
+
+	tokens *tokens
+}
+
+// Init starts taking the scheduled snapshots and registers the commands
+func Init(ctx context.Context) context.Context {
+	b := &backups{
+		cfg:    config.FromContext(ctx).Backup,
+		reset:  make(chan struct{}, 1),
+		tokens: newTokens(),
+	}
+	if err := os.MkdirAll(b.cfg.Dir, 0700); err != nil {
+		d.F("Could not create the backup directory: %v", err)
+	}
+	b.tokens.clean(b.cfg.Dir)
+
+	config.OnReload(config.Hook{
+		Name: "backup",
+		Check: func(cfg *config.AppConfig) error {
+			return os.MkdirAll(cfg.Backup.Dir, 0700)
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			b.mu.Lock()
+			b.cfg = cfg.Backup
+			b.mu.Unlock()
+
+			select {
+			case b.reset <- struct{}{}:
+			default:
+			}
+		},
+	})
+
+	b.registerCommands(ctx)
+	b.handle()
+	go b.schedule()
+
+	return ctx
+}
+
+func (b *backups) config() config.Backup {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg
+}
+
+// schedule takes a snapshot every interval, the interval is read again
+// after every snapshot and when the config is reloaded
+func (b *backups) schedule() {
+	for {
+		var tick <-chan time.Time
+		// the config is validated, but without a valid interval nothing is
+		// scheduled rather than taking snapshots in a loop
+		cfg := b.config()
+		if interval, err := time.ParseDuration(cfg.Interval); err == nil && interval > 0 {
+			wait := interval
+			if last, ok := latest(cfg.Dir); ok {
+				wait = time.Until(last.Add(interval))
+			}
+			tick = time.After(wait)
+		}
+
+		select {
+		case <-b.reset:
+			continue
+		case <-tick:
+		}
+
+		recovery.Run("backup snapshot", func() {
+			if name, err := b.snapshot(); err != nil {
+				d.P("Could not take a snapshot", err)
+			} else {
+				d.D("took a snapshot", name)
+			}
+		})
+	}
+}
+
+// snapshot writes a snapshot of the state and removes the old ones
+func (b *backups) snapshot() (string, error) {
+	cfg := b.config()
+	var name string
+	for {
+		name = snapshotPrefix + time.Now().UTC().Format(snapshotFormat) + ".zip"
+		if _, err := os.Stat(filepath.Join(cfg.Dir, name)); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := write(filepath.Join(cfg.Dir, name)); err != nil {
+		return "", err
+	}
+
+	return name, prune(cfg.Dir, cfg.Keep)
+}
+
+// snapshots returns the names of the snapshots in the directory, the newest
+// first
+func snapshots(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, name := range names {
+		if snapshotRE.MatchString(name) {
+			ret = append(ret, name)
+		}
+	}
+
+	// the names sort by the time they were taken
+	sort.Sort(sort.Reverse(sort.StringSlice(ret)))
+	return ret, nil
+}
+
+// latest returns when the last snapshot was taken
+func latest(dir string) (time.Time, bool) {
+	names, err := snapshots(dir)
+	if err != nil || len(names) == 0 {
+		return time.Time{}, false
+	}
+
+	t, err := snapshotTime(names[0])
+	return t, err == nil
+}
+
+func snapshotTime(name string) (time.Time, error) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), ".zip")
+	return time.Parse(snapshotParse, name)
+}
+
+// prune removes every snapshot but the last keep ones, zero keeps all of them
+func prune(dir string, keep int) error {
+	if keep == 0 {
+		return nil
+	}
+
+	names, err := snapshots(dir)
+	if err != nil || len(names) <= keep {
+		return err
+	}
+
+	for _, name := range names[keep:] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotPath returns the path of the snapshot, the name is checked so
+// that nothing outside the backup directory can be restored
+func (b *backups) snapshotPath(name string) (string, error) {
+	if !strings.HasSuffix(name, ".zip") {
+		name += ".zip"
+	}
+	if !snapshotRE.MatchString(name) {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+
+	path := filepath.Join(b.config().Dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("there is no snapshot %q", name)
+	}
+
+	return path, nil
+}
+
+func (b *backups) registerCommands(ctx context.Context) {
+	commands.Register(commands.Command{
+		Name:        ".downloadstate",
+		Description: "Generates a link that automatically disables itself after accessing it or after 5 minutes. The link downloads a zip file that contains the bot configuration including factoids, aliases, etc.",
+		Group:       "Backups",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			go b.handleDownload(ctx, r)
+		},
+	})
+	commands.Register(commands.Command{
+		Name:        ".snapshot",
+		Args:        "[list]",
+		Description: "Takes a snapshot of the state now, or lists the snapshots that can be restored.",
+		Group:       "Backups",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			go b.handleSnapshot(r)
+		},
+	})
+	commands.Register(commands.Command{
+		Name:        ".restore",
+		Args:        "<snapshot|upload>",
+		Description: "Replaces the state with the one in the snapshot, or generates a link that a zip from .downloadstate can be uploaded to within 5 minutes. A snapshot of the current state is taken first.",
+		Group:       "Backups",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			go b.handleRestore(ctx, r)
+		},
+	})
+}
+
+func (b *backups) handleDownload(ctx context.Context, r *commands.Request) {
+	defer recovery.Recover(".downloadstate")
+	token, err := b.tokens.add(download, b.config().Dir, r.Msg.Prefix.Name)
+	if err == nil {
+		_, err = write(b.tokens.path(token))
+	}
+	if err != nil {
+		b.tokens.remove(token)
+		r.Reply("Error while generating zip: " + err.Error())
+		return
+	}
+
+	url := config.FromContext(ctx).Website.BaseURL + downloadPath + token
+	r.Reply("Your one-time use URL (expiring in 5 minutes) is: " + url)
+}
+
+func (b *backups) handleSnapshot(r *commands.Request) {
+	defer recovery.Recover(".snapshot")
+	if r.Args == "list" {
+		names, err := snapshots(b.config().Dir)
+		if err != nil {
+			r.Reply("Could not list the snapshots: " + err.Error())
+			return
+		}
+		if len(names) == 0 {
+			r.Reply("There are no snapshots")
+			return
+		}
+
+		for i, name := range names {
+			names[i] = strings.TrimSuffix(name, ".zip")
+		}
+		r.Reply("Snapshots: " + strings.Join(names, ", "))
+		return
+	}
+
+	name, err := b.snapshot()
+	if err != nil {
+		r.Reply("Could not take a snapshot: " + err.Error())
+		return
+	}
+	r.Reply("Took the snapshot " + strings.TrimSuffix(name, ".zip"))
+}
+
+func (b *backups) handleRestore(ctx context.Context, r *commands.Request) {
+	defer recovery.Recover(".restore")
+	switch r.Args {
+	case "":
+		r.Reply("Usage: .restore <snapshot|upload>")
+	case "upload":
+		token, err := b.tokens.add(upload, b.config().Dir, r.Msg.Prefix.Name)
+		if err != nil {
+			r.Reply("Could not create the link: " + err.Error())
+			return
+		}
+
+		url := config.FromContext(ctx).Website.BaseURL + restorePath + token
+		r.Reply("POST the zip as the \"backup\" field of a form to this one-time use URL (expiring in 5 minutes): " + url)
+	default:
+		path, err := b.snapshotPath(r.Args)
+		if err != nil {
+			r.Reply(err.Error())
+			return
+		}
+
+		name, err := b.restore(path)
+		if err != nil {
+			r.Reply("Nothing was restored: " + err.Error())
+			return
+		}
+		r.Reply("Restored the state, the previous one is in the snapshot " + name)
+	}
+}
+
+// restore takes a snapshot of the current state and restores the backup,
+// returning the name of the snapshot
+func (b *backups) restore(path string) (string, error) {
+	var name string
+	man, err := restore(path, func() (err error) {
+		// the snapshot being restored may be pruned here, it was extracted
+		// already
+		if name, err = b.snapshot(); err != nil {
+			return fmt.Errorf("could not take a snapshot first: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	d.P("Restored the state from", filepath.Base(path), "created at", man.Created)
+	return strings.TrimSuffix(name, ".zip"), nil
+}
@@ -0,0 +1,270 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package backup
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/persist"
+)
+
+// chdir switches to a temporary directory since the states are stored in
+// the working directory
+func chdir(t *testing.T) (string, func()) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		_ = os.Chdir(wd)
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// rewrite copies the zip, replacing the contents of the files with the
+// result of f, files f returns nil for are left out
+func rewrite(t *testing.T, from, to string, f func(name string, data []byte) []byte) {
+	zr, err := zip.OpenReader(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	defer zw.Close()
+	add := func(name string, data []byte) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+
+	for _, file := range zr.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+
+		if data = f(file.Name, data); data != nil {
+			add(file.Name, data)
+		}
+	}
+	if data := f("", nil); data != nil {
+		add("extra.json", data)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, cleanup := chdir(t)
+	defer cleanup()
+
+	m := map[string]string{"foo": "bar"}
+	s, err := persist.New("backuptest", &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "backup.zip")
+	man, err := write(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(man.Files) != 1 || man.Files[0].Name != "backuptest.json" || man.Backend != "json" {
+		t.Fatalf("unexpected manifest %+v", man)
+	}
+
+	for _, tc := range []struct {
+		name string
+		f    func(name string, data []byte) []byte
+		err  string
+	}{
+		{"modified", func(name string, data []byte) []byte {
+			if name == "backuptest.json" {
+				return []byte(strings.Replace(string(data), "bar", "baz", 1))
+			}
+			return data
+		}, "checksum"},
+		{"extra", func(name string, data []byte) []byte {
+			if name == "" {
+				return []byte("{}")
+			}
+			return data
+		}, "not in the manifest"},
+		{"missing", func(name string, data []byte) []byte {
+			if name == "backuptest.json" {
+				return nil
+			}
+			return data
+		}, "missing"},
+		{"no manifest", func(name string, data []byte) []byte {
+			if name == manifestName {
+				return nil
+			}
+			return data
+		}, "no manifest"},
+	} {
+		tampered := filepath.Join(dir, "tampered.zip")
+		rewrite(t, path, tampered, tc.f)
+
+		m["foo"] = "changed"
+		called := false
+		_, err := restore(tampered, func() error { called = true; return nil })
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error about %q, got %v", tc.name, tc.err, err)
+		}
+		if called || m["foo"] != "changed" {
+			t.Errorf("%s: the state was restored", tc.name)
+		}
+	}
+
+	m["foo"] = "changed"
+	m["new"] = "value"
+	if _, err := restore(path, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["foo"] != "bar" {
+		t.Errorf("unexpected state after the restore %v", m)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	dir, cleanup := chdir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "evil.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("../evil.json")
+	io.WriteString(w, "{}")
+	zw.Close()
+	f.Close()
+
+	if _, err := extract(path, dir); err == nil || !strings.Contains(err.Error(), "invalid file name") {
+		t.Errorf("expected an invalid name error, got %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, cleanup := chdir(t)
+	defer cleanup()
+
+	names := []string{
+		"snapshot-20180101-120000.zip",
+		"snapshot-20180102-120000.zip",
+		"snapshot-20180103-120000.zip",
+		"snapshot-20180104-120000.zip",
+		"upload-whatever.zip",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := prune(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	left, err := snapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(left, ",") != "snapshot-20180104-120000.zip,snapshot-20180103-120000.zip" {
+		t.Errorf("unexpected snapshots after pruning %v", left)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "upload-whatever.zip")); err != nil {
+		t.Errorf("pruning removed something else: %v", err)
+	}
+
+	last, ok := latest(dir)
+	if !ok || last.Format(snapshotFormat) != "20180104-120000.000" {
+		t.Errorf("unexpected latest snapshot %v", last)
+	}
+
+	// the safety snapshot of .restore is taken right after the one it
+	// restores
+	b := &backups{cfg: config.Backup{Dir: dir}}
+	first, err := b.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || !snapshotRE.MatchString(first) {
+		t.Errorf("unexpected snapshot names %s and %s", first, second)
+	}
+	if last, ok := latest(dir); !ok || last.Format(snapshotFormat) != strings.TrimSuffix(strings.TrimPrefix(second, snapshotPrefix), ".zip") {
+		t.Errorf("unexpected latest snapshot %v, expected %s", last, second)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens := newTokens()
+	id, err := tokens.add(upload, "dir", "nick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tokenRE.MatchString(id) {
+		t.Fatalf("unexpected token %q", id)
+	}
+
+	if _, ok := tokens.take(download, id); ok {
+		t.Error("an upload token was accepted for a download")
+	}
+	tok, ok := tokens.take(upload, id)
+	if !ok || tok.path != filepath.Join("dir", "upload-"+id+".zip") {
+		t.Fatalf("unexpected token %+v", tok)
+	}
+	if _, ok := tokens.take(upload, id); ok {
+		t.Error("the token was accepted twice")
+	}
+}
@@ -0,0 +1,237 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/audit"
+	"github.com/obsproject/obscommits/internal/debug"
+)
+
+const (
+	downloadPath = "/state/"
+	restorePath  = "/state/restore/"
+	tokenExpiry  = 5 * time.Minute
+)
+
+// 32 random bytes encoded with base64.RawURLEncoding
+var tokenRE = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+type tokenKind string
+
+const (
+	download tokenKind = "download"
+	upload   tokenKind = "upload"
+)
+
+type token struct {
+	kind tokenKind
+	// path is the zip that is downloaded or where the upload is written to
+	path string
+	// by is the nick that asked for the token
+	by    string
+	timer *time.Timer
+}
+
+// tokens are the one-time use links of the downloads and the uploads, they
+// expire after tokenExpiry
+type tokens struct {
+	mu sync.Mutex
+	m  map[string]*token
+}
+
+func newTokens() *tokens {
+	return &tokens{m: map[string]*token{}}
+}
+
+// add creates a token for the nick, the file of it is in the directory
+func (t *tokens) add(kind tokenKind, dir, by string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.m[id] = &token{
+		kind: kind,
+		path: filepath.Join(dir, string(kind)+"-"+id+".zip"),
+		by:   by,
+		timer: time.AfterFunc(tokenExpiry, func() {
+			t.remove(id)
+		}),
+	}
+
+	return id, nil
+}
+
+// path returns the path of the file of the token
+func (t *tokens) path(id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tok, ok := t.m[id]; ok {
+		return tok.path
+	}
+	return ""
+}
+
+// take returns the token and removes it so that it cannot be used again
+func (t *tokens) take(kind tokenKind, id string) (*token, bool) {
+	if !tokenRE.MatchString(id) {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tok, ok := t.m[id]
+	if !ok || tok.kind != kind {
+		return nil, false
+	}
+	tok.timer.Stop()
+	delete(t.m, id)
+
+	return tok, true
+}
+
+// remove removes the token and its file
+func (t *tokens) remove(id string) {
+	t.mu.Lock()
+	tok, ok := t.m[id]
+	delete(t.m, id)
+	t.mu.Unlock()
+
+	if ok {
+		tok.timer.Stop()
+		_ = os.Remove(tok.path)
+	}
+}
+
+// clean removes the files of the tokens that were left behind by a restart
+func (t *tokens) clean(dir string) {
+	for _, kind := range []tokenKind{download, upload} {
+		paths, _ := filepath.Glob(filepath.Join(dir, string(kind)+"-*.zip"))
+		for _, p := range paths {
+			_ = os.Remove(p)
+		}
+	}
+}
+
+func (b *backups) handle() {
+	http.HandleFunc(downloadPath, b.handleDownloadHTTP)
+	http.HandleFunc(restorePath, b.handleRestoreHTTP)
+}
+
+func (b *backups) handleDownloadHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tok, ok := b.tokens.take(download, strings.TrimPrefix(r.URL.Path, downloadPath))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	defer os.Remove(tok.path)
+
+	f, err := os.Open(tok.path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Add("Content-Disposition", "attachment; filename=\"obscommits-backup.zip\"")
+	http.ServeContent(w, r, "obscommits-backup.zip", time.Now(), f)
+}
+
+func (b *backups) handleRestoreHTTP(w http.ResponseWriter, r *http.Request) {
+	// only a POST uses up the token
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tok, ok := b.tokens.take(upload, strings.TrimPrefix(r.URL.Path, restorePath))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	defer os.Remove(tok.path)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRestoreSize)
+	if err := saveUpload(r, tok.path); err != nil {
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e := audit.Entry{
+		Nick:    tok.by,
+		Host:    r.RemoteAddr,
+		Command: ".restore",
+		Args:    "upload",
+	}
+	name, err := b.restore(tok.path)
+	if err != nil {
+		e.Outcome = "Nothing was restored: " + err.Error()
+		audit.Record(e)
+		d.P("Could not restore the uploaded backup", err)
+		http.Error(w, "nothing was restored: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	e.Outcome = "Restored the state, the previous one is in the snapshot " + name
+	audit.Record(e)
+	fmt.Fprintln(w, e.Outcome)
+}
+
+// saveUpload writes the zip in the "backup" field of the form to the path
+func saveUpload(r *http.Request, path string) error {
+	src, _, err := r.FormFile("backup")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, src); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,194 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package commands is the registry of every IRC command the bot knows,
+// modules register their commands at init time, the dispatching and the
+// help (both on IRC and on the website) is generated from the registry
+package commands
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/perms"
+)
+
+// Request is a single invocation of a command
+type Request struct {
+	Conn ircconn.Conn
+	Msg  *ircconn.Message
+	// Name is the name of the command that was invoked
+	Name string
+	// Args is everything after the command name, without leading whitespace
+	Args string
+	// Role is the role of the sender, it is only looked up for commands that
+	// require one, otherwise it is perms.None
+	Role perms.Role
+	// ID is who sent the command, it is only set when the role is looked up
+	ID perms.Identity
+	// Done is called with the outcome of the command, the first reply or
+	// what was passed to Finish, it can be nil
+	Done func(outcome string)
+
+	once sync.Once
+}
+
+// Reply sends a notice to the sender, the first reply is the outcome of the
+// command
+func (r *Request) Reply(args ...string) {
+	r.Conn.Notice(r.Msg, args...)
+	r.Finish(strings.Join(args, ""))
+}
+
+// Finish records the outcome of a command that does not reply, only the
+// first outcome is kept
+func (r *Request) Finish(outcome string) {
+	r.once.Do(func() {
+		if r.Done != nil {
+			r.Done(outcome)
+		}
+	})
+}
+
+// Handler runs the command, it must not block
+type Handler func(r *Request)
+
+// Command describes a command, Name includes the prefix character, either
+// "." for administrative commands or "!" for everything else
+type Command struct {
+	Name string
+	// Args is the syntax of the arguments, like "<factoid-trigger> [nick]"
+	Args        string
+	Description string
+	// Group is the heading the command is listed under in the help
+	Group   string
+	Role    perms.Role
+	Handler Handler
+}
+
+// Group is a set of commands listed under the same heading
+type Group struct {
+	Name     string
+	Commands []*Command
+}
+
+var (
+	mu       sync.RWMutex
+	commands []*Command
+	byName   = map[string]*Command{}
+)
+
+// Register adds the command to the registry, registering a name twice is a
+// programming error and panics
+func Register(cmd Command) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	name := strings.ToLower(cmd.Name)
+	if _, ok := byName[name]; ok {
+		panic("command registered twice: " + cmd.Name)
+	}
+
+	c := &cmd
+	commands = append(commands, c)
+	byName[name] = c
+}
+
+// Match returns the command the line invokes and the arguments of it
+func Match(line string) (*Command, string, bool) {
+	if len(line) < 2 || (line[0] != '.' && line[0] != '!') {
+		return nil, "", false
+	}
+
+	name := line
+	var args string
+	if pos := strings.IndexAny(line, " \t"); pos > 0 {
+		name = line[:pos]
+		args = strings.TrimLeft(line[pos:], " \t")
+	}
+
+	mu.RLock()
+	cmd, ok := byName[strings.ToLower(name)]
+	mu.RUnlock()
+
+	return cmd, args, ok
+}
+
+// Lookup returns the command with the given name, the prefix character can
+// be omitted
+func Lookup(name string) (*Command, bool) {
+	name = strings.ToLower(name)
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if cmd, ok := byName[name]; ok {
+		return cmd, true
+	}
+	for _, prefix := range []string{"!", "."} {
+		if cmd, ok := byName[prefix+name]; ok {
+			return cmd, true
+		}
+	}
+
+	return nil, false
+}
+
+// All returns every command in the order they were registered in
+func All() []*Command {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	ret := make([]*Command, len(commands))
+	copy(ret, commands)
+	return ret
+}
+
+// Groups returns the commands grouped by their heading, in the order the
+// groups were first seen
+func Groups() []Group {
+	var ret []Group
+	index := map[string]int{}
+	for _, cmd := range All() {
+		ix, ok := index[cmd.Group]
+		if !ok {
+			ix = len(ret)
+			index[cmd.Group] = ix
+			ret = append(ret, Group{Name: cmd.Group})
+		}
+		ret[ix].Commands = append(ret[ix].Commands, cmd)
+	}
+
+	return ret
+}
+
+// Usage returns the one line description of the command for IRC
+func (c *Command) Usage() string {
+	s := c.Name
+	if c.Args != "" {
+		s += " " + c.Args
+	}
+	s += " - " + c.Description
+	if c.Role != perms.None {
+		s += " (requires " + c.Role.String() + ")"
+	}
+
+	return s
+}
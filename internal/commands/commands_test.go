@@ -0,0 +1,81 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/obsproject/obscommits/internal/perms"
+)
+
+func TestRegistry(t *testing.T) {
+	Register(Command{Name: "!help", Args: "[command]", Description: "Helps.", Group: "General"})
+	Register(Command{Name: ".add", Args: "<trigger> <text>", Description: "Adds.", Group: "Factoids", Role: perms.FactoidEditor})
+	Register(Command{Name: ".del", Args: "<trigger>", Description: "Deletes.", Group: "Factoids", Role: perms.FactoidEditor})
+
+	cmd, args, ok := Match(".ADD  foo  some text ")
+	if !ok || cmd.Name != ".add" || args != "foo  some text " {
+		t.Fatalf("unexpected match %v %q %v", cmd, args, ok)
+	}
+	if cmd, args, ok = Match("!help"); !ok || cmd.Name != "!help" || args != "" {
+		t.Fatalf("unexpected match %v %q %v", cmd, args, ok)
+	}
+	if _, _, ok = Match(".address"); ok {
+		t.Fatal("matched a prefix of a word")
+	}
+	if _, _, ok = Match("add foo"); ok {
+		t.Fatal("matched without a prefix character")
+	}
+
+	if cmd, ok = Lookup("del"); !ok || cmd.Name != ".del" {
+		t.Fatalf("unexpected lookup %v %v", cmd, ok)
+	}
+	if u := cmd.Usage(); u != ".del <trigger> - Deletes. (requires factoid-editor)" {
+		t.Fatalf("unexpected usage %q", u)
+	}
+
+	g := Groups()
+	if len(g) != 2 || g[0].Name != "General" || len(g[1].Commands) != 2 {
+		t.Fatalf("unexpected groups %#v", g)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice did not panic")
+		}
+	}()
+	Register(Command{Name: ".Add"})
+}
+
+func TestFinish(t *testing.T) {
+	var outcomes []string
+	r := &Request{Done: func(outcome string) {
+		outcomes = append(outcomes, outcome)
+	}}
+
+	r.Finish("first")
+	r.Finish("second")
+	if len(outcomes) != 1 || outcomes[0] != "first" {
+		t.Errorf("unexpected outcomes %v", outcomes)
+	}
+
+	// without Done nothing happens
+	(&Request{}).Finish("ignored")
+}
@@ -21,6 +21,7 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -44,19 +45,88 @@ type Factoids struct {
 	TplPath  string `toml:"tplpath"`
 }
 
+// Templates is where the announcement templates are loaded from, the built
+// in ones are used if Path is empty
+type Templates struct {
+	Path string `toml:"path"`
+}
+
+// Storage is where the state is kept, Backend is either "json" or "kv"
+type Storage struct {
+	Backend string `toml:"backend"`
+	Path    string `toml:"path"`
+}
+
+// Backup is where the backups go, snapshots of the state are taken every
+// Interval and the last Keep of them are kept
+type Backup struct {
+	Dir      string `toml:"dir"`
+	Interval string `toml:"interval"`
+	Keep     int    `toml:"keep"`
+}
+
+// Audit is where the log of the admin commands is written, the commands in
+// Mirror are also announced to the staff channel or the routes
+type Audit struct {
+	Path    string   `toml:"path"`
+	Channel string   `toml:"channel"`
+	Routes  []string `toml:"routes"`
+	Mirror  []string `toml:"mirror"`
+}
+
+// Deliveries is where the webhook deliveries are logged, the last Keep of
+// them are kept, a delivery with the id of another one within Window is
+// dropped
+type Deliveries struct {
+	Dir    string `toml:"dir"`
+	Keep   int    `toml:"keep"`
+	Window string `toml:"window"`
+}
+
+// Alerts is where the alerts about panics go, at most one alert is sent
+// about the same place every Interval
+type Alerts struct {
+	Channel  string   `toml:"channel"`
+	Routes   []string `toml:"routes"`
+	Interval string   `toml:"interval"`
+}
+
 type Debug struct {
 	Debug   bool   `toml:"debug"`
 	Logfile string `toml:"logfile"`
+	// Level is the level logged by default, "debug", "info", "warn" or
+	// "error", Debug turns on the debug level regardless
+	Level string `toml:"level"`
+	// Levels are the levels of the subsystems, like github="debug"
+	Levels map[string]string `toml:"levels"`
+	// Format is either "text" or "json"
+	Format string `toml:"format"`
+	// the log file is rotated once it is larger than MaxSize megabytes or
+	// older than MaxAge, zero and empty disable them, the last Keep rotated
+	// files are kept
+	MaxSize int    `toml:"maxsize"`
+	MaxAge  string `toml:"maxage"`
+	Keep    int    `toml:"keep"`
 }
 
 type Github struct {
-	HookPath     string `toml:"hookpath"`
-	AnnounceChan string `toml:"announcechan"`
+	HookPath     string   `toml:"hookpath"`
+	AnnounceChan string   `toml:"announcechan"`
+	Routes       []string `toml:"routes"`
 }
 
 type Travis struct {
-	HookPath     string `toml:"hookpath"`
-	AnnounceChan string `toml:"announcechan"`
+	HookPath     string   `toml:"hookpath"`
+	AnnounceChan string   `toml:"announcechan"`
+	Routes       []string `toml:"routes"`
+}
+
+// Sink is an incoming webhook that announcements can be routed to
+type Sink struct {
+	// Type is either "discord" or "slack"
+	Type     string `toml:"type"`
+	URL      string `toml:"url"`
+	Username string `toml:"username"`
 }
 
 type IRC struct {
@@ -66,13 +136,43 @@ type IRC struct {
 	UserName string   `toml:"username"`
 	Password string   `toml:"password"`
 	Channels []string `toml:"channels"`
+	// SuperAdmins are services accounts that have every privilege
+	SuperAdmins []string `toml:"superadmins"`
+	// QuitMessage is sent when the bot shuts down
+	QuitMessage string `toml:"quitmessage"`
+
+	TLS         bool   `toml:"tls"`
+	TLSInsecure bool   `toml:"tlsinsecure"`
+	TLSCert     string `toml:"tlscert"`
+	TLSKey      string `toml:"tlskey"`
+
+	SASLMech     string `toml:"saslmech"`
+	SASLUser     string `toml:"sasluser"`
+	SASLPassword string `toml:"saslpassword"`
+
+	Services         string `toml:"services"`
+	ServicesUser     string `toml:"servicesuser"`
+	ServicesPassword string `toml:"servicespassword"`
 }
 
 type RSS struct {
-	ForumURL   string `toml:"forumurl"`
-	ForumChan  string `toml:"forumchan"`
-	MantisURL  string `toml:"mantisurl"`
-	MantisChan string `toml:"mantischan"`
+	ForumURL     string   `toml:"forumurl"`
+	ForumChan    string   `toml:"forumchan"`
+	ForumRoutes  []string `toml:"forumroutes"`
+	MantisURL    string   `toml:"mantisurl"`
+	MantisChan   string   `toml:"mantischan"`
+	MantisRoutes []string `toml:"mantisroutes"`
+}
+
+// Matrix is the account used on a Matrix homeserver, either the access token
+// or the user and password is needed
+type Matrix struct {
+	Homeserver  string `toml:"homeserver"`
+	AccessToken string `toml:"accesstoken"`
+	User        string `toml:"user"`
+	Password    string `toml:"password"`
+	// Rooms are joined on startup, they are room ids or aliases
+	Rooms []string `toml:"rooms"`
 }
 
 type AppConfig struct {
@@ -80,21 +180,54 @@ type AppConfig struct {
 	Debug
 	Factoids
 	Analyzer
+	Templates  `toml:"templates"`
+	Storage    `toml:"storage"`
+	Backup     `toml:"backup"`
+	Audit      `toml:"audit"`
+	Alerts     `toml:"alerts"`
+	Deliveries `toml:"deliveries"`
 	Github
 	Travis
-	IRC `toml:"irc"`
-	RSS `toml:"rss"`
+	IRC    `toml:"irc"`
+	RSS    `toml:"rss"`
+	Matrix `toml:"matrix"`
+	Sinks  map[string]Sink `toml:"sinks"`
 }
 
-var settingsFile *string
+// the flags are parsed by main, so that it can tell the subcommands apart
+// before the config is opened
+var (
+	settingsFile = flag.String("config", "settings.cfg", `path to the config file, it it doesn't exist it will
+			be created with default values`)
+	checkConfig = flag.Bool("check-config", false, "check the config file and exit")
+	dryRun      = flag.Bool("dry-run", false, `instead of connecting to IRC, print what would be sent to
+			stdout and read the lines said in a channel from stdin, the webhook sinks are
+			printed too`)
+)
 
-const sampleconf = `[website]
+const sampleconf = `# every setting can be overridden with an environment variable named after
+# the section and the key, like OBSCOMMITS_IRC_PASSWORD, this way secrets do
+# not have to be stored here, lists are separated by commas
+[website]
 addr=":80"
 baseurl="http://obscommits.sztanpet.net"
 
 [debug]
 debug=false
 logfile="logs/debug.txt"
+# the level logged by default, debug, info, warn or error, the levels of the
+# subsystems can be set below or changed at runtime with .loglevel
+level="info"
+# text or json
+format="text"
+# the log file is rotated once it is larger than maxsize megabytes or older
+# than maxage, like "24h", the last keep rotated files are kept
+maxsize=10
+maxage=""
+keep=5
+
+[debug.levels]
+# github="debug"
 
 [factoids]
 hookpath="/"
@@ -102,12 +235,62 @@ hookpath="/"
 [analyzer]
 url="http://obsproject.com/analyzer?"
 
+[storage]
+# json keeps every state in a json file in the path, kv keeps all of them in
+# a single database file in the path that only the changes are written to,
+# the .state files of older versions are migrated on startup
+backend="json"
+path="state"
+
+[backup]
+# the backups and the downloads of .downloadstate are written here, a
+# snapshot of the state is taken every interval, like "24h", an empty
+# interval disables the snapshots
+dir="backups"
+interval="24h"
+keep=7
+
+[audit]
+# every admin command is appended to the file, the commands in mirror are
+# also announced to the staff channel
+path="audit.log"
+channel=""
+mirror=[".grant", ".revoke", ".raw", ".restore"]
+
+[alerts]
+# a short alert is sent to the admin channel when something panics, at most
+# once every interval for the same place
+channel=""
+interval="10m"
+
+[deliveries]
+# the requests to the github and travis webhooks are written here along with
+# what was announced, they can be looked at and replayed with .deliveries
+# and .replay
+dir="deliveries"
+keep=200
+# the deliveries are processed in the background, GitHub retrying or
+# redelivering the same delivery within the window is ignored, "0" turns
+# this off
+window="1h"
+
+[templates]
+# a file of {{define "name"}}...{{end}} blocks replacing the built in
+# templates, they can also be overridden with the .tpl command, formatting
+# is done with bold, italic, underline, color "red", status and reset, like
+# {{bold .Author}} or {{.Repo | color "lightblue"}}
+path=""
+
 [github]
-hookpath="somethingrandom"
+hookpath="/somethingrandom-github"
 announcechan="#obs-dev"
+# where to announce, a route is the name of a sink and a target separated by a
+# colon, the irc sink needs a channel as the target, the announcechan is used
+# if there are no routes
+# routes=["irc:#obs-dev", "discord-dev"]
 
 [travis]
-hookpath="somethingrandom"
+hookpath="/somethingrandom-travis"
 announcechan="#obs-dev"
 
 [irc]
@@ -117,13 +300,46 @@ username="http://obscommits.sztanpet.net/"
 nick="OBScommits"
 password=""
 channels=["#obs-dev", "#obsproject"]
+# services accounts that have every privilege, only they can use .raw
+superadmins=[]
+quitmessage="Shutting down"
+# tlscert and tlskey are the paths to a client certificate used for CertFP
+tls=false
+tlsinsecure=false
+tlscert=""
+tlskey=""
+# PLAIN or EXTERNAL, if empty SASL is disabled
+saslmech=""
+sasluser=""
+saslpassword=""
+# used if SASL is disabled or fails, "nickserv" or "q"
+services=""
+servicesuser=""
+servicespassword=""
 
 [rss]
 # if url is empty, reporting is disabled
-forumurl=
+forumurl=""
 forumchan="#obsproject"
 mantisurl="https://obsproject.com/mantis/issues_rss.php?"
 mantischan="#obs-dev"
+# forumroutes and mantisroutes work like the routes of github
+
+[matrix]
+# if homeserver is empty, matrix is disabled, announcements are routed to a
+# room with "matrix:<room>", factoids are answered in every joined room
+homeserver=""
+accesstoken=""
+user=""
+password=""
+rooms=[]
+
+# incoming webhooks to announce to, type is either discord or slack
+# [sinks.discord-dev]
+# type="discord"
+# the url can be left out and set with OBSCOMMITS_SINKS_DISCORD_DEV_URL
+# url="https://discordapp.com/api/webhooks/..."
+# username="OBScommits"
 `
 
 var contextKey *int
@@ -133,28 +349,81 @@ func init() {
 }
 
 func Init(ctx context.Context) context.Context {
-	settingsFile = flag.String("config", "settings.cfg", `path to the config file, it it doesn't exist it will
-			be created with default values`)
-	flag.Parse()
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+
+	if *checkConfig {
+		cfg, err := open(*settingsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s is valid, the irc nick is %s\n", *settingsFile, cfg.IRC.Nick)
+		os.Exit(0)
+	}
 
 	f, err := os.OpenFile(*settingsFile, os.O_CREATE|os.O_RDWR, 0660)
 	if err != nil {
-		panic("Could not open " + *settingsFile + " err: " + err.Error())
+		fmt.Fprintln(os.Stderr, "Could not open "+*settingsFile+" err: "+err.Error())
+		os.Exit(1)
 	}
-	defer f.Close()
 
 	// empty? initialize it
 	if info, err := f.Stat(); err == nil && info.Size() == 0 {
 		io.WriteString(f, sampleconf)
 		f.Seek(0, 0)
 	}
+	f.Close()
+
+	cfg, err := open(*settingsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return context.WithValue(ctx, contextKey, &holder{cfg: cfg})
+}
+
+// Load reads the config file without creating it, for the subcommands that
+// work with the files of the bot
+func Load(ctx context.Context) (context.Context, error) {
+	cfg, err := open(Path())
+	if err != nil {
+		return ctx, err
+	}
+
+	return context.WithValue(ctx, contextKey, &holder{cfg: cfg}), nil
+}
 
+// open reads the config file, applies the environment variables and
+// validates the result
+func open(path string) (*AppConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return load(f, path, os.Environ())
+}
+
+func load(r io.Reader, path string, env []string) (*AppConfig, error) {
 	cfg := &AppConfig{}
-	if err := ReadConfig(f, cfg); err != nil {
-		panic("Failed to parse config file, err: " + err.Error())
+	if err := ReadConfig(r, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	if err := applyEnv(cfg, env); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
-	return context.WithValue(ctx, contextKey, cfg)
+	return cfg, nil
 }
 
 func ReadConfig(r io.Reader, d interface{}) error {
@@ -191,7 +460,24 @@ func SafeSave(file string, data interface{}) error {
 	return os.Rename(f.Name(), file)
 }
 
+// Path returns the path of the config file
+func Path() string {
+	return *settingsFile
+}
+
+// DryRun returns whether the bot runs in the dry run mode, where nothing is
+// sent to IRC or the webhooks but printed instead
+func DryRun() bool {
+	return *dryRun
+}
+
+// FromContext returns the current config, it is replaced as a whole on
+// reload so it must not be modified
 func FromContext(ctx context.Context) *AppConfig {
-	cfg, _ := ctx.Value(contextKey).(*AppConfig)
-	return cfg
+	h, _ := ctx.Value(contextKey).(*holder)
+	if h == nil {
+		return nil
+	}
+
+	return h.get()
 }
@@ -0,0 +1,145 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// holder is what is stored in the context, so that the config can be
+// replaced on reload
+type holder struct {
+	mu  sync.RWMutex
+	cfg *AppConfig
+}
+
+func (h *holder) get() *AppConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cfg
+}
+
+func (h *holder) set(cfg *AppConfig) {
+	h.mu.Lock()
+	h.cfg = cfg
+	h.mu.Unlock()
+}
+
+// Hook is how modules apply a reloaded config, Check is called with the new
+// config before anything is changed and can reject it, Apply makes the
+// changes live, both of them are optional
+type Hook struct {
+	Name  string
+	Check func(cfg *AppConfig) error
+	Apply func(old, cfg *AppConfig)
+}
+
+var (
+	hooksMu sync.Mutex
+	hooks   []Hook
+	// only one reload at a time
+	reloadMu sync.Mutex
+)
+
+// OnReload registers the hook, hooks are run in the order they were
+// registered in, so modules initialized later can depend on the earlier
+// ones having applied the config already
+func OnReload(h Hook) {
+	hooksMu.Lock()
+	hooks = append(hooks, h)
+	hooksMu.Unlock()
+}
+
+// Reload reads the config file again, if every hook accepts it, the new
+// config replaces the old one and the hooks apply it, returns the settings
+// that changed but only take effect after a restart
+func Reload(ctx context.Context) ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	h, _ := ctx.Value(contextKey).(*holder)
+	if h == nil {
+		return nil, fmt.Errorf("no config in the context")
+	}
+
+	cfg, err := open(*settingsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return apply(h, cfg)
+}
+
+func apply(h *holder, cfg *AppConfig) ([]string, error) {
+	hooksMu.Lock()
+	hs := make([]Hook, len(hooks))
+	copy(hs, hooks)
+	hooksMu.Unlock()
+
+	for _, hook := range hs {
+		if hook.Check == nil {
+			continue
+		}
+		if err := hook.Check(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", hook.Name, err)
+		}
+	}
+
+	old := h.get()
+	h.set(cfg)
+	for _, hook := range hs {
+		if hook.Apply != nil {
+			hook.Apply(old, cfg)
+		}
+	}
+
+	return restartNeeded(old, cfg), nil
+}
+
+// restartNeeded returns the settings that changed and are only read at
+// startup
+func restartNeeded(old, cfg *AppConfig) []string {
+	// rooms are joined on reload
+	om, m := old.Matrix, cfg.Matrix
+	om.Rooms, m.Rooms = nil, nil
+
+	var ret []string
+	for _, v := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"website.addr", old.Website.Addr, cfg.Website.Addr},
+		{"debug.logfile", old.Debug.Logfile, cfg.Debug.Logfile},
+		{"storage", old.Storage, cfg.Storage},
+		{"audit.path", old.Audit.Path, cfg.Audit.Path},
+		{"deliveries.dir", old.Deliveries.Dir, cfg.Deliveries.Dir},
+		{"matrix", om, m},
+	} {
+		if !reflect.DeepEqual(v.old, v.new) {
+			ret = append(ret, v.name)
+		}
+	}
+
+	return ret
+}
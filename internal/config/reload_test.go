@@ -0,0 +1,80 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	defer func(hs []Hook) { hooks = hs }(hooks)
+	hooks = nil
+
+	old := &AppConfig{}
+	old.IRC.Nick = "OBScommits"
+	h := &holder{cfg: old}
+
+	var applied []string
+	OnReload(Hook{
+		Name: "a",
+		Check: func(cfg *AppConfig) error {
+			if cfg.IRC.Nick == "" {
+				return errors.New("no nick")
+			}
+			return nil
+		},
+		Apply: func(o, cfg *AppConfig) {
+			applied = append(applied, o.IRC.Nick+">"+cfg.IRC.Nick)
+		},
+	})
+	OnReload(Hook{
+		Name: "b",
+		Apply: func(o, cfg *AppConfig) {
+			applied = append(applied, "b")
+		},
+	})
+
+	if _, err := apply(h, &AppConfig{}); err == nil || err.Error() != "a: no nick" {
+		t.Errorf("expected the error of the check, got %v", err)
+	}
+	if h.get() != old || len(applied) != 0 {
+		t.Fatal("a rejected config was applied")
+	}
+
+	cfg := &AppConfig{}
+	cfg.IRC.Nick = "OBS"
+	cfg.Website.Addr = ":8080"
+	cfg.Matrix.Rooms = []string{"#obs:matrix.org"}
+	restart, err := apply(h, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.get() != cfg {
+		t.Error("the config was not replaced")
+	}
+	if want := []string{"OBScommits>OBS", "b"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("expected the hooks to run in order %v, got %v", want, applied)
+	}
+	if want := []string{"website.addr"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("expected %v to need a restart, got %v", want, restart)
+	}
+}
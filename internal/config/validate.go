@@ -0,0 +1,354 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of the environment variables that override the
+// settings, the rest of the name is the section and the key, like
+// OBSCOMMITS_IRC_PASSWORD, webhook sinks use their name as well, like
+// OBSCOMMITS_SINKS_DISCORD_DEV_URL for [sinks.discord-dev]
+const EnvPrefix = "OBSCOMMITS_"
+
+// the paths the bot serves itself on the same mux as the hooks, the ones
+// ending in a slash take everything below them as well
+var reservedPaths = []struct{ path, what string }{
+	{"/state/restore/", "the state restore"},
+	{"/state/", "the state download"},
+	{"/audit/", "the audit log"},
+	{"/deliveries/", "the webhook deliveries"},
+	{"/metrics", "the metrics"},
+	{"/healthz", "the health check"},
+}
+
+// reserved returns what is served at the path already, if anything
+func reserved(path string) (string, bool) {
+	for _, r := range reservedPaths {
+		if path == r.path {
+			return r.what, true
+		}
+		// the path without the slash is redirected to the one with it
+		if strings.HasSuffix(r.path, "/") && (strings.HasPrefix(path, r.path) || path+"/" == r.path) {
+			return r.what, true
+		}
+	}
+	return "", false
+}
+
+// ValidationError lists every problem of the config
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the config for mistakes that would only show up later,
+// or not at all
+func (cfg *AppConfig) Validate() error {
+	var errs ValidationError
+	add := func(key, format string, v ...interface{}) {
+		errs = append(errs, key+": "+fmt.Sprintf(format, v...))
+	}
+
+	if cfg.Website.Addr == "" {
+		add("website.addr", "must not be empty")
+	}
+	if _, err := url.Parse(cfg.Website.BaseURL); err != nil || cfg.Website.BaseURL == "" {
+		add("website.baseurl", "must be a url, like \"http://obscommits.sztanpet.net\"")
+	}
+	switch cfg.Storage.Backend {
+	case "", "json", "kv":
+	default:
+		add("storage.backend", "must be json or kv, got %q", cfg.Storage.Backend)
+	}
+	if cfg.Backup.Dir == "" {
+		add("backup.dir", "must not be empty")
+	}
+	if cfg.Backup.Interval != "" {
+		if d, err := time.ParseDuration(cfg.Backup.Interval); err != nil || d < time.Minute {
+			add("backup.interval", "must be a duration of at least a minute, like \"24h\", got %q", cfg.Backup.Interval)
+		}
+	}
+	if cfg.Backup.Keep < 0 {
+		add("backup.keep", "must not be negative")
+	}
+	if cfg.Audit.Path == "" {
+		add("audit.path", "must not be empty")
+	}
+	if cfg.Deliveries.Dir == "" {
+		add("deliveries.dir", "must not be empty")
+	}
+	if cfg.Deliveries.Keep < 0 {
+		add("deliveries.keep", "must not be negative")
+	}
+	if cfg.Deliveries.Window != "" {
+		if d, err := time.ParseDuration(cfg.Deliveries.Window); err != nil || d < 0 {
+			add("deliveries.window", "must be a duration, like \"1h\", got %q", cfg.Deliveries.Window)
+		}
+	}
+	if cfg.Alerts.Interval != "" {
+		if _, err := time.ParseDuration(cfg.Alerts.Interval); err != nil {
+			add("alerts.interval", "must be a duration, like \"10m\", got %q", cfg.Alerts.Interval)
+		}
+	}
+	if cfg.Debug.Logfile == "" {
+		add("debug.logfile", "must not be empty")
+	}
+	if !validLevel(cfg.Debug.Level) {
+		add("debug.level", "must be debug, info, warn or error, got %q", cfg.Debug.Level)
+	}
+	for sub, level := range cfg.Debug.Levels {
+		if !validLevel(level) {
+			add("debug.levels."+sub, "must be debug, info, warn or error, got %q", level)
+		}
+	}
+	switch cfg.Debug.Format {
+	case "", "text", "json":
+	default:
+		add("debug.format", "must be text or json, got %q", cfg.Debug.Format)
+	}
+	if cfg.Debug.MaxSize < 0 {
+		add("debug.maxsize", "must not be negative")
+	}
+	if cfg.Debug.MaxAge != "" {
+		if d, err := time.ParseDuration(cfg.Debug.MaxAge); err != nil || d < time.Minute {
+			add("debug.maxage", "must be a duration of at least a minute, like \"24h\", got %q", cfg.Debug.MaxAge)
+		}
+	}
+	if cfg.Debug.Keep < 0 {
+		add("debug.keep", "must not be negative")
+	}
+
+	// the paths are registered on the same mux, so they have to be distinct
+	paths := map[string]string{}
+	for _, v := range []struct{ key, path string }{
+		{"factoids.hookpath", cfg.Factoids.HookPath},
+		{"github.hookpath", cfg.Github.HookPath},
+		{"travis.hookpath", cfg.Travis.HookPath},
+	} {
+		if !strings.HasPrefix(v.path, "/") {
+			add(v.key, "must start with a slash, got %q", v.path)
+			continue
+		}
+		if what, ok := reserved(v.path); ok {
+			add(v.key, "%q is already used by %s", v.path, what)
+			continue
+		}
+		if other, ok := paths[v.path]; ok {
+			add(v.key, "%q is already used by %s", v.path, other)
+			continue
+		}
+		paths[v.path] = v.key
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.IRC.Addr); err != nil {
+		add("irc.addr", "must be a host and a port, like \"irc.quakenet.org:6667\"")
+	}
+	if cfg.IRC.Nick == "" {
+		add("irc.nick", "must not be empty")
+	}
+	for _, ch := range cfg.IRC.Channels {
+		if !strings.HasPrefix(ch, "#") && !strings.HasPrefix(ch, "&") {
+			add("irc.channels", "%q is not a channel", ch)
+		}
+	}
+	if cfg.IRC.TLSCert != "" && (cfg.IRC.TLSKey == "" || !cfg.IRC.TLS) {
+		add("irc.tlscert", "needs tls enabled and a tlskey")
+	}
+	switch strings.ToUpper(cfg.IRC.SASLMech) {
+	case "", "PLAIN":
+	case "EXTERNAL":
+		if cfg.IRC.TLSCert == "" {
+			add("irc.saslmech", "EXTERNAL needs a tlscert")
+		}
+	default:
+		add("irc.saslmech", "must be PLAIN, EXTERNAL or empty, got %q", cfg.IRC.SASLMech)
+	}
+	switch strings.ToLower(cfg.IRC.Services) {
+	case "", "nickserv", "q":
+	default:
+		add("irc.services", "must be nickserv, q or empty, got %q", cfg.IRC.Services)
+	}
+
+	for _, v := range []struct{ key, url string }{
+		{"analyzer.url", cfg.Analyzer.URL},
+		{"rss.forumurl", cfg.RSS.ForumURL},
+		{"rss.mantisurl", cfg.RSS.MantisURL},
+		{"matrix.homeserver", cfg.Matrix.Homeserver},
+	} {
+		if v.url == "" {
+			continue
+		}
+		if u, err := url.Parse(v.url); err != nil || u.Scheme == "" || u.Host == "" {
+			add(v.key, "%q is not a url", v.url)
+		}
+	}
+
+	if cfg.Matrix.Homeserver != "" && cfg.Matrix.AccessToken == "" &&
+		(cfg.Matrix.User == "" || cfg.Matrix.Password == "") {
+		add("matrix", "needs either an accesstoken or a user and a password")
+	}
+
+	names := make([]string, 0, len(cfg.Sinks))
+	for name := range cfg.Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := cfg.Sinks[name]
+		switch strings.ToLower(s.Type) {
+		case "discord", "slack":
+		default:
+			add("sinks."+name+".type", "must be discord or slack, got %q", s.Type)
+		}
+		if u, err := url.Parse(s.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			add("sinks."+name+".url", "must be the url of the webhook")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// validLevel returns whether the level is one the debug package knows, the
+// config cannot import it
+func validLevel(level string) bool {
+	switch level {
+	case "", "debug", "info", "warn", "error":
+		return true
+	}
+
+	return false
+}
+
+// applyEnv overrides the settings with the environment variables, env is in
+// the format of os.Environ
+func applyEnv(cfg *AppConfig, env []string) error {
+	vars := map[string]string{}
+	for _, kv := range env {
+		if pos := strings.Index(kv, "="); pos > 0 && strings.HasPrefix(kv, EnvPrefix) {
+			vars[kv[:pos]] = kv[pos+1:]
+		}
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+
+	var errs ValidationError
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Type.Kind() != reflect.Struct {
+			continue
+		}
+
+		prefix := EnvPrefix + strings.ToUpper(section(f)) + "_"
+		if err := setFields(v.Field(i), prefix, vars); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for name, s := range cfg.Sinks {
+		prefix := EnvPrefix + "SINKS_" + envName(name) + "_"
+		if err := setFields(reflect.ValueOf(&s).Elem(), prefix, vars); err != nil {
+			errs = append(errs, err.Error())
+		}
+		cfg.Sinks[name] = s
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// section returns the name of the section of the field in the config file
+func section(f reflect.StructField) string {
+	if tag := f.Tag.Get("toml"); tag != "" {
+		return tag
+	}
+
+	return strings.ToLower(f.Name)
+}
+
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// setFields sets the fields of the struct that have a variable, lists are
+// separated by commas
+func setFields(v reflect.Value, prefix string, vars map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		name := prefix + envName(f.Tag.Get("toml"))
+		val, ok := vars[name]
+		if !ok || f.Tag.Get("toml") == "" {
+			continue
+		}
+
+		switch fv := v.Field(i); fv.Kind() {
+		case reflect.String:
+			fv.SetString(val)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", name, val)
+			}
+			fv.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", name, val)
+			}
+			fv.SetInt(int64(n))
+		case reflect.Slice:
+			var l []string
+			for _, s := range strings.Split(val, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					l = append(l, s)
+				}
+			}
+			fv.Set(reflect.ValueOf(l))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSampleConfig(t *testing.T) {
+	if _, err := load(strings.NewReader(sampleconf), "sample", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if _, err := load(strings.NewReader("[irc\naddr="), "bad", nil); err == nil {
+		t.Error("expected an error for a broken file")
+	}
+
+	cfg, err := load(strings.NewReader(sampleconf), "sample", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Backup.Interval = "0s"
+	cfg.Github.HookPath = "somethingrandom"
+	cfg.Travis.HookPath = "/"
+	cfg.IRC.SASLMech = "CERT"
+	cfg.Sinks = map[string]Sink{"discord-dev": {Type: "discord"}}
+
+	err = cfg.Validate()
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+
+	want := ValidationError{
+		`backup.interval: must be a duration of at least a minute, like "24h", got "0s"`,
+		`github.hookpath: must start with a slash, got "somethingrandom"`,
+		`travis.hookpath: "/" is already used by factoids.hookpath`,
+		`irc.saslmech: must be PLAIN, EXTERNAL or empty, got "CERT"`,
+		`sinks.discord-dev.url: must be the url of the webhook`,
+	}
+	if !reflect.DeepEqual(verr, want) {
+		t.Errorf("expected\n%v\ngot\n%v", want, verr)
+	}
+}
+
+func TestReservedPaths(t *testing.T) {
+	cfg, err := load(strings.NewReader(sampleconf), "sample", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		path, want string
+	}{
+		{"/state/", `github.hookpath: "/state/" is already used by the state download`},
+		{"/state", `github.hookpath: "/state" is already used by the state download`},
+		{"/state/hook", `github.hookpath: "/state/hook" is already used by the state download`},
+		{"/state/restore/", `github.hookpath: "/state/restore/" is already used by the state restore`},
+		{"/audit/", `github.hookpath: "/audit/" is already used by the audit log`},
+		{"/deliveries/", `github.hookpath: "/deliveries/" is already used by the webhook deliveries`},
+		{"/metrics", `github.hookpath: "/metrics" is already used by the metrics`},
+		{"/healthz", `github.hookpath: "/healthz" is already used by the health check`},
+		{"/metrics2", ""},
+	} {
+		cfg.Github.HookPath = v.path
+		err := cfg.Validate()
+		if v.want == "" {
+			if err != nil {
+				t.Errorf("unexpected error for %q: %v", v.path, err)
+			}
+			continue
+		}
+		if verr, ok := err.(ValidationError); !ok || !reflect.DeepEqual(verr, ValidationError{v.want}) {
+			t.Errorf("expected %q for %q, got %v", v.want, v.path, err)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	src := sampleconf + `
+[sinks.discord-dev]
+type="discord"
+`
+	env := []string{
+		"PATH=/bin",
+		"OBSCOMMITS_IRC_PASSWORD=hunter2",
+		"OBSCOMMITS_IRC_CHANNELS=#obs, #obs-dev",
+		"OBSCOMMITS_DEBUG_DEBUG=true",
+		"OBSCOMMITS_SINKS_DISCORD_DEV_URL=https://discordapp.com/api/webhooks/1",
+	}
+
+	cfg, err := load(strings.NewReader(src), "sample", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IRC.Password != "hunter2" || !cfg.Debug.Debug {
+		t.Errorf("the variables were not applied: %+v %+v", cfg.IRC, cfg.Debug)
+	}
+	if want := []string{"#obs", "#obs-dev"}; !reflect.DeepEqual(cfg.IRC.Channels, want) {
+		t.Errorf("expected the channels %v, got %v", want, cfg.IRC.Channels)
+	}
+	if url := cfg.Sinks["discord-dev"].URL; url != "https://discordapp.com/api/webhooks/1" {
+		t.Errorf("the url of the sink was not set, got %q", url)
+	}
+
+	env = append(env, "OBSCOMMITS_DEBUG_DEBUG=maybe")
+	if _, err := load(strings.NewReader(src), "sample", env); err == nil {
+		t.Error("expected an error for an invalid boolean")
+	}
+}
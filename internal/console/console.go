@@ -0,0 +1,127 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package console stands in for the IRC server in the dry run mode, the
+// lines read from the input are said in a channel as if someone typed them
+// and what the bot sends is printed to the output
+package console
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/obsproject/obscommits/internal/fakeirc"
+	"github.com/obsproject/obscommits/internal/ircfmt"
+)
+
+const (
+	// the name of the server and the nick of the one typing
+	serverName = "console"
+	userNick   = "console"
+)
+
+// Server is the pretend IRC server, the bot connects to it with Dial
+type Server struct {
+	*fakeirc.Server
+
+	omu sync.Mutex
+	out io.Writer
+
+	mu sync.Mutex
+	// where the lines are said and the services account of the one typing
+	channel string
+	account string
+}
+
+// New reads the lines from in until it ends, the lines are said in the
+// channel by someone logged in as the account, an empty account means not
+// logged in
+func New(in io.Reader, out io.Writer, channel, account string) *Server {
+	s := &Server{
+		out:     out,
+		channel: channel,
+		account: account,
+	}
+	s.Server = fakeirc.New(serverName, func(line string) {
+		s.printf("%s", ircfmt.ToANSI(line))
+	})
+	s.printf("-- type the lines to say in %s, /join <channel> to switch channels and /account [name] to change the account", channel)
+	go s.read(in)
+
+	return s
+}
+
+func (s *Server) printf(format string, args ...interface{}) {
+	s.omu.Lock()
+	fmt.Fprintf(s.out, format+"\n", args...)
+	s.omu.Unlock()
+}
+
+// read says the lines of the input in the channel, the lines starting with
+// a slash change the channel or the account
+func (s *Server) read(in io.Reader) {
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			s.command(line)
+			continue
+		}
+
+		s.mu.Lock()
+		channel, account := s.channel, s.account
+		s.mu.Unlock()
+
+		if err := s.Say(userNick, account, channel, line); err != nil {
+			s.printf("-- the bot is not connected yet, dropped the line")
+		}
+	}
+}
+
+func (s *Server) command(line string) {
+	f := strings.Fields(line)
+	switch {
+	case f[0] == "/join" && len(f) == 2:
+		s.mu.Lock()
+		s.channel = f[1]
+		s.mu.Unlock()
+		s.printf("-- the lines are said in %s from now on", f[1])
+	case f[0] == "/account" && len(f) <= 2:
+		account := ""
+		if len(f) == 2 {
+			account = f[1]
+		}
+		s.mu.Lock()
+		s.account = account
+		s.mu.Unlock()
+		if account == "" {
+			s.printf("-- %s is not logged in from now on", userNick)
+		} else {
+			s.printf("-- %s is logged in as %s from now on", userNick, account)
+		}
+	default:
+		s.printf("-- unknown command, use /join <channel> or /account [name]")
+	}
+}
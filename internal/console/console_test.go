@@ -0,0 +1,103 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package console
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type buffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// expect reads lines from the server until one has the prefix
+func expect(t *testing.T, conn net.Conn, r *bufio.Reader, prefix string) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected a line starting with %q: %v", prefix, err)
+		}
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(line)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	in, typed := io.Pipe()
+	out := &buffer{}
+	s := New(in, out, "#obs-dev", "jim")
+
+	conn, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for _, line := range []string{"CAP LS 302", "NICK bot", "USER bot 0 * :bot"} {
+		io.WriteString(conn, line+"\r\n")
+	}
+	expect(t, conn, r, ":console CAP * LS")
+	// nobody is welcome before the negotiation ended
+	io.WriteString(conn, "CAP REQ :account-tag\r\n")
+	expect(t, conn, r, ":console CAP * ACK")
+	io.WriteString(conn, "CAP END\r\n")
+	expect(t, conn, r, ":console 001 bot")
+
+	io.WriteString(typed, ".help\n")
+	if got, want := expect(t, conn, r, "@"), "@account=jim :console!console@console PRIVMSG #obs-dev :.help"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	io.WriteString(typed, "/account\n/join #obs\nhi\n")
+	if got, want := expect(t, conn, r, ":console!"), ":console!console@console PRIVMSG #obs :hi"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	io.WriteString(conn, "PRIVMSG #obs :\x02hello\x02\r\nNOTICE console :done\r\nPING :x\r\n")
+	expect(t, conn, r, ":console PONG")
+	for _, want := range []string{"[#obs] <bot> \x1b[1mhello\x1b[22m\x1b[0m", "[console] -bot- done"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in the output %q", want, out.String())
+		}
+	}
+}
@@ -18,7 +18,9 @@
 ***/
 
 // The d package is just a very simple collection of debugging and logging aids
-// everything is safe to call from anywhere
+// everything is safe to call from anywhere, every entry is a single line of
+// key value pairs with the level and the subsystem, the package under
+// internal the entry comes from, the level can be set per subsystem
 package d
 
 import (
@@ -29,8 +31,6 @@ import (
 	"log"
 	"os"
 	"runtime"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/obsproject/obscommits/internal/config"
@@ -42,119 +42,89 @@ const (
 	DisableDebug = false
 )
 
-var (
-	mu               sync.RWMutex
-	debuggingEnabled bool
-)
-
-// Init initializes the printing of debugging information based on its arg
+// Init opens the log file and applies the levels and the format from the
+// config
 func Init(ctx context.Context) context.Context {
 	cfg := config.FromContext(ctx)
 
-	mu.Lock()
-	debuggingEnabled = cfg.Debug.Debug
-	mu.Unlock()
-
 	logfile := cfg.Debug.Logfile
-	w, err := os.OpenFile(logfile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660)
+	r, err := openRotator(logfile)
 	if err != nil {
 		panic(logfile + err.Error())
 	}
-	mw := io.MultiWriter(os.Stderr, w)
-	log.SetOutput(mw)
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	apply(cfg.Debug, r)
 
-	return ctx
-}
+	config.OnReload(config.Hook{
+		Name: "debug",
+		Apply: func(old, cfg *config.AppConfig) {
+			apply(cfg.Debug, r)
+		},
+	})
 
-func shouldPrint() bool {
-	mu.RLock()
-	defer mu.RUnlock()
-	return debuggingEnabled
+	wmu.Lock()
+	out = io.MultiWriter(os.Stderr, r)
+	wmu.Unlock()
+
+	// the packages that use the log package directly end up in the log too
+	log.SetOutput(stdWriter{})
+	log.SetFlags(0)
+
+	return ctx
 }
 
-func getFormatStr(numargs int, addlineinfo bool) string {
-	var formatStr string
-	if addlineinfo {
-		formatStr = "%+v:%+v \n  "
-	} else {
-		formatStr = "\n  "
+// apply applies the settings, the config was validated already
+func apply(cfg config.Debug, r *rotator) {
+	s := settings{
+		levels: map[string]Level{},
+		json:   cfg.Format == "json",
 	}
-	for i := numargs; i >= 1; i-- {
-		formatStr += "|%+v|\n  "
+	s.level, _ = ParseLevel(cfg.Level)
+	if cfg.Debug {
+		s.level = LevelDebug
 	}
-	formatStr += "\n\n"
-	return formatStr
-}
+	for sub, name := range cfg.Levels {
+		s.levels[sub], _ = ParseLevel(name)
+	}
+
+	lmu.Lock()
+	cur = s
+	lmu.Unlock()
 
-func logWithCaller(file string, line int, args ...interface{}) {
-	pos := strings.LastIndex(file, "obscommits/") + len("obscommits/")
-	newargs := make([]interface{}, 0, len(args)+2)
-	newargs = append(newargs, file[pos:], line)
-	newargs = append(newargs, args...)
-	log.Printf(getFormatStr(len(args), true), newargs...)
+	maxAge, _ := time.ParseDuration(cfg.MaxAge)
+	r.limits(int64(cfg.MaxSize)<<20, maxAge, cfg.Keep)
 }
 
-// D prints debug info about its arguments depending on whether debug printing
-// is enabled or not
+// D logs its arguments at the debug level, the first one is the message if
+// it is a string
 func D(args ...interface{}) {
-	if shouldPrint() {
-		_, file, line, ok := runtime.Caller(1)
-		if ok {
-			logWithCaller(file, line, args...)
-		} else {
-			log.Printf(getFormatStr(len(args), false), args...)
-		}
-	}
+	msg, kv := positional(args)
+	logAt(1, LevelDebug, msg, kv)
 }
 
-// DF prints debug info and allows specifying how many stack frames to skip and
-// expects a format string, only prints if debug printing is enabled
+// DF logs the formatted string at the debug level, skip is the number of
+// stack frames to skip to get to the caller
 func DF(skip int, format string, args ...interface{}) {
-	if !shouldPrint() {
-		return
-	}
-
-	_, file, line, ok := runtime.Caller(skip)
-	if ok {
-		pos := strings.LastIndex(file, "obscommits/") + len("obscommits/")
-		newargs := make([]interface{}, 0, len(args)+2)
-		newargs = append(newargs, file[pos:], line)
-		newargs = append(newargs, args...)
-		log.Printf("%+v:%+v "+format+"\n", newargs...)
-	} else {
-		log.Printf(format, args...)
-	}
+	logAt(skip, LevelDebug, fmt.Sprintf(format, args...), nil)
 }
 
-// P prints debug info about its arguments always
+// P logs its arguments at the info level, the first one is the message if
+// it is a string
 func P(args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if ok {
-		logWithCaller(file, line, args...)
-	} else {
-		log.Printf(getFormatStr(len(args), false), args...)
-	}
+	msg, kv := positional(args)
+	logAt(1, LevelInfo, msg, kv)
 }
 
-// PF prints debug info and allows specifying how many stack frames to skip and
-// expects a format string, always prints
+// PF logs the formatted string at the info level, skip is the number of
+// stack frames to skip to get to the caller
 func PF(skip int, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(skip)
-	if ok {
-		pos := strings.LastIndex(file, "obscommits/") + len("obscommits/")
-		newargs := make([]interface{}, 0, len(args)+2)
-		newargs = append(newargs, file[pos:], line)
-		newargs = append(newargs, args...)
-		log.Printf("%+v:%+v "+format+"\n", newargs...)
-	} else {
-		log.Printf(format, args...)
-	}
+	logAt(skip, LevelInfo, fmt.Sprintf(format, args...), nil)
 }
 
-// F calls panic with a formatted string based on its arguments
+// F logs the formatted string at the error level and panics with it
 func F(format string, args ...interface{}) {
-	panic(fmt.Sprintf(format, args...))
+	msg := fmt.Sprintf(format, args...)
+	logAt(1, LevelError, msg, nil)
+	panic(msg)
 }
 
 // source https://groups.google.com/forum/?fromgroups#!topic/golang-nuts/C24fRw8HDmI
@@ -198,13 +168,13 @@ func (et ErrorTrace) Error() string {
 
 // BT prints a backtrace
 func BT(args ...interface{}) {
-	ts := time.Now().Format("2006-02-01 15:04:05: ")
+	ts := time.Now().Format("2006-01-02 15:04:05: ")
 	println(ts, NewErrorTrace(2, args...).Error())
 }
 
 // FBT prints a backtrace and then panics (fatal backtrace)
 func FBT(args ...interface{}) {
-	ts := time.Now().Format("2006-02-01 15:04:05: ")
+	ts := time.Now().Format("2006-01-02 15:04:05: ")
 	println(ts, NewErrorTrace(2, args...).Error())
 	panic("-----")
 }
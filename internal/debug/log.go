@@ -0,0 +1,374 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package d
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how important a log entry is
+type Level int
+
+// the levels from the least to the most important
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level, an empty name is LevelInfo
+func ParseLevel(s string) (Level, bool) {
+	if s == "" {
+		return LevelInfo, true
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// the settings of the logger, they are replaced as a whole
+type settings struct {
+	level Level
+	// the levels of the subsystems from the config
+	levels map[string]Level
+	json   bool
+}
+
+var (
+	lmu sync.RWMutex
+	cur = settings{level: LevelInfo}
+	// the levels set at runtime, they take precedence over the config
+	overrides = map[string]Level{}
+	// the subsystems that logged something, for listing them
+	seen = map[string]bool{}
+
+	wmu sync.Mutex
+	out io.Writer = os.Stderr
+)
+
+// SetLevel sets the level of the subsystem until the program exits, an
+// empty subsystem sets the default level
+func SetLevel(sub string, l Level) {
+	lmu.Lock()
+	defer lmu.Unlock()
+
+	if sub == "" {
+		cur.level = l
+		return
+	}
+	overrides[sub] = l
+}
+
+// ResetLevel removes the level set at runtime for the subsystem
+func ResetLevel(sub string) {
+	lmu.Lock()
+	delete(overrides, sub)
+	lmu.Unlock()
+}
+
+// LevelOf returns the level the subsystem logs at, an empty subsystem
+// returns the default level
+func LevelOf(sub string) Level {
+	lmu.RLock()
+	defer lmu.RUnlock()
+
+	return levelOf(sub)
+}
+
+// levelOf is LevelOf with the lock held by the caller
+func levelOf(sub string) Level {
+	if l, ok := overrides[sub]; ok {
+		return l
+	}
+	if l, ok := cur.levels[sub]; ok {
+		return l
+	}
+
+	return cur.level
+}
+
+// Subsystems returns the subsystems that logged something or have a level
+// set, sorted
+func Subsystems() []string {
+	lmu.RLock()
+	defer lmu.RUnlock()
+
+	m := map[string]bool{}
+	for sub := range seen {
+		m[sub] = true
+	}
+	for sub := range cur.levels {
+		m[sub] = true
+	}
+	for sub := range overrides {
+		m[sub] = true
+	}
+
+	ret := make([]string, 0, len(m))
+	for sub := range m {
+		ret = append(ret, sub)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// enabled returns whether the subsystem logs at the level
+func enabled(sub string, l Level) bool {
+	lmu.RLock()
+	ok := seen[sub]
+	enabled := l >= levelOf(sub)
+	lmu.RUnlock()
+
+	if !ok {
+		lmu.Lock()
+		seen[sub] = true
+		lmu.Unlock()
+	}
+
+	return enabled
+}
+
+// caller returns the subsystem and the file and line of the caller skip
+// frames up, the subsystem is the name of the package under internal, or
+// main for everything else
+func caller(skip int) (sub, pos string) {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "main", "?"
+	}
+
+	file = filepath.ToSlash(file)
+	dir, base := filepath.Split(file)
+	dir = strings.TrimSuffix(dir, "/")
+	sub = "main"
+	if pos := strings.LastIndex(dir, "/internal/"); pos >= 0 {
+		sub = dir[pos+len("/internal/"):]
+		pos := strings.Index(sub, "/")
+		if pos >= 0 {
+			sub = sub[:pos]
+		}
+		base = sub + "/" + base
+	}
+
+	return sub, base + ":" + strconv.Itoa(line)
+}
+
+// Debug logs the message with key value pairs at the debug level
+func Debug(msg string, kv ...interface{}) {
+	logAt(1, LevelDebug, msg, kv)
+}
+
+// Info logs the message with key value pairs at the info level
+func Info(msg string, kv ...interface{}) {
+	logAt(1, LevelInfo, msg, kv)
+}
+
+// Warn logs the message with key value pairs at the warn level
+func Warn(msg string, kv ...interface{}) {
+	logAt(1, LevelWarn, msg, kv)
+}
+
+// Error logs the message with key value pairs at the error level
+func Error(msg string, kv ...interface{}) {
+	logAt(1, LevelError, msg, kv)
+}
+
+// logAt logs the entry if the subsystem of the caller skip frames up logs
+// at the level
+func logAt(skip int, l Level, msg string, kv []interface{}) {
+	sub, pos := caller(skip + 1)
+	if !enabled(sub, l) {
+		return
+	}
+
+	write(entry{
+		time:   time.Now(),
+		level:  l,
+		sub:    sub,
+		caller: pos,
+		msg:    msg,
+		kv:     kv,
+	})
+}
+
+// entry is a single line of the log
+type entry struct {
+	time   time.Time
+	level  Level
+	sub    string
+	caller string
+	msg    string
+	// key value pairs, a key without a value is logged with an empty value
+	kv []interface{}
+}
+
+func write(e entry) {
+	lmu.RLock()
+	asJSON := cur.json
+	lmu.RUnlock()
+
+	var b []byte
+	if asJSON {
+		b = e.json()
+	} else {
+		b = e.text()
+	}
+
+	wmu.Lock()
+	out.Write(b)
+	wmu.Unlock()
+}
+
+// pairs returns the keys and the values of the entry as strings, the fixed
+// fields first
+func (e entry) pairs() [][2]string {
+	ret := [][2]string{
+		{"time", e.time.UTC().Format("2006-01-02T15:04:05.000000Z")},
+		{"level", e.level.String()},
+		{"sub", e.sub},
+		{"caller", e.caller},
+		{"msg", e.msg},
+	}
+	for i := 0; i < len(e.kv); i += 2 {
+		key := fmt.Sprint(e.kv[i])
+		var val string
+		if i+1 < len(e.kv) {
+			val = format(e.kv[i+1])
+		}
+		ret = append(ret, [2]string{key, val})
+	}
+
+	return ret
+}
+
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		if v == nil {
+			return "<nil>"
+		}
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return fmt.Sprintf("%+v", v)
+}
+
+// text formats the entry as logfmt, key=value pairs on a single line
+func (e entry) text() []byte {
+	b := bytes.NewBuffer(nil)
+	for i, p := range e.pairs() {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p[0])
+		b.WriteByte('=')
+		b.WriteString(quote(p[1]))
+	}
+	b.WriteByte('\n')
+
+	return b.Bytes()
+}
+
+// quote quotes the value if it is empty or has anything that would make
+// the line ambiguous
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") || !strconv.CanBackquote(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// json formats the entry as a JSON object on a single line
+func (e entry) json() []byte {
+	b := bytes.NewBuffer(nil)
+	b.WriteByte('{')
+	for i, p := range e.pairs() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(p[0])
+		v, _ := json.Marshal(p[1])
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+
+	return b.Bytes()
+}
+
+// positional turns the arguments of the older functions into key value
+// pairs, the first argument is the message if it is a string
+func positional(args []interface{}) (string, []interface{}) {
+	var msg string
+	if len(args) > 0 {
+		if s, ok := args[0].(string); ok {
+			msg, args = s, args[1:]
+		}
+	}
+
+	kv := make([]interface{}, 0, len(args)*2)
+	for i, a := range args {
+		kv = append(kv, "arg"+strconv.Itoa(i+1), a)
+	}
+
+	return msg, kv
+}
+
+// stdWriter sends what the log package of the standard library writes to
+// the log, the lines of the packages that use it directly
+type stdWriter struct{}
+
+func (stdWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimRight(string(b), "\n")
+	if enabled("log", LevelInfo) {
+		write(entry{time: time.Now(), level: LevelInfo, sub: "log", msg: msg})
+	}
+	return len(b), nil
+}
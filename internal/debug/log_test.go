@@ -0,0 +1,171 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package d
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture sends the log to a buffer with the given settings
+func capture(s settings) (*bytes.Buffer, func()) {
+	b := bytes.NewBuffer(nil)
+	wmu.Lock()
+	old := out
+	out = b
+	wmu.Unlock()
+
+	lmu.Lock()
+	oldSettings := cur
+	cur = s
+	lmu.Unlock()
+
+	return b, func() {
+		wmu.Lock()
+		out = old
+		wmu.Unlock()
+
+		lmu.Lock()
+		cur = oldSettings
+		overrides = map[string]Level{}
+		lmu.Unlock()
+	}
+}
+
+func TestText(t *testing.T) {
+	b, reset := capture(settings{level: LevelInfo})
+	defer reset()
+
+	Debug("not logged")
+	Info("Could not deliver", "sink", "discord dev", "err", errors.New(`bad "request"`), "n", 3)
+	P("Reloaded the config", "extra")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", b.String())
+	}
+	if !strings.Contains(lines[0], `level=info sub=debug caller=debug/log_test.go:`) ||
+		!strings.HasSuffix(lines[0], `msg="Could not deliver" sink="discord dev" err="bad \"request\"" n=3`) {
+		t.Errorf("unexpected line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], `msg="Reloaded the config" arg1=extra`) {
+		t.Errorf("unexpected line %q", lines[1])
+	}
+}
+
+func TestJSON(t *testing.T) {
+	b, reset := capture(settings{level: LevelInfo, json: true})
+	defer reset()
+
+	Warn("multi\nline", "key", "value")
+
+	var m map[string]string
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatalf("invalid JSON %q: %v", b.String(), err)
+	}
+	if m["level"] != "warn" || m["msg"] != "multi\nline" || m["key"] != "value" || m["sub"] != "debug" {
+		t.Errorf("unexpected entry %v", m)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	b, reset := capture(settings{level: LevelWarn, levels: map[string]Level{"debug": LevelError}})
+	defer reset()
+
+	Warn("hidden by the level of the subsystem")
+	if b.Len() != 0 {
+		t.Fatalf("unexpected line %q", b.String())
+	}
+
+	SetLevel("debug", LevelDebug)
+	D("shown")
+	if !strings.Contains(b.String(), "msg=shown") {
+		t.Fatalf("expected a line, got %q", b.String())
+	}
+
+	ResetLevel("debug")
+	if LevelOf("debug") != LevelError || LevelOf("") != LevelWarn || LevelOf("other") != LevelWarn {
+		t.Errorf("unexpected levels %v %v %v", LevelOf("debug"), LevelOf(""), LevelOf("other"))
+	}
+
+	found := false
+	for _, sub := range Subsystems() {
+		found = found || sub == "debug"
+	}
+	if !found {
+		t.Errorf("the subsystem is not listed %v", Subsystems())
+	}
+
+	if l, ok := ParseLevel("WARN"); !ok || l != LevelWarn {
+		t.Errorf("unexpected level %v %v", l, ok)
+	}
+	if _, ok := ParseLevel("verbose"); ok {
+		t.Error("parsed an unknown level")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "debug.txt")
+	r, err := openRotator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.limits(10, 0, 2)
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, expected := range map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	} {
+		if b, _ := ioutil.ReadFile(file); string(b) != expected {
+			t.Errorf("unexpected contents of %s: %q", file, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("kept too many files")
+	}
+
+	// by age
+	r.limits(0, time.Minute, 2)
+	r.created = time.Now().Add(-2 * time.Minute)
+	r.Write([]byte("eeeeeeee\n"))
+	if b, _ := ioutil.ReadFile(path + ".1"); string(b) != "dddddddd\n" {
+		t.Errorf("the file was not rotated by age: %q", b)
+	}
+}
@@ -0,0 +1,120 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package d
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotator is a log file that is rotated once it gets too large or too old,
+// the rotated files are named like the file with .1 being the newest
+type rotator struct {
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	created time.Time
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+}
+
+func openRotator(path string) (*rotator, error) {
+	r := &rotator{path: path}
+	return r, r.open()
+}
+
+// open opens the file, the lock needs to be held by the caller
+func (r *rotator) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	// the creation time of a file is not known, an existing one counts as
+	// created when it was opened
+	r.created = time.Now()
+	return nil
+}
+
+// limits sets when the file is rotated
+func (r *rotator) limits(maxSize int64, maxAge time.Duration, keep int) {
+	r.mu.Lock()
+	r.maxSize, r.maxAge, r.keep = maxSize, maxAge, keep
+	r.mu.Unlock()
+}
+
+func (r *rotator) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f != nil && r.size > 0 &&
+		((r.maxSize > 0 && r.size+int64(len(b)) > r.maxSize) ||
+			(r.maxAge > 0 && time.Since(r.created) > r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not rotate the log file:", err)
+		}
+	}
+	if r.f == nil {
+		return 0, fmt.Errorf("the log file %s is not open", r.path)
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and the rotated ones and opens a new one, the
+// lock needs to be held by the caller
+func (r *rotator) rotate() error {
+	r.f.Close()
+	r.f = nil
+
+	if r.keep == 0 {
+		if err := os.Remove(r.path); err != nil {
+			return err
+		}
+		return r.open()
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		// keep writing to the same file rather than losing the lines
+		r.open()
+		return err
+	}
+
+	return r.open()
+}
@@ -0,0 +1,615 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package deliveries keeps the recent webhook deliveries on disk, what was
+// received, what came of it and what was announced, so that a missing
+// announcement can be looked into, the deliveries can also be replayed
+package deliveries
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/metrics"
+	"github.com/obsproject/obscommits/internal/recovery"
+	"github.com/obsproject/obscommits/internal/sink"
+	"golang.org/x/net/context"
+)
+
+const (
+	// the largest body that is accepted
+	maxBody       = 5 << 20
+	defaultKeep   = 200
+	defaultWindow = time.Hour
+	// the most deliveries waiting to be processed
+	maxQueued = 100
+)
+
+// the delivery ids are used in the file names
+var idRE = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// the headers that are not written to the disk
+var redacted = []string{"Authorization", "Cookie"}
+
+var received = metrics.NewCounter("obscommits_webhook_deliveries_total", "Incoming webhook deliveries by source, event and outcome.", "source", "event", "outcome")
+
+// ErrIgnored is returned by a Func for the events that are not announced at
+// all
+var ErrIgnored = errors.New("ignored event")
+
+// Func turns a delivery into announcements, event is the kind of the event
+// the delivery is about
+type Func func(r *http.Request) (event string, anns []sink.Announcement, err error)
+
+// Validate decodes the payload of a delivery before it is queued, the
+// delivery is refused as invalid if it returns an error
+type Validate func(h http.Header, payload []byte) error
+
+// Delivery is a single request to one of the webhooks
+type Delivery struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Event  string    `json:"event"`
+	// Replay is the id of the delivery this one is the replay of
+	Replay string      `json:"replay,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	// Result is ok, error, ignored, invalid if the payload could not be
+	// decoded or duplicate, Error is what went wrong
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// Lines are the lines that were announced
+	Lines []string `json:"lines,omitempty"`
+
+	// the name of the file the delivery is in
+	file string
+}
+
+// String returns the delivery without the request on a single line
+func (dl Delivery) String() string {
+	s := dl.Time.UTC().Format("2006-01-02 15:04:05") + " " + dl.ID + " " + dl.Source + " " + dl.Event
+	if dl.Replay != "" {
+		s += " (replay of " + dl.Replay + ")"
+	}
+
+	switch dl.Result {
+	case "error", "invalid":
+		return s + " -> " + dl.Result + ": " + dl.Error
+	case "ok":
+		return s + fmt.Sprintf(" -> %d lines", len(dl.Lines))
+	}
+	return s + " -> " + dl.Result
+}
+
+type source struct {
+	process Func
+	out     *sink.Router
+}
+
+type job struct {
+	dl  *Delivery
+	src source
+}
+
+// Log is the log of the deliveries, a file per delivery in a directory,
+// only the last ones are kept, the deliveries are processed one by one in
+// the background
+type Log struct {
+	dir string
+
+	mu   sync.Mutex
+	keep int
+	// the deliveries without the request, oldest first
+	recent  []Delivery
+	sources map[string]source
+	// when the ids were first seen, a delivery with the same id within the
+	// window is a duplicate
+	seen   map[string]time.Time
+	window time.Duration
+
+	qmu    sync.RWMutex
+	queue  chan job
+	closed bool
+	done   chan struct{}
+}
+
+var current struct {
+	sync.RWMutex
+	l *Log
+}
+
+// Init opens the log, it has to come before the webhooks
+func Init(ctx context.Context) context.Context {
+	cfg := config.FromContext(ctx).Deliveries
+	l, err := Open(cfg.Dir, cfg.Keep)
+	if err != nil {
+		d.F("Could not open the delivery log: %v", err)
+	}
+	l.SetWindow(window(cfg.Window))
+
+	config.OnReload(config.Hook{
+		Name: "deliveries",
+		Apply: func(old, cfg *config.AppConfig) {
+			l.setKeep(cfg.Deliveries.Keep)
+			l.SetWindow(window(cfg.Deliveries.Window))
+		},
+	})
+
+	current.Lock()
+	current.l = l
+	current.Unlock()
+
+	registerCommands(ctx, l)
+	handle(l)
+
+	return ctx
+}
+
+func window(s string) time.Duration {
+	if ret, err := time.ParseDuration(s); err == nil {
+		return ret
+	}
+	return defaultWindow
+}
+
+// Open reads the deliveries in the directory, creating it if needed, only
+// the last keep deliveries are kept, the deliveries are processed until
+// the log is drained
+func Open(dir string, keep int) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:     dir,
+		sources: map[string]source{},
+		seen:    map[string]time.Time{},
+		window:  defaultWindow,
+		queue:   make(chan job, maxQueued),
+		done:    make(chan struct{}),
+	}
+	for _, file := range files {
+		dl, err := readFile(file)
+		if err != nil {
+			d.P("Invalid delivery, skipping it", file, err)
+			continue
+		}
+		l.recent = append(l.recent, summary(dl))
+	}
+	sort.Slice(l.recent, func(i, j int) bool {
+		return l.recent[i].Time.Before(l.recent[j].Time)
+	})
+	l.setKeep(keep)
+
+	// the ids are remembered across restarts
+	for _, dl := range l.recent {
+		if dl.Replay == "" && counts(dl.Result) {
+			l.seen[dl.ID] = dl.Time
+		}
+	}
+
+	go l.work()
+	return l, nil
+}
+
+// counts returns whether a delivery with the result makes the later ones
+// with the same id duplicates, the ones that failed can be delivered again
+func counts(result string) bool {
+	return result == "ok" || result == "ignored"
+}
+
+// SetWindow sets how long the ids of the deliveries are remembered, zero
+// turns the checking for duplicates off
+func (l *Log) SetWindow(window time.Duration) {
+	l.mu.Lock()
+	l.window = window
+	l.mu.Unlock()
+}
+
+// duplicate returns whether the id was seen within the window, the id is
+// remembered if not
+func (l *Log) duplicate(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.window <= 0 {
+		return false
+	}
+	for seen, t := range l.seen {
+		if time.Since(t) >= l.window {
+			delete(l.seen, seen)
+		}
+	}
+	if _, ok := l.seen[id]; ok {
+		return true
+	}
+
+	l.seen[id] = time.Now()
+	return false
+}
+
+// forget forgets the id, so that the delivery can be delivered again
+func (l *Log) forget(id string) {
+	l.mu.Lock()
+	delete(l.seen, id)
+	l.mu.Unlock()
+}
+
+// enqueue queues the job, returns false if the queue is full or the log is
+// drained already
+func (l *Log) enqueue(j job) bool {
+	l.qmu.RLock()
+	defer l.qmu.RUnlock()
+
+	if l.closed {
+		return false
+	}
+	select {
+	case l.queue <- j:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Log) work() {
+	defer close(l.done)
+
+	for j := range l.queue {
+		dl := j.dl
+		if !recovery.Run("webhook "+dl.Source, func() { run(dl, j.src, false) }) {
+			dl.Result, dl.Error = "error", "panicked"
+		}
+		if !counts(dl.Result) {
+			l.forget(dl.ID)
+		}
+		l.finish(dl)
+	}
+}
+
+// finish logs the processed delivery
+func (l *Log) finish(dl *Delivery) {
+	if dl.Result == "invalid" || dl.Result == "duplicate" {
+		received.Inc(dl.Source, "other", dl.Result)
+	}
+	if err := l.save(dl); err != nil {
+		d.P("Could not save the delivery", dl.ID, err)
+	}
+}
+
+// Drain stops accepting deliveries and waits for the queued ones to be
+// processed, it gives up once the context is done
+func (l *Log) Drain(ctx context.Context) {
+	l.qmu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.qmu.Unlock()
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		d.P("Gave up waiting for the webhook deliveries", len(l.queue))
+	}
+}
+
+// Drain drains the delivery log if it was opened
+func Drain(ctx context.Context) {
+	current.RLock()
+	l := current.l
+	current.RUnlock()
+
+	if l != nil {
+		l.Drain(ctx)
+	}
+}
+
+func readFile(file string) (*Delivery, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	dl := &Delivery{}
+	if err := json.Unmarshal(b, dl); err != nil {
+		return nil, err
+	}
+	dl.file = filepath.Base(file)
+	return dl, nil
+}
+
+// summary returns the delivery without the request
+func summary(dl *Delivery) Delivery {
+	ret := *dl
+	ret.Header, ret.Body = nil, ""
+	return ret
+}
+
+func (l *Log) setKeep(keep int) {
+	if keep <= 0 {
+		keep = defaultKeep
+	}
+
+	l.mu.Lock()
+	l.keep = keep
+	l.prune()
+	l.mu.Unlock()
+}
+
+// prune removes the oldest deliveries over the limit, the lock needs to be
+// held by the caller
+func (l *Log) prune() {
+	for len(l.recent) > l.keep {
+		if err := os.Remove(filepath.Join(l.dir, l.recent[0].file)); err != nil && !os.IsNotExist(err) {
+			d.P("Could not remove the delivery", l.recent[0].file, err)
+		}
+		l.recent = l.recent[1:]
+	}
+}
+
+// save writes the delivery to the disk
+func (l *Log) save(dl *Delivery) error {
+	dl.file = dl.Time.UTC().Format("20060102T150405.000000000") + "-" + dl.ID + ".json"
+	b, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(l.dir, "."+dl.file)
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(l.dir, dl.file)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	l.mu.Lock()
+	l.recent = append(l.recent, summary(dl))
+	l.prune()
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Recent returns the last n deliveries without the requests, newest first
+func (l *Log) Recent(n int) []Delivery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ret []Delivery
+	for i := len(l.recent) - 1; i >= 0 && len(ret) < n; i-- {
+		ret = append(ret, l.recent[i])
+	}
+	return ret
+}
+
+// Get returns the last delivery with the id along with the request
+func (l *Log) Get(id string) (*Delivery, error) {
+	var file string
+	l.mu.Lock()
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		if l.recent[i].ID == id {
+			file = l.recent[i].file
+			break
+		}
+	}
+	l.mu.Unlock()
+
+	if file == "" {
+		return nil, fmt.Errorf("no delivery with the id %q", id)
+	}
+	return readFile(filepath.Join(l.dir, file))
+}
+
+// Handler returns the HTTP handler of the webhook, every delivery is checked
+// with v, run through f in the background and logged, the announcements are
+// sent to out
+func Handler(name string, out *sink.Router, f Func, v Validate) http.HandlerFunc {
+	current.RLock()
+	l := current.l
+	current.RUnlock()
+
+	if l == nil {
+		d.F("The delivery log has to be opened before the webhooks")
+	}
+	return l.Handler(name, out, f, v)
+}
+
+// Handler returns the HTTP handler of the webhook, the payload is checked
+// and the delivery is queued, 202 is returned if it was queued and 200 if
+// it was a duplicate, v may be nil if any JSON will do
+func (l *Log) Handler(name string, out *sink.Router, f Func, v Validate) http.HandlerFunc {
+	src := source{process: f, out: out}
+	l.mu.Lock()
+	l.sources[name] = src
+	l.mu.Unlock()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			http.Error(w, "Could not read the body", http.StatusBadRequest)
+			return
+		}
+
+		dl := &Delivery{
+			ID:     deliveryID(r.Header),
+			Time:   time.Now(),
+			Source: name,
+			Event:  r.Header.Get("X-Github-Event"),
+			Header: http.Header{},
+			Body:   string(body),
+		}
+		for k, v := range r.Header {
+			dl.Header[k] = v
+		}
+		for _, k := range redacted {
+			dl.Header.Del(k)
+		}
+
+		if err := validate(dl.Header, body, v); err != nil {
+			dl.Result, dl.Error = "invalid", err.Error()
+			l.finish(dl)
+			http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if l.duplicate(dl.ID) {
+			dl.Result = "duplicate"
+			l.finish(dl)
+			fmt.Fprintln(w, "Duplicate delivery, ignored")
+			return
+		}
+		if !l.enqueue(job{dl: dl, src: src}) {
+			l.forget(dl.ID)
+			http.Error(w, "Too many deliveries, try again later", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "Queued delivery", dl.ID)
+	}
+}
+
+// payload returns the json the webhooks decode, it is either the body or
+// the payload field of a form
+func payload(h http.Header, body []byte) ([]byte, error) {
+	if h.Get("Content-Type") == "application/json" {
+		return body, nil
+	}
+
+	v, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v.Get("payload")), nil
+}
+
+// validate checks whether the payload is JSON the webhook can decode, the
+// rest is up to the webhook once the delivery is processed
+func validate(h http.Header, body []byte, v Validate) error {
+	p, err := payload(h, body)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(p) {
+		return errors.New("the payload is not valid JSON")
+	}
+	if v == nil {
+		return nil
+	}
+	return v(h, p)
+}
+
+// deliveryID returns the id GitHub sent or a random one
+func deliveryID(h http.Header) string {
+	if id := h.Get("X-Github-Delivery"); idRE.MatchString(id) {
+		return id
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// run runs the delivery through the webhook and fills in the result,
+// nothing is announced and counted on a dry run
+func run(dl *Delivery, src source, dry bool) {
+	r, err := http.NewRequest("POST", "/", strings.NewReader(dl.Body))
+	if err != nil {
+		dl.Result, dl.Error = "error", err.Error()
+		return
+	}
+	for k, v := range dl.Header {
+		r.Header[k] = v
+	}
+
+	event, anns, err := src.process(r)
+	dl.Event, dl.Lines = event, nil
+	label := event
+	switch {
+	case err == ErrIgnored:
+		dl.Result, label = "ignored", "other"
+	case err != nil:
+		dl.Result, dl.Error = "error", err.Error()
+		d.P("Could not handle the delivery", dl.Source, event, err)
+	default:
+		dl.Result = "ok"
+		for _, a := range anns {
+			dl.Lines = append(dl.Lines, a.Text)
+		}
+	}
+
+	if dry {
+		return
+	}
+	received.Inc(dl.Source, label, dl.Result)
+	if len(anns) > 0 && err == nil {
+		src.out.Announce(anns...)
+	}
+}
+
+// Replay runs the delivery through its webhook again, the replay is logged
+// as a new delivery unless it is a dry run, which announces nothing
+func (l *Log) Replay(id string, dry bool) (*Delivery, error) {
+	dl, err := l.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	src, ok := l.sources[dl.Source]
+	l.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("the webhook %q is not enabled", dl.Source)
+	}
+
+	dl.Replay = dl.ID
+	dl.ID = deliveryID(nil)
+	dl.Time = time.Now()
+	dl.Error = ""
+	run(dl, src, dry)
+	if !dry {
+		l.finish(dl)
+	}
+
+	return dl, nil
+}
@@ -0,0 +1,265 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package deliveries
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/obsproject/obscommits/internal/sink"
+	"golang.org/x/net/context"
+)
+
+func process(r *http.Request) (string, []sink.Announcement, error) {
+	var data struct {
+		Do string
+	}
+	if err := json.Unmarshal([]byte(r.FormValue("payload")), &data); err != nil {
+		return "", nil, err
+	}
+
+	event := r.Header.Get("X-Github-Event")
+	switch data.Do {
+	case "ignore":
+		return event, nil, ErrIgnored
+	case "fail":
+		return event, nil, errors.New("invalid payload")
+	case "panic":
+		panic("boom")
+	}
+
+	return event, []sink.Announcement{{Text: "got " + data.Do}}, nil
+}
+
+func check(h http.Header, payload []byte) error {
+	var data struct {
+		Do string
+	}
+	return json.Unmarshal(payload, &data)
+}
+
+func deliver(h http.HandlerFunc, id, do string) int {
+	body := url.Values{"payload": {`{"do": "` + do + `"}`}}.Encode()
+	if do == "" {
+		body = "payload=nope"
+	}
+
+	r := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Github-Event", "push")
+	r.Header.Set("Authorization", "secret")
+	if id != "" {
+		r.Header.Set("X-Github-Delivery", id)
+	}
+
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Code
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := (&sink.Registry{}).Router(nil)
+	h := l.Handler("github", out, process, nil)
+
+	for _, v := range []struct {
+		id, do string
+		code   int
+	}{
+		{"a", "one", http.StatusAccepted},
+		{"b", "ignore", http.StatusAccepted},
+		{"c", "fail", http.StatusAccepted},
+		{"../d", "two", http.StatusAccepted},
+	} {
+		if code := deliver(h, v.id, v.do); code != v.code {
+			t.Fatalf("expected the status %d for %s, got %d", v.code, v.id, code)
+		}
+	}
+	l.Drain(context.Background())
+
+	// only the last three are kept
+	dls := l.Recent(10)
+	if len(dls) != 3 {
+		t.Fatalf("expected 3 deliveries, got %d", len(dls))
+	}
+	if dls[0].ID == "../d" || dls[0].Result != "ok" || len(dls[0].Lines) != 1 || dls[0].Lines[0] != "got two" {
+		t.Fatalf("unexpected delivery %+v", dls[0])
+	}
+	if dls[1].Result != "error" || dls[1].Error != "invalid payload" {
+		t.Fatalf("unexpected delivery %+v", dls[1])
+	}
+	if dls[2].Result != "ignored" || dls[2].Event != "push" {
+		t.Fatalf("unexpected delivery %+v", dls[2])
+	}
+	if _, err := l.Get("a"); err == nil {
+		t.Fatal("the oldest delivery was not removed")
+	}
+
+	dl, err := l.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Header.Get("X-Github-Event") != "push" || dl.Header.Get("Authorization") != "" {
+		t.Fatalf("unexpected request %+v", dl)
+	}
+
+	// a dry run is not logged
+	if _, err := l.Replay("c", true); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(l.Recent(10)); n != 3 {
+		t.Fatalf("expected the dry run not to be logged, got %d deliveries", n)
+	}
+
+	dl, err = l.Replay(dls[0].ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Replay != dls[0].ID || dl.ID == dls[0].ID || len(dl.Lines) != 1 {
+		t.Fatalf("unexpected replay %+v", dl)
+	}
+
+	// the deliveries are read back when the log is opened again
+	l, err = Open(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Drain(context.Background())
+	dls = l.Recent(10)
+	if len(dls) != 3 || dls[0].Replay == "" || dls[2].ID != "c" {
+		t.Fatalf("unexpected deliveries after opening the log again %+v", dls)
+	}
+	if _, err := l.Replay("c", false); err == nil {
+		t.Fatal("expected an error replaying a delivery of an unknown webhook")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := (&sink.Registry{}).Router(nil)
+	h := l.Handler("github", out, process, nil)
+
+	for _, v := range []struct {
+		id, do string
+		code   int
+	}{
+		{"a", "one", http.StatusAccepted},
+		{"a", "one", http.StatusOK},
+		{"b", "", http.StatusBadRequest},
+		// an invalid delivery can be delivered again
+		{"b", "one", http.StatusAccepted},
+		{"c", "panic", http.StatusAccepted},
+	} {
+		if code := deliver(h, v.id, v.do); code != v.code {
+			t.Fatalf("expected the status %d for %s %s, got %d", v.code, v.id, v.do, code)
+		}
+	}
+	l.Drain(context.Background())
+
+	if l, err = Open(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	h = l.Handler("github", out, process, nil)
+	// a delivery that failed can be delivered again, the other ids are
+	// remembered when the log is opened again
+	if code := deliver(h, "c", "one"); code != http.StatusAccepted {
+		t.Fatalf("expected the failed delivery to be accepted again, got %d", code)
+	}
+	if code := deliver(h, "a", "one"); code != http.StatusOK {
+		t.Fatalf("expected a duplicate after opening the log again, got %d", code)
+	}
+	l.Drain(context.Background())
+
+	results := map[string]int{}
+	for _, dl := range l.Recent(10) {
+		results[dl.Result]++
+	}
+	if results["ok"] != 3 || results["duplicate"] != 2 || results["invalid"] != 1 || results["error"] != 1 {
+		t.Fatalf("unexpected results %v", results)
+	}
+
+	if code := deliver(h, "d", "one"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the deliveries to be refused after draining, got %d", code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Drain(context.Background())
+	out, _ := (&sink.Registry{}).Router(nil)
+	h := l.Handler("github", out, process, check)
+
+	for _, v := range []struct {
+		payload string
+		code    int
+	}{
+		{`{"do": "one"}`, http.StatusAccepted},
+		{`{"do": 1}`, http.StatusBadRequest},
+		{`[]`, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("POST", "/hook", strings.NewReader(v.payload))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Github-Event", "push")
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != v.code {
+			t.Fatalf("expected the status %d for %s, got %d", v.code, v.payload, w.Code)
+		}
+	}
+
+	dls := l.Recent(10)
+	if len(dls) < 2 || dls[0].Result != "invalid" || !strings.Contains(dls[0].Error, "cannot unmarshal") {
+		t.Fatalf("unexpected deliveries %+v", dls)
+	}
+}
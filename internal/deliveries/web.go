@@ -0,0 +1,302 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package deliveries
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/audit"
+	"github.com/obsproject/obscommits/internal/commands"
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/ircfmt"
+	"github.com/obsproject/obscommits/internal/perms"
+	"golang.org/x/net/context"
+)
+
+const (
+	webPath = "/deliveries/"
+	// the link to the pages can be used until it expires
+	webExpiry = 30 * time.Minute
+	// the most deliveries that are printed on IRC
+	maxQuery = 20
+	// the most lines of a replay that are printed on IRC
+	maxLines = 5
+)
+
+var pages = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Webhook deliveries</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Webhook deliveries</h1>
+<table>
+<tr><th>Time (UTC)</th><th>ID</th><th>Source</th><th>Event</th><th>Result</th><th>Lines</th></tr>
+{{range .Deliveries}}<tr><td>{{.Time.UTC.Format "2006-01-02 15:04:05"}}</td><td><a href="{{$.Base}}/{{.ID}}">{{.ID}}</a>{{if .Replay}} (replay of {{.Replay}}){{end}}</td><td>{{.Source}}</td><td>{{.Event}}</td><td>{{.Result}} {{.Error}}</td><td>{{len .Lines}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+var _ = template.Must(pages.New("delivery").Funcs(template.FuncMap{
+	// the lines are escaped before the formatting is turned into html
+	"ircize": func(s string) template.HTML {
+		return ircfmt.ToHTML(template.HTML(template.HTMLEscapeString(s)))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Delivery {{.Delivery.ID}}</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #f4f4f4; padding: 6px; overflow: auto; }
+</style>
+</head>
+<body>
+<p><a href="{{.Base}}">All deliveries</a></p>
+{{if .Replayed}}<h2>{{if .Dry}}Dry run{{else}}Replayed{{end}}</h2>{{end}}
+{{with .Delivery}}
+<h1>Delivery {{.ID}}</h1>
+<p>{{.Time.UTC.Format "2006-01-02 15:04:05"}} UTC, {{.Source}} {{.Event}}{{if .Replay}}, the replay of {{.Replay}}{{end}}</p>
+<p>Result: {{.Result}} {{.Error}}</p>
+<h2>Announced</h2>
+{{range .Lines}}<pre>{{ircize .}}</pre>
+{{else}}<p>Nothing</p>
+{{end}}
+<h2>Headers</h2>
+<pre>{{range $k, $v := .Header}}{{$k}}: {{range $v}}{{.}} {{end}}
+{{end}}</pre>
+{{end}}
+<h2>Body</h2>
+<pre>{{.Body}}</pre>
+{{if not .Replayed}}
+<form method="post" action="{{.Base}}/{{.Delivery.ID}}/replay">
+<label><input type="checkbox" name="dry" value="1" checked> Dry run, nothing is announced</label>
+<input type="submit" value="Replay">
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// links are the tokens of the links to the pages with their expiry
+var links = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+func newLink() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	links.Lock()
+	defer links.Unlock()
+	for t, expires := range links.m {
+		if time.Now().After(expires) {
+			delete(links.m, t)
+		}
+	}
+	links.m[token] = time.Now().Add(webExpiry)
+
+	return token, nil
+}
+
+func validLink(token string) bool {
+	links.Lock()
+	defer links.Unlock()
+
+	expires, ok := links.m[token]
+	return ok && time.Now().Before(expires)
+}
+
+// indent returns the body indented if it is json
+func indent(body string) string {
+	b := bytes.NewBuffer(nil)
+	if err := json.Indent(b, []byte(body), "", "  "); err != nil {
+		return body
+	}
+	return b.String()
+}
+
+// handle serves the list at /deliveries/<token>, a delivery at
+// /deliveries/<token>/<id> and replays it at /deliveries/<token>/<id>/replay
+func handle(l *Log) {
+	http.HandleFunc(webPath, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, webPath), "/")
+		if !validLink(parts[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		base := webPath + parts[0]
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		switch {
+		case len(parts) == 1:
+			pages.ExecuteTemplate(w, "list", struct {
+				Base       string
+				Deliveries []Delivery
+			}{base, l.Recent(defaultKeep)})
+			return
+
+		case len(parts) == 2:
+			dl, err := l.Get(parts[1])
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			showDelivery(w, base, dl, false, false)
+			return
+
+		case len(parts) == 3 && parts[2] == "replay" && r.Method == "POST":
+			dry := r.FormValue("dry") != ""
+			dl, err := l.Replay(parts[1], dry)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !dry {
+				audit.Record(audit.Entry{
+					Time:    time.Now(),
+					Nick:    "(web)",
+					Host:    r.RemoteAddr,
+					Command: "replay",
+					Args:    parts[1],
+					Outcome: dl.String(),
+				})
+			}
+			showDelivery(w, base, dl, true, dry)
+			return
+		}
+
+		http.NotFound(w, r)
+	})
+}
+
+func showDelivery(w http.ResponseWriter, base string, dl *Delivery, replayed, dry bool) {
+	pages.ExecuteTemplate(w, "delivery", struct {
+		Base     string
+		Delivery *Delivery
+		Body     string
+		Replayed bool
+		Dry      bool
+	}{base, dl, indent(dl.Body), replayed, dry})
+}
+
+func registerCommands(ctx context.Context, l *Log) {
+	commands.Register(commands.Command{
+		Name:        ".deliveries",
+		Args:        "[count] | web",
+		Description: "Prints the last webhook deliveries and what came of them, 5 by default. web generates a link to the deliveries with their requests that works for 30 minutes.",
+		Group:       "Webhooks",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			handleDeliveries(ctx, l, r)
+		},
+	})
+	commands.Register(commands.Command{
+		Name:        ".replay",
+		Args:        "<id> [dry]",
+		Description: "Runs a webhook delivery through the webhook again, with dry the lines are only printed instead of being announced.",
+		Group:       "Webhooks",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			handleReplay(l, r)
+		},
+	})
+}
+
+func handleDeliveries(ctx context.Context, l *Log, r *commands.Request) {
+	args := strings.Fields(r.Args)
+	if len(args) == 1 && args[0] == "web" {
+		token, err := newLink()
+		if err != nil {
+			r.Reply("Could not create the link: ", err.Error())
+			return
+		}
+
+		r.Reply("The webhook deliveries (the link expires in 30 minutes): ", config.FromContext(ctx).Website.BaseURL+webPath+token)
+		return
+	}
+
+	n := 5
+	if len(args) == 1 {
+		n, _ = strconv.Atoi(args[0])
+	}
+	if n < 1 || n > maxQuery || len(args) > 1 {
+		r.Reply("Usage: ", r.Name, " [count] | web, the count is at most ", strconv.Itoa(maxQuery))
+		return
+	}
+
+	dls := l.Recent(n)
+	if len(dls) == 0 {
+		r.Reply("No deliveries yet")
+		return
+	}
+	for i := len(dls) - 1; i >= 0; i-- {
+		r.Reply(dls[i].String())
+	}
+}
+
+func handleReplay(l *Log, r *commands.Request) {
+	args := strings.Fields(r.Args)
+	if len(args) < 1 || len(args) > 2 || len(args) == 2 && args[1] != "dry" {
+		r.Reply("Usage: ", r.Name, " <id> [dry]")
+		return
+	}
+
+	dry := len(args) == 2
+	dl, err := l.Replay(args[0], dry)
+	if err != nil {
+		r.Reply("Could not replay the delivery: ", err.Error())
+		return
+	}
+
+	r.Reply(dl.String())
+	if !dry {
+		return
+	}
+	for i, line := range dl.Lines {
+		if i == maxLines {
+			r.Reply("... and ", strconv.Itoa(len(dl.Lines)-maxLines), " more lines")
+			break
+		}
+		r.Reply(line)
+	}
+}
@@ -20,17 +20,24 @@
 package factoids
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/obsproject/obscommits/internal/commands"
 	"github.com/obsproject/obscommits/internal/config"
 	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/hookmux"
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/metrics"
+	"github.com/obsproject/obscommits/internal/perms"
 	"github.com/obsproject/obscommits/internal/persist"
-	"github.com/sztanpet/sirc"
 	"golang.org/x/net/context"
-	"gopkg.in/sorcix/irc.v1"
 )
 
 type st struct {
@@ -39,38 +46,254 @@ type st struct {
 	Used     map[string]time.Time
 }
 
+// Factoid is a factoid with the aliases that trigger it
+type Factoid struct {
+	Name    string
+	Text    string
+	Aliases []string `json:",omitempty"`
+}
+
+// exported is the format of the factoids exported and imported
+type exported struct {
+	Factoids map[string]string `json:"factoids"`
+	Aliases  map[string]string `json:"aliases"`
+}
+
+func init() {
+	// the gob file was decoded into the state itself
+	persist.Register("factoids", persist.Schema{
+		Gob: []persist.GobFormat{
+			{Version: 1, New: func() interface{} { return &st{} }},
+		},
+	})
+}
+
 var (
 	alphaRE  = regexp.MustCompile(`^[a-zA-Z0-9-.]+$`)
 	handleRE = regexp.MustCompile(`^!([a-zA-Z0-9-.]+)(?:\s+(\S+)\s*)?$`)
-	adminRE  = regexp.MustCompile(`^\.(add|mod|del|rename|addalias|modalias|delalias)(?:\s+([a-zA-Z0-9-.]+)\s*)(?:(\S+))?(?:(.+))?$`)
+	argsRE   = regexp.MustCompile(`^([a-zA-Z0-9-.]+)\s*(?:(\S+))?(?:(.+))?$`)
 	s        *st
 	state    *persist.State
+	hits     = metrics.NewCounter("obscommits_factoid_hits_total", "Factoids triggered by name.", "factoid")
 )
 
+var adminCommands = []commands.Command{
+	{
+		Name:        ".add",
+		Args:        "<factoid-trigger> <factoid-text>",
+		Description: "The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed. This command adds a new factoid.",
+		Group:       "Administer factoids",
+	},
+	{
+		Name:        ".mod",
+		Args:        "<factoid-trigger> <factoid-text>",
+		Description: "The factoid-trigger will trigger the factoid, upon which fact the factoid-text will be printed. This command modifies an existing factoid.",
+		Group:       "Administer factoids",
+	},
+	{
+		Name:        ".del",
+		Args:        "<factoid-trigger>",
+		Description: "This command deletes an existing factoid with the given trigger and all of its aliases.",
+		Group:       "Administer factoids",
+	},
+	{
+		Name:        ".rename",
+		Args:        "<old-factoid-trigger> <new-factoid-trigger>",
+		Description: "This command renames an existing factoid to the new trigger, the new trigger must not exist beforehand. Also updates the aliases.",
+		Group:       "Administer factoids",
+	},
+	{
+		Name:        ".addalias",
+		Args:        "<alias-trigger> <factoid-trigger>",
+		Description: "The alias-trigger will trigger the factoid-trigger. This command adds a new alias.",
+		Group:       "Administer factoid aliases",
+	},
+	{
+		Name:        ".modalias",
+		Args:        "<alias-trigger> <factoid-trigger>",
+		Description: "The alias-trigger will trigger the factoid-trigger. This command modifies an existing alias.",
+		Group:       "Administer factoid aliases",
+	},
+	{
+		Name:        ".delalias",
+		Args:        "<alias-trigger>",
+		Description: "This command deletes an existing alias with the given trigger.",
+		Group:       "Administer factoid aliases",
+	},
+}
+
 func Init(ctx context.Context) context.Context {
 	handleRE.Longest()
-	adminRE.Longest()
+	argsRE.Longest()
+
+	if err := Load(); err != nil {
+		d.F("%v", err)
+	}
+	state.OnRestore(tpl.invalidate)
+
+	for _, cmd := range adminCommands {
+		cmd.Role = perms.FactoidEditor
+		cmd.Handler = handleAdmin
+		commands.Register(cmd)
+	}
 
+	tpl.init()
+	path := config.FromContext(ctx).Factoids.HookPath
+	hookmux.Handle("factoids", path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tpl.render()
+		tpl.execute(w)
+	}))
+	config.OnReload(config.Hook{
+		Name: "factoids",
+		Apply: func(old, cfg *config.AppConfig) {
+			hookmux.Move("factoids", cfg.Factoids.HookPath)
+		},
+	})
+
+	return ctx
+}
+
+// Load loads the factoids without handling anything, for using them outside
+// of the bot, persist has to be initialized first
+func Load() error {
 	var err error
-	state, err = persist.New("factoids.state", &st{
+	state, err = persist.New("factoids", &st{
 		Factoids: map[string]string{},
 		Aliases:  map[string]string{},
 		Used:     map[string]time.Time{},
 	})
 	if err != nil {
-		d.F(err.Error())
+		return err
 	}
 
 	s = state.Get().(*st)
+	return nil
+}
 
-	tpl.init()
-	path := config.FromContext(ctx).Factoids.HookPath
-	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		tpl.render()
-		tpl.execute(w)
-	})
+// All returns the factoids sorted by name
+func All() []Factoid {
+	state.Lock()
+	defer state.Unlock()
 
-	return ctx
+	a := make(map[string][]string)
+	for alias, factoid := range s.Aliases {
+		a[factoid] = append(a[factoid], alias)
+	}
+
+	for _, v := range a {
+		sort.Strings(v)
+	}
+
+	fs := make([]Factoid, 0, len(s.Factoids))
+	for name, text := range s.Factoids {
+		fs = append(fs, Factoid{
+			Name:    name,
+			Text:    text,
+			Aliases: a[name],
+		})
+	}
+
+	sort.Sort(factoidSlice(fs))
+	return fs
+}
+
+// Get returns the factoid with the name, or the one the alias with the name
+// resolves to
+func Get(name string) (Factoid, bool) {
+	state.Lock()
+	defer state.Unlock()
+	text, key, ok := getfactoidByKey(strings.ToLower(name))
+	if !ok {
+		return Factoid{}, false
+	}
+
+	f := Factoid{Name: key, Text: text}
+	for alias, factoid := range s.Aliases {
+		if factoid == key {
+			f.Aliases = append(f.Aliases, alias)
+		}
+	}
+	sort.Strings(f.Aliases)
+
+	return f, true
+}
+
+// Set adds or modifies the factoid with the name and saves the factoids
+func Set(name, text string) error {
+	name = strings.ToLower(name)
+	if !alphaRE.MatchString(name) {
+		return fmt.Errorf("invalid factoid name %q", name)
+	}
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("the text of the factoid %s is empty", name)
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	if _, ok := s.Aliases[name]; ok {
+		return fmt.Errorf("%s is an alias, delete it first", name)
+	}
+	s.Factoids[name] = text
+	tpl.invalidate()
+
+	return state.Save(false)
+}
+
+// Export writes the factoids and aliases as json
+func Export(w io.Writer) error {
+	state.Lock()
+	e := exported{Factoids: s.Factoids, Aliases: s.Aliases}
+	b, err := json.MarshalIndent(&e, "", "  ")
+	state.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Import adds the factoids and aliases in the json written by Export,
+// overwriting the ones with the same name, and saves them, it returns the
+// number of factoids and aliases imported
+func Import(r io.Reader) (int, error) {
+	var e exported
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return 0, err
+	}
+
+	for name, text := range e.Factoids {
+		if !alphaRE.MatchString(name) || strings.ToLower(name) != name {
+			return 0, fmt.Errorf("invalid factoid name %q", name)
+		}
+		if strings.TrimSpace(text) == "" {
+			return 0, fmt.Errorf("the text of the factoid %s is empty", name)
+		}
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	for alias, name := range e.Aliases {
+		if !alphaRE.MatchString(alias) || strings.ToLower(alias) != alias {
+			return 0, fmt.Errorf("invalid alias name %q", alias)
+		}
+		if _, ok := e.Factoids[name]; ok {
+			continue
+		}
+		if _, ok := s.Factoids[name]; !ok {
+			return 0, fmt.Errorf("the alias %s is for the missing factoid %s", alias, name)
+		}
+	}
+
+	for name, text := range e.Factoids {
+		s.Factoids[name] = text
+	}
+	for alias, name := range e.Aliases {
+		s.Aliases[alias] = name
+	}
+	tpl.invalidate()
+
+	return len(e.Factoids) + len(e.Aliases), state.Save(false)
 }
 
 func factoidUsedRecently(factoidkey string) (ret bool) {
@@ -98,7 +321,7 @@ restart:
 	return
 }
 
-func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
+func Handle(c ircconn.Conn, m *ircconn.Message) (abort bool) {
 	matches := handleRE.FindStringSubmatch(m.Trailing)
 	if len(matches) == 0 {
 		return
@@ -110,14 +333,11 @@ func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
 	defer state.Unlock()
 	if factoid, factoidkey, ok := getfactoidByKey(factoidkey); ok {
 		abort = true
+		hits.Inc(factoidkey)
 		if factoidUsedRecently(factoidkey) {
 			return
 		}
-		if len(matches[2]) > 0 { // someone is being sent a factoid
-			c.PrivMsg(m, matches[2], ": ", factoid)
-		} else { // otherwise just print the factoid
-			c.PrivMsg(m, factoid)
-		}
+		c.PrivMsg(m, reply(factoid, matches[2]))
 
 		return
 	}
@@ -125,21 +345,52 @@ func Handle(c *sirc.IConn, m *irc.Message) (abort bool) {
 	return
 }
 
-func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
-	matches := adminRE.FindStringSubmatch(m.Trailing)
+// Lookup returns the reply to the line if it triggers a factoid, key is the
+// name of the factoid the trigger resolved to, it is up to the caller to
+// rate limit the replies
+func Lookup(line string) (text, key string, ok bool) {
+	matches := handleRE.FindStringSubmatch(line)
 	if len(matches) == 0 {
 		return
 	}
 
+	state.Lock()
+	defer state.Unlock()
+	factoid, key, ok := getfactoidByKey(strings.ToLower(matches[1]))
+	if !ok {
+		return
+	}
+	hits.Inc(key)
+
+	return reply(factoid, matches[2]), key, true
+}
+
+func reply(factoid, nick string) string {
+	if len(nick) > 0 { // someone is being sent a factoid
+		return nick + ": " + factoid
+	}
+
+	// otherwise just print the factoid
+	return factoid
+}
+
+func handleAdmin(r *commands.Request) {
+	matches := argsRE.FindStringSubmatch(r.Args)
+	if len(matches) == 0 {
+		if cmd, ok := commands.Lookup(r.Name); ok {
+			r.Reply("Usage: ", cmd.Name, " ", cmd.Args)
+		}
+		return
+	}
+
 	var savestate bool
-	abort = true
 
-	command := matches[1]
-	factoidkey := strings.ToLower(matches[2])
-	newfactoidkey := strings.ToLower(matches[3])
-	factoid := matches[3]
-	if len(matches[4]) > 0 {
-		factoid = matches[3] + matches[4]
+	command := strings.TrimPrefix(r.Name, ".")
+	factoidkey := strings.ToLower(matches[1])
+	newfactoidkey := strings.ToLower(matches[2])
+	factoid := matches[2]
+	if len(matches[3]) > 0 {
+		factoid = matches[2] + matches[3]
 	}
 
 	switch command {
@@ -151,7 +402,7 @@ func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
 
 		s.Factoids[factoidkey] = factoid
 		savestate = true
-		c.Notice(m, "Added/Modified successfully")
+		r.Reply("Added/Modified successfully")
 
 	case "del":
 		state.Lock()
@@ -160,7 +411,7 @@ func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
 	restartdelete:
 		if _, ok := s.Factoids[factoidkey]; ok {
 			delete(s.Factoids, factoidkey)
-			c.Notice(m, "Deleted successfully")
+			r.Reply("Deleted successfully")
 			// clean up the aliases too
 			for k, v := range s.Aliases {
 				if v == factoidkey {
@@ -168,7 +419,7 @@ func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
 				}
 			}
 		} else if factoidkey, ok = s.Aliases[factoidkey]; ok {
-			c.Notice(m, "Found an alias, deleting the original factoid")
+			r.Reply("Found an alias, deleting the original factoid")
 			goto restartdelete
 		}
 
@@ -182,11 +433,11 @@ func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
 		defer state.Unlock()
 
 		if _, ok := s.Factoids[newfactoidkey]; ok {
-			c.Notice(m, "Renaming would overwrite, please delete first")
+			r.Reply("Renaming would overwrite, please delete first")
 			return
 		}
 		if _, ok := s.Aliases[newfactoidkey]; ok {
-			c.Notice(m, "Renaming would overwrite an alias, please delete first")
+			r.Reply("Renaming would overwrite an alias, please delete first")
 			return
 		}
 		if _, ok := s.Factoids[factoidkey]; ok {
@@ -199,9 +450,9 @@ func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
 				}
 			}
 			savestate = true
-			c.Notice(m, "Renamed successfully")
+			r.Reply("Renamed successfully")
 		} else {
-			c.Notice(m, "Not present")
+			r.Reply("Not present")
 		}
 
 	case "addalias":
@@ -221,9 +472,9 @@ func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
 		if ok {
 			s.Aliases[factoidkey] = newfactoidkey
 			savestate = true
-			c.Notice(m, "Added/Modified alias for ", newfactoidkey, " successfully")
+			r.Reply("Added/Modified alias for ", newfactoidkey, " successfully")
 		} else {
-			c.Notice(m, "No factoid with name ", newfactoidkey, " found")
+			r.Reply("No factoid with name ", newfactoidkey, " found")
 		}
 
 	case "delalias":
@@ -231,20 +482,14 @@ func HandleAdmin(c *sirc.IConn, m *irc.Message) (abort bool) {
 		defer state.Unlock()
 
 		if _, ok := s.Aliases[factoidkey]; ok {
-			c.Notice(m, "Deleted alias successfully")
+			r.Reply("Deleted alias successfully")
 			delete(s.Aliases, factoidkey)
 			savestate = true
 		}
-
-	default:
-		abort = false
-		return
 	}
 
 	if savestate {
 		state.Save(false)
 		tpl.invalidate()
 	}
-
-	return
 }
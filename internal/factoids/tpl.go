@@ -6,21 +6,23 @@ import (
 	"html/template"
 	"math/rand"
 	"net/http"
-	"sort"
 	"strings"
 	"sync"
 
+	"github.com/obsproject/obscommits/internal/commands"
 	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/ircfmt"
+	"github.com/obsproject/obscommits/internal/perms"
 	"mvdan.cc/xurls"
 )
 
-type factoid struct {
-	Name    string
-	Text    string
-	Aliases []string
+type page struct {
+	Factoids []Factoid
+	Commands []commands.Group
+	Roles    []perms.Role
 }
 
-type factoidSlice []factoid
+type factoidSlice []Factoid
 
 func (f factoidSlice) Len() int           { return len(f) }
 func (f factoidSlice) Less(i, j int) bool { return f[i].Name < f[j].Name }
@@ -67,12 +69,15 @@ func (c *cache) init() {
 
 			return template.HTML(s)
 		},
-		"ircize": ircToHTML,
+		"ircize": ircfmt.ToHTML,
+		// splits the argument syntax of a command into the separate arguments
+		// so that they can be kept from wrapping individually
+		"args": strings.Fields,
 	})
 
 	tpl, err := c.t.ParseFiles("factoid.tpl")
 	if err != nil {
-		d.F("Unable to parse factoid.tpl, err:", err)
+		d.F("Unable to parse factoid.tpl, err: %v", err)
 	}
 
 	c.t = tpl
@@ -100,34 +105,12 @@ func (c *cache) render() {
 
 	c.mu.Lock()
 	b := bytes.NewBuffer(nil)
-	c.t.ExecuteTemplate(b, "factoid.tpl", c.sortFactoids())
+	c.t.ExecuteTemplate(b, "factoid.tpl", &page{
+		Factoids: All(),
+		Commands: commands.Groups(),
+		Roles:    []perms.Role{perms.FactoidEditor, perms.Moderator, perms.Owner, perms.SuperAdmin},
+	})
 	c.cache = b.Bytes()
 	c.valid = true
 	c.mu.Unlock()
 }
-
-func (c *cache) sortFactoids() []factoid {
-	state.Lock()
-	defer state.Unlock()
-
-	a := make(map[string][]string)
-	for alias, factoid := range s.Aliases {
-		a[factoid] = append(a[factoid], alias)
-	}
-
-	for _, v := range a {
-		sort.Strings(v)
-	}
-
-	fs := make([]factoid, 0, len(s.Factoids))
-	for name, text := range s.Factoids {
-		fs = append(fs, factoid{
-			Name:    name,
-			Text:    text,
-			Aliases: a[name],
-		})
-	}
-
-	sort.Sort(factoidSlice(fs))
-	return fs
-}
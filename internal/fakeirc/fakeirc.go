@@ -0,0 +1,344 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package fakeirc is an IRC server in the same process that the bot connects
+// to instead of a real one, it registers the bot, says the lines of users to
+// it and records what the bot sends, the console of the dry run mode and the
+// tests use it
+package fakeirc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v1"
+)
+
+const (
+	// the capabilities offered, every requested one is acknowledged
+	caps = "account-tag"
+	// the most lines waiting to be written to the bot
+	maxPending = 100
+)
+
+// Server is the pretend IRC server
+type Server struct {
+	name string
+	log  func(line string)
+
+	mu sync.Mutex
+	// the connection of the bot and the lines waiting to be written to it
+	conn    net.Conn
+	pending chan string
+	// the nick of the bot, empty until it registered
+	nick string
+	// what the bot sent and how far Wait got in it
+	sent []*irc.Message
+	next int
+	// closed and replaced when the bot sends something or registers
+	changed chan struct{}
+}
+
+// New returns a server with the name, log is told what happens in a form
+// meant for people, like "[#obs] <bot> hi", it can be nil
+func New(name string, log func(line string)) *Server {
+	return &Server{
+		name:    name,
+		log:     log,
+		changed: make(chan struct{}),
+	}
+}
+
+// Dial connects the bot to the server, an earlier connection is closed
+func (s *Server) Dial() (net.Conn, error) {
+	client, conn := net.Pipe()
+	pending := make(chan string, maxPending)
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+		close(s.pending)
+	}
+	s.conn, s.pending, s.nick = conn, pending, ""
+	s.mu.Unlock()
+
+	go s.write(conn, pending)
+	go s.serve(conn)
+	return client, nil
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.log != nil {
+		s.log(fmt.Sprintf(format, args...))
+	}
+}
+
+// send queues the message for the bot
+func (s *Server) send(m *irc.Message) {
+	s.sendLine(m.String())
+}
+
+// sendLine queues the line for the bot, the pipe blocks until the bot reads
+// it and the bot might be waiting for us to read, so it is written in the
+// background
+func (s *Server) sendLine(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil {
+		return
+	}
+	select {
+	case s.pending <- line:
+	default:
+		s.logf("-- the bot is not reading, dropped %s", line)
+	}
+}
+
+func (s *Server) write(conn net.Conn, pending chan string) {
+	for line := range pending {
+		if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+			return
+		}
+	}
+}
+
+// record keeps the message the bot sent for Sent and Wait
+func (s *Server) record(m *irc.Message) {
+	s.mu.Lock()
+	s.sent = append(s.sent, m)
+	s.notify()
+	s.mu.Unlock()
+}
+
+// notify wakes up the ones waiting, the lock needs to be held by the caller
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// serve handles what the bot sends until the connection is closed
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		if s.conn == conn {
+			close(s.pending)
+			s.conn, s.pending = nil, nil
+		}
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	var nick string
+	var user, capping bool
+	dec := irc.NewDecoder(conn)
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			return
+		}
+		if m == nil {
+			continue
+		}
+		s.record(m)
+
+		switch m.Command {
+		case irc.CAP:
+			if len(m.Params) == 0 {
+				continue
+			}
+			switch m.Params[0] {
+			case irc.CAP_LS:
+				capping = true
+				s.send(&irc.Message{Prefix: s.server(), Command: irc.CAP, Params: []string{"*", irc.CAP_LS}, Trailing: caps})
+			case irc.CAP_REQ:
+				s.send(&irc.Message{Prefix: s.server(), Command: irc.CAP, Params: []string{"*", irc.CAP_ACK}, Trailing: m.Trailing})
+			case irc.CAP_END:
+				capping = false
+			}
+		case irc.NICK:
+			if len(m.Params) > 0 {
+				nick = m.Params[0]
+			}
+			if s.Registered() {
+				s.setNick(nick)
+				s.logf("-- the bot is now known as %s", nick)
+			}
+		case irc.USER:
+			user = true
+		case irc.PING:
+			s.send(&irc.Message{Prefix: s.server(), Command: irc.PONG, Params: []string{s.name}, Trailing: m.Trailing})
+		case irc.JOIN:
+			if len(m.Params) == 0 {
+				continue
+			}
+			for _, channel := range strings.Split(m.Params[0], ",") {
+				s.send(&irc.Message{Prefix: s.prefix(), Command: irc.JOIN, Params: []string{channel}})
+				s.logf("-- joined %s", channel)
+			}
+		case irc.PRIVMSG:
+			if len(m.Params) > 0 {
+				s.logf("[%s] <%s> %s", m.Params[0], s.Nick(), m.Trailing)
+			}
+		case irc.NOTICE:
+			if len(m.Params) > 0 {
+				s.logf("[%s] -%s- %s", m.Params[0], s.Nick(), m.Trailing)
+			}
+		case irc.QUIT:
+			s.logf("-- the bot quit: %s", m.Trailing)
+			return
+		}
+
+		// registration is held back until the capabilities are negotiated
+		if user && !capping && nick != "" && !s.Registered() {
+			s.setNick(nick)
+			s.send(&irc.Message{Prefix: s.server(), Command: irc.RPL_WELCOME, Params: []string{nick}, Trailing: "Welcome to " + s.name + " " + s.prefix().String()})
+			s.send(&irc.Message{Prefix: s.server(), Command: irc.RPL_ENDOFMOTD, Params: []string{nick}, Trailing: "End of /MOTD command."})
+			s.logf("-- the bot connected as %s", nick)
+		}
+	}
+}
+
+func (s *Server) server() *irc.Prefix {
+	return &irc.Prefix{Name: s.name}
+}
+
+func (s *Server) setNick(nick string) {
+	s.mu.Lock()
+	s.nick = nick
+	s.notify()
+	s.mu.Unlock()
+}
+
+// Registered returns whether the bot is connected and registered
+func (s *Server) Registered() bool {
+	return s.Nick() != ""
+}
+
+// Nick returns the nick of the bot, empty until it registered
+func (s *Server) Nick() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nick
+}
+
+// prefix returns the prefix of the bot
+func (s *Server) prefix() *irc.Prefix {
+	return &irc.Prefix{Name: s.Nick(), User: "bot", Host: s.name}
+}
+
+// Say sends the text to the bot as if the nick said it in the target, a
+// channel or the nick of the bot, an empty account means the nick is not
+// logged in to services
+func (s *Server) Say(nick, account, target, text string) error {
+	if !s.Registered() {
+		return fmt.Errorf("the bot is not connected")
+	}
+
+	m := &irc.Message{
+		Prefix:   &irc.Prefix{Name: nick, User: nick, Host: s.name},
+		Command:  irc.PRIVMSG,
+		Params:   []string{target},
+		Trailing: text,
+	}
+
+	// the irc package does not know about tags
+	raw := m.String()
+	if account != "" {
+		raw = "@account=" + account + " " + raw
+	}
+	s.sendLine(raw)
+	return nil
+}
+
+// Sent returns everything the bot sent so far
+func (s *Server) Sent() []*irc.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]*irc.Message, len(s.sent))
+	copy(ret, s.sent)
+	return ret
+}
+
+// Wait returns the next message the bot sends with one of the commands,
+// every command if none are given, the messages in between are skipped, the
+// next Wait continues after the message returned
+func (s *Server) Wait(timeout time.Duration, commands ...string) (*irc.Message, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		for s.next < len(s.sent) {
+			m := s.sent[s.next]
+			s.next++
+			if matches(m, commands) {
+				s.mu.Unlock()
+				return m, nil
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			what := strings.Join(commands, " or ")
+			if what == "" {
+				what = "message"
+			}
+			return nil, fmt.Errorf("the bot sent no %s in %v", what, timeout)
+		}
+	}
+}
+
+func matches(m *irc.Message, commands []string) bool {
+	if len(commands) == 0 {
+		return true
+	}
+	for _, c := range commands {
+		if m.Command == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WaitRegistered waits until the bot registered
+func (s *Server) WaitRegistered(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		registered, changed := s.nick != "", s.changed
+		s.mu.Unlock()
+		if registered {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("the bot did not register in %v", timeout)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package fakeirc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"golang.org/x/net/context"
+	"gopkg.in/sorcix/irc.v1"
+)
+
+func TestServer(t *testing.T) {
+	s := New("irc.test", func(line string) { t.Log(line) })
+
+	said := make(chan *ircconn.Message, 1)
+	c := ircconn.Init(ircconn.Config{
+		Nick: "bot",
+		Caps: []string{"account-tag"},
+		Dial: s.Dial,
+	}, func(c *ircconn.IConn, m *ircconn.Message) bool {
+		if m.Command == irc.PRIVMSG {
+			said <- m
+		}
+		return false
+	})
+
+	if err := s.WaitRegistered(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if s.Nick() != "bot" {
+		t.Errorf("expected the nick bot, got %q", s.Nick())
+	}
+
+	if err := s.Say("jim", "jimmy", "#obs", "!help"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-said:
+		if m.Prefix.Name != "jim" || m.Trailing != "!help" || m.Tag("account") != "jimmy" {
+			t.Errorf("unexpected message %s with the tags %v", m, m.Tags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bot did not receive the line")
+	}
+
+	c.Queue(ircconn.Low, "#obs", "commits", "a", "b")
+	for _, want := range []string{"a", "b"} {
+		m, err := s.Wait(5*time.Second, irc.PRIVMSG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Params[0] != "#obs" || m.Trailing != want {
+			t.Errorf("expected %q in #obs, got %s", want, m)
+		}
+	}
+	if m, err := s.Wait(100*time.Millisecond, irc.PRIVMSG); err == nil {
+		t.Errorf("unexpected message %s", m)
+	}
+
+	var caps bool
+	for _, m := range s.Sent() {
+		if m.Command == irc.CAP && len(m.Params) > 0 && m.Params[0] == irc.CAP_REQ {
+			caps = m.Trailing == "account-tag"
+		}
+	}
+	if !caps {
+		t.Error("expected the bot to request account-tag")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Quit(ctx, "bye")
+	if m, err := s.Wait(5*time.Second, irc.QUIT); err != nil || m.Trailing != "bye" {
+		t.Errorf("expected the bot to quit, got %v %v", m, err)
+	}
+}
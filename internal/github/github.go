@@ -22,49 +22,180 @@ package github
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"html"
 	"net/http"
 	"strings"
 
 	"github.com/obsproject/obscommits/internal/config"
 	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/deliveries"
+	"github.com/obsproject/obscommits/internal/hookmux"
+	"github.com/obsproject/obscommits/internal/sink"
 	"github.com/obsproject/obscommits/internal/tpl"
-	"github.com/sztanpet/sirc"
 	"golang.org/x/net/context"
-	"gopkg.in/sorcix/irc.v1"
 )
 
 const maxLines = 5
 
 type gh struct {
 	cfg config.Github
-	irc *sirc.IConn
+	out *sink.Router
 	tpl *tpl.Tpl
 }
 
+// the data the templates are rendered with
+type (
+	pushData struct {
+		Author  string // commits[i].author.username
+		URL     string // commits[i].url
+		Message string // commits[i].message
+		ID      string // commits[i].id
+		Repo    string // repository.name
+		RepoURL string // repository.url
+		Branch  string // .ref the part after refs/heads/
+	}
+	pushSkippedData struct {
+		Author    string // commits[i].author.username
+		FromID    string // commits[0].id
+		ToID      string // commits[len - 2].id
+		SkipCount int
+		Repo      string // repository.name
+		RepoURL   string // repository.url
+	}
+	itemData struct {
+		Author string
+		Title  string
+		URL    string
+	}
+	wikiData struct {
+		Author string
+		Page   string
+		URL    string
+		Action string
+		Sha    string
+	}
+)
+
+// the parts of the payloads of the events that are used
+type (
+	pushPayload struct {
+		Ref     string
+		Before  string
+		Commits []struct {
+			Author struct {
+				Username string
+			}
+			URL     string
+			Message string
+			ID      string
+		}
+		Repository struct {
+			Name string
+			URL  string
+		}
+	}
+	prPayload struct {
+		Action string
+		PR     struct {
+			URL   string `json:"html_url"`
+			Title string
+			User  struct {
+				Login string
+			}
+		} `json:"pull_request"`
+	}
+	wikiPayload struct {
+		Pages []struct {
+			Page   string `json:"page_name"`
+			Action string
+			Sha    string
+			URL    string `json:"html_url"`
+		}
+		Sender struct {
+			Login string
+		}
+	}
+	issuePayload struct {
+		Action string
+		Issue  struct {
+			Title string
+			URL   string `json:"html_url"`
+			User  struct {
+				Login string
+			}
+		}
+	}
+)
+
 func Init(ctx context.Context) context.Context {
 	cfg := config.FromContext(ctx).Github
 	gh := &gh{
 		cfg: cfg,
-		irc: sirc.FromContext(ctx),
+		out: sink.FromContext(ctx).MustRouter(sink.Routes(cfg.Routes, cfg.AnnounceChan)),
 		tpl: tpl.FromContext(ctx),
 	}
+	gh.samples()
+
+	reg := sink.FromContext(ctx)
+	config.OnReload(config.Hook{
+		Name: "github",
+		Check: func(cfg *config.AppConfig) error {
+			return reg.Check(cfg, sink.Routes(cfg.Github.Routes, cfg.Github.AnnounceChan))
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			if err := gh.out.Reset(sink.Routes(cfg.Github.Routes, cfg.Github.AnnounceChan)); err != nil {
+				d.P("Could not reset the github routes", err)
+			}
+			hookmux.Move("github", cfg.Github.HookPath)
+		},
+	})
 
-	http.HandleFunc(gh.cfg.HookPath, gh.handler)
+	hookmux.Handle("github", gh.cfg.HookPath, deliveries.Handler("github", gh.out, gh.process, validate))
 	return ctx
 }
 
-func (s *gh) handler(w http.ResponseWriter, r *http.Request) {
+// process returns the announcements of the delivery, they are sent by the
+// delivery log
+func (s *gh) process(r *http.Request) (string, []sink.Announcement, error) {
 	d.D("request", r)
-	switch r.Header.Get("X-Github-Event") {
+
+	var anns []sink.Announcement
+	var err error
+	event := r.Header.Get("X-Github-Event")
+	switch event {
 	case "push":
-		s.pushHandler(r)
+		anns, err = s.pushHandler(r)
 	case "gollum":
-		s.wikiHandler(r)
+		anns, err = s.wikiHandler(r)
 	case "pull_request":
-		s.prHandler(r)
+		anns, err = s.prHandler(r)
 	case "issues":
-		s.issueHandler(r)
+		anns, err = s.issueHandler(r)
+	default:
+		return event, nil, deliveries.ErrIgnored
 	}
+
+	return event, anns, err
+}
+
+// validate decodes the payload of the events that are announced, the rest
+// are ignored once they are processed
+func validate(h http.Header, payload []byte) error {
+	var data interface{}
+	switch h.Get("X-Github-Event") {
+	case "push":
+		data = &pushPayload{}
+	case "gollum":
+		data = &wikiPayload{}
+	case "pull_request":
+		data = &prPayload{}
+	case "issues":
+		data = &issuePayload{}
+	default:
+		return nil
+	}
+	return json.Unmarshal(payload, data)
 }
 
 func handlePayload(r *http.Request, data interface{}) error {
@@ -77,39 +208,22 @@ func handlePayload(r *http.Request, data interface{}) error {
 	return json.Unmarshal([]byte(payload), &data)
 }
 
-func (s *gh) pushHandler(r *http.Request) {
-	var data struct {
-		Ref     string
-		Before  string
-		Commits []struct {
-			Author struct {
-				Username string
-			}
-			URL     string
-			Message string
-			ID      string
-		}
-		Repository struct {
-			Name string
-			URL  string
-		}
-	}
+func (s *gh) pushHandler(r *http.Request) ([]sink.Announcement, error) {
+	var data pushPayload
 
-	err := handlePayload(r, &data)
-	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+	if err := handlePayload(r, &data); err != nil {
+		return nil, err
 	}
 
 	pos := strings.LastIndex(data.Ref, "/") + 1
 	branch := data.Ref[pos:]
-	lines := make([]string, 0, maxLines)
+	anns := make([]sink.Announcement, 0, maxLines)
 	repo := data.Repository.Name
 	repoURL := data.Repository.URL
 	b := bytes.NewBuffer(nil)
 
 	if branch != "master" {
-		return
+		return nil, nil
 	}
 
 	// if we want to print more than 5 lines, just print two lines, one line
@@ -125,32 +239,26 @@ func (s *gh) pushHandler(r *http.Request) {
 		}
 
 		b.Reset()
+		ann := sink.Announcement{
+			Source: "GitHub " + repo,
+			Author: v.Author.Username,
+			Kind:   "commits",
+		}
 		if needSkip && k == len(data.Commits)-2 {
-			s.tpl.Execute(b, "pushSkipped", &struct {
-				Author    string // commits[i].author.username
-				FromID    string // commits[0].id
-				ToID      string // commits[len - 2].id
-				SkipCount int
-				Repo      string // repository.name
-				RepoURL   string // repository.url
-			}{
+			ann.Template = "pushSkipped"
+			ann.Data = &pushSkippedData{
 				Author:    v.Author.Username,
 				FromID:    data.Before,
 				ToID:      v.ID,
 				SkipCount: len(data.Commits) - 1,
 				Repo:      repo,
 				RepoURL:   repoURL,
-			})
+			}
+			ann.Title = fmt.Sprintf("Skipped %d commits", len(data.Commits)-1)
+			ann.URL = repoURL + "/compare/" + data.Before + "..." + v.ID
 		} else if !needSkip || k > len(data.Commits)-2 {
-			s.tpl.Execute(b, "push", &struct {
-				Author  string // commits[i].author.username
-				URL     string // commits[i].url
-				Message string // commits[i].message
-				ID      string // commits[i].id
-				Repo    string // repository.name
-				RepoURL string // repository.url
-				Branch  string // .ref the part after refs/heads/
-			}{
+			ann.Template = "push"
+			ann.Data = &pushData{
 				Author:  v.Author.Username,
 				URL:     v.URL,
 				Message: firstline,
@@ -158,145 +266,169 @@ func (s *gh) pushHandler(r *http.Request) {
 				Repo:    repo,
 				RepoURL: repoURL,
 				Branch:  branch,
-			})
+			}
+			ann.Title = firstline
+			ann.URL = v.URL
+		} else {
+			continue
+		}
+
+		if err := s.tpl.Execute(b, ann.Template, ann.Data); err != nil {
+			d.P("Could not render the template", ann.Template, err)
+			continue
 		}
 
 		if b.Len() > 0 {
-			lines = append(lines, b.String())
+			ann.Text = b.String()
+			anns = append(anns, ann)
 		}
 	}
 
-	for _, line := range lines {
-		s.writeLine(line)
-	}
+	return anns, nil
 }
 
-func (s *gh) prHandler(r *http.Request) {
-	var data struct {
-		Action string
-		PR     struct {
-			URL   string `json:"html_url"`
-			Title string
-			User  struct {
-				Login string
-			}
-		} `json:"pull_request"`
-	}
+func (s *gh) prHandler(r *http.Request) ([]sink.Announcement, error) {
+	var data prPayload
 
-	err := handlePayload(r, &data)
-	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+	if err := handlePayload(r, &data); err != nil {
+		return nil, err
 	}
 
 	if data.Action != "opened" {
-		return
+		return nil, nil
 	}
 
 	b := bytes.NewBuffer(nil)
-	s.tpl.Execute(b, "pr", &struct {
-		Author string
-		Title  string
-		URL    string
-	}{
+	tdata := &itemData{
 		Author: data.PR.User.Login,
 		Title:  data.PR.Title,
 		URL:    data.PR.URL,
-	})
+	}
+	if err := s.tpl.Execute(b, "pr", tdata); err != nil {
+		return nil, fmt.Errorf("could not render the template pr: %v", err)
+	}
 
-	s.writeLine(b.String())
+	return []sink.Announcement{{
+		Text:     b.String(),
+		Source:   "GitHub pull request",
+		Title:    html.UnescapeString(data.PR.Title),
+		URL:      data.PR.URL,
+		Author:   data.PR.User.Login,
+		Kind:     "pull requests",
+		Template: "pr",
+		Data:     tdata,
+	}}, nil
 }
 
-func (s *gh) wikiHandler(r *http.Request) {
-	var data struct {
-		Pages []struct {
-			Page   string `json:"page_name"`
-			Action string
-			Sha    string
-			URL    string `json:"html_url"`
-		}
-		Sender struct {
-			Login string
-		}
-	}
+func (s *gh) wikiHandler(r *http.Request) ([]sink.Announcement, error) {
+	var data wikiPayload
 
-	err := handlePayload(r, &data)
-	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+	if err := handlePayload(r, &data); err != nil {
+		return nil, err
 	}
 
-	lines := make([]string, 0, len(data.Pages))
+	anns := make([]sink.Announcement, 0, len(data.Pages))
 	b := bytes.NewBuffer(nil)
 	for _, v := range data.Pages {
 
 		b.Reset()
-		s.tpl.Execute(b, "wiki", &struct {
-			Author string
-			Page   string
-			URL    string
-			Action string
-			Sha    string
-		}{
+		tdata := &wikiData{
 			Author: data.Sender.Login,
 			Page:   v.Page,
 			URL:    v.URL,
 			Action: v.Action,
 			Sha:    v.Sha,
+		}
+		if err := s.tpl.Execute(b, "wiki", tdata); err != nil {
+			d.P("Could not render the template", "wiki", err)
+			continue
+		}
+		anns = append(anns, sink.Announcement{
+			Text:     b.String(),
+			Source:   "GitHub wiki",
+			Title:    html.UnescapeString(v.Page) + " " + v.Action,
+			URL:      v.URL,
+			Author:   data.Sender.Login,
+			Kind:     "wiki edits",
+			Template: "wiki",
+			Data:     tdata,
 		})
-		lines = append(lines, b.String())
 	}
 
-	if l := len(lines); l > maxLines {
-		lines = lines[l-maxLines:]
+	if l := len(anns); l > maxLines {
+		anns = anns[l-maxLines:]
 	}
 
-	for _, line := range lines {
-		s.writeLine(line)
-	}
+	return anns, nil
 }
 
-func (s *gh) issueHandler(r *http.Request) {
-	var data struct {
-		Action string
-		Issue  struct {
-			Title string
-			URL   string `json:"html_url"`
-			User  struct {
-				Login string
-			}
-		}
-	}
+func (s *gh) issueHandler(r *http.Request) ([]sink.Announcement, error) {
+	var data issuePayload
 
-	err := handlePayload(r, &data)
-	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+	if err := handlePayload(r, &data); err != nil {
+		return nil, err
 	}
 
 	if data.Action != "opened" {
-		return
+		return nil, nil
 	}
 
 	b := bytes.NewBuffer(nil)
-	s.tpl.Execute(b, "issues", &struct {
-		Author string
-		Title  string
-		URL    string
-	}{
+	tdata := &itemData{
 		Author: data.Issue.User.Login,
 		Title:  data.Issue.Title,
 		URL:    data.Issue.URL,
-	})
+	}
+	if err := s.tpl.Execute(b, "issues", tdata); err != nil {
+		return nil, fmt.Errorf("could not render the template issues: %v", err)
+	}
 
-	s.writeLine(b.String())
+	return []sink.Announcement{{
+		Text:     b.String(),
+		Source:   "GitHub issue",
+		Title:    html.UnescapeString(data.Issue.Title),
+		URL:      data.Issue.URL,
+		Author:   data.Issue.User.Login,
+		Kind:     "issues",
+		Template: "issues",
+		Data:     tdata,
+	}}, nil
 }
 
-func (s *gh) writeLine(line string) {
-	m := &irc.Message{
-		Command:  irc.PRIVMSG,
-		Params:   []string{s.cfg.AnnounceChan},
-		Trailing: line,
-	}
-	s.irc.Write(m)
+// samples registers the payloads the templates are previewed with
+func (s *gh) samples() {
+	s.tpl.Sample("push", &pushData{
+		Author:  "jp9000",
+		URL:     "https://github.com/obsproject/obs-studio/commit/0123456789abcdef0123456789abcdef01234567",
+		Message: "libobs: Fix a crash when the source is removed",
+		ID:      "0123456789abcdef0123456789abcdef01234567",
+		Repo:    "obs-studio",
+		RepoURL: "https://github.com/obsproject/obs-studio",
+		Branch:  "master",
+	})
+	s.tpl.Sample("pushSkipped", &pushSkippedData{
+		Author:    "jp9000",
+		FromID:    "0123456789abcdef0123456789abcdef01234567",
+		ToID:      "76543210fedcba9876543210fedcba9876543210",
+		SkipCount: 7,
+		Repo:      "obs-studio",
+		RepoURL:   "https://github.com/obsproject/obs-studio",
+	})
+	s.tpl.Sample("pr", &itemData{
+		Author: "someone",
+		Title:  "UI: Add a setting for the thing",
+		URL:    "https://github.com/obsproject/obs-studio/pull/1000",
+	})
+	s.tpl.Sample("issues", &itemData{
+		Author: "someone",
+		Title:  "The thing does not work",
+		URL:    "https://github.com/obsproject/obs-studio/issues/1001",
+	})
+	s.tpl.Sample("wiki", &wikiData{
+		Author: "someone",
+		Page:   "Install Instructions",
+		URL:    "https://github.com/obsproject/obs-studio/wiki/Install-Instructions",
+		Action: "edited",
+		Sha:    "0123456789abcdef0123456789abcdef01234567",
+	})
 }
@@ -0,0 +1,101 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package hookmux serves the handlers at the paths set in the config, a
+// reload moves them without a restart, the fixed paths of the bot stay on
+// http.DefaultServeMux and everything it does not handle comes here
+package hookmux
+
+import (
+	"net/http"
+	"sync"
+)
+
+type entry struct {
+	path string
+	h    http.Handler
+	// when it was last moved, on a clash the later one wins until the other
+	// one is moved too, like when two paths are swapped
+	seq int
+}
+
+var (
+	mu       sync.RWMutex
+	handlers = map[string]entry{}
+	seq      int
+	mux      = http.NewServeMux()
+	once     sync.Once
+)
+
+// Handle serves the handler named name at the path, a handler with the same
+// name is replaced
+func Handle(name, path string, h http.Handler) {
+	once.Do(func() {
+		http.Handle("/", http.HandlerFunc(serve))
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	seq++
+	handlers[name] = entry{path: path, h: h, seq: seq}
+	rebuild()
+}
+
+// Move serves the handler named name at the path instead, the old path stops
+// working
+func Move(name, path string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := handlers[name]
+	if !ok || e.path == path {
+		return
+	}
+
+	seq++
+	e.path, e.seq = path, seq
+	handlers[name] = e
+	rebuild()
+}
+
+// rebuild replaces the mux since paths can not be removed from one, the lock
+// needs to be held by the caller
+func rebuild() {
+	byPath := map[string]entry{}
+	for _, e := range handlers {
+		if other, ok := byPath[e.path]; !ok || e.seq > other.seq {
+			byPath[e.path] = e
+		}
+	}
+
+	m := http.NewServeMux()
+	for path, e := range byPath {
+		m.Handle(path, e.h)
+	}
+	mux = m
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	m := mux
+	mu.RUnlock()
+
+	m.ServeHTTP(w, r)
+}
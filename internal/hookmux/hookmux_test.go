@@ -0,0 +1,66 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package hookmux
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+// get returns what answers at the path, empty if nothing does
+func get(path string) string {
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK {
+		return ""
+	}
+	return w.Body.String()
+}
+
+func TestMove(t *testing.T) {
+	Handle("github", "/a", named("github"))
+	Handle("travis", "/b", named("travis"))
+	if get("/a") != "github" || get("/b") != "travis" || get("/c") != "" {
+		t.Fatal("the handlers are not served at their paths")
+	}
+
+	Move("github", "/c")
+	if get("/a") != "" || get("/c") != "github" {
+		t.Error("the handler was not moved")
+	}
+
+	// swapped one by one like the reload hooks do
+	Move("github", "/b")
+	if get("/b") != "github" {
+		t.Error("the handler moved last should win a clash")
+	}
+	Move("travis", "/c")
+	if get("/b") != "github" || get("/c") != "travis" {
+		t.Error("the handlers were not swapped")
+	}
+}
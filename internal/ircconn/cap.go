@@ -0,0 +1,276 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircconn
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"gopkg.in/sorcix/irc.v1"
+)
+
+// the maximum length of a single AUTHENTICATE payload chunk
+const saslChunkLen = 400
+
+// negotiation holds the state of the IRCv3 capability negotiation and the
+// authentication, it is reset on every reconnect
+type negotiation struct {
+	// the capabilities the server offers, with their values if any
+	offered map[string]string
+	// the capabilities that the server acknowledged
+	enabled map[string]struct{}
+	// whether CAP END was sent already
+	ended bool
+	// whether we logged in to an account via SASL
+	authed bool
+	// the account name we are logged in as
+	account string
+}
+
+// HasCap returns whether the given capability was enabled by the server
+// for the current connection
+func (c *IConn) HasCap(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.neg.enabled[name]
+	return ok
+}
+
+// Account returns the services account the connection is logged in as, it
+// is only known if SASL was used
+func (c *IConn) Account() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.neg.account
+}
+
+// negotiate handles the messages related to capability negotiation and
+// SASL, returns true if the message should not be handled any further
+func (c *IConn) negotiate(m *irc.Message) bool {
+	switch m.Command {
+	case irc.CAP:
+		c.handleCap(m)
+		return true
+	case irc.AUTHENTICATE:
+		c.handleAuthenticate(m)
+		return true
+	case irc.RPL_LOGGEDIN:
+		// :server 900 nick nick!user@host account :You are now logged in
+		if len(m.Params) > 2 {
+			c.mu.Lock()
+			c.neg.account = m.Params[2]
+			c.mu.Unlock()
+		}
+	case irc.RPL_SASLSUCCESS:
+		debug("SASL authentication successful")
+		c.mu.Lock()
+		c.neg.authed = true
+		c.mu.Unlock()
+		c.endCap()
+		return true
+	case irc.RPL_NICKLOCKED, irc.ERR_SASLFAIL, irc.ERR_SASLTOOLONG,
+		irc.ERR_SASLABORTED, irc.ERR_SASLALREADY, irc.RPL_SASLMECHS:
+		debug("SASL authentication failed: %v", m.String())
+		c.endCap()
+		return true
+	case irc.ERR_UNKNOWNCOMMAND:
+		// the server does not know about CAP, nothing to negotiate
+		if len(m.Params) > 1 && m.Params[1] == irc.CAP {
+			c.neg.ended = true
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *IConn) handleCap(m *irc.Message) {
+	// :server CAP * LS [*] :cap1 cap2=value
+	if len(m.Params) < 2 {
+		return
+	}
+
+	switch m.Params[1] {
+	case irc.CAP_LS:
+		if c.neg.offered == nil {
+			c.neg.offered = map[string]string{}
+		}
+		for _, v := range strings.Fields(m.Trailing) {
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) == 2 {
+				c.neg.offered[kv[0]] = kv[1]
+			} else {
+				c.neg.offered[kv[0]] = ""
+			}
+		}
+
+		// there are more lines coming
+		if len(m.Params) > 2 && m.Params[2] == "*" {
+			return
+		}
+
+		c.requestCaps()
+	case irc.CAP_ACK:
+		c.mu.Lock()
+		if c.neg.enabled == nil {
+			c.neg.enabled = map[string]struct{}{}
+		}
+		for _, v := range strings.Fields(m.Trailing) {
+			// a dash means the capability got disabled
+			if strings.HasPrefix(v, "-") {
+				delete(c.neg.enabled, v[1:])
+				continue
+			}
+			c.neg.enabled[v] = struct{}{}
+		}
+		_, sasl := c.neg.enabled["sasl"]
+		c.mu.Unlock()
+
+		if sasl && c.wantSASL() {
+			c.w <- &irc.Message{
+				Command: irc.AUTHENTICATE,
+				Params:  []string{strings.ToUpper(c.cfg.SASLMech)},
+			}
+			return
+		}
+
+		c.endCap()
+	case irc.CAP_NAK:
+		c.endCap()
+	}
+}
+
+// requestCaps requests the wanted capabilities that the server offers
+func (c *IConn) requestCaps() {
+	var req []string
+	for _, v := range c.cfg.Caps {
+		if _, ok := c.neg.offered[v]; ok {
+			req = append(req, v)
+		}
+	}
+
+	if c.wantSASL() {
+		mechs, ok := c.neg.offered["sasl"]
+		// the mechanism list is optional, if it is there, respect it
+		if ok && (mechs == "" || hasMech(mechs, c.cfg.SASLMech)) {
+			req = append(req, "sasl")
+		}
+	}
+
+	if len(req) == 0 {
+		c.endCap()
+		return
+	}
+
+	c.w <- &irc.Message{
+		Command:  irc.CAP,
+		Params:   []string{irc.CAP_REQ},
+		Trailing: strings.Join(req, " "),
+	}
+}
+
+func hasMech(mechs, mech string) bool {
+	for _, v := range strings.Split(mechs, ",") {
+		if strings.EqualFold(v, mech) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *IConn) wantSASL() bool {
+	return c.cfg.SASLMech != ""
+}
+
+func (c *IConn) handleAuthenticate(m *irc.Message) {
+	// the server signals that it is ready for the payload with a "+"
+	if len(m.Params) == 0 || m.Params[0] != "+" {
+		return
+	}
+
+	var payload string
+	switch strings.ToUpper(c.cfg.SASLMech) {
+	case "PLAIN":
+		payload = base64.StdEncoding.EncodeToString([]byte(
+			c.cfg.SASLUser + "\x00" + c.cfg.SASLUser + "\x00" + c.cfg.SASLPassword,
+		))
+	case "EXTERNAL":
+		// the identity comes from the client certificate, send an empty
+		// response
+	default:
+		c.w <- &irc.Message{Command: irc.AUTHENTICATE, Params: []string{"*"}}
+		return
+	}
+
+	// the payload has to be split into 400 byte chunks, if the last chunk
+	// is exactly 400 bytes, an additional "+" signals the end
+	for len(payload) >= saslChunkLen {
+		c.w <- &irc.Message{Command: irc.AUTHENTICATE, Params: []string{payload[:saslChunkLen]}}
+		payload = payload[saslChunkLen:]
+	}
+	if payload == "" {
+		payload = "+"
+	}
+	c.w <- &irc.Message{Command: irc.AUTHENTICATE, Params: []string{payload}}
+}
+
+func (c *IConn) endCap() {
+	if c.neg.ended {
+		return
+	}
+
+	c.neg.ended = true
+	c.w <- &irc.Message{Command: irc.CAP, Params: []string{irc.CAP_END}}
+}
+
+// servicesLogin identifies with the services if SASL did not log us in
+func (c *IConn) servicesLogin() {
+	c.mu.Lock()
+	authed := c.neg.authed
+	c.mu.Unlock()
+
+	if authed || c.cfg.ServicesPassword == "" {
+		return
+	}
+
+	switch strings.ToLower(c.cfg.Services) {
+	case "nickserv":
+		args := []string{"IDENTIFY"}
+		if c.cfg.ServicesUser != "" {
+			args = append(args, c.cfg.ServicesUser)
+		}
+		args = append(args, c.cfg.ServicesPassword)
+
+		c.w <- &irc.Message{
+			Command:  irc.PRIVMSG,
+			Params:   []string{"NickServ"},
+			Trailing: strings.Join(args, " "),
+		}
+	case "q":
+		c.w <- &irc.Message{
+			Command:  irc.PRIVMSG,
+			Params:   []string{"Q@CServe.quakenet.org"},
+			Trailing: "AUTH " + c.cfg.ServicesUser + " " + c.cfg.ServicesPassword,
+		}
+	}
+}
@@ -0,0 +1,662 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package ircconn handles the connection to the IRC server and provides a
+// single callback for code to interact with, it started out as a fork of
+// github.com/sztanpet/sirc and adds TLS, IRCv3 capability negotiation, SASL
+// and services login on top of it
+package ircconn
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/sorcix/irc.v1"
+)
+
+// Config is the basic info used for setting up an IRC connection
+type Config struct {
+	Addr     string
+	Nick     string
+	User     string
+	Password string
+	RealName string
+
+	// TLS enables TLS for the connection when not nil, client certificates
+	// for CertFP go into TLS.Certificates
+	TLS *tls.Config
+
+	// SASLMech is either "PLAIN" or "EXTERNAL", empty disables SASL
+	SASLMech     string
+	SASLUser     string
+	SASLPassword string
+
+	// Services is used as a fallback if SASL is not configured or fails,
+	// it is either "nickserv" or "q", empty disables it
+	Services         string
+	ServicesUser     string
+	ServicesPassword string
+
+	// Caps are the extra capabilities to request if the server offers them
+	Caps []string
+
+	// Dial is used instead of connecting to Addr when not nil, like for the
+	// console of the dry run mode
+	Dial func() (net.Conn, error)
+}
+
+// DebuggingEnabled controls debug log output
+var DebuggingEnabled bool
+var contextKey *int
+
+func init() {
+	contextKey = new(int)
+}
+
+// Callback is function that is called for every irc command except PING
+// which is handled by the package (not overridable)
+// ERR_NICKNAMEINUSE also has a default handler, appends a random 0-10 int to
+// the nick, extra pseudo event names are "CONNECT" and "DISCONNECT"
+// CONNECT is emitted right after connecting to the server but before sending
+// anything to it,
+// DISCONNECT is emitted right before reconnecting, writing is no longer allowed
+// return true to stop the default handling of events like ERR_NICKNAMEINUSE or
+// "CONNECT"
+// the function must not block, or it will block further reading from the conn
+type Callback func(*IConn, *Message) bool
+
+// Conn is the part of the connection the handlers use, so that they can be
+// given something else than a connection to a server
+type Conn interface {
+	Write(m *irc.Message)
+	Send(p Priority, m *irc.Message)
+	Queue(p Priority, target, kind string, lines ...string)
+	PrivMsg(m *Message, args ...string)
+	Notice(m *Message, args ...string)
+	Target(m *Message) string
+	HasCap(name string) bool
+}
+
+var _ Conn = (*IConn)(nil)
+
+// IConn represents the IRC connection to the server
+type IConn struct {
+	Callback Callback
+
+	conn net.Conn
+	quit chan struct{}
+	w    chan *irc.Message
+
+	wg sync.WaitGroup
+	r  *bufio.Reader
+	*irc.Encoder
+	// cfg is only replaced by Reconnect while nothing is reading or writing,
+	// the others use the copies guarded by pmu
+	cfg Config
+
+	mu       sync.Mutex
+	Loggedin bool
+	// exponentially increase the time we sleep based on the number of tries
+	// only resets when successfully connected to the server
+	tries float64
+	// the number of pings that were sent but not yet answered, should never go
+	// beyond 2
+	pendingPings int
+	// closed when the server closed the connection after quitting
+	closed     chan struct{}
+	closedOnce sync.Once
+
+	// capability negotiation state, only touched from the read goroutine
+	// and Reconnect while the reader is not running
+	neg negotiation
+
+	// for ratelimiting purposes
+	badness  time.Duration
+	lastsent time.Time
+
+	// the outgoing messages waiting for their turn
+	q *queue
+
+	// the nick and the nick!user@host of the bot as the server sees it, used
+	// to calculate how long the lines of the bot can be
+	pmu    sync.Mutex
+	nick   string
+	prefix string
+	// the nick of the config, until the server told us ours
+	cfgNick string
+	// the config to use from the next connection on, guarded by pmu
+	next *Config
+	// set by Quit, no more reconnecting after that, guarded by pmu, not mu
+	// because the reader checks it while Reconnect waits for the reader
+	closing bool
+
+	// a copy of the state for Stats, it has its own lock because mu is held
+	// while reconnecting
+	smu   sync.Mutex
+	stats Stats
+}
+
+// maxLineLen is the longest line a server accepts, including the CRLF
+const maxLineLen = 512
+
+// the longest user and host a server might use for the bot, assumed until
+// the real prefix of the bot is known
+const (
+	maxUserLen = 10
+	maxHostLen = 63
+)
+
+func debug(format string, v ...interface{}) {
+	if DebuggingEnabled {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+// Init creates a client and connects to the server
+func Init(cfg Config, cb Callback) *IConn {
+	c := &IConn{
+		Callback: cb,
+		cfg:      cfg,
+		cfgNick:  cfg.Nick,
+		w:        make(chan *irc.Message, 1),
+		quit:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	c.q = newQueue(c.Write, c.Budget)
+	go c.q.run()
+
+	c.Reconnect("init")
+	return c
+}
+
+// FromContext returns the client from the context
+func FromContext(ctx context.Context) *IConn {
+	c, _ := ctx.Value(contextKey).(*IConn)
+	return c
+}
+
+// ToContext assigns the connection to the given context
+func (c *IConn) ToContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKey, c)
+}
+
+func (c *IConn) dial() (net.Conn, error) {
+	if c.cfg.Dial != nil {
+		return c.cfg.Dial()
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if c.cfg.TLS == nil {
+		return dialer.Dial("tcp", c.cfg.Addr)
+	}
+
+	tcfg := c.cfg.TLS.Clone()
+	if tcfg.ServerName == "" && !tcfg.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(c.cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		tcfg.ServerName = host
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", c.cfg.Addr, tcfg)
+}
+
+// Reconnect does exactly that and takes a message to be printed as arguments
+// can be called concurrently
+func (c *IConn) Reconnect(format string, v ...interface{}) {
+	c.mu.Lock()
+	if c.isClosing() {
+		c.mu.Unlock()
+		return
+	}
+
+	close(c.quit)
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.smu.Lock()
+		c.stats.Connected = false
+		c.stats.Reconnects++
+		c.smu.Unlock()
+	}
+	c.wg.Wait()
+
+	c.pmu.Lock()
+	if c.next != nil {
+		c.cfg = *c.next
+		c.cfgNick = c.next.Nick
+		c.next = nil
+		c.nick, c.prefix = "", ""
+	}
+	c.pmu.Unlock()
+
+	if c.tries > 0 {
+		d := time.Duration(math.Pow(2.0, c.tries)*300) * time.Millisecond
+		newargs := make([]interface{}, 0, len(v)+1)
+		newargs = append(newargs, v...)
+		newargs = append(newargs, d)
+		debug(format+", reconnecting in %s", newargs...)
+		time.Sleep(d)
+	}
+
+	c.quit = make(chan struct{})
+	conn, err := c.dial()
+	if err != nil {
+		c.mu.Unlock()
+		c.addDelay()
+		c.Reconnect("conn error: %+v", err)
+		return
+	}
+	defer c.mu.Unlock()
+
+	c.Loggedin = false
+	c.pendingPings = 0
+	c.badness = 0
+	c.neg = negotiation{}
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	c.Encoder = irc.NewEncoder(conn)
+
+	c.wg.Add(2)
+	go c.write()
+	go c.read()
+
+	if c.Callback != nil {
+		ret := c.Callback(c, &Message{Message: &irc.Message{
+			Command: "CONNECT",
+		}})
+		if ret {
+			return
+		}
+	}
+
+	// servers that do not know about CAP just ignore it or reply with
+	// ERR_UNKNOWNCOMMAND, registration continues regardless
+	c.w <- &irc.Message{Command: irc.CAP, Params: []string{irc.CAP_LS, "302"}}
+	if len(c.cfg.Password) > 0 {
+		c.w <- &irc.Message{Command: irc.PASS, Params: []string{c.cfg.Password}}
+	}
+	c.w <- &irc.Message{Command: irc.NICK, Params: []string{c.cfg.Nick}}
+
+	user := c.cfg.User
+	if user == "" {
+		user = c.cfg.Nick
+	}
+	c.w <- &irc.Message{
+		Command: irc.USER,
+		Params: []string{
+			user,
+			"0",
+			"*",
+		},
+		Trailing:      c.cfg.RealName,
+		EmptyTrailing: true,
+	}
+}
+
+// Stats is the state of the connection for monitoring
+type Stats struct {
+	// Connected is whether the bot is registered with the server
+	Connected bool
+	// Reconnects is the number of times the connection was made again
+	Reconnects int
+	// Queued is the number of messages waiting to be sent
+	Queued int
+}
+
+// Stats returns the state of the connection
+func (c *IConn) Stats() Stats {
+	c.smu.Lock()
+	ret := c.stats
+	c.smu.Unlock()
+
+	ret.Queued = c.q.len()
+	return ret
+}
+
+func (c *IConn) addDelay() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// clamp tries, so that the maximum amount of time we wait is ~5 minutes
+	if c.tries > 10.0 {
+		c.tries = 10.0
+	}
+
+	c.tries++
+}
+
+func (c *IConn) write() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case m := <-c.w:
+			debug("\t> %v", m.String())
+			_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := c.Encode(m); err != nil {
+				c.addDelay()
+				go c.Reconnect("write error: %+v", err)
+				return
+			}
+		}
+	}
+}
+
+// Write handles sending messages, it reconnects if there are problems
+// can be called concurrently, it bypasses the queue so it should only be used
+// for protocol messages, use Send or Queue for everything else
+func (c *IConn) Write(m *irc.Message) {
+	if t := c.rateLimit(m.Len()); t != 0 {
+		<-time.After(t)
+	}
+
+	c.w <- m
+}
+
+// Quit waits until the queued messages are sent or the context is done,
+// then quits with the message and stops reconnecting
+func (c *IConn) Quit(ctx context.Context, message string) {
+	c.q.drain(ctx)
+
+	c.pmu.Lock()
+	c.closing = true
+	c.pmu.Unlock()
+
+	select {
+	case c.w <- &irc.Message{Command: irc.QUIT, Trailing: message, EmptyTrailing: true}:
+		// the server closes the connection once it got the QUIT
+		select {
+		case <-c.closed:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	close(c.quit)
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.mu.Unlock()
+}
+
+func (c *IConn) isClosing() bool {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	return c.closing
+}
+
+// Send queues the message with the given priority, PRIVMSGs and NOTICEs are
+// also subject to the flood control of their target
+func (c *IConn) Send(p Priority, m *irc.Message) {
+	c.q.push(p, m)
+}
+
+// Queue queues the lines as PRIVMSGs to the target, kind is what the lines
+// are in plural, like "commits", if too many lines of the same kind are
+// waiting to be sent to the target, the rest are summarized as
+// "...and 7 more commits"
+func (c *IConn) Queue(p Priority, target, kind string, lines ...string) {
+	c.q.pushLines(p, target, kind, lines)
+}
+
+// read handles parsing messages from IRC and reconnects if there are problems
+// returns nil on error
+func (c *IConn) read() {
+	defer c.wg.Done()
+
+	for {
+		// if there are pending pings, lower the timeout duration to speed up
+		// the disconnection
+		if c.pendingPings > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		} else {
+			_ = c.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		}
+
+		m, err := c.decode()
+
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+
+		if err != nil && c.isClosing() {
+			c.closedOnce.Do(func() { close(c.closed) })
+			return
+		}
+
+		if err == nil && m == nil {
+			// an empty or unparseable line, nothing to do
+			continue
+		}
+
+		if err == nil {
+			// we do not actually care about the type of the message the server sends us,
+			// as long as it sends something it signals that its alive
+			if c.pendingPings > 0 {
+				c.pendingPings--
+			}
+
+			if c.negotiate(m.Message) {
+				debug("\t< %v", m.String())
+				continue
+			}
+			c.trackSelf(m)
+
+			switch m.Command {
+			case irc.PING:
+				c.w <- &irc.Message{Command: irc.PONG, Params: m.Params, Trailing: m.Trailing}
+			case irc.ERR_NICKNAMEINUSE:
+				if c.Callback != nil && c.Callback(c, m) {
+					continue
+				}
+
+				c.w <- &irc.Message{
+					Command: irc.NICK,
+					Params: []string{
+						fmt.Sprintf(c.cfg.Nick+"%d", rand.Intn(10)),
+					},
+				}
+			case irc.RPL_WELCOME: // successfully connected
+				debug("Successfully connected to IRC")
+				c.mu.Lock()
+				c.Loggedin = true
+				c.smu.Lock()
+				c.stats.Connected = true
+				c.smu.Unlock()
+				c.tries = 0
+				c.mu.Unlock()
+				c.servicesLogin()
+				fallthrough
+			default:
+				debug("\t< %v", m.String())
+				if c.Callback != nil {
+					c.Callback(c, m)
+				}
+			}
+
+			continue
+		}
+
+		// if we hit the timeout and there are no outstanding pings, send one
+		if e, ok := err.(net.Error); ok && e.Timeout() && c.pendingPings < 1 {
+			c.pendingPings++
+			c.w <- &irc.Message{
+				Command: "PING",
+				Params:  []string{time.Now().Format(time.RFC3339Nano)},
+			}
+
+			continue
+		}
+
+		// otherwise there either was an error or we did not get a reply for our ping
+		// call the callback with a made up command name
+		if c.Callback != nil {
+			c.Callback(c, &Message{Message: &irc.Message{
+				Command: "DISCONNECT",
+			}})
+		}
+		c.addDelay()
+		go c.Reconnect("read error: %+v", err)
+		return
+	}
+}
+
+// rateLimit implements Hybrid's flood control algorithm for outgoing lines.
+// Copyright (c) 2009+ Alex Bramley, github.com/fluffle/goirc
+func (c *IConn) rateLimit(chars int) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Hybrid's algorithm allows for 2 seconds per line and an additional
+	// 1/120 of a second per character on that line.
+	linetime := 2*time.Second + time.Duration(chars)*time.Second/120
+	elapsed := time.Now().Sub(c.lastsent)
+	if c.badness += linetime - elapsed; c.badness < 0 {
+		// negative badness times are badness...
+		c.badness = 0
+	}
+	c.lastsent = time.Now()
+	// If we've sent more than 10 second's worth of lines according to the
+	// calculation above, then we're at risk of "Excess Flood".
+	if c.badness > 10*time.Second {
+		return linetime
+	}
+	return 0
+}
+
+// trackSelf keeps track of the nick and the prefix of the bot
+func (c *IConn) trackSelf(m *Message) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	if m.Command == irc.RPL_WELCOME {
+		c.prefix = ""
+		if len(m.Params) > 0 {
+			c.nick = m.Params[0]
+		}
+		// most servers end the welcome with the full prefix of the client
+		if f := strings.Fields(m.Trailing); len(f) > 0 && strings.Contains(f[len(f)-1], "!") {
+			c.prefix = f[len(f)-1]
+		}
+		return
+	}
+
+	if m.Prefix == nil || c.nick == "" || !strings.EqualFold(m.Prefix.Name, c.nick) {
+		return
+	}
+
+	switch m.Command {
+	case irc.JOIN:
+		c.prefix = m.Prefix.String()
+	case irc.NICK:
+		c.nick = m.Trailing
+		if len(m.Params) > 0 {
+			c.nick = m.Params[0]
+		}
+		if c.prefix != "" {
+			c.prefix = c.nick + c.prefix[len(m.Prefix.Name):]
+		}
+	case "CHGHOST":
+		if len(m.Params) > 1 {
+			c.prefix = c.nick + "!" + m.Params[0] + "@" + m.Params[1]
+		}
+	}
+}
+
+// Reconfigure reconnects to the server with the new config
+func (c *IConn) Reconfigure(cfg Config) {
+	c.pmu.Lock()
+	c.next = &cfg
+	c.pmu.Unlock()
+
+	go c.Reconnect("config changed")
+}
+
+// Budget returns how many bytes the trailing of a message with the command
+// to the target can be, so that the line still fits once the server adds the
+// prefix of the bot when relaying it
+func (c *IConn) Budget(command, target string) int {
+	c.pmu.Lock()
+	prefix := len(c.prefix)
+	if prefix == 0 {
+		nick := c.nick
+		if nick == "" {
+			nick = c.cfgNick
+		}
+		prefix = len(nick) + len("!") + maxUserLen + len("@") + maxHostLen
+	}
+	c.pmu.Unlock()
+
+	// ":prefix COMMAND target :trailing\r\n"
+	return maxLineLen - len(":") - prefix - len(" ") - len(command) -
+		len(" ") - len(target) - len(" :") - len("\r\n")
+}
+
+// Target returns the appropriate target of an operation based on the message
+// if it's a private message, it returns the nick of the person messaging,
+// if its a channel message, it returns the channel
+func (c *IConn) Target(m *Message) string {
+	if len(m.Params) == 0 || len(m.Params[0]) == 0 {
+		return ""
+	}
+
+	target := m.Params[0]
+	// FIXME way too naive of a way to see if we got a private message or not
+	if target[0] == '#' {
+		return target
+	}
+
+	// not a channel message, so its a private message, so return the sender
+	return m.Prefix.Name
+}
+
+// PrivMsg queues a PRIVMSG with normal priority to the "appropriate" target
+// as decided by func Target with the following trailing arguments
+func (c *IConn) PrivMsg(m *Message, args ...string) {
+	c.Send(Normal, &irc.Message{
+		Command:  irc.PRIVMSG,
+		Params:   []string{c.Target(m)},
+		Trailing: strings.Join(args, ""),
+	})
+}
+
+// Notice queues a NOTICE with high priority to the sender of the message
+// with the following trailing arguments, it is meant for replies to commands
+func (c *IConn) Notice(m *Message, args ...string) {
+	c.Send(High, &irc.Message{
+		Command:  irc.NOTICE,
+		Params:   []string{m.Prefix.Name},
+		Trailing: strings.Join(args, ""),
+	})
+}
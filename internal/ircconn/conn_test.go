@@ -0,0 +1,384 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircconn
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/sorcix/irc.v1"
+)
+
+// server is a stand-in for an IRC server, it accepts a single connection
+// and lets the test script the conversation line by line
+type server struct {
+	t  *testing.T
+	l  net.Listener
+	c  net.Conn
+	r  *bufio.Reader
+	tc *tls.ConnectionState
+}
+
+func newServer(t *testing.T, tcfg *tls.Config) *server {
+	var l net.Listener
+	var err error
+	if tcfg != nil {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", tcfg)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	return &server{t: t, l: l}
+}
+
+func (s *server) accept() {
+	c, err := s.l.Accept()
+	if err != nil {
+		s.t.Fatalf("could not accept: %v", err)
+	}
+
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			s.t.Fatalf("tls handshake failed: %v", err)
+		}
+		st := tc.ConnectionState()
+		s.tc = &st
+	}
+
+	s.c = c
+	s.r = bufio.NewReader(c)
+}
+
+// expect reads a line and fails if it is not the expected one
+func (s *server) expect(line string) {
+	_ = s.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := s.r.ReadString('\n')
+	if err != nil {
+		s.t.Fatalf("expected %q, got error %v", line, err)
+	}
+
+	got = strings.TrimRight(got, "\r\n")
+	if got != line {
+		s.t.Fatalf("expected %q, got %q", line, got)
+	}
+}
+
+func (s *server) send(line string) {
+	if _, err := s.c.Write([]byte(line + "\r\n")); err != nil {
+		s.t.Fatalf("could not write %q: %v", line, err)
+	}
+}
+
+func (s *server) close() {
+	if s.c != nil {
+		s.c.Close()
+	}
+	s.l.Close()
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func waitWelcome(t *testing.T, welcome chan struct{}) {
+	select {
+	case <-welcome:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback did not receive RPL_WELCOME")
+	}
+}
+
+func welcomeCallback(welcome chan struct{}) Callback {
+	return func(c *IConn, m *Message) bool {
+		if m.Command == irc.RPL_WELCOME {
+			close(welcome)
+		}
+		return false
+	}
+}
+
+func TestTLSSASLPlain(t *testing.T) {
+	s := newServer(t, &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}})
+	defer s.close()
+
+	welcome := make(chan struct{})
+	go Init(Config{
+		Addr:         s.l.Addr().String(),
+		Nick:         "bot",
+		RealName:     "real name",
+		TLS:          &tls.Config{InsecureSkipVerify: true},
+		SASLMech:     "PLAIN",
+		SASLUser:     "account",
+		SASLPassword: "secret",
+		Services:     "nickserv",
+		// must not be used since SASL succeeds
+		ServicesPassword: "secret",
+		Caps:             []string{"account-tag", "not-offered"},
+	}, welcomeCallback(welcome))
+
+	s.accept()
+	s.expect("CAP LS 302")
+	s.expect("NICK bot")
+	s.expect("USER bot 0 * :real name")
+	s.send(":irc.test CAP * LS * :multi-prefix account-tag")
+	s.send(":irc.test CAP * LS :sasl=PLAIN,EXTERNAL")
+	s.expect("CAP REQ :account-tag sasl")
+	s.send(":irc.test CAP * ACK :account-tag sasl")
+	s.expect("AUTHENTICATE PLAIN")
+	s.send("AUTHENTICATE +")
+	payload := base64.StdEncoding.EncodeToString([]byte("account\x00account\x00secret"))
+	s.expect("AUTHENTICATE " + payload)
+	s.send(":irc.test 900 bot bot!bot@host account :You are now logged in as account")
+	s.send(":irc.test 903 bot :SASL authentication successful")
+	s.expect("CAP END")
+	s.send(":irc.test 001 bot :Welcome")
+	waitWelcome(t, welcome)
+
+	// the next line we get has to be the reply to our ping, not an IDENTIFY
+	s.send("PING :check")
+	s.expect("PONG :check")
+}
+
+func TestSASLExternal(t *testing.T) {
+	s := newServer(t, &tls.Config{
+		Certificates: []tls.Certificate{selfSigned(t)},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	defer s.close()
+
+	welcome := make(chan struct{})
+	go Init(Config{
+		Addr: s.l.Addr().String(),
+		Nick: "bot",
+		TLS: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{selfSigned(t)},
+		},
+		SASLMech: "EXTERNAL",
+	}, welcomeCallback(welcome))
+
+	s.accept()
+	if s.tc == nil || len(s.tc.PeerCertificates) == 0 {
+		t.Fatal("client did not present a certificate")
+	}
+
+	s.expect("CAP LS 302")
+	s.expect("NICK bot")
+	s.expect("USER bot 0 * :")
+	s.send(":irc.test CAP * LS :sasl")
+	s.expect("CAP REQ :sasl")
+	s.send(":irc.test CAP * ACK :sasl")
+	s.expect("AUTHENTICATE EXTERNAL")
+	s.send("AUTHENTICATE +")
+	s.expect("AUTHENTICATE +")
+	s.send(":irc.test 903 bot :SASL authentication successful")
+	s.expect("CAP END")
+	s.send(":irc.test 001 bot :Welcome")
+	waitWelcome(t, welcome)
+}
+
+func TestServicesFallback(t *testing.T) {
+	s := newServer(t, nil)
+	defer s.close()
+
+	welcome := make(chan struct{})
+	go Init(Config{
+		Addr:             s.l.Addr().String(),
+		Nick:             "bot",
+		User:             "ident",
+		Password:         "serverpass",
+		SASLMech:         "PLAIN",
+		SASLUser:         "account",
+		SASLPassword:     "secret",
+		Services:         "q",
+		ServicesUser:     "account",
+		ServicesPassword: "secret",
+	}, welcomeCallback(welcome))
+
+	s.accept()
+	s.expect("CAP LS 302")
+	s.expect("PASS serverpass")
+	s.expect("NICK bot")
+	s.expect("USER ident 0 * :")
+	// an old server without CAP support
+	s.send(":irc.test 421 * CAP :Unknown command")
+	s.send(":irc.test 001 bot :Welcome")
+	s.expect("PRIVMSG Q@CServe.quakenet.org :AUTH account secret")
+	waitWelcome(t, welcome)
+}
+
+func TestSASLFailure(t *testing.T) {
+	s := newServer(t, nil)
+	defer s.close()
+
+	welcome := make(chan struct{})
+	go Init(Config{
+		Addr:             s.l.Addr().String(),
+		Nick:             "bot",
+		SASLMech:         "PLAIN",
+		SASLUser:         "account",
+		SASLPassword:     "wrong",
+		Services:         "nickserv",
+		ServicesPassword: "secret",
+	}, welcomeCallback(welcome))
+
+	s.accept()
+	s.expect("CAP LS 302")
+	s.expect("NICK bot")
+	s.expect("USER bot 0 * :")
+	s.send(":irc.test CAP * LS :sasl")
+	s.expect("CAP REQ :sasl")
+	s.send(":irc.test CAP * ACK :sasl")
+	s.expect("AUTHENTICATE PLAIN")
+	s.send("AUTHENTICATE +")
+	s.expect("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("account\x00account\x00wrong")))
+	s.send(":irc.test 904 bot :SASL authentication failed")
+	s.expect("CAP END")
+	s.send(":irc.test 001 bot :Welcome")
+	s.expect("PRIVMSG NickServ :IDENTIFY secret")
+	waitWelcome(t, welcome)
+}
+
+func TestQuit(t *testing.T) {
+	s := newServer(t, nil)
+	defer s.close()
+
+	welcome := make(chan struct{})
+	conns := make(chan *IConn, 1)
+	go func() {
+		conns <- Init(Config{
+			Addr: s.l.Addr().String(),
+			Nick: "bot",
+		}, welcomeCallback(welcome))
+	}()
+
+	s.accept()
+	s.expect("CAP LS 302")
+	s.expect("NICK bot")
+	s.expect("USER bot 0 * :")
+	s.send(":irc.test 421 * CAP :Unknown command")
+	s.send(":irc.test 001 bot :Welcome")
+	waitWelcome(t, welcome)
+	c := <-conns
+
+	c.Queue(Low, "#obs", "commits", "a", "b")
+	quit := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Quit(ctx, "bye")
+		close(quit)
+	}()
+
+	s.expect("PRIVMSG #obs :a")
+	s.expect("PRIVMSG #obs :b")
+	s.expect("QUIT :bye")
+	s.c.Close()
+
+	select {
+	case <-quit:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Quit did not return after the server closed the connection")
+	}
+
+	// no reconnecting after quitting
+	_ = s.l.(*net.TCPListener).SetDeadline(time.Now().Add(500 * time.Millisecond))
+	if c, err := s.l.Accept(); err == nil {
+		c.Close()
+		t.Error("reconnected after quitting")
+	}
+}
+
+func TestParseMessageTags(t *testing.T) {
+	m := ParseMessage(`@account=jim;time=2018-01-01T00:00:00Z;msg=a\sb\:c\\d;flag :jim!j@host PRIVMSG #obs :hello`)
+	if m == nil {
+		t.Fatal("could not parse tagged message")
+	}
+
+	if m.Tag("account") != "jim" || m.Tag("msg") != `a b;c\d` || m.Command != irc.PRIVMSG {
+		t.Fatalf("unexpected message %#v %#v", m.Message, m.Tags)
+	}
+	if _, ok := m.Tags["flag"]; !ok {
+		t.Fatalf("valueless tag missing %#v", m.Tags)
+	}
+	if m.Prefix.Host != "host" || m.Trailing != "hello" {
+		t.Fatalf("unexpected message %#v", m.Message)
+	}
+
+	m = ParseMessage(":jim!j@host PRIVMSG #obs :hello")
+	if m == nil || m.Tags != nil || m.Trailing != "hello" {
+		t.Fatalf("unexpected untagged message %#v", m)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	c := &IConn{cfg: Config{Nick: "bot"}, cfgNick: "bot"}
+	// nothing known yet, assume the longest user and host
+	if got, want := c.Budget(irc.PRIVMSG, "#obs"), 512-len(":bot!@  #obs :\r\n")-len(irc.PRIVMSG)-maxUserLen-maxHostLen; got != want {
+		t.Errorf("expected %d, got %d", want, got)
+	}
+
+	for _, raw := range []string{
+		":server 001 obsbot :Welcome to the network obsbot",
+		":obsbot!~obs@example.org JOIN #obs",
+		":obsbot!~obs@example.org NICK :newbot",
+	} {
+		c.trackSelf(ParseMessage(raw))
+	}
+
+	line := ":newbot!~obs@example.org PRIVMSG #obs :"
+	if got, want := c.Budget(irc.PRIVMSG, "#obs"), 512-2-len(line); got != want {
+		t.Errorf("expected %d, got %d", want, got)
+	}
+}
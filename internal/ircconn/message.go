@@ -0,0 +1,98 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircconn
+
+import (
+	"strings"
+
+	"gopkg.in/sorcix/irc.v1"
+)
+
+// Message is an incoming irc message along with its IRCv3 message tags,
+// the irc package does not know about tags so they are split off before
+// handing the rest of the line to it
+type Message struct {
+	*irc.Message
+	Tags map[string]string
+}
+
+var tagUnescaper = strings.NewReplacer(
+	`\:`, ";",
+	`\s`, " ",
+	`\\`, `\`,
+	`\r`, "\r",
+	`\n`, "\n",
+)
+
+// ParseMessage parses a raw line that can optionally start with message
+// tags, returns nil if the message is invalid
+func ParseMessage(raw string) *Message {
+	var tags map[string]string
+	if strings.HasPrefix(raw, "@") {
+		pos := strings.IndexByte(raw, ' ')
+		if pos < 0 {
+			return nil
+		}
+
+		tags = parseTags(raw[1:pos])
+		raw = raw[pos+1:]
+	}
+
+	m := irc.ParseMessage(raw)
+	if m == nil {
+		return nil
+	}
+
+	return &Message{Message: m, Tags: tags}
+}
+
+func parseTags(s string) map[string]string {
+	ret := map[string]string{}
+	for _, v := range strings.Split(s, ";") {
+		if v == "" {
+			continue
+		}
+
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			ret[kv[0]] = tagUnescaper.Replace(kv[1])
+		} else {
+			ret[kv[0]] = ""
+		}
+	}
+
+	return ret
+}
+
+// Tag returns the value of the given message tag, or an empty string
+func (m *Message) Tag(name string) string {
+	return m.Tags[name]
+}
+
+// decode reads and parses a single line from the connection, it returns a
+// nil message and a nil error for empty or unparseable lines
+func (c *IConn) decode() (*Message, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMessage(strings.TrimRight(line, "\r\n")), nil
+}
@@ -0,0 +1,346 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircconn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/ircfmt"
+	"golang.org/x/net/context"
+	"gopkg.in/sorcix/irc.v1"
+)
+
+// Priority decides the order of the queued messages, higher priorities are
+// sent first, messages of the same priority are sent in the order they were
+// queued in
+type Priority int
+
+const (
+	// Low is for announcements
+	Low Priority = iota
+	// Normal is for replies to users
+	Normal
+	// High is for replies to administrators
+	High
+	numPriorities
+)
+
+const (
+	// how many lines can be sent to a target in a burst
+	targetBurst = 5
+	// how long it takes for the bucket of a target to gain a token
+	targetRate = 2 * time.Second
+	// how many lines of the same kind can wait for a target, the rest are
+	// summarized
+	maxWaiting = 5
+)
+
+type outgoing struct {
+	m      *irc.Message
+	target string
+	// key is the target and kind of lines that can be summarized
+	key string
+	// summary is the kind of the lines summarized, more is how many of them
+	summary string
+	more    int
+}
+
+func (o *outgoing) message() *irc.Message {
+	if o.summary == "" {
+		return o.m
+	}
+
+	return &irc.Message{
+		Command:  irc.PRIVMSG,
+		Params:   []string{o.target},
+		Trailing: fmt.Sprintf("...and %d more %s", o.more, o.summary),
+	}
+}
+
+// bucket is a token bucket, it gains a token every rate up to burst tokens
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// queue orders the outgoing messages by priority and limits how fast
+// messages are sent to a single target, on top of the flood control of the
+// connection
+type queue struct {
+	write func(*irc.Message)
+	// budget returns how long the trailing of a message can be, longer ones
+	// are split
+	budget func(command, target string) int
+	burst  int
+	rate   time.Duration
+	max    int
+
+	mu        sync.Mutex
+	items     [numPriorities][]*outgoing
+	buckets   map[string]*bucket
+	waiting   map[string]int
+	summaries map[string]*outgoing
+	wake      chan struct{}
+	// whether a message was taken from the queue and is being written
+	busy bool
+}
+
+func newQueue(write func(*irc.Message), budget func(string, string) int) *queue {
+	return &queue{
+		write:     write,
+		budget:    budget,
+		burst:     targetBurst,
+		rate:      targetRate,
+		max:       maxWaiting,
+		buckets:   map[string]*bucket{},
+		waiting:   map[string]int{},
+		summaries: map[string]*outgoing{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// targetOf returns the target the flood control applies to, messages that
+// are not PRIVMSGs or NOTICEs do not have one
+func targetOf(m *irc.Message) string {
+	if (m.Command != irc.PRIVMSG && m.Command != irc.NOTICE) || len(m.Params) == 0 {
+		return ""
+	}
+
+	return m.Params[0]
+}
+
+// split splits the message into as many as needed to fit into a line
+func (q *queue) split(m *irc.Message) []*irc.Message {
+	target := targetOf(m)
+	if target == "" || q.budget == nil {
+		return []*irc.Message{m}
+	}
+
+	parts := ircfmt.Split(m.Trailing, q.budget(m.Command, target))
+	if len(parts) == 1 {
+		return []*irc.Message{m}
+	}
+
+	ret := make([]*irc.Message, 0, len(parts))
+	for _, part := range parts {
+		nm := *m
+		nm.Trailing = part
+		ret = append(ret, &nm)
+	}
+
+	return ret
+}
+
+// push queues the message
+func (q *queue) push(p Priority, m *irc.Message) {
+	ms := q.split(m)
+
+	q.mu.Lock()
+	for _, m := range ms {
+		q.items[p] = append(q.items[p], &outgoing{m: m, target: targetOf(m)})
+	}
+	q.mu.Unlock()
+	q.signal()
+}
+
+// pushLines queues the lines as PRIVMSGs to the target, if too many lines of
+// the same kind are already waiting, they are summarized in a single line
+// like "...and 7 more commits"
+func (q *queue) pushLines(p Priority, target, kind string, lines []string) {
+	key := target + " " + kind
+
+	q.mu.Lock()
+	for _, line := range lines {
+		if s, ok := q.summaries[key]; ok {
+			s.more++
+			continue
+		}
+
+		if q.waiting[key] >= q.max {
+			s := &outgoing{target: target, summary: kind, more: 1}
+			q.summaries[key] = s
+			q.items[p] = append(q.items[p], s)
+			continue
+		}
+
+		ms := q.split(&irc.Message{
+			Command:  irc.PRIVMSG,
+			Params:   []string{target},
+			Trailing: line,
+		})
+		q.waiting[key] += len(ms)
+		for _, m := range ms {
+			q.items[p] = append(q.items[p], &outgoing{m: m, target: target, key: key})
+		}
+	}
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take refills the bucket of the target and takes a token from it if there
+// is one, otherwise it returns how long until there is one, the lock needs
+// to be held by the caller
+func (q *queue) take(target string, now time.Time) (bool, time.Duration) {
+	if target == "" {
+		return true, 0
+	}
+
+	b, ok := q.buckets[target]
+	if !ok {
+		b = &bucket{tokens: float64(q.burst)}
+		q.buckets[target] = b
+	} else {
+		b.tokens += float64(now.Sub(b.last)) / float64(q.rate)
+		if b.tokens > float64(q.burst) {
+			b.tokens = float64(q.burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) * float64(q.rate))
+}
+
+// next returns the next message that can be sent, if there is none it
+// returns how long to wait, zero meaning until something is queued
+func (q *queue) next() (*irc.Message, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	// targets that are out of tokens, so that messages to them are not
+	// reordered among themselves
+	throttled := map[string]bool{}
+	for p := numPriorities - 1; p >= Low; p-- {
+		for i, o := range q.items[p] {
+			if throttled[o.target] {
+				continue
+			}
+
+			ok, d := q.take(o.target, now)
+			if !ok {
+				throttled[o.target] = true
+				if wait == 0 || d < wait {
+					wait = d
+				}
+				continue
+			}
+
+			q.items[p] = append(q.items[p][:i], q.items[p][i+1:]...)
+			if o.summary != "" {
+				delete(q.summaries, o.target+" "+o.summary)
+			} else if o.key != "" {
+				if q.waiting[o.key]--; q.waiting[o.key] <= 0 {
+					delete(q.waiting, o.key)
+				}
+			}
+			// the buckets of idle targets are full again, no need to keep them
+			for t, b := range q.buckets {
+				if float64(now.Sub(b.last)) >= float64(q.burst)*float64(q.rate) {
+					delete(q.buckets, t)
+				}
+			}
+
+			q.busy = true
+			return o.message(), 0
+		}
+	}
+
+	return nil, wait
+}
+
+// run sends the queued messages forever
+func (q *queue) run() {
+	for {
+		m, wait := q.next()
+		if m != nil {
+			q.write(m)
+			q.mu.Lock()
+			q.busy = false
+			q.mu.Unlock()
+			continue
+		}
+
+		if wait == 0 {
+			<-q.wake
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// empty returns whether every message was written
+func (q *queue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.busy {
+		return false
+	}
+	for _, items := range q.items {
+		if len(items) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// len returns the number of messages waiting to be sent
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var ret int
+	for _, items := range q.items {
+		ret += len(items)
+	}
+
+	return ret
+}
+
+// drain waits until every message is written or the context is done
+func (q *queue) drain(ctx context.Context) {
+	for !q.empty() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
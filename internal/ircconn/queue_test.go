@@ -0,0 +1,148 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircconn
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/sorcix/irc.v1"
+)
+
+func privmsg(target, text string) *irc.Message {
+	return &irc.Message{Command: irc.PRIVMSG, Params: []string{target}, Trailing: text}
+}
+
+func drain(q *queue) []string {
+	var ret []string
+	for {
+		m, _ := q.next()
+		if m == nil {
+			return ret
+		}
+		ret = append(ret, m.Trailing)
+	}
+}
+
+func expectLines(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := newQueue(nil, nil)
+	q.push(Low, privmsg("#a", "announcement"))
+	q.push(Normal, privmsg("#b", "factoid"))
+	q.push(High, privmsg("nick", "admin reply"))
+	q.push(Low, privmsg("#a", "announcement 2"))
+	q.push(High, &irc.Message{Command: irc.JOIN, Params: []string{"#c"}})
+
+	expectLines(t, drain(q), "admin reply", "", "factoid", "announcement", "announcement 2")
+}
+
+func TestQueueTargetBucket(t *testing.T) {
+	q := newQueue(nil, nil)
+	q.burst = 2
+	q.rate = time.Hour
+
+	q.push(Low, privmsg("#a", "a1"))
+	q.push(Low, privmsg("#a", "a2"))
+	q.push(Low, privmsg("#a", "a3"))
+	q.push(Low, privmsg("#b", "b1"))
+	q.push(High, privmsg("#a", "a4"))
+
+	expectLines(t, drain(q), "a4", "a1", "b1")
+
+	m, wait := q.next()
+	if m != nil || wait <= 0 || wait > time.Hour {
+		t.Fatalf("expected to wait for #a, got %v %s", m, wait)
+	}
+
+	// a token was gained, the order of the messages to #a must be kept
+	q.buckets["#a"].tokens = 1
+	expectLines(t, drain(q), "a2")
+}
+
+func TestQueueSummary(t *testing.T) {
+	q := newQueue(nil, nil)
+	q.max = 2
+	q.burst = 100
+
+	q.pushLines(Low, "#a", "commits", []string{"c1", "c2", "c3", "c4", "c5"})
+	q.pushLines(Low, "#a", "builds", []string{"b1"})
+	q.pushLines(Low, "#b", "commits", []string{"x1", "x2", "x3"})
+	q.pushLines(Low, "#a", "commits", []string{"c6"})
+
+	expectLines(t, drain(q),
+		"c1", "c2", "...and 4 more commits", "b1",
+		"x1", "x2", "...and 1 more commits",
+	)
+
+	// everything was sent, nothing is summarized anymore
+	q.pushLines(Low, "#a", "commits", []string{"c7", "c8"})
+	expectLines(t, drain(q), "c7", "c8")
+	if len(q.waiting) != 0 || len(q.summaries) != 0 {
+		t.Errorf("leftover state %v %v", q.waiting, q.summaries)
+	}
+}
+
+func TestQueueRun(t *testing.T) {
+	sent := make(chan *irc.Message, 10)
+	q := newQueue(func(m *irc.Message) { sent <- m }, nil)
+	q.burst = 1
+	q.rate = 50 * time.Millisecond
+	go q.run()
+
+	start := time.Now()
+	q.pushLines(Normal, "#a", "lines", []string{"1", "2", "3"})
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case m := <-sent:
+			if m.Trailing != want {
+				t.Fatalf("expected %q, got %q", want, m.Trailing)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the queue did not send")
+		}
+	}
+
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("the target was not throttled, took %s", d)
+	}
+}
+
+func TestQueueSplit(t *testing.T) {
+	q := newQueue(nil, func(command, target string) int { return 10 })
+	q.push(Normal, privmsg("#a", "aaaa bbbb cccc"))
+	q.pushLines(Low, "#a", "lines", []string{"dddd eeee ffff"})
+	q.push(Normal, &irc.Message{Command: irc.JOIN, Params: []string{"#a"}, Trailing: "long trailing of a join"})
+
+	expectLines(t, drain(q), "aaaa bbbb", "cccc", "long trailing of a join", "dddd eeee", "ffff")
+	if len(q.waiting) != 0 {
+		t.Errorf("leftover state %v", q.waiting)
+	}
+}
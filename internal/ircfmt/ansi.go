@@ -0,0 +1,110 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircfmt
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the ANSI foreground colors closest to the IRC colors, the background is
+// ten more
+var ansiColors = map[string]int{
+	white:      97,
+	black:      30,
+	darkBlue:   34,
+	darkGreen:  32,
+	red:        91,
+	darkRed:    31,
+	darkViolet: 35,
+	orange:     33,
+	yellow:     93,
+	lightGreen: 92,
+	cyan:       36,
+	lightCyan:  96,
+	blue:       94,
+	violet:     95,
+	darkGray:   90,
+	lightGray:  37,
+}
+
+// the ANSI codes turning the formatting on and off
+var ansiToggles = map[string][2]int{
+	Bold:          {1, 22},
+	Italic:        {3, 23},
+	Underline:     {4, 24},
+	Reverse:       {7, 27},
+	StrikeThrough: {9, 29},
+}
+
+var ansiRE = regexp.MustCompile("[\x02\x0f\x11\x16\x1d\x1e\x1f]|\x03(\\d{1,2})?(?:,(\\d{1,2}))?")
+
+// ToANSI turns the formatting control codes into the escape sequences of
+// terminals, monospace is dropped since everything is monospace there
+func ToANSI(s string) string {
+	on := map[string]bool{}
+	used := false
+
+	ret := ansiRE.ReplaceAllStringFunc(s, func(code string) string {
+		var seq []int
+		switch c := code[:1]; c {
+		case Reset:
+			on = map[string]bool{}
+			seq = []int{0}
+		case Monospace:
+			return ""
+		case Color:
+			m := ansiRE.FindStringSubmatch(code)
+			if m[1] == "" {
+				seq = []int{39, 49}
+				break
+			}
+			if fg, ok := ansiColors[colorCode(m[1])]; ok {
+				seq = append(seq, fg)
+			}
+			if bg, ok := ansiColors[colorCode(m[2])]; ok && m[2] != "" {
+				seq = append(seq, bg+10)
+			}
+		default:
+			t := ansiToggles[c]
+			if on[c] = !on[c]; on[c] {
+				seq = []int{t[0]}
+			} else {
+				seq = []int{t[1]}
+			}
+		}
+		if len(seq) == 0 {
+			return ""
+		}
+
+		used = true
+		codes := make([]string, len(seq))
+		for i, v := range seq {
+			codes[i] = strconv.Itoa(v)
+		}
+		return "\x1b[" + strings.Join(codes, ";") + "m"
+	})
+
+	if used {
+		ret += "\x1b[0m"
+	}
+	return ret
+}
@@ -0,0 +1,125 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircfmt
+
+import (
+	"strings"
+)
+
+// colorCodes are the colors by name, as understood by most clients
+var colorCodes = map[string]string{
+	"white":      "00",
+	"black":      "01",
+	"blue":       "02",
+	"green":      "03",
+	"red":        "04",
+	"brown":      "05",
+	"purple":     "06",
+	"orange":     "07",
+	"yellow":     "08",
+	"lightgreen": "09",
+	"cyan":       "10",
+	"lightcyan":  "11",
+	"lightblue":  "12",
+	"pink":       "13",
+	"grey":       "14",
+	"gray":       "14",
+	"lightgrey":  "15",
+	"lightgray":  "15",
+}
+
+// statusColors are the colors of the build statuses
+var statusColors = map[string]string{
+	"passed":        "green",
+	"fixed":         "green",
+	"broken":        "red",
+	"failed":        "red",
+	"still failing": "red",
+	"errored":       "red",
+	"canceled":      "grey",
+	"pending":       "orange",
+}
+
+// Wrap surrounds s with the control code, turning the formatting on and then
+// off again
+func Wrap(code, s string) string {
+	if s == "" {
+		return s
+	}
+
+	return code + s + code
+}
+
+// lookupColor returns the two digit code of the color, either a name or a
+// number
+func lookupColor(color string) (string, bool) {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if c, ok := colorCodes[color]; ok {
+		return c, true
+	}
+
+	if n := digits(color); n > 0 && n == len(color) {
+		if n == 1 {
+			color = "0" + color
+		}
+		return color, true
+	}
+
+	return "", false
+}
+
+// Colorize colors s, the color is either a name like "red" or a number, a
+// background can be given after a comma like "white,red", s is returned as
+// is if the color is unknown
+func Colorize(color, s string) string {
+	if s == "" {
+		return s
+	}
+
+	colors := strings.SplitN(color, ",", 2)
+	fg, ok := lookupColor(colors[0])
+	if !ok {
+		return s
+	}
+
+	if len(colors) > 1 {
+		if bg, ok := lookupColor(colors[1]); ok {
+			fg += "," + bg
+		}
+	}
+
+	return Color + fg + s + Color
+}
+
+// Status colors the build status, good ones green and bad ones red, both of
+// them bold, anything unknown is returned as is
+func Status(status string) string {
+	color, ok := statusColors[strings.ToLower(status)]
+	if !ok {
+		return status
+	}
+
+	ret := Colorize(color, status)
+	if color == "green" || color == "red" {
+		ret = Wrap(Bold, ret)
+	}
+
+	return ret
+}
@@ -0,0 +1,89 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircfmt
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestColors(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{Wrap(Bold, "x"), "\x02x\x02"},
+		{Wrap(Bold, ""), ""},
+		{Colorize("red", "x"), "\x0304x\x03"},
+		{Colorize("White,Red", "x"), "\x0300,04x\x03"},
+		{Colorize("7", "x"), "\x0307x\x03"},
+		{Colorize("nosuchcolor", "x"), "x"},
+		{Status("Passed"), "\x02\x0303Passed\x03\x02"},
+		{Status("Still Failing"), "\x02\x0304Still Failing\x03\x02"},
+		{Status("Canceled"), "\x0314Canceled\x03"},
+		{Status("Unknown"), "Unknown"},
+	}
+
+	for i, v := range tests {
+		if v.got != v.want {
+			t.Errorf("%d: expected %q, got %q", i, v.want, v.got)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		in, discord, slack, html string
+	}{
+		{"plain", "plain", "plain", "plain"},
+		{"\x02bold\x02 \x0304red\x03", "**bold** red", "*bold* red", `<b>bold</b> <span style="color: #C33B3B">red</span>`},
+		{"\x1ditalic\x1d \x1estrike\x1e \x11code", "*italic* ~~strike~~ `code`", "_italic_ ~strike~ `code`", "<i>italic</i> <strike>strike</strike> <code>code</code>"},
+		{"\x02a\x1db\x02c\x0f", "**a*b****c*", "*a_b_*_c_", "<b>a<i>b</b>c</i>"},
+		{"a*b_c <d>", `a\*b\_c <d>`, "a*b_c &lt;d&gt;", "a*b_c <d>"},
+	}
+
+	for _, v := range tests {
+		if got := ToDiscord(v.in); got != v.discord {
+			t.Errorf("ToDiscord(%q) = %q, want %q", v.in, got, v.discord)
+		}
+		if got := ToSlack(v.in); got != v.slack {
+			t.Errorf("ToSlack(%q) = %q, want %q", v.in, got, v.slack)
+		}
+		if got := string(ToHTML(template.HTML(v.in))); got != v.html {
+			t.Errorf("ToHTML(%q) = %q, want %q", v.in, got, v.html)
+		}
+	}
+}
+
+func TestANSI(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"\x02bold\x02 \x0304red\x03", "\x1b[1mbold\x1b[22m \x1b[91mred\x1b[39;49m\x1b[0m"},
+		{"\x0300,01x\x0f y", "\x1b[97;40mx\x1b[0m y\x1b[0m"},
+		{"\x11code \x1funder", "code \x1b[4munder\x1b[0m"},
+	}
+
+	for i, v := range tests {
+		if got := ToANSI(v.in); got != v.want {
+			t.Errorf("%d: expected %q, got %q", i, v.want, got)
+		}
+	}
+}
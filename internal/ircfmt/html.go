@@ -1,4 +1,4 @@
-package factoids
+package ircfmt
 
 import (
 	"bytes"
@@ -54,6 +54,10 @@ const (
 	underline     = "\x15"
 	underline2    = "\x1f"
 	reverse       = "\x16"
+	// the codes most clients use today for italic and strike through
+	italic2        = "\x1d"
+	strikeThrough2 = "\x1e"
+	monospace      = "\x11"
 )
 
 var tags = map[string][]string{
@@ -62,14 +66,17 @@ var tags = map[string][]string{
 	strikeThrough: {"<strike>", "</strike>"},
 	underline:     {"<u>", "</u>"},
 	reverse:       {`<span class="reverse">`, "</span>"},
+	monospace:     {"<code>", "</code>"},
 }
 
-var controlRE = regexp.MustCompile("([\x02\x03\x09\x13\x0f\x15\x1f\x16])(?:(\\d+)?(?:,(\\d+))?)?")
+var controlRE = regexp.MustCompile("([\x02\x03\x09\x13\x0f\x15\x1f\x16\x1d\x1e\x11])(?:(\\d+)?(?:,(\\d+))?)?")
 
 func init() {
 	controlRE.Longest()
 }
-func ircToHTML(html template.HTML) template.HTML {
+
+// ToHTML turns the formatting of the already escaped html into tags
+func ToHTML(html template.HTML) template.HTML {
 	s := string(html)
 	// functions as a stack almost, for any given opened tag, there is a
 	// record here, so we can close everything properly
@@ -82,9 +89,14 @@ func ircToHTML(html template.HTML) template.HTML {
 		firstarg := match[2]
 		secondarg := match[3]
 
-		// normalize the two underline control codes into one
-		if controlcode == underline2 {
+		// normalize the old and new control codes into one
+		switch controlcode {
+		case underline2:
 			controlcode = underline
+		case italic2:
+			controlcode = italic
+		case strikeThrough2:
+			controlcode = strikeThrough
 		}
 
 		// just a controlcode without arguments, if there was one before,
@@ -104,6 +116,8 @@ func ircToHTML(html template.HTML) template.HTML {
 			fallthrough
 		case underline:
 			fallthrough
+		case monospace:
+			fallthrough
 		case reverse:
 			// push the closing tag onto the stack
 			closetags := state[controlcode]
@@ -133,10 +147,10 @@ func ircToHTML(html template.HTML) template.HTML {
 
 			// write out the opening tag
 			b.WriteString(`<span style="color: `)
-			b.WriteString(colors[firstarg])
+			b.WriteString(colors[colorCode(firstarg)])
 			if secondarg != "" {
 				b.WriteString("; background-color: ")
-				b.WriteString(colors[secondarg])
+				b.WriteString(colors[colorCode(secondarg)])
 			}
 			b.WriteString(`">`)
 			return b.String()
@@ -170,3 +184,13 @@ func ircToHTML(html template.HTML) template.HTML {
 
 	return template.HTML(s)
 }
+
+// colorCode normalizes the zero padded color codes like "04" to the keys of
+// the colors map
+func colorCode(s string) string {
+	if s = strings.TrimLeft(s, "0"); s == "" {
+		return white
+	}
+
+	return s
+}
@@ -0,0 +1,46 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package ircfmt is a collection of helpers dealing with IRC formatting
+// control codes
+package ircfmt
+
+import (
+	"regexp"
+)
+
+// the control codes as understood by most clients
+const (
+	Bold          = "\x02"
+	Color         = "\x03"
+	Monospace     = "\x11"
+	Reverse       = "\x16"
+	Italic        = "\x1d"
+	StrikeThrough = "\x1e"
+	Underline     = "\x1f"
+	Reset         = "\x0f"
+)
+
+// stripRE matches every control code along with the arguments of colors
+var stripRE = regexp.MustCompile("[\x02\x0f\x11\x16\x1d\x1e\x1f]|\x03(?:\\d{1,2}(?:,\\d{1,2})?)?")
+
+// Strip removes every formatting control code from the string
+func Strip(s string) string {
+	return stripRE.ReplaceAllString(s, "")
+}
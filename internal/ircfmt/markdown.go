@@ -0,0 +1,121 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircfmt
+
+import (
+	"strings"
+)
+
+// the control codes that start a run of formatting
+const controlChars = "\x02\x03\x0f\x11\x16\x1d\x1e\x1f"
+
+var (
+	discordMarkers = map[string]string{
+		Bold:          "**",
+		Italic:        "*",
+		Underline:     "__",
+		StrikeThrough: "~~",
+		Monospace:     "`",
+	}
+	discordEscaper = strings.NewReplacer(
+		`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`,
+	)
+
+	slackMarkers = map[string]string{
+		Bold:          "*",
+		Italic:        "_",
+		StrikeThrough: "~",
+		Monospace:     "`",
+	}
+	slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+// ToDiscord translates the formatting to Discord markdown, colors are dropped
+// since Discord does not support them
+func ToDiscord(s string) string {
+	return translate(s, discordMarkers, discordEscaper)
+}
+
+// ToSlack translates the formatting to the mrkdwn of Slack, colors and
+// underlines are dropped
+func ToSlack(s string) string {
+	return translate(s, slackMarkers, slackEscaper)
+}
+
+// translate turns the control codes into the markers, the text between them
+// is escaped so that it is not mistaken for markup
+func translate(s string, markers map[string]string, escaper *strings.Replacer) string {
+	var b strings.Builder
+	// the codes in the order they were turned on, markdown needs them to be
+	// closed in the reverse order
+	var open []string
+	closeFrom := func(i int) {
+		for j := len(open) - 1; j >= i; j-- {
+			b.WriteString(markers[open[j]])
+		}
+	}
+
+	for s != "" {
+		n := controlLen(s)
+		if n == 0 {
+			end := strings.IndexAny(s, controlChars)
+			if end < 0 {
+				end = len(s)
+			}
+			b.WriteString(escaper.Replace(s[:end]))
+			s = s[end:]
+			continue
+		}
+
+		code := s[:1]
+		s = s[n:]
+		if code == Reset {
+			closeFrom(0)
+			open = open[:0]
+			continue
+		}
+		if _, ok := markers[code]; !ok {
+			continue
+		}
+
+		pos := -1
+		for i, v := range open {
+			if v == code {
+				pos = i
+			}
+		}
+
+		if pos < 0 {
+			open = append(open, code)
+			b.WriteString(markers[code])
+			continue
+		}
+
+		// close everything opened after it, then reopen those
+		closeFrom(pos)
+		open = append(open[:pos], open[pos+1:]...)
+		for _, v := range open[pos:] {
+			b.WriteString(markers[v])
+		}
+	}
+
+	closeFrom(0)
+	return b.String()
+}
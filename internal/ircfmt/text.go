@@ -0,0 +1,365 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircfmt
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const zwj = '\u200d'
+
+// extends returns whether the rune belongs to the grapheme before it
+func extends(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		r == zwj ||
+		(r >= 0xfe00 && r <= 0xfe0f) || // variation selectors
+		(r >= 0x1f3fb && r <= 0x1f3ff) || // emoji skin tone modifiers
+		(r >= 0xe0020 && r <= 0xe007f) // emoji tag sequences
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// graphemeLen returns the length in bytes of the user perceived character at
+// the start of s, it is an approximation of the rules of UAX #29 that keeps
+// combining marks, emoji modifiers, zero width joiner sequences and flags
+// together
+func graphemeLen(s string) int {
+	if s == "" {
+		return 0
+	}
+
+	r, i := utf8.DecodeRuneInString(s)
+	if r == '\r' && len(s) > 1 && s[1] == '\n' {
+		return 2
+	}
+
+	flag := isRegionalIndicator(r)
+	joined := false
+	for i < len(s) {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case joined || extends(r):
+		case flag && isRegionalIndicator(r):
+			// a flag is a pair of regional indicators, a third one starts a
+			// new flag
+			flag = false
+		default:
+			return i
+		}
+
+		joined = r == zwj
+		i += n
+	}
+
+	return i
+}
+
+// controlLen returns the length in bytes of the formatting control code at
+// the start of s, or zero if s does not start with one
+func controlLen(s string) int {
+	if s == "" {
+		return 0
+	}
+
+	switch s[:1] {
+	case Bold, Monospace, Reverse, Italic, StrikeThrough, Underline, Reset:
+		return 1
+	case Color:
+	default:
+		return 0
+	}
+
+	i := 1 + digits(s[1:])
+	if i > 1 && i+1 < len(s) && s[i] == ',' {
+		if n := digits(s[i+1:]); n > 0 {
+			i += 1 + n
+		}
+	}
+
+	return i
+}
+
+// digits returns how many digits s starts with, at most two
+func digits(s string) int {
+	i := 0
+	for i < len(s) && i < 2 && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	return i
+}
+
+// tokenLen returns the length of the first unit of s that must not be split,
+// either a control code or a grapheme
+func tokenLen(s string) int {
+	if n := controlLen(s); n > 0 {
+		return n
+	}
+
+	return graphemeLen(s)
+}
+
+// Len returns the number of user perceived characters in s, formatting
+// control codes are not counted
+func Len(s string) int {
+	ret := 0
+	for s != "" {
+		if n := controlLen(s); n > 0 {
+			s = s[n:]
+			continue
+		}
+
+		s = s[graphemeLen(s):]
+		ret++
+	}
+
+	return ret
+}
+
+// Truncate shortens s to at most l characters including the end string that
+// marks the cut, it never cuts a multi-byte character, a grapheme or a
+// formatting control code in half
+func Truncate(s string, l int, end string) string {
+	if Len(s) <= l {
+		return s
+	}
+
+	keep := l - Len(end)
+	if keep < 0 {
+		keep = 0
+	}
+
+	i := 0
+	for keep > 0 && i < len(s) {
+		if n := controlLen(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+
+		i += graphemeLen(s[i:])
+		keep--
+	}
+
+	return s[:i] + end
+}
+
+// format is the formatting in effect at a point of a line
+type format struct {
+	bold, italic, underline, strike, reverse, monospace bool
+	fg, bg                                              string
+}
+
+// apply updates the formatting with the control codes in s
+func (f *format) apply(s string) {
+	for s != "" {
+		n := controlLen(s)
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(s)
+			s = s[n:]
+			continue
+		}
+
+		switch s[:1] {
+		case Bold:
+			f.bold = !f.bold
+		case Italic:
+			f.italic = !f.italic
+		case Underline:
+			f.underline = !f.underline
+		case StrikeThrough:
+			f.strike = !f.strike
+		case Reverse:
+			f.reverse = !f.reverse
+		case Monospace:
+			f.monospace = !f.monospace
+		case Reset:
+			*f = format{}
+		case Color:
+			args := strings.SplitN(s[1:n], ",", 2)
+			f.fg = args[0]
+			if f.fg == "" {
+				f.bg = ""
+			} else if len(args) > 1 {
+				f.bg = args[1]
+			}
+		}
+		s = s[n:]
+	}
+}
+
+// within reports whether everything f turns on is turned on in g as well
+func (f format) within(g format) bool {
+	for _, v := range [][2]bool{
+		{f.bold, g.bold},
+		{f.italic, g.italic},
+		{f.underline, g.underline},
+		{f.strike, g.strike},
+		{f.reverse, g.reverse},
+		{f.monospace, g.monospace},
+	} {
+		if v[0] && !v[1] {
+			return false
+		}
+	}
+	return f.fg == "" || f.fg == g.fg && (f.bg == "" || f.bg == g.bg)
+}
+
+// render updates the formatting with the control codes in s and returns s as
+// it has to be sent to a client that starts with the formatting shown, the
+// codes that would show something f does not have are replaced by a reset
+func (f *format) render(shown format, s string) string {
+	if shown == *f {
+		f.apply(s)
+		return s
+	}
+
+	var b strings.Builder
+	for s != "" {
+		n := controlLen(s)
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(s)
+			b.WriteString(s[:n])
+			s = s[n:]
+			continue
+		}
+
+		code := s[:n]
+		f.apply(code)
+		shown.apply(code)
+		if !shown.within(*f) {
+			// only a toggle can get here, so the reset keeps the length
+			code, shown = Reset, format{}
+		}
+		b.WriteString(code)
+		s = s[n:]
+	}
+	return b.String()
+}
+
+// codes returns the control codes that turn the formatting on
+func (f format) codes() string {
+	var b strings.Builder
+	for _, v := range []struct {
+		on   bool
+		code string
+	}{
+		{f.bold, Bold},
+		{f.italic, Italic},
+		{f.underline, Underline},
+		{f.strike, StrikeThrough},
+		{f.reverse, Reverse},
+		{f.monospace, Monospace},
+	} {
+		if v.on {
+			b.WriteString(v.code)
+		}
+	}
+
+	if f.fg != "" {
+		b.WriteString(Color)
+		b.WriteString(colorNumber(f.fg))
+		if f.bg != "" {
+			b.WriteString(",")
+			b.WriteString(colorNumber(f.bg))
+		}
+	}
+
+	return b.String()
+}
+
+// colorNumber pads the color to two digits, otherwise a digit following the
+// code would be read as part of the color
+func colorNumber(c string) string {
+	if len(c) == 1 {
+		return "0" + c
+	}
+	return c
+}
+
+// Split splits the line into parts of at most budget bytes, preferably at
+// spaces, the formatting in effect at the end of a part is restored at the
+// start of the next one
+func Split(line string, budget int) []string {
+	if budget <= 0 || len(line) <= budget {
+		return []string{line}
+	}
+
+	var ret []string
+	var f format
+	for {
+		prefix := f.codes()
+		room := budget - len(prefix)
+		shown := f
+		if room < budget/2 {
+			// do not let the formatting eat up the line, the part starts
+			// without any formatting then, f still follows the line
+			prefix, room = "", budget
+			shown = format{}
+		}
+
+		if len(line) <= room {
+			return append(ret, prefix+f.render(shown, line))
+		}
+
+		cut, next := cutAt(line, room)
+		ret = append(ret, prefix+f.render(shown, line[:cut]))
+		line = line[next:]
+		if line == "" {
+			return ret
+		}
+	}
+}
+
+// cutAt returns where to end the part that fits into room bytes and where
+// the next part starts, the space the line is split at is dropped
+func cutAt(s string, room int) (int, int) {
+	i, space := 0, -1
+	for i < len(s) {
+		n := tokenLen(s[i:])
+		if i+n > room {
+			break
+		}
+		if s[i] == ' ' {
+			space = i
+		}
+		i += n
+	}
+
+	if i == 0 {
+		// the budget is smaller than a single character, send it anyway
+		i = tokenLen(s)
+	}
+
+	// the part ends right before a space
+	if i < len(s) && s[i] == ' ' {
+		return i, i + 1
+	}
+
+	// only split at a space if it does not waste too much of the line
+	if space > room/2 {
+		return space, space + 1
+	}
+
+	return i, i
+}
@@ -0,0 +1,125 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package ircfmt
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		l    int
+		end  string
+		want string
+	}{
+		{"short", 10, "...", "short"},
+		{"exactly", 7, "...", "exactly"},
+		{"a longer line", 8, "...", "a lon..."},
+		{"0123456789abcdef", 7, "", "0123456"},
+		{"日本語のコミット", 5, "…", "日本語の…"},
+		{"👍🏽👍🏽👍🏽", 2, "", "👍🏽👍🏽"},
+		{"👩‍👩‍👧 family", 3, "", "👩‍👩‍👧 f"},
+		{"🇭🇺🇩🇪🇫🇷", 2, "", "🇭🇺🇩🇪"},
+		{"ééé", 2, "", "éé"},
+		{"\x02bold\x02 text", 6, "", "\x02bold\x02 t"},
+		{"\x0304,12red", 2, "", "\x0304,12re"},
+		{"abc", 2, "...", "..."},
+	}
+
+	for _, v := range tests {
+		got := Truncate(v.in, v.l, v.end)
+		if got != v.want {
+			t.Errorf("Truncate(%q, %d, %q) = %q, want %q", v.in, v.l, v.end, got, v.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("Truncate(%q) returned invalid UTF-8", v.in)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	if got := Split("short line", 20); len(got) != 1 || got[0] != "short line" {
+		t.Errorf("a short line was split: %q", got)
+	}
+
+	got := Split("aaaa bbbb cccc dddd", 10)
+	want := []string{"aaaa bbbb", "cccc dddd"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// no spaces, the split happens at a character boundary
+	got = Split(strings.Repeat("é", 10), 5)
+	for _, part := range got {
+		if len(part) > 5 || !utf8.ValidString(part) {
+			t.Errorf("invalid part %q", part)
+		}
+	}
+	if strings.Join(got, "") != strings.Repeat("é", 10) {
+		t.Errorf("the parts do not add up: %q", got)
+	}
+
+	// the formatting carries over and color codes are not split
+	got = Split("\x02\x0304,12bold red text\x02 plain "+strings.Repeat("x", 20), 24)
+	want = []string{
+		"\x02\x0304,12bold red text\x02",
+		"\x0304,12plain xxxxxxxxxxxx",
+		"\x0304,12xxxxxxxx",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// the colors are carried over with two digits, so the digits after them
+	// are not read as part of the color
+	got = Split("\x034"+strings.Repeat("a", 10)+"25xxxxx", 12)
+	want = []string{"\x034aaaaaaaaaa", "\x030425xxxxx"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	got = Split("\x034,2"+strings.Repeat("a", 8)+"25xxxx", 12)
+	want = []string{"\x034,2aaaaaaaa", "\x0304,0225xxxx"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	got = Split("\x1dital\x0f "+strings.Repeat("y", 8), 6)
+	want = []string{"\x1dital\x0f", "yyyyyy", "yy"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// the formatting is too long to carry over, so the parts after the first
+	// start plain, turning off bold in them must not turn it on, it is sent
+	// as a reset instead
+	got = Split("\x02\x1d\x1f\x0304,12"+strings.Repeat("a", 15)+"\x02"+strings.Repeat("b", 20), 12)
+	want = []string{
+		"\x02\x1d\x1f\x0304,12aaa",
+		"aaaaaaaaaaaa",
+		"\x0fbbbbbbbbbbb",
+		"bbbbbbbbb",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
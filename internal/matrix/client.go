@@ -0,0 +1,249 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+)
+
+// the prefix of every client-server API endpoint
+const apiPrefix = "/_matrix/client/v3"
+
+// Error is an error returned by the homeserver
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+	// RetryAfter is set when the request was rate limited
+	RetryAfter int64 `json:"retry_after_ms"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("matrix: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Client talks to a homeserver with the client-server API
+type Client struct {
+	hs     string
+	token  string
+	userID string
+	http   *http.Client
+
+	mu    sync.Mutex
+	rooms map[string]string
+	txn   int64
+}
+
+// NewClient logs in to the homeserver if there is no access token in the
+// config, and looks up the user the token belongs to
+func NewClient(cfg config.Matrix) (*Client, error) {
+	if cfg.Homeserver == "" {
+		return nil, fmt.Errorf("the homeserver is empty")
+	}
+
+	c := &Client{
+		hs:    strings.TrimSuffix(cfg.Homeserver, "/"),
+		token: cfg.AccessToken,
+		// the sync requests are long polling ones, the timeout has to be longer
+		http:  &http.Client{Timeout: 2 * syncTimeout},
+		rooms: map[string]string{},
+		txn:   time.Now().UnixNano(),
+	}
+
+	if c.token == "" {
+		if cfg.User == "" || cfg.Password == "" {
+			return nil, fmt.Errorf("either the access token or the user and password is needed")
+		}
+		if err := c.login(cfg.User, cfg.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	var res struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.do("GET", "/account/whoami", nil, &res); err != nil {
+		return nil, err
+	}
+	c.userID = res.UserID
+
+	return c, nil
+}
+
+// do sends the request to the homeserver and decodes the response into out
+// if it is not nil
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.hs+apiPrefix+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 300 {
+		e := &Error{Status: res.StatusCode}
+		_ = json.Unmarshal(b, e)
+		return e
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+func (c *Client) login(user, password string) error {
+	req := map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]string{
+			"type": "m.id.user",
+			"user": user,
+		},
+		"password":                    password,
+		"initial_device_display_name": "obscommits",
+	}
+
+	var res struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := c.do("POST", "/login", req, &res); err != nil {
+		return err
+	}
+
+	c.token = res.AccessToken
+	return nil
+}
+
+// resolve returns the id of the room, aliases are looked up and cached
+func (c *Client) resolve(room string) (string, error) {
+	if !strings.HasPrefix(room, "#") {
+		return room, nil
+	}
+
+	c.mu.Lock()
+	id, ok := c.rooms[room]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.do("GET", "/directory/room/"+url.PathEscape(room), nil, &res); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.rooms[room] = res.RoomID
+	c.mu.Unlock()
+
+	return res.RoomID, nil
+}
+
+// join joins the room, the room can be an id or an alias
+func (c *Client) join(room string) (string, error) {
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.do("POST", "/join/"+url.PathEscape(room), struct{}{}, &res); err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(room, "#") {
+		c.mu.Lock()
+		c.rooms[room] = res.RoomID
+		c.mu.Unlock()
+	}
+
+	return res.RoomID, nil
+}
+
+// message is the content of an m.room.message event, if FormattedBody is set
+// Body is the plain text fallback of it
+type message struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+// send sends the message to the room, waiting and retrying once if the
+// homeserver rate limited us
+func (c *Client) send(room string, msg message) error {
+	id, err := c.resolve(room)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.txn++
+	txn := strconv.FormatInt(c.txn, 10)
+	c.mu.Unlock()
+
+	path := "/rooms/" + url.PathEscape(id) + "/send/m.room.message/" + txn
+	for try := 0; ; try++ {
+		err = c.do("PUT", path, msg, nil)
+		e, ok := err.(*Error)
+		if !ok || e.Code != "M_LIMIT_EXCEEDED" || try > 0 {
+			return err
+		}
+
+		// the transaction id makes retrying safe
+		time.Sleep(time.Duration(e.RetryAfter) * time.Millisecond)
+	}
+}
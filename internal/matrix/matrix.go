@@ -0,0 +1,335 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package matrix connects the bot to a Matrix homeserver, announcements can
+// be routed to rooms and factoids are answered in every joined room
+package matrix
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/factoids"
+	"github.com/obsproject/obscommits/internal/ircfmt"
+	"github.com/obsproject/obscommits/internal/recovery"
+	"github.com/obsproject/obscommits/internal/sink"
+	"golang.org/x/net/context"
+)
+
+const (
+	// how long the homeserver can hold a sync request
+	syncTimeout = 30 * time.Second
+	// how many messages can wait to be sent before new ones are dropped
+	queueLen = 100
+	// how often the same factoid can be sent to a room
+	factoidDelay = 30 * time.Second
+)
+
+// how long to wait after a failed sync, a var so that the tests can lower it
+var retryDelay = 10 * time.Second
+
+// the filter of the first sync, only the position in the stream is needed
+// from it, not the history of the rooms
+const initialFilter = `{"room":{"timeline":{"limit":1}},"presence":{"not_types":["*"]}}`
+
+type outgoing struct {
+	room string
+	msg  message
+}
+
+// Bot is a Client that answers factoids and announces to rooms, it is a
+// sink.Sink
+type Bot struct {
+	*Client
+	// lookup returns the factoid the line triggers
+	lookup func(line string) (text, key string, ok bool)
+	queue  chan outgoing
+	done   chan struct{}
+	// closed once the sender stopped
+	stopped chan struct{}
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+var contextKey *int
+
+func init() {
+	contextKey = new(int)
+}
+
+// Init connects to the homeserver if it is configured and registers the
+// "matrix" sink, has to be called after sink.Init and factoids.Init
+func Init(ctx context.Context) context.Context {
+	cfg := config.FromContext(ctx).Matrix
+	if cfg.Homeserver == "" {
+		return ctx
+	}
+	if config.DryRun() {
+		sink.FromContext(ctx).Add("matrix", &sink.Printer{Name: "matrix", W: os.Stdout})
+		return ctx
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		d.F("Matrix: %v", err)
+	}
+
+	for _, room := range cfg.Rooms {
+		if _, err := c.join(room); err != nil {
+			d.P("Could not join matrix room", room, err)
+		}
+	}
+
+	b := newBot(c, factoids.Lookup)
+	sink.FromContext(ctx).Add("matrix", b)
+	go b.run()
+
+	// the rest of the settings need a restart
+	config.OnReload(config.Hook{
+		Name: "matrix",
+		Apply: func(old, cfg *config.AppConfig) {
+			for _, room := range cfg.Matrix.Rooms {
+				if contains(old.Matrix.Rooms, room) {
+					continue
+				}
+				if _, err := c.join(room); err != nil {
+					d.P("Could not join matrix room", room, err)
+				}
+			}
+		},
+	})
+
+	return context.WithValue(ctx, contextKey, b)
+}
+
+// FromContext returns the bot from the context, it is nil if matrix is
+// disabled
+func FromContext(ctx context.Context) *Bot {
+	b, _ := ctx.Value(contextKey).(*Bot)
+	return b
+}
+
+func newBot(c *Client, lookup func(string) (string, string, bool)) *Bot {
+	b := &Bot{
+		Client:  c,
+		lookup:  lookup,
+		queue:   make(chan outgoing, queueLen),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		used:    map[string]time.Time{},
+	}
+	go b.sender()
+
+	return b
+}
+
+// Close stops syncing and sending
+func (b *Bot) Close() {
+	close(b.done)
+}
+
+// Send sends the announcements to the room as a single notice, the target is
+// the id or alias of the room
+func (b *Bot) Send(target string, anns []sink.Announcement) {
+	lines := make([]string, 0, len(anns))
+	for _, a := range anns {
+		lines = append(lines, a.Text)
+	}
+
+	b.enqueue(target, notice(lines...))
+}
+
+func (b *Bot) enqueue(room string, msg message) {
+	select {
+	case b.queue <- outgoing{room: room, msg: msg}:
+	default:
+		d.P("Matrix queue full, dropping message to", room)
+	}
+}
+
+// Flush sends the messages that are still waiting and stops the bot
+func (b *Bot) Flush(ctx context.Context) {
+	b.Close()
+
+	select {
+	case <-b.stopped:
+	case <-ctx.Done():
+		d.P("Gave up on sending the waiting matrix messages")
+	}
+}
+
+func (b *Bot) sender() {
+	defer close(b.stopped)
+
+	for {
+		select {
+		case <-b.done:
+			b.drain()
+			return
+		case o := <-b.queue:
+			if err := b.send(o.room, o.msg); err != nil {
+				d.P("Could not send matrix message to", o.room, err)
+			}
+		}
+	}
+}
+
+// drain sends what is left in the queue
+func (b *Bot) drain() {
+	for {
+		select {
+		case o := <-b.queue:
+			if err := b.send(o.room, o.msg); err != nil {
+				d.P("Could not send matrix message to", o.room, err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// notice turns the lines into a notice with the IRC formatting translated to
+// html
+func notice(lines ...string) message {
+	text := make([]string, 0, len(lines))
+	formatted := make([]string, 0, len(lines))
+	for _, l := range lines {
+		text = append(text, ircfmt.Strip(l))
+		formatted = append(formatted, string(ircfmt.ToHTML(template.HTML(html.EscapeString(l)))))
+	}
+
+	return message{
+		MsgType:       "m.notice",
+		Body:          strings.Join(text, "\n"),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(formatted, "<br>"),
+	}
+}
+
+type event struct {
+	Type    string  `json:"type"`
+	Sender  string  `json:"sender"`
+	Content message `json:"content"`
+}
+
+type syncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []event `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// run syncs with the homeserver until the bot is closed, the events of the
+// first sync are skipped so that old messages are not answered after a restart
+func (b *Bot) run() {
+	var since string
+	for {
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+
+		q := url.Values{}
+		if since == "" {
+			q.Set("filter", initialFilter)
+		} else {
+			q.Set("since", since)
+			q.Set("timeout", strconv.FormatInt(int64(syncTimeout/time.Millisecond), 10))
+		}
+
+		var res syncResponse
+		if err := b.do("GET", "/sync?"+q.Encode(), nil, &res); err != nil {
+			d.P("Matrix sync error", err)
+			select {
+			case <-b.done:
+				return
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+
+		if since != "" {
+			recovery.Run("matrix sync", func() {
+				b.handleSync(&res)
+			})
+		}
+		since = res.NextBatch
+	}
+}
+
+func (b *Bot) handleSync(res *syncResponse) {
+	for room, v := range res.Rooms.Join {
+		for _, ev := range v.Timeline.Events {
+			if ev.Type != "m.room.message" || ev.Sender == b.userID ||
+				ev.Content.MsgType != "m.text" {
+				continue
+			}
+
+			b.handleMessage(room, ev.Content.Body)
+		}
+	}
+}
+
+func (b *Bot) handleMessage(room, body string) {
+	text, key, ok := b.lookup(body)
+	if !ok {
+		return
+	}
+
+	b.mu.Lock()
+	k := room + " " + key
+	last, seen := b.used[k]
+	if seen && time.Since(last) < factoidDelay {
+		b.mu.Unlock()
+		return
+	}
+	b.used[k] = time.Now()
+	for k, v := range b.used {
+		if time.Since(v) >= factoidDelay {
+			delete(b.used, k)
+		}
+	}
+	b.mu.Unlock()
+
+	b.enqueue(room, notice(text))
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,256 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package matrix
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/sink"
+)
+
+type sent struct {
+	room string
+	msg  message
+}
+
+// homeserver is a fake homeserver implementing the bits of the client-server
+// API the bot uses, the timeline events it is given are returned by the
+// next sync
+type homeserver struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	syncs   int
+	pending []event
+	limited bool
+	sent    chan sent
+}
+
+func newHomeserver(t *testing.T) *homeserver {
+	h := &homeserver{t: t, sent: make(chan sent, 10)}
+	h.srv = httptest.NewServer(http.HandlerFunc(h.serve))
+	return h
+}
+
+func (h *homeserver) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (h *homeserver) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix)
+	if path == "/login" {
+		var req struct {
+			Identifier struct{ User string } `json:"identifier"`
+			Password   string                `json:"password"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.Identifier.User != "bot" || req.Password != "secret" {
+			h.reply(w, 403, Error{Code: "M_FORBIDDEN", Message: "bad password"})
+			return
+		}
+		h.reply(w, 200, map[string]string{"access_token": "token"})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		h.reply(w, 401, Error{Code: "M_UNKNOWN_TOKEN", Message: "bad token"})
+		return
+	}
+
+	switch {
+	case path == "/account/whoami":
+		h.reply(w, 200, map[string]string{"user_id": "@bot:example.org"})
+	case path == "/directory/room/%23obs:example.org":
+		h.reply(w, 200, map[string]string{"room_id": "!obs:example.org"})
+	case strings.HasPrefix(path, "/join/"):
+		h.reply(w, 200, map[string]string{"room_id": "!joined:example.org"})
+	case path == "/sync":
+		h.mu.Lock()
+		h.syncs++
+		first := h.syncs == 1
+		if first && r.URL.Query().Get("since") != "" {
+			h.t.Error("the first sync had a since token")
+		}
+		// the first sync only returns history that must not be answered
+		events := []event{{Type: "m.room.message", Sender: "@a:example.org", Content: message{MsgType: "m.text", Body: "!old"}}}
+		if !first {
+			events = h.pending
+			h.pending = nil
+		}
+		h.mu.Unlock()
+
+		if len(events) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		res := map[string]interface{}{
+			"next_batch": "s" + r.URL.Query().Get("since"),
+			"rooms": map[string]interface{}{
+				"join": map[string]interface{}{
+					"!obs:example.org": map[string]interface{}{
+						"timeline": map[string]interface{}{"events": events},
+					},
+				},
+			},
+		}
+		h.reply(w, 200, res)
+	case strings.HasPrefix(path, "/rooms/") && strings.Contains(path, "/send/m.room.message/"):
+		h.mu.Lock()
+		limited := !h.limited
+		h.limited = true
+		h.mu.Unlock()
+		if limited {
+			h.reply(w, 429, Error{Code: "M_LIMIT_EXCEEDED", RetryAfter: 10})
+			return
+		}
+
+		var msg message
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &msg); err != nil {
+			h.t.Error(err)
+		}
+		room := strings.SplitN(strings.TrimPrefix(path, "/rooms/"), "/", 2)[0]
+		h.sent <- sent{room: strings.Replace(room, "%21", "!", 1), msg: msg}
+		h.reply(w, 200, map[string]string{"event_id": "$1"})
+	default:
+		h.reply(w, 404, Error{Code: "M_UNRECOGNIZED", Message: path})
+	}
+}
+
+func (h *homeserver) push(ev event) {
+	h.mu.Lock()
+	h.pending = append(h.pending, ev)
+	h.mu.Unlock()
+}
+
+func (h *homeserver) expect(t *testing.T) sent {
+	select {
+	case s := <-h.sent:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message was sent")
+	}
+
+	return sent{}
+}
+
+func TestLogin(t *testing.T) {
+	h := newHomeserver(t)
+	defer h.srv.Close()
+
+	if _, err := NewClient(config.Matrix{Homeserver: h.srv.URL, User: "bot", Password: "wrong"}); err == nil {
+		t.Fatal("expected the login to fail")
+	} else if e, ok := err.(*Error); !ok || e.Code != "M_FORBIDDEN" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	c, err := NewClient(config.Matrix{Homeserver: h.srv.URL + "/", User: "bot", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.token != "token" || c.userID != "@bot:example.org" {
+		t.Errorf("unexpected token %q or user %q", c.token, c.userID)
+	}
+
+	if _, err := NewClient(config.Matrix{Homeserver: h.srv.URL, AccessToken: "expired"}); err == nil {
+		t.Error("expected an invalid access token to fail")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	h := newHomeserver(t)
+	defer h.srv.Close()
+
+	c, err := NewClient(config.Matrix{Homeserver: h.srv.URL, AccessToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBot(c, func(string) (string, string, bool) { return "", "", false })
+	defer b.Close()
+
+	b.Send("#obs:example.org", []sink.Announcement{
+		{Text: "\x02bold\x02 <tag>"},
+		{Text: "\x0304red"},
+	})
+
+	s := h.expect(t)
+	if s.room != "!obs:example.org" {
+		t.Errorf("the alias was not resolved, sent to %q", s.room)
+	}
+	if s.msg.MsgType != "m.notice" || s.msg.Body != "bold <tag>\nred" {
+		t.Errorf("unexpected message %+v", s.msg)
+	}
+	want := `<b>bold</b> &lt;tag&gt;<br><span style="color: #C33B3B">red</span>`
+	if s.msg.Format != "org.matrix.custom.html" || s.msg.FormattedBody != want {
+		t.Errorf("unexpected formatted body %q", s.msg.FormattedBody)
+	}
+}
+
+func TestFactoids(t *testing.T) {
+	retryDelay = 10 * time.Millisecond
+	h := newHomeserver(t)
+	defer h.srv.Close()
+
+	c, err := NewClient(config.Matrix{Homeserver: h.srv.URL, AccessToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBot(c, func(line string) (string, string, bool) {
+		switch line {
+		case "!obs":
+			return "OBS is \x02great\x02", "obs", true
+		case "!obs bob":
+			return "bob: OBS is \x02great\x02", "obs", true
+		case "!old":
+			t.Error("a message from the first sync was answered")
+		}
+		return "", "", false
+	})
+	defer b.Close()
+	go b.run()
+
+	h.push(event{Type: "m.room.message", Sender: "@bot:example.org", Content: message{MsgType: "m.text", Body: "!obs"}})
+	h.push(event{Type: "m.room.message", Sender: "@a:example.org", Content: message{MsgType: "m.text", Body: "hello"}})
+	h.push(event{Type: "m.room.message", Sender: "@a:example.org", Content: message{MsgType: "m.text", Body: "!obs bob"}})
+	h.push(event{Type: "m.room.message", Sender: "@a:example.org", Content: message{MsgType: "m.text", Body: "!obs"}})
+
+	s := h.expect(t)
+	if s.room != "!obs:example.org" || s.msg.Body != "bob: OBS is great" ||
+		s.msg.FormattedBody != "bob: OBS is <b>great</b>" {
+		t.Errorf("unexpected reply %+v", s)
+	}
+
+	select {
+	case s := <-h.sent:
+		t.Errorf("the factoid was not rate limited, got %+v", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,338 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package metrics keeps counters, gauges and histograms and exports them in
+// the text format of Prometheus, the metrics are registered once at init
+// time and live for the whole lifetime of the program
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is anything that can be exported
+type metric interface {
+	describe() (name, help, typ string, labels []string)
+	write(w *bufio.Writer)
+}
+
+var (
+	mu      sync.Mutex
+	metrics = map[string]metric{}
+)
+
+// register registers the metric, a metric that is registered again with the
+// same type and labels is returned instead, so that packages can share it
+func register(m metric) metric {
+	mu.Lock()
+	defer mu.Unlock()
+
+	name, _, typ, labels := m.describe()
+	if old, ok := metrics[name]; ok {
+		_, _, otyp, olabels := old.describe()
+		if otyp != typ || strings.Join(olabels, ",") != strings.Join(labels, ",") {
+			panic("metric registered twice with different types or labels: " + name)
+		}
+		return old
+	}
+
+	metrics[name] = m
+	return m
+}
+
+// series are the values of a metric by their label values
+type series struct {
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labels []string
+	v      float64
+	// for histograms
+	counts []uint64
+	count  uint64
+}
+
+func newSeries(labels []string) series {
+	return series{labels: labels, values: map[string]*value{}}
+}
+
+// get returns the value of the label values, the lock needs to be held by
+// the caller
+func (s *series) get(values []string) *value {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(s.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	v, ok := s.values[key]
+	if !ok {
+		v = &value{labels: append([]string(nil), values...)}
+		s.values[key] = v
+	}
+
+	return v
+}
+
+// sorted returns the values sorted by their labels, the lock needs to be
+// held by the caller
+func (s *series) sorted() []*value {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := make([]*value, len(keys))
+	for i, k := range keys {
+		ret[i] = s.values[k]
+	}
+	return ret
+}
+
+// Counter is a value that only goes up, optionally split by labels
+type Counter struct {
+	name, help string
+	series
+}
+
+// NewCounter registers a counter with the names of its labels
+func NewCounter(name, help string, labels ...string) *Counter {
+	return register(&Counter{name: name, help: help, series: newSeries(labels)}).(*Counter)
+}
+
+// Inc adds one to the counter of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter of the label values, v must not be negative
+func (c *Counter) Add(v float64, values ...string) {
+	c.mu.Lock()
+	c.get(values).v += v
+	c.mu.Unlock()
+}
+
+// Value returns the counter of the label values
+func (c *Counter) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(values).v
+}
+
+func (c *Counter) describe() (string, string, string, []string) {
+	return c.name, c.help, "counter", c.labels
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, v := range c.sorted() {
+		writeSample(w, c.name, c.labels, v.labels, "", "", v.v)
+	}
+}
+
+// Gauge is a value that can go up and down, optionally split by labels
+type Gauge struct {
+	name, help string
+	series
+}
+
+// NewGauge registers a gauge with the names of its labels
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return register(&Gauge{name: name, help: help, series: newSeries(labels)}).(*Gauge)
+}
+
+// Set sets the gauge of the label values
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mu.Lock()
+	g.get(values).v = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) describe() (string, string, string, []string) {
+	return g.name, g.help, "gauge", g.labels
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, v := range g.sorted() {
+		writeSample(w, g.name, g.labels, v.labels, "", "", v.v)
+	}
+}
+
+// Histogram counts the observed values in buckets, like durations
+type Histogram struct {
+	name, help string
+	// the upper bounds of the buckets, sorted
+	buckets []float64
+	series
+}
+
+// DefBuckets are buckets for durations in seconds from 5ms to 10s
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewHistogram registers a histogram with the upper bounds of its buckets
+// and the names of its labels
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return register(&Histogram{name: name, help: help, buckets: b, series: newSeries(labels)}).(*Histogram)
+}
+
+// Observe adds the value to the histogram of the label values
+func (h *Histogram) Observe(f float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v := h.get(values)
+	if v.counts == nil {
+		v.counts = make([]uint64, len(h.buckets))
+	}
+	for i, b := range h.buckets {
+		if f <= b {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.v += f
+}
+
+func (h *Histogram) describe() (string, string, string, []string) {
+	return h.name, h.help, "histogram", h.labels
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, v := range h.sorted() {
+		for i, b := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, v.labels, "le", formatFloat(b), float64(v.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, v.labels, "le", "+Inf", float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, v.labels, "", "", v.v)
+		writeSample(w, h.name+"_count", h.labels, v.labels, "", "", float64(v.count))
+	}
+}
+
+// funcMetric is a counter or gauge without labels whose value is read when
+// the metrics are exported
+type funcMetric struct {
+	name, help, typ string
+	f               func() float64
+}
+
+// NewCounterFunc registers a counter whose value is returned by f, for
+// counters that are kept elsewhere
+func NewCounterFunc(name, help string, f func() float64) {
+	register(&funcMetric{name: name, help: help, typ: "counter", f: f})
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by f
+func NewGaugeFunc(name, help string, f func() float64) {
+	register(&funcMetric{name: name, help: help, typ: "gauge", f: f})
+}
+
+func (m *funcMetric) describe() (string, string, string, []string) {
+	return m.name, m.help, m.typ, nil
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	writeSample(w, m.name, nil, nil, "", "", m.f())
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escape(values[i]) + `"`)
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Handler returns the handler exporting every metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		names := make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+		all := make([]metric, len(names))
+		sort.Strings(names)
+		for i, name := range names {
+			all[i] = metrics[name]
+		}
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, m := range all {
+			name, help, typ, _ := m.describe()
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, strings.Replace(help, "\n", " ", -1), name, typ)
+			m.write(bw)
+		}
+		bw.Flush()
+	})
+}
@@ -0,0 +1,83 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	c := NewCounter("test_deliveries_total", "Deliveries.", "event", "outcome")
+	c.Inc("push", "ok")
+	c.Inc("push", "ok")
+	c.Add(3, "issues", "error")
+
+	// registering it again returns the same counter
+	if NewCounter("test_deliveries_total", "Deliveries.", "event", "outcome") != c {
+		t.Error("expected the registered counter")
+	}
+
+	NewGauge("test_last", "Last \"success\".", "feed").Set(1.5, `a"b\c`)
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+	NewGaugeFunc("test_connected", "Connected.", func() float64 { return 1 })
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP test_connected Connected.
+# TYPE test_connected gauge
+test_connected 1
+# HELP test_deliveries_total Deliveries.
+# TYPE test_deliveries_total counter
+test_deliveries_total{event="issues",outcome="error"} 3
+test_deliveries_total{event="push",outcome="ok"} 2
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 2.55
+test_duration_seconds_count 3
+# HELP test_last Last "success".
+# TYPE test_last gauge
+test_last{feed="a\"b\\c"} 1.5
+`
+	if got := w.Body.String(); got != expected {
+		t.Errorf("unexpected output\n%s\nexpected\n%s", got, expected)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+}
+
+func TestRegisterMismatch(t *testing.T) {
+	NewCounter("test_mismatch", "Mismatch.", "a")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	NewGauge("test_mismatch", "Mismatch.", "a")
+}
@@ -0,0 +1,375 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package perms decides who is allowed to run which command, roles are
+// granted to services accounts or hosts, either globally or for a channel
+package perms
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/persist"
+	"golang.org/x/net/context"
+)
+
+// Role is a set of privileges, every role includes the ones below it
+type Role int
+
+const (
+	None Role = iota
+	FactoidEditor
+	Moderator
+	Owner
+	// SuperAdmin can only be given in the config file
+	SuperAdmin
+)
+
+var roleNames = []string{
+	None:          "none",
+	FactoidEditor: "factoid-editor",
+	Moderator:     "moderator",
+	Owner:         "owner",
+	SuperAdmin:    "superadmin",
+}
+
+func (r Role) String() string {
+	if r < None || int(r) >= len(roleNames) {
+		return "unknown"
+	}
+
+	return roleNames[r]
+}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, bool) {
+	for r, v := range roleNames {
+		if strings.EqualFold(v, name) && Role(r) != None {
+			return Role(r), true
+		}
+	}
+
+	return None, false
+}
+
+// Grant is a role given to someone, if Channel is empty the role applies
+// everywhere
+type Grant struct {
+	Role    Role
+	Channel string
+}
+
+type st struct {
+	Accounts map[string][]Grant
+	Hosts    map[string][]Grant
+}
+
+// Identity is who issued a command and where, Channel is empty for private
+// messages
+type Identity struct {
+	Account string
+	Host    string
+	Channel string
+}
+
+const hostPrefix = "host:"
+
+// the suffix of the hosts of authed users on QuakeNet, the part before it is
+// the account name
+const quakenetHostSuffix = ".users.quakenet.org"
+
+var (
+	mu          sync.Mutex
+	s           *st
+	state       *persist.State
+	superAdmins []string
+)
+
+func Init(ctx context.Context) context.Context {
+	var err error
+	state, err = load()
+	if err != nil {
+		d.F("%v", err)
+	}
+
+	s = state.Get().(*st)
+	mu.Lock()
+	superAdmins = config.FromContext(ctx).IRC.SuperAdmins
+	mu.Unlock()
+
+	config.OnReload(config.Hook{
+		Name: "perms",
+		Apply: func(old, cfg *config.AppConfig) {
+			mu.Lock()
+			superAdmins = cfg.IRC.SuperAdmins
+			mu.Unlock()
+		},
+	})
+
+	return ctx
+}
+
+func newSt() *st {
+	return &st{
+		Accounts: map[string][]Grant{},
+		Hosts:    map[string][]Grant{},
+	}
+}
+
+// the formats of the state, in the first two everyone in it was an
+// administrator with every privilege
+//  1. administrators by host only, map[string]struct{}
+//  2. administrators by account or host, admins
+//  3. roles by account or host, st
+type admins struct {
+	Accounts map[string]struct{}
+	Hosts    map[string]struct{}
+}
+
+func init() {
+	persist.Register("admins", persist.Schema{
+		Version:     3,
+		Unversioned: 3,
+		Migrations: map[int]persist.Migration{
+			1: migrateHosts,
+			2: migrateAdmins,
+		},
+		Gob: []persist.GobFormat{
+			{Version: 1, New: func() interface{} { return &map[string]struct{}{} }},
+			{Version: 2, New: func() interface{} { return &admins{} }},
+			{Version: 3, New: func() interface{} { return newSt() }},
+		},
+	})
+}
+
+// migrateHosts turns the cloaked hosts of QuakeNet into accounts
+func migrateHosts(e persist.Entries) (persist.Entries, error) {
+	hosts := map[string]struct{}{}
+	if err := e.Decode(&hosts); err != nil {
+		return nil, err
+	}
+
+	a := admins{
+		Accounts: map[string]struct{}{},
+		Hosts:    map[string]struct{}{},
+	}
+	for host := range hosts {
+		if strings.HasSuffix(host, quakenetHostSuffix) {
+			account := strings.TrimSuffix(host, quakenetHostSuffix)
+			a.Accounts[strings.ToLower(account)] = struct{}{}
+			continue
+		}
+
+		a.Hosts[host] = struct{}{}
+	}
+
+	return persist.Encode(&a)
+}
+
+// migrateAdmins makes every administrator an owner
+func migrateAdmins(e persist.Entries) (persist.Entries, error) {
+	var a admins
+	if err := e.Decode(&a); err != nil {
+		return nil, err
+	}
+
+	n := newSt()
+	for account := range a.Accounts {
+		n.Accounts[account] = []Grant{{Role: Owner}}
+	}
+	for host := range a.Hosts {
+		n.Hosts[host] = []Grant{{Role: Owner}}
+	}
+
+	return persist.Encode(n)
+}
+
+// load loads the grants, migrating the older formats
+func load() (*persist.State, error) {
+	return persist.New("admins", newSt())
+}
+
+// subject returns the map and key the grants of the subject are stored under
+// subjects are either account names or hosts prefixed with "host:", the
+// state lock needs to be held by the caller
+func subject(name string) (map[string][]Grant, string) {
+	if strings.HasPrefix(name, hostPrefix) {
+		return s.Hosts, strings.TrimPrefix(name, hostPrefix)
+	}
+
+	return s.Accounts, strings.ToLower(name)
+}
+
+func applies(g Grant, channel string) bool {
+	return g.Channel == "" || strings.EqualFold(g.Channel, channel)
+}
+
+// RoleOf returns the highest role of the identity that applies in the
+// channel of the identity
+func RoleOf(id Identity) Role {
+	if id.Account != "" {
+		mu.Lock()
+		for _, v := range superAdmins {
+			if strings.EqualFold(v, id.Account) {
+				mu.Unlock()
+				return SuperAdmin
+			}
+		}
+		mu.Unlock()
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	ret := None
+	var grants []Grant
+	if id.Account != "" {
+		grants = append(grants, s.Accounts[strings.ToLower(id.Account)]...)
+	}
+	if id.Host != "" {
+		grants = append(grants, s.Hosts[id.Host]...)
+	}
+
+	for _, g := range grants {
+		if g.Role > ret && applies(g, id.Channel) {
+			ret = g.Role
+		}
+	}
+
+	return ret
+}
+
+// Has returns whether the identity has at least the given role
+func Has(id Identity, r Role) bool {
+	return RoleOf(id) >= r
+}
+
+// CanGrantIn returns whether the identity is allowed to grant or revoke the
+// role in the channel, or everywhere if the channel is empty, only the roles
+// the identity has there count, not the ones of the channel it asks in
+func CanGrantIn(id Identity, r Role, channel string) bool {
+	id.Channel = channel
+	return CanGrant(RoleOf(id), r)
+}
+
+// CanGrant returns whether someone with the actor role is allowed to grant
+// or revoke the role, only owners can grant owner, and superadmin can only
+// be given in the config file
+func CanGrant(actor, r Role) bool {
+	switch {
+	case r <= None || r >= SuperAdmin:
+		return false
+	case r == Owner:
+		return actor >= Owner
+	}
+
+	return actor > r
+}
+
+// Give grants the role to the subject, subjects are either account names or
+// hosts prefixed with "host:"
+func Give(name string, r Role, channel string) {
+	state.Lock()
+	defer state.Unlock()
+
+	m, key := subject(name)
+	for _, g := range m[key] {
+		if g.Role == r && strings.EqualFold(g.Channel, channel) {
+			return
+		}
+	}
+
+	m[key] = append(m[key], Grant{Role: r, Channel: channel})
+	_ = state.Save(false)
+}
+
+// Take revokes the role from the subject, returns false if the subject did not
+// have the role
+func Take(name string, r Role, channel string) bool {
+	state.Lock()
+	defer state.Unlock()
+
+	m, key := subject(name)
+	grants := m[key][:0]
+	var found bool
+	for _, g := range m[key] {
+		if g.Role == r && strings.EqualFold(g.Channel, channel) {
+			found = true
+			continue
+		}
+		grants = append(grants, g)
+	}
+
+	if len(grants) == 0 {
+		delete(m, key)
+	} else {
+		m[key] = grants
+	}
+
+	if found {
+		_ = state.Save(false)
+	}
+
+	return found
+}
+
+// Describe returns a human readable list of the grants, if name is empty
+// every subject is listed
+func Describe(name string) []string {
+	state.Lock()
+	defer state.Unlock()
+
+	describe := func(prefix, key string, grants []Grant) string {
+		a := make([]string, 0, len(grants))
+		for _, g := range grants {
+			if g.Channel != "" {
+				a = append(a, g.Role.String()+"@"+g.Channel)
+			} else {
+				a = append(a, g.Role.String())
+			}
+		}
+		return prefix + key + ": " + strings.Join(a, ", ")
+	}
+
+	var ret []string
+	if name != "" {
+		m, key := subject(name)
+		prefix := ""
+		if strings.HasPrefix(name, hostPrefix) {
+			prefix = hostPrefix
+		}
+		if grants, ok := m[key]; ok {
+			ret = append(ret, describe(prefix, key, grants))
+		}
+		return ret
+	}
+
+	for key, grants := range s.Accounts {
+		ret = append(ret, describe("", key, grants))
+	}
+	for key, grants := range s.Hosts {
+		ret = append(ret, describe(hostPrefix, key, grants))
+	}
+
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,231 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package perms
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// chdir switches to a temporary directory since the state file name is fixed
+func chdir(t *testing.T) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "perms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		_ = os.Chdir(wd)
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestMigrateHosts(t *testing.T) {
+	defer chdir(t)()
+
+	hosts := map[string]struct{}{
+		"melkor.lan":             {},
+		"Jim.users.quakenet.org": {},
+	}
+	// the state of the first format as written by older versions
+	f, err := os.Create("admins.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(&hosts); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	state, err = load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = state.Get().(*st)
+
+	if r := RoleOf(Identity{Account: "JIM"}); r != Owner {
+		t.Fatalf("expected the migrated account to be an owner, got %v", r)
+	}
+	if r := RoleOf(Identity{Host: "melkor.lan"}); r != Owner {
+		t.Fatalf("expected the migrated host to be an owner, got %v", r)
+	}
+	if r := RoleOf(Identity{Host: "Jim.users.quakenet.org"}); r != None {
+		t.Fatalf("expected the cloaked host to be migrated to an account, got %v", r)
+	}
+
+	// loading it again must not fail now that it is in the new format
+	if _, err := load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateAdmins(t *testing.T) {
+	defer chdir(t)()
+
+	// the second format of the gob file
+	f, err := os.Create("admins.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(&admins{
+		Accounts: map[string]struct{}{"jim": {}},
+		Hosts:    map[string]struct{}{"melkor.lan": {}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	state, err = load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = state.Get().(*st)
+
+	if r := RoleOf(Identity{Account: "jim"}); r != Owner {
+		t.Fatalf("expected the migrated account to be an owner, got %v", r)
+	}
+	if r := RoleOf(Identity{Host: "melkor.lan"}); r != Owner {
+		t.Fatalf("expected the migrated host to be an owner, got %v", r)
+	}
+}
+
+func TestUnversioned(t *testing.T) {
+	defer chdir(t)()
+
+	// the json file as saved before there were versions
+	data := `{"Accounts/jim": [{"Role": 2, "Channel": "#obs"}]}`
+	if err := ioutil.WriteFile("admins.json", []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	state, err = load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = state.Get().(*st)
+
+	if r := RoleOf(Identity{Account: "jim", Channel: "#obs"}); r != Moderator {
+		t.Fatalf("expected the grant to be kept, got %v", r)
+	}
+	if b, _ := ioutil.ReadFile("admins.json"); !strings.Contains(string(b), `"version": 3`) {
+		t.Fatalf("expected the version to be saved, got %s", b)
+	}
+}
+
+func TestGrants(t *testing.T) {
+	defer chdir(t)()
+
+	var err error
+	state, err = load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = state.Get().(*st)
+	superAdmins = []string{"root"}
+
+	Give("jim", FactoidEditor, "#obsproject")
+	Give("jim", FactoidEditor, "#obsproject")
+	Give("host:melkor.lan", Moderator, "")
+
+	if r := RoleOf(Identity{Account: "jim", Channel: "#obsproject"}); r != FactoidEditor {
+		t.Fatalf("unexpected role in the channel %v", r)
+	}
+	if r := RoleOf(Identity{Account: "jim", Channel: "#obs-dev"}); r != None {
+		t.Fatalf("unexpected role outside of the channel %v", r)
+	}
+	if r := RoleOf(Identity{Account: "jim"}); r != None {
+		t.Fatalf("unexpected role in private %v", r)
+	}
+	if !Has(Identity{Host: "melkor.lan", Channel: "#obs-dev"}, FactoidEditor) {
+		t.Fatal("moderators should be able to edit factoids")
+	}
+	if r := RoleOf(Identity{Account: "Root"}); r != SuperAdmin {
+		t.Fatalf("unexpected role for a superadmin %v", r)
+	}
+
+	if !Take("jim", FactoidEditor, "#obsproject") || Take("jim", FactoidEditor, "#obsproject") {
+		t.Fatal("the duplicate grant should not have been stored")
+	}
+	if len(Describe("jim")) != 0 || len(Describe("")) != 1 {
+		t.Fatalf("unexpected grants %v", Describe(""))
+	}
+}
+
+func TestCanGrant(t *testing.T) {
+	cases := []struct {
+		actor, role Role
+		ok          bool
+	}{
+		{FactoidEditor, FactoidEditor, false},
+		{Moderator, FactoidEditor, true},
+		{Moderator, Moderator, false},
+		{Owner, Moderator, true},
+		{Owner, Owner, true},
+		{Moderator, Owner, false},
+		{SuperAdmin, Owner, true},
+		{SuperAdmin, SuperAdmin, false},
+	}
+
+	for _, c := range cases {
+		if CanGrant(c.actor, c.role) != c.ok {
+			t.Errorf("CanGrant(%v, %v) should be %v", c.actor, c.role, c.ok)
+		}
+	}
+}
+
+func TestCanGrantIn(t *testing.T) {
+	defer chdir(t)()
+
+	var err error
+	state, err = load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = state.Get().(*st)
+	superAdmins = []string{"root"}
+
+	Give("jim", Owner, "#x")
+	// owner in the channel the command is sent in
+	id := Identity{Account: "jim", Channel: "#x"}
+
+	if !CanGrantIn(id, Owner, "#x") {
+		t.Error("an owner in the channel should be able to grant owner there")
+	}
+	if CanGrantIn(id, Owner, "") || CanGrantIn(id, FactoidEditor, "") {
+		t.Error("an owner in a channel should not be able to grant roles everywhere")
+	}
+	if CanGrantIn(id, Moderator, "#y") {
+		t.Error("an owner in a channel should not be able to grant roles in other channels")
+	}
+	if !CanGrantIn(Identity{Account: "root", Channel: "#x"}, Owner, "") {
+		t.Error("a superadmin should be able to grant owner everywhere")
+	}
+}
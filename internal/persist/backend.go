@@ -0,0 +1,230 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Backend stores the states by name
+type Backend interface {
+	// Load returns the state, nil if it was never saved
+	Load(name string) (*Envelope, error)
+	// Save replaces the state
+	Save(name string, env *Envelope) error
+	// Backup copies the stored state before it is migrated, tag is added
+	// to the name of the copy, returns the path of the copy
+	Backup(name, tag string) (string, error)
+	// Files returns the files the states are stored in
+	Files() []string
+	// Kind is the kind of the backend as passed to Open
+	Kind() string
+	Close() error
+}
+
+// Open opens the backend of the given kind, "json" stores every state in a
+// JSON file in the directory, "kv" stores all of them in a single database
+// file in the directory that is only appended to with what changed
+func Open(kind, dir string) (Backend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "", "json":
+		return &jsonBackend{dir: dir, names: map[string]struct{}{}}, nil
+	case "kv":
+		return openKV(filepath.Join(dir, "state.db"))
+	}
+
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+// jsonBackend stores every state as a JSON object in its own file, so that
+// they can be read and edited by hand
+type jsonBackend struct {
+	dir string
+
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+func (b *jsonBackend) path(name string) string {
+	return filepath.Join(b.dir, name+".json")
+}
+
+// the file is the envelope, files without a version are the bare entries
+// as written before there were versions
+func (b *jsonBackend) Load(name string) (*Envelope, error) {
+	b.mu.Lock()
+	b.names[name] = struct{}{}
+	b.mu.Unlock()
+
+	data, err := ioutil.ReadFile(b.path(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := Entries{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.path(name), err)
+	}
+
+	var version int
+	if _, ok := entries["data"]; ok && len(entries) == 2 && json.Unmarshal(entries["version"], &version) == nil {
+		env := &Envelope{}
+		if err := json.Unmarshal(data, env); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.path(name), err)
+		}
+		if env.Data == nil {
+			env.Data = Entries{}
+		}
+
+		return env, nil
+	}
+
+	return &Envelope{Data: entries}, nil
+}
+
+func (b *jsonBackend) Save(name string, env *Envelope) error {
+	b.mu.Lock()
+	b.names[name] = struct{}{}
+	b.mu.Unlock()
+
+	data, err := json.MarshalIndent(env, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(b.path(name), append(data, '\n'))
+}
+
+func (b *jsonBackend) Backup(name, tag string) (string, error) {
+	path := b.path(name) + "." + tag + ".bak"
+	return path, copyFile(b.path(name), path)
+}
+
+func (b *jsonBackend) Files() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ret []string
+	for name := range b.names {
+		if _, err := os.Stat(b.path(name)); err == nil {
+			ret = append(ret, b.path(name))
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+func (b *jsonBackend) Kind() string {
+	return "json"
+}
+
+func (b *jsonBackend) Close() error {
+	return nil
+}
+
+func copyFile(from, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(to, data)
+}
+
+// writeFile replaces the file atomically
+func writeFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// snapshot holds the states read by Dump, saving them does nothing
+type snapshot struct {
+	kind   string
+	states map[string]*Envelope
+}
+
+// openSnapshot reads the states of the backend of the kind in the directory,
+// there are none if nothing was saved yet
+func openSnapshot(kind, dir string) (*snapshot, error) {
+	states, err := Dump(kind, dir)
+	if os.IsNotExist(err) {
+		states, err = map[string]*Envelope{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{kind: kind, states: states}, nil
+}
+
+func (b *snapshot) Load(name string) (*Envelope, error) {
+	return b.states[name], nil
+}
+
+func (b *snapshot) Save(name string, env *Envelope) error {
+	return nil
+}
+
+func (b *snapshot) Backup(name, tag string) (string, error) {
+	return "", nil
+}
+
+func (b *snapshot) Files() []string {
+	return nil
+}
+
+func (b *snapshot) Kind() string {
+	return b.kind
+}
+
+func (b *snapshot) Close() error {
+	return nil
+}
@@ -0,0 +1,207 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package persist
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Entries are the JSON encoded parts of a state by key, this is what the
+// backends store
+type Entries map[string]json.RawMessage
+
+// flatten turns the data into entries, the elements of maps and of the map
+// fields of structs become separate entries so that a backend can store
+// them one by one, anything else is a single entry with an empty key
+func flatten(data interface{}) (Entries, error) {
+	ret := Entries{}
+	v := reflect.Indirect(reflect.ValueOf(data))
+
+	switch v.Kind() {
+	case reflect.Map:
+		return ret, flattenMap(ret, "", v)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+
+			if v.Field(i).Kind() == reflect.Map {
+				if err := flattenMap(ret, f.Name+"/", v.Field(i)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			b, err := json.Marshal(v.Field(i).Interface())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+			ret[f.Name] = b
+		}
+
+		return ret, nil
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	ret[""] = b
+
+	return ret, nil
+}
+
+func flattenMap(ret Entries, prefix string, m reflect.Value) error {
+	for _, k := range m.MapKeys() {
+		key, err := encodeKey(k)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(m.MapIndex(k).Interface())
+		if err != nil {
+			return fmt.Errorf("%s%s: %v", prefix, key, err)
+		}
+		ret[prefix+key] = b
+	}
+
+	return nil
+}
+
+// unflatten is the inverse of flatten, data has to be a pointer, the
+// entries are merged into the maps that are already there, entries of
+// fields that no longer exist are ignored
+func unflatten(entries Entries, data interface{}) error {
+	p := reflect.ValueOf(data)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return fmt.Errorf("the state has to be a pointer, got %T", data)
+	}
+	v := p.Elem()
+
+	switch v.Kind() {
+	case reflect.Map:
+		for key, raw := range entries {
+			if err := setEntry(v, key, raw); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case reflect.Struct:
+		for key, raw := range entries {
+			name, sub := key, ""
+			pos := strings.Index(key, "/")
+			if pos >= 0 {
+				name, sub = key[:pos], key[pos+1:]
+			}
+
+			f := v.FieldByName(name)
+			if !f.IsValid() || !f.CanSet() {
+				continue
+			}
+
+			if pos < 0 {
+				if err := json.Unmarshal(raw, f.Addr().Interface()); err != nil {
+					return fmt.Errorf("%s: %v", key, err)
+				}
+				continue
+			}
+
+			if f.Kind() != reflect.Map {
+				return fmt.Errorf("%s: %s is not a map", key, name)
+			}
+			if err := setEntry(f, sub, raw); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if raw, ok := entries[""]; ok {
+		return json.Unmarshal(raw, data)
+	}
+
+	return nil
+}
+
+func setEntry(m reflect.Value, key string, raw json.RawMessage) error {
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+
+	k, err := decodeKey(m.Type().Key(), key)
+	if err != nil {
+		return err
+	}
+
+	e := reflect.New(m.Type().Elem())
+	if err := json.Unmarshal(raw, e.Interface()); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	m.SetMapIndex(k, e.Elem())
+
+	return nil
+}
+
+// encodeKey turns a map key into a string, strings are kept as they are,
+// byte arrays like hashes are hex encoded, the rest is JSON
+func encodeKey(k reflect.Value) (string, error) {
+	switch {
+	case k.Kind() == reflect.String:
+		return k.String(), nil
+	case k.Kind() == reflect.Array && k.Type().Elem().Kind() == reflect.Uint8:
+		b := make([]byte, k.Len())
+		reflect.Copy(reflect.ValueOf(b), k)
+		return hex.EncodeToString(b), nil
+	}
+
+	b, err := json.Marshal(k.Interface())
+	return string(b), err
+}
+
+func decodeKey(t reflect.Type, s string) (reflect.Value, error) {
+	switch {
+	case t.Kind() == reflect.String:
+		return reflect.ValueOf(s).Convert(t), nil
+	case t.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8:
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != t.Len() {
+			return reflect.Value{}, fmt.Errorf("invalid key %q", s)
+		}
+
+		k := reflect.New(t).Elem()
+		reflect.Copy(k, reflect.ValueOf(b))
+		return k, nil
+	}
+
+	k := reflect.New(t)
+	if err := json.Unmarshal([]byte(s), k.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("invalid key %q: %v", s, err)
+	}
+
+	return k.Elem(), nil
+}
@@ -0,0 +1,132 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Inspect reads the states in the file without changing it, the file is
+// either a gob file from before there were backends named after its state,
+// like factoids.state, a file of the json backend or the database of the kv
+// backend
+func Inspect(path string) (map[string]*Envelope, error) {
+	base := filepath.Base(path)
+	switch {
+	case strings.HasSuffix(base, ".json"):
+		name := strings.TrimSuffix(base, ".json")
+		b := &jsonBackend{dir: filepath.Dir(path), names: map[string]struct{}{}}
+		env, err := b.Load(name)
+		if err != nil {
+			return nil, err
+		}
+		if env == nil {
+			return nil, fmt.Errorf("%s does not exist", path)
+		}
+		return map[string]*Envelope{name: env}, nil
+
+	case strings.HasSuffix(base, ".db"):
+		return inspectKV(path)
+	}
+
+	// the gob files are renamed once they are migrated
+	name := strings.TrimSuffix(strings.TrimSuffix(base, ".migrated"), ".state")
+	if name == base {
+		return nil, fmt.Errorf("%s is not a .state, .json or .db file", path)
+	}
+	schema := schemaOf(name)
+	if len(schema.Gob) == 0 {
+		return nil, fmt.Errorf("the gob format of the state %s is not known", name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, version, err := schema.decodeGob(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return map[string]*Envelope{name: {Version: version, Data: entries}}, nil
+}
+
+func inspectKV(path string) (map[string]*Envelope, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &kvBackend{
+		path:     path,
+		data:     map[string]json.RawMessage{},
+		readOnly: true,
+	}
+	if err := b.replay(f); err != nil {
+		return nil, err
+	}
+
+	ret := map[string]*Envelope{}
+	for key := range b.data {
+		if strings.Contains(key, "/") {
+			continue
+		}
+		if ret[key], err = b.Load(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// Dump reads every state of the backend of the kind in the directory
+// without changing anything
+func Dump(kind, dir string) (map[string]*Envelope, error) {
+	switch kind {
+	case "", "json":
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+
+		ret := map[string]*Envelope{}
+		for _, file := range files {
+			states, err := Inspect(file)
+			if err != nil {
+				return nil, err
+			}
+			for name, env := range states {
+				ret[name] = env
+			}
+		}
+		return ret, nil
+
+	case "kv":
+		return inspectKV(filepath.Join(dir, "state.db"))
+	}
+
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
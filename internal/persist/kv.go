@@ -0,0 +1,293 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the log is compacted once it is at least this big and more than half of
+// it is overwritten data
+const compactSize = 1 << 20
+
+// kvBackend is a key-value store kept in memory and backed by an append-only
+// log, every save is a transaction that is a single line in the log with the
+// keys that changed, a line that was only partially written when the
+// process died is dropped the next time the log is opened
+type kvBackend struct {
+	path string
+
+	mu   sync.Mutex
+	f    *os.File
+	data map[string]json.RawMessage
+	// the size of the log and of the data in it that is still current
+	size int64
+	live int64
+	// the log is only read, a torn write at the end is left alone since the
+	// bot might be in the middle of writing it
+	readOnly bool
+}
+
+type kvOp struct {
+	Key    string          `json:"k"`
+	Value  json.RawMessage `json:"v,omitempty"`
+	Delete bool            `json:"d,omitempty"`
+}
+
+type kvTx struct {
+	Ops []kvOp `json:"ops"`
+}
+
+func openKV(path string) (*kvBackend, error) {
+	b := &kvBackend{
+		path: path,
+		data: map[string]json.RawMessage{},
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.replay(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(b.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	b.f = f
+	return b, nil
+}
+
+// replay reads the log into memory, a torn write at the end is cut off
+func (b *kvBackend) replay(f *os.File) error {
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 && !b.readOnly {
+				return f.Truncate(b.size)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var tx kvTx
+		if err := json.Unmarshal(line, &tx); err != nil {
+			return fmt.Errorf("%s is corrupt at offset %d: %v", b.path, b.size, err)
+		}
+
+		b.size += int64(len(line))
+		b.apply(tx)
+	}
+}
+
+// apply applies the transaction to the data in memory, the lock needs to be
+// held by the caller
+func (b *kvBackend) apply(tx kvTx) {
+	for _, op := range tx.Ops {
+		if old, ok := b.data[op.Key]; ok {
+			b.live -= int64(len(op.Key) + len(old))
+		}
+
+		if op.Delete {
+			delete(b.data, op.Key)
+			continue
+		}
+
+		b.data[op.Key] = op.Value
+		b.live += int64(len(op.Key) + len(op.Value))
+	}
+}
+
+// the entries of a state are stored under name/key, the name on its own is
+// the version, it is true for states saved before there were versions
+func (b *kvBackend) Load(name string) (*Envelope, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	marker, ok := b.data[name]
+	if !ok {
+		return nil, nil
+	}
+
+	env := &Envelope{Data: Entries{}}
+	if string(marker) != "true" {
+		if err := json.Unmarshal(marker, &env.Version); err != nil {
+			return nil, fmt.Errorf("invalid version of %s: %v", name, err)
+		}
+	}
+
+	prefix := name + "/"
+	for k, v := range b.data {
+		if strings.HasPrefix(k, prefix) {
+			env.Data[k[len(prefix):]] = v
+		}
+	}
+
+	return env, nil
+}
+
+func (b *kvBackend) Save(name string, env *Envelope) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.f == nil {
+		return fmt.Errorf("%s is closed", b.path)
+	}
+
+	var tx kvTx
+	version := json.RawMessage(strconv.Itoa(env.Version))
+	if old, ok := b.data[name]; !ok || !bytes.Equal(old, version) {
+		tx.Ops = append(tx.Ops, kvOp{Key: name, Value: version})
+	}
+
+	entries := env.Data
+
+	prefix := name + "/"
+	for k, v := range entries {
+		if old, ok := b.data[prefix+k]; !ok || !bytes.Equal(old, v) {
+			tx.Ops = append(tx.Ops, kvOp{Key: prefix + k, Value: v})
+		}
+	}
+	for k := range b.data {
+		if _, ok := entries[strings.TrimPrefix(k, prefix)]; strings.HasPrefix(k, prefix) && !ok {
+			tx.Ops = append(tx.Ops, kvOp{Key: k, Delete: true})
+		}
+	}
+
+	if len(tx.Ops) == 0 {
+		return nil
+	}
+
+	if err := b.write(tx); err != nil {
+		return err
+	}
+
+	if b.size >= compactSize && b.size > 2*b.live {
+		return b.compact()
+	}
+
+	return nil
+}
+
+// write appends the transaction to the log, the lock needs to be held by
+// the caller
+func (b *kvBackend) write(tx kvTx) error {
+	line, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := b.f.Write(line); err != nil {
+		// do not leave a partial line around for the next transaction to be
+		// appended to
+		_ = b.f.Truncate(b.size)
+		_, _ = b.f.Seek(b.size, io.SeekStart)
+		return err
+	}
+	if err := b.f.Sync(); err != nil {
+		return err
+	}
+
+	b.size += int64(len(line))
+	b.apply(tx)
+	return nil
+}
+
+// compact replaces the log with a single transaction of the current data,
+// the lock needs to be held by the caller
+func (b *kvBackend) compact() error {
+	keys := make([]string, 0, len(b.data))
+	for k := range b.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tx := kvTx{Ops: make([]kvOp, 0, len(keys))}
+	for _, k := range keys {
+		tx.Ops = append(tx.Ops, kvOp{Key: k, Value: b.data[k]})
+	}
+
+	line, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if err := writeFile(b.path, line); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(b.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	b.f.Close()
+	b.f = f
+	b.size = int64(len(line))
+	return nil
+}
+
+// Backup copies the whole database, the states are all in the same file
+func (b *kvBackend) Backup(name, tag string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	path := b.path + "." + name + "-" + tag + ".bak"
+	return path, copyFile(b.path, path)
+}
+
+func (b *kvBackend) Files() []string {
+	return []string{b.path}
+}
+
+func (b *kvBackend) Kind() string {
+	return "kv"
+}
+
+func (b *kvBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.f == nil {
+		return nil
+	}
+
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
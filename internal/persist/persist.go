@@ -17,49 +17,213 @@
   along with obscommits; If not, see <http://www.gnu.org/licenses/>.
 ***/
 
+// Package persist keeps the state of the modules, the state is a map or a
+// struct that is stored by a Backend, the states used to be gob files, they
+// are migrated to the backend the first time they are loaded
 package persist
 
 import (
-	"encoding/gob"
+	"fmt"
 	"os"
 	"sync"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"golang.org/x/net/context"
 )
 
 type State struct {
 	sync.Mutex
-	path string
-	data interface{}
+	name    string
+	version int
+	data    interface{}
+	backend Backend
+	// called after the state was restored
+	restored []func()
+}
+
+var (
+	// every state, so that they can be saved on shutdown
+	allMu sync.Mutex
+	all   []*State
+	// the backend new states use, json files in the working directory
+	// unless Init is called
+	backend Backend
+)
+
+// Init opens the backend from the config, it has to be called before any
+// of the states are created
+func Init(ctx context.Context) context.Context {
+	b, err := Open(Location(ctx))
+	if err != nil {
+		d.F("Could not open the storage: %v", err)
+	}
+
+	allMu.Lock()
+	backend = b
+	allMu.Unlock()
+
+	return ctx
+}
+
+// InitReadOnly reads the states from the backend of the config instead,
+// nothing is ever written, the gob files are not migrated and saving the
+// states does nothing, so that they can be looked at without changing them
+func InitReadOnly(ctx context.Context) context.Context {
+	b, err := openSnapshot(Location(ctx))
+	if err != nil {
+		d.F("Could not read the storage: %v", err)
+	}
+
+	allMu.Lock()
+	backend = b
+	allMu.Unlock()
+
+	return ctx
 }
 
-func New(p string, d interface{}) (*State, error) {
+// Location returns the kind of the backend and the directory the state is
+// kept in according to the config
+func Location(ctx context.Context) (kind, dir string) {
+	cfg := config.FromContext(ctx).Storage
+	dir = cfg.Path
+	if dir == "" {
+		dir = "state"
+	}
+
+	return cfg.Backend, dir
+}
+
+func currentBackend() Backend {
+	allMu.Lock()
+	defer allMu.Unlock()
+
+	if backend == nil {
+		backend = &jsonBackend{dir: ".", names: map[string]struct{}{}}
+	}
+
+	return backend
+}
+
+// New loads the state with the name into data, it has to be a pointer, if the
+// state was never saved but there is a gob file from before, name.state, it
+// is loaded from that and saved to the backend, older versions of the data
+// are migrated with the registered schema after backing them up
+func New(name string, data interface{}) (*State, error) {
+	schema := schemaOf(name)
 	ret := &State{
-		path: p,
-		data: d,
+		name:    name,
+		version: schema.Version,
+		data:    data,
+		backend: currentBackend(),
+	}
+
+	env, err := ret.backend.Load(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the state %s: %v", name, err)
 	}
 
-	// closing the file unlocks it, always
-	ret.Lock()
+	legacy := name + ".state"
+	var entries Entries
+	var version int
+	if env != nil {
+		entries, version = env.Data, env.Version
+		if version == 0 {
+			version = schema.Unversioned
+		}
+	} else if entries, version, err = loadGob(legacy, schema, data); err != nil {
+		return nil, fmt.Errorf("could not migrate %s: %v", legacy, err)
+	}
 
-	// os.IsExist returns false when the error is nil, so use IsNotExist
-	f, err := os.OpenFile(ret.path, os.O_RDONLY, 0600)
-	if !os.IsNotExist(err) {
-		err := ret.load(f)
-		ret.close(f, true)
+	_, readOnly := ret.backend.(*snapshot)
+	if env != nil && version < schema.Version && !readOnly {
+		path, err := ret.backend.Backup(name, fmt.Sprintf("v%d", version))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("could not back up the state %s: %v", name, err)
 		}
-	} else {
-		ret.close(f, true)
+		d.P("Migrating the state", name, "from version", version, "to", schema.Version, "backed up to", path)
 	}
 
-	err = ret.Save()
-	if err != nil {
+	if entries != nil {
+		if entries, err = schema.migrate(entries, version); err != nil {
+			return nil, fmt.Errorf("could not migrate the state %s: %v", name, err)
+		}
+		if err := unflatten(entries, data); err != nil {
+			return nil, fmt.Errorf("could not load the state %s: %v", name, err)
+		}
+	}
+
+	if err := ret.Save(); err != nil {
 		return nil, err
 	}
 
+	// only renamed once it is saved, so that nothing is lost if saving fails,
+	// it is kept as the backup
+	if env == nil && entries != nil && !readOnly {
+		if err := os.Rename(legacy, legacy+".migrated"); err != nil {
+			return nil, err
+		}
+	}
+
+	allMu.Lock()
+	all = append(all, ret)
+	allMu.Unlock()
+
 	return ret, nil
 }
 
+// loadGob decodes the gob file, returns nil entries if there is no file
+func loadGob(path string, schema Schema, data interface{}) (Entries, int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	return schema.decodeGob(f, data)
+}
+
+// SaveAll saves every state, returns the first error but tries to save the
+// rest regardless
+func SaveAll() error {
+	allMu.Lock()
+	states := make([]*State, len(all))
+	copy(states, all)
+	allMu.Unlock()
+
+	var ret error
+	for _, s := range states {
+		if err := s.Save(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// Close saves every state and closes the backend
+func Close() error {
+	err := SaveAll()
+	if cerr := currentBackend().Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Files returns the files the states are stored in
+func Files() []string {
+	return currentBackend().Files()
+}
+
+// Kind returns the kind of the backend, like "json"
+func Kind() string {
+	return currentBackend().Kind()
+}
+
 func (s *State) Set(d interface{}) {
 	s.Lock()
 	s.data = d
@@ -74,51 +238,17 @@ func (s *State) Get() interface{} {
 	return ret
 }
 
-func (s *State) load(f *os.File) error {
-	d := gob.NewDecoder(f)
-	err := d.Decode(s.data)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
+// Save stores the state, pass false if the lock is already held
 func (s *State) Save(lock ...bool) error {
-	var needLock bool
 	if len(lock) == 0 || lock[0] {
-		needLock = true
 		s.Lock()
+		defer s.Unlock()
 	}
 
-	tmpPath := s.path + ".tmp"
-	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	defer s.close(f, needLock)
-
+	entries, err := flatten(s.data)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not save the state %s: %v", s.name, err)
 	}
 
-	e := gob.NewEncoder(f)
-	err = e.Encode(s.data)
-	if err != nil {
-		return err
-	}
-
-	err = os.Rename(tmpPath, s.path)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *State) close(f *os.File, needUnlock bool) {
-	if needUnlock {
-		s.Unlock()
-	}
-
-	if f != nil {
-		_ = f.Close()
-	}
+	return s.backend.Save(s.name, &Envelope{Version: s.version, Data: entries})
 }
@@ -20,40 +20,417 @@
 package persist
 
 import (
+	"encoding/gob"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-const testFileName = "teststate.tmp"
+// tempBackend makes new states use a backend of the kind in a temporary
+// directory
+func tempBackend(t *testing.T, kind string) (string, func()) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Open(kind, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = b
+
+	return dir, func() {
+		b.Close()
+		backend = nil
+		_ = os.RemoveAll(dir)
+	}
+}
 
 func TestSanity(t *testing.T) {
-	m := map[string]string{
-		"foo": "bar",
+	for _, kind := range []string{"json", "kv"} {
+		dir, cleanup := tempBackend(t, kind)
+
+		m := map[string]string{
+			"foo": "bar",
+		}
+		s, err := New("test", &m)
+		if err != nil || len(m) != 1 || m["foo"] != "bar" {
+			t.Fatalf("%s: unexpected map %#v, err %v", kind, m, err)
+		}
+
+		m["bar"] = "foo"
+		m["foo"] = "bar2"
+		err = s.Save()
+		if err != nil {
+			t.Fatalf("%s: unexpected err %v", kind, err)
+		}
+
+		// reopen the backend so that the state is read from the disk
+		backend.Close()
+		if backend, err = Open(kind, dir); err != nil {
+			t.Fatal(err)
+		}
+
+		// the state exists, so our map should be overwritten by the existing
+		// values, plus the non-existing value should be retained
+		m = map[string]string{
+			"foo": "bar",
+			"qwe": "asd",
+		}
+		s, err = New("test", &m)
+		if err != nil || len(m) != 3 || m["foo"] != "bar2" || m["bar"] != "foo" || m["qwe"] != "asd" {
+			t.Fatalf("%s: unexpected map %#v, err %v", kind, m, err)
+		}
+
+		cleanup()
 	}
+}
 
-	_ = os.Remove(testFileName)
-	defer os.Remove(testFileName)
+type testState struct {
+	Names map[string]time.Time
+	Seen  map[[16]byte]int64
+	Count int
+}
 
-	s, err := New(testFileName, &m)
-	if err != nil || len(m) != 1 || m["foo"] != "bar" {
-		t.Fatalf("unexpected map %#v, err %v", m, err)
+func TestMigrate(t *testing.T) {
+	dir, cleanup := tempBackend(t, "json")
+	defer cleanup()
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	old := testState{
+		Names: map[string]time.Time{"jim": now},
+		Seen:  map[[16]byte]int64{{1, 2}: 3},
+		Count: 4,
+	}
+	f, err := os.Create("test.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(&old); err != nil {
+		t.Fatal(err)
 	}
+	f.Close()
 
-	m["bar"] = "foo"
-	m["foo"] = "bar2"
-	err = s.Save()
+	var st testState
+	if _, err := New("test", &st); err != nil {
+		t.Fatal(err)
+	}
+	if !st.Names["jim"].Equal(now) || st.Seen[[16]byte{1, 2}] != 3 || st.Count != 4 {
+		t.Fatalf("the gob file was not migrated: %+v", st)
+	}
+	if _, err := os.Stat("test.state.migrated"); err != nil {
+		t.Error("the gob file was not renamed")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "test.json"))
 	if err != nil {
-		t.Fatalf("unexpected err %v", err)
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"Seen/01020000000000000000000000000000": 3`) {
+		t.Errorf("unexpected json %s", b)
+	}
+
+	// loading it again uses the json file
+	st = testState{}
+	if _, err := New("test", &st); err != nil || st.Count != 4 {
+		t.Fatalf("unexpected state %+v, err %v", st, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, cleanup := tempBackend(t, "json")
+	defer cleanup()
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	m := map[string]string{"foo": "bar"}
+	if _, err := New("saved", &m); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create("test.state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(&testState{Count: 4}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := ioutil.ReadFile(filepath.Join(dir, "saved.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk := backend
+	defer func() { backend = disk }()
+	if backend, err = openSnapshot("json", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	m = map[string]string{}
+	s, err := New("saved", &m)
+	if err != nil || m["foo"] != "bar" {
+		t.Fatalf("unexpected state %v, err %v", m, err)
+	}
+	m["foo"] = "changed"
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	var st testState
+	if _, err := New("test", &st); err != nil || st.Count != 4 {
+		t.Fatalf("unexpected state %+v, err %v", st, err)
+	}
+
+	// nothing was written, the gob file is neither migrated nor renamed
+	after, err := ioutil.ReadFile(filepath.Join(dir, "saved.json"))
+	if err != nil || string(after) != string(before) {
+		t.Errorf("the state was saved: %s, err %v", after, err)
+	}
+	if _, err := os.Stat("test.state"); err != nil {
+		t.Error("the gob file was renamed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.json")); !os.IsNotExist(err) {
+		t.Errorf("the gob file was migrated, err %v", err)
+	}
+}
+
+func TestKV(t *testing.T) {
+	dir, cleanup := tempBackend(t, "kv")
+	defer cleanup()
+	path := filepath.Join(dir, "state.db")
+
+	m := map[string]string{"a": "1", "b": "2"}
+	s, err := New("test", &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := os.Stat(path)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
 	}
+	if after, _ := os.Stat(path); after.Size() != before.Size() {
+		t.Error("saving an unchanged state wrote to the log")
+	}
+
+	m["a"] = "3"
+	delete(m, "b")
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if want := `{"ops":[{"k":"test/a","v":"3"},{"k":"test/b","d":true}]}`; lines[len(lines)-1] != want {
+		t.Errorf("expected only the changes in the transaction %s, got %s", want, lines[len(lines)-1])
+	}
+
+	// a transaction that was only partially written is dropped
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"ops":[{"k":"test/a","v":"4`)
+	f.Close()
 
-	// the file exists, so our map should be overwritten by the existing
-	// values, plus the non-existing value should be retained
-	m = map[string]string{
-		"foo": "bar",
-		"qwe": "asd",
+	backend.Close()
+	if backend, err = Open("kv", dir); err != nil {
+		t.Fatal(err)
 	}
-	s, err = New(testFileName, &m)
-	if err != nil || len(m) != 3 || m["foo"] != "bar2" || m["bar"] != "foo" || m["qwe"] != "asd" {
+	m = map[string]string{}
+	if _, err := New("test", &m); err != nil || len(m) != 1 || m["a"] != "3" {
 		t.Fatalf("unexpected map %#v, err %v", m, err)
 	}
+
+	kv := backend.(*kvBackend)
+	kv.mu.Lock()
+	err = kv.compact()
+	kv.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env, _ := kv.Load("test"); env == nil || string(env.Data["a"]) != `"3"` {
+		t.Errorf("unexpected state after compacting %v", env)
+	}
+	b, _ = ioutil.ReadFile(path)
+	if strings.Count(string(b), "\n") != 1 {
+		t.Errorf("expected a single transaction after compacting, got %s", b)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	for _, kind := range []string{"json", "kv"} {
+		dir, cleanup := tempBackend(t, kind)
+
+		// the format before there were versions
+		if err := backend.Save("versions", &Envelope{Data: Entries{"a": []byte(`1`)}}); err != nil {
+			t.Fatal(err)
+		}
+		if kind == "json" {
+			if err := ioutil.WriteFile(filepath.Join(dir, "versions.json"), []byte(`{"a": 1}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			kv := backend.(*kvBackend)
+			kv.mu.Lock()
+			kv.write(kvTx{Ops: []kvOp{{Key: "versions", Value: []byte("true")}}})
+			kv.mu.Unlock()
+		}
+
+		Register("versions", Schema{
+			Version: 2,
+			Migrations: map[int]Migration{
+				1: func(e Entries) (Entries, error) {
+					var m map[string]int
+					if err := e.Decode(&m); err != nil {
+						return nil, err
+					}
+					m["a"]++
+					return Encode(&m)
+				},
+			},
+		})
+
+		m := map[string]int{}
+		if _, err := New("versions", &m); err != nil || m["a"] != 2 {
+			t.Fatalf("%s: unexpected map %v, err %v", kind, m, err)
+		}
+		if env, _ := backend.Load("versions"); env.Version != 2 {
+			t.Errorf("%s: the version was not saved: %+v", kind, env)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.v1.bak")); kind == "json" && len(files) != 1 {
+			t.Errorf("%s: expected a backup, got %v", kind, files)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*-v1.bak")); kind == "kv" && len(files) != 1 {
+			t.Errorf("%s: expected a backup, got %v", kind, files)
+		}
+
+		// loading it again does not migrate it again
+		m = map[string]int{}
+		if _, err := New("versions", &m); err != nil || m["a"] != 2 {
+			t.Fatalf("%s: unexpected map %v, err %v", kind, m, err)
+		}
+
+		// newer versions are not loaded
+		Register("versions", Schema{Version: 1})
+		if _, err := New("versions", &m); err == nil {
+			t.Errorf("%s: expected an error for a newer version", kind)
+		}
+
+		cleanup()
+	}
+}
+
+func TestRestore(t *testing.T) {
+	_, cleanup := tempBackend(t, "json")
+	defer cleanup()
+
+	type data struct {
+		M map[string]int
+		N int
+	}
+	v := &data{M: map[string]int{"a": 1, "b": 2}, N: 1}
+	s, err := New("restore", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := v.M
+	restored := 0
+	s.OnRestore(func() { restored++ })
+
+	srcDir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	src, err := Open("json", srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	// an invalid state keeps everything as it was
+	if err := src.Save("restore", &Envelope{Version: 1, Data: Entries{"N": []byte(`"x"`)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(src); err == nil || v.N != 1 || restored != 0 {
+		t.Fatalf("expected an error and no changes, got %v %+v", err, v)
+	}
+
+	e, err := Encode(&data{M: map[string]int{"c": 3}, N: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Save("restore", &Envelope{Version: 1, Data: e}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(src); err != nil {
+		t.Fatal(err)
+	}
+
+	// the map is the same one, modules hold on to it
+	if len(m) != 1 || m["c"] != 3 || v.N != 2 || restored != 1 {
+		t.Errorf("unexpected state after the restore %+v, %v, %d hooks", v, m, restored)
+	}
+	if env, _ := backend.Load("restore"); env == nil || string(env.Data["N"]) != "2" {
+		t.Errorf("the restored state was not saved: %+v", env)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir, cleanup := tempBackend(t, "kv")
+	defer cleanup()
+	path := filepath.Join(dir, "state.db")
+
+	m := map[string]string{"a": "1"}
+	if _, err := New("test", &m); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn write is left alone while inspecting
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"ops":[{"k":"test/a","v":"4`)
+	f.Close()
+	before, _ := os.Stat(path)
+
+	states, err := Dump("kv", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := states["test"]; env == nil || string(env.Data["a"]) != `"1"` {
+		t.Errorf("unexpected states %v", states)
+	}
+	if after, _ := os.Stat(path); after.Size() != before.Size() {
+		t.Error("inspecting the log changed it")
+	}
+
+	// gob files need a known format
+	gobPath := filepath.Join(dir, "inspect.state")
+	gf, _ := os.Create(gobPath)
+	gob.NewEncoder(gf).Encode(map[string]string{"b": "2"})
+	gf.Close()
+	if _, err := Inspect(gobPath); err == nil {
+		t.Error("expected an error for a gob file of an unknown format")
+	}
+	Register("inspect", Schema{Gob: []GobFormat{{
+		Version: 1,
+		New:     func() interface{} { return &map[string]string{} },
+	}}})
+	states, err = Inspect(gobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := states["inspect"]; env == nil || env.Version != 1 || string(env.Data["b"]) != `"2"` {
+		t.Errorf("unexpected states %v", states)
+	}
 }
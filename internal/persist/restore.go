@@ -0,0 +1,127 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package persist
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// OnRestore registers a function that is called after the state was
+// replaced by Restore, for modules that keep something derived from it
+func (s *State) OnRestore(f func()) {
+	s.Lock()
+	s.restored = append(s.restored, f)
+	s.Unlock()
+}
+
+// Restore replaces every state with the one stored in the backend, the
+// states are migrated and decoded first, nothing is replaced if any of them
+// is invalid, states that are missing from the backend are kept as they are
+func Restore(src Backend) error {
+	allMu.Lock()
+	states := make([]*State, len(all))
+	copy(states, all)
+	allMu.Unlock()
+
+	restored := map[*State]Entries{}
+	for _, s := range states {
+		env, err := src.Load(s.name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.name, err)
+		}
+		if env == nil {
+			continue
+		}
+
+		schema := schemaOf(s.name)
+		version := env.Version
+		if version == 0 {
+			version = schema.Unversioned
+		}
+
+		entries, err := schema.migrate(env.Data, version)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.name, err)
+		}
+
+		// decode it into a new value of the same type to see if it is valid
+		s.Lock()
+		v := reflect.New(reflect.TypeOf(s.data).Elem())
+		s.Unlock()
+		if err := unflatten(entries, v.Interface()); err != nil {
+			return fmt.Errorf("%s: %v", s.name, err)
+		}
+
+		restored[s] = entries
+	}
+
+	var ret error
+	for s, entries := range restored {
+		s.Lock()
+		// the data is replaced in place since the modules hold on to it
+		reset(s.data)
+		err := unflatten(entries, s.data)
+		if err == nil {
+			err = s.Save(false)
+		}
+		hooks := s.restored
+		s.Unlock()
+
+		if err != nil && ret == nil {
+			ret = fmt.Errorf("%s: %v", s.name, err)
+		}
+		for _, f := range hooks {
+			f()
+		}
+	}
+
+	return ret
+}
+
+// reset empties the maps of the data in place and zeroes everything else
+func reset(data interface{}) {
+	v := reflect.Indirect(reflect.ValueOf(data))
+	switch v.Kind() {
+	case reflect.Map:
+		resetMap(v)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if !f.CanSet() {
+				continue
+			}
+
+			if f.Kind() == reflect.Map && !f.IsNil() {
+				resetMap(f)
+				continue
+			}
+			f.Set(reflect.Zero(f.Type()))
+		}
+	default:
+		v.Set(reflect.Zero(v.Type()))
+	}
+}
+
+func resetMap(m reflect.Value) {
+	for _, k := range m.MapKeys() {
+		m.SetMapIndex(k, reflect.Value{})
+	}
+}
@@ -0,0 +1,159 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package persist
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Envelope is what a backend stores for a state, the data along with the
+// version of its format
+type Envelope struct {
+	Version int     `json:"version"`
+	Data    Entries `json:"data"`
+}
+
+// Migration upgrades the data of a state by one version
+type Migration func(Entries) (Entries, error)
+
+// GobFormat is a format the state was saved in as a gob file before there
+// were backends, New returns a value of the type the file is decoded into
+type GobFormat struct {
+	Version int
+	New     func() interface{}
+}
+
+// Schema describes how the format of a state changed over time, the
+// version of a state without a schema is 1 and its gob file is decoded into
+// the state itself
+type Schema struct {
+	// Version is the current version of the format, starting at 1
+	Version int
+	// Unversioned is the version of the data saved before versions were
+	// recorded, 1 if zero
+	Unversioned int
+	// Migrations upgrade the data from the version of the key to the next
+	// one
+	Migrations map[int]Migration
+	// Gob are the formats of the gob file, the newest one the file decodes
+	// into is used
+	Gob []GobFormat
+}
+
+var (
+	schemaMu sync.Mutex
+	schemas  = map[string]Schema{}
+)
+
+// Register registers the schema of the state with the name, it has to be
+// called before the state is created
+func Register(name string, s Schema) {
+	schemaMu.Lock()
+	schemas[name] = s
+	schemaMu.Unlock()
+}
+
+func schemaOf(name string) Schema {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+
+	s, ok := schemas[name]
+	if !ok || s.Version == 0 {
+		s.Version = 1
+	}
+	if s.Unversioned == 0 {
+		s.Unversioned = 1
+	}
+
+	return s
+}
+
+// migrate upgrades the entries from the version to the current one
+func (s Schema) migrate(entries Entries, version int) (Entries, error) {
+	if version > s.Version {
+		return nil, fmt.Errorf("the data is version %d, only version %d and older is supported", version, s.Version)
+	}
+
+	for v := version; v < s.Version; v++ {
+		m, ok := s.Migrations[v]
+		if !ok {
+			return nil, fmt.Errorf("no migration from version %d", v)
+		}
+
+		var err error
+		if entries, err = m(entries); err != nil {
+			return nil, fmt.Errorf("migrating from version %d: %v", v, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// decodeGob decodes the gob file with the newest format it decodes into,
+// without formats it is decoded into d
+func (s Schema) decodeGob(r io.ReadSeeker, d interface{}) (Entries, int, error) {
+	if len(s.Gob) == 0 {
+		if err := gob.NewDecoder(r).Decode(d); err != nil {
+			return nil, 0, err
+		}
+
+		entries, err := flatten(d)
+		return entries, s.Unversioned, err
+	}
+
+	formats := make([]GobFormat, len(s.Gob))
+	copy(formats, s.Gob)
+	sort.Slice(formats, func(i, j int) bool { return formats[i].Version > formats[j].Version })
+
+	var first error
+	for _, f := range formats {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+
+		v := f.New()
+		if err := gob.NewDecoder(r).Decode(v); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		entries, err := flatten(v)
+		return entries, f.Version, err
+	}
+
+	return nil, 0, first
+}
+
+// Encode turns the data into entries, for migrations
+func Encode(d interface{}) (Entries, error) {
+	return flatten(d)
+}
+
+// Decode decodes the entries into d, which has to be a pointer, for
+// migrations
+func (e Entries) Decode(d interface{}) error {
+	return unflatten(e, d)
+}
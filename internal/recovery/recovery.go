@@ -0,0 +1,200 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package recovery recovers from the panics of the IRC handlers, the HTTP
+// handlers and the background pollers, the stack is logged and a short
+// alert is sent to the admin channel, at most once every interval for the
+// same place
+package recovery
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/ircfmt"
+	"github.com/obsproject/obscommits/internal/sink"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultInterval = 10 * time.Minute
+	// the longest panic value that is sent in an alert
+	maxAlertLen = 200
+	// the number of places remembered before the old ones are forgotten
+	maxPlaces = 100
+)
+
+type alerter struct {
+	mu       sync.Mutex
+	out      *sink.Router
+	interval time.Duration
+	// when the last alert was sent about a place and how many panics there
+	// were since then
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+var alerts = &alerter{
+	interval:   defaultInterval,
+	last:       map[string]time.Time{},
+	suppressed: map[string]int{},
+}
+
+// Init starts sending the alerts, the sinks have to be in the context
+// already, panics before that are only logged
+func Init(ctx context.Context) context.Context {
+	cfg := config.FromContext(ctx).Alerts
+	out := sink.FromContext(ctx).MustRouter(sink.Routes(cfg.Routes, cfg.Channel))
+
+	alerts.mu.Lock()
+	alerts.out = out
+	alerts.interval = interval(cfg.Interval)
+	alerts.mu.Unlock()
+
+	reg := sink.FromContext(ctx)
+	config.OnReload(config.Hook{
+		Name: "alerts",
+		Check: func(cfg *config.AppConfig) error {
+			return reg.Check(cfg, sink.Routes(cfg.Alerts.Routes, cfg.Alerts.Channel))
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			if err := out.Reset(sink.Routes(cfg.Alerts.Routes, cfg.Alerts.Channel)); err != nil {
+				d.P("Could not reset the alert routes", err)
+			}
+
+			alerts.mu.Lock()
+			alerts.interval = interval(cfg.Alerts.Interval)
+			alerts.mu.Unlock()
+		},
+	})
+
+	return ctx
+}
+
+func interval(s string) time.Duration {
+	if ret, err := time.ParseDuration(s); err == nil {
+		return ret
+	}
+	return defaultInterval
+}
+
+// Recover recovers from a panic, it has to be deferred directly, where is
+// what was running, like "rss forum"
+func Recover(where string) {
+	if v := recover(); v != nil {
+		report(where, v)
+	}
+}
+
+// Run runs f and recovers if it panics, returns whether it did not
+func Run(where string, f func()) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			report(where, v)
+			ok = false
+		}
+	}()
+
+	f()
+	return true
+}
+
+// Handler recovers from the panics of the HTTP handler and replies with an
+// internal server error
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// the way to abort a response on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			report("http "+r.URL.Path, v)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// report logs the stack of the panic and sends an alert, it is called from
+// the deferred function that recovered
+func report(where string, v interface{}) {
+	// skip report, the deferred function and the runtime, so that the trace
+	// starts where the panic happened
+	trace := d.NewErrorTrace(3)
+	d.Error("Recovered from a panic", "where", where, "panic", v, "trace", trace)
+
+	alerts.alert(where, v)
+}
+
+func (a *alerter) alert(where string, v interface{}) {
+	a.mu.Lock()
+	if time.Since(a.last[where]) < a.interval {
+		a.suppressed[where]++
+		a.mu.Unlock()
+		return
+	}
+	suppressed := a.suppressed[where]
+	// the places come from the URLs too, the ones that are quiet again are
+	// forgotten so that they do not pile up
+	if len(a.last) > maxPlaces {
+		for p, t := range a.last {
+			if time.Since(t) >= a.interval {
+				delete(a.last, p)
+				delete(a.suppressed, p)
+			}
+		}
+	}
+	a.last[where] = time.Now()
+	a.suppressed[where] = 0
+	out := a.out
+	a.mu.Unlock()
+
+	if out == nil {
+		return
+	}
+
+	out.Announce(sink.Announcement{
+		Text:   alertText(where, v, suppressed),
+		Source: "Alert",
+		Title:  "Panic in " + where,
+		Kind:   "alerts",
+	})
+}
+
+// alertText returns the alert of the panic on a single line, the panic
+// value is shortened to maxAlertLen characters
+func alertText(where string, v interface{}, suppressed int) string {
+	text := strings.Replace(fmt.Sprintf("%v", v), "\n", " ", -1)
+	text = "Panic in " + where + ": " + ircfmt.Truncate(text, maxAlertLen, "…")
+	if suppressed > 0 {
+		text += fmt.Sprintf(" (%d more since the last alert)", suppressed)
+	}
+	return text
+}
@@ -0,0 +1,98 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package recovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestRun(t *testing.T) {
+	if !Run("test ok", func() {}) {
+		t.Fatal("Run reported a panic when there was none")
+	}
+	if Run("test panic", func() { panic("boom") }) {
+		t.Fatal("Run did not report the panic")
+	}
+
+	func() {
+		defer Recover("test recover")
+		var m map[string]int
+		m["crash"] = 1
+	}()
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/hook", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", w.Code)
+	}
+}
+
+func TestAlertInterval(t *testing.T) {
+	a := &alerter{
+		interval:   time.Hour,
+		last:       map[string]time.Time{},
+		suppressed: map[string]int{},
+	}
+
+	for i := 0; i < 3; i++ {
+		a.alert("rss forum", "boom")
+	}
+	a.alert("matrix sync", "boom")
+
+	if n := a.suppressed["rss forum"]; n != 2 {
+		t.Fatalf("expected 2 suppressed panics, got %d", n)
+	}
+	if n := a.suppressed["matrix sync"]; n != 0 {
+		t.Fatalf("expected no suppressed panics for another place, got %d", n)
+	}
+
+	// once the interval passed the place alerts again and the count starts over
+	a.last["rss forum"] = time.Now().Add(-2 * time.Hour)
+	a.alert("rss forum", "boom")
+	if n := a.suppressed["rss forum"]; n != 0 {
+		t.Fatalf("expected the count to be reset, got %d", n)
+	}
+}
+
+func TestAlertText(t *testing.T) {
+	if got := alertText("rss forum", "boom\nagain", 2); got != "Panic in rss forum: boom again (2 more since the last alert)" {
+		t.Fatalf("unexpected alert %q", got)
+	}
+
+	// the value is cut between the characters
+	got := alertText("irc", strings.Repeat("ő", maxAlertLen+10), 0)
+	if !utf8.ValidString(got) || !strings.HasSuffix(got, "…") {
+		t.Fatalf("unexpected alert %q", got)
+	}
+	if n := utf8.RuneCountInString(strings.TrimPrefix(got, "Panic in irc: ")); n != maxAlertLen {
+		t.Fatalf("expected %d characters, got %d", maxAlertLen, n)
+	}
+}
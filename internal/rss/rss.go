@@ -27,16 +27,18 @@ import (
 	"net/http"
 	"regexp"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/mmcdole/gofeed"
 	"github.com/obsproject/obscommits/internal/config"
 	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/metrics"
 	"github.com/obsproject/obscommits/internal/persist"
+	"github.com/obsproject/obscommits/internal/recovery"
+	"github.com/obsproject/obscommits/internal/sink"
 	"github.com/obsproject/obscommits/internal/tpl"
-	"github.com/sztanpet/sirc"
 	"golang.org/x/net/context"
-	"gopkg.in/sorcix/irc.v1"
 )
 
 var (
@@ -45,12 +47,34 @@ var (
 	forumauthorre  = regexp.MustCompile(`^.+@.+ \((.+)\)$`)
 	seenLinks      = map[[16]byte]int64{}
 	state          *persist.State
+
+	fetches     = metrics.NewCounter("obscommits_rss_fetches_total", "Feed fetches by feed and outcome.", "feed", "outcome")
+	lastSuccess = metrics.NewGauge("obscommits_rss_last_success_timestamp_seconds", "When the feed was last fetched successfully.", "feed")
+	// when the feeds being polled were last fetched successfully, zero if
+	// they were not yet
+	polls = struct {
+		sync.Mutex
+		m map[string]time.Time
+	}{m: map[string]time.Time{}}
 )
 
 type rs struct {
-	cfg config.RSS
-	irc *sirc.IConn
-	tpl *tpl.Tpl
+	forum  *sink.Router
+	mantis *sink.Router
+	tpl    *tpl.Tpl
+
+	mu sync.Mutex
+	// closed to stop the pollers
+	quit chan struct{}
+}
+
+func init() {
+	// the gob file was decoded into the seen links themselves
+	persist.Register("rss", persist.Schema{
+		Gob: []persist.GobFormat{
+			{Version: 1, New: func() interface{} { return &map[[16]byte]int64{} }},
+		},
+	})
 }
 
 type sortableInt64 []int64
@@ -61,28 +85,139 @@ func (a sortableInt64) Less(i, j int) bool { return a[i] < a[j] }
 
 func Init(ctx context.Context) context.Context {
 	var err error
-	state, err = persist.New("rss.state", &seenLinks)
+	state, err = persist.New("rss", &seenLinks)
 	if err != nil {
-		d.F(err.Error())
+		d.F("%v", err)
 	}
 
 	seenLinks = *state.Get().(*map[[16]byte]int64)
 
+	cfg := config.FromContext(ctx).RSS
+	sinks := sink.FromContext(ctx)
 	r := &rs{
-		cfg: config.FromContext(ctx).RSS,
-		irc: sirc.FromContext(ctx),
-		tpl: tpl.FromContext(ctx),
+		forum:  sinks.MustRouter(sink.Routes(cfg.ForumRoutes, cfg.ForumChan)),
+		mantis: sinks.MustRouter(sink.Routes(cfg.MantisRoutes, cfg.MantisChan)),
+		tpl:    tpl.FromContext(ctx),
 	}
 
-	if len(r.cfg.ForumChan) > 0 && len(r.cfg.ForumURL) > 0 {
-		go r.pollRSS()
+	r.tpl.Sample("rss", &gofeed.Item{
+		Title:  "Black screen when capturing a game",
+		Link:   "https://obsproject.com/forum/threads/black-screen.1/",
+		Author: &gofeed.Person{Name: "someone"},
+	})
+	r.tpl.Sample("mantisissue", &gofeed.Item{
+		Title:      "Crash on startup",
+		Link:       "https://obsproject.com/mantis/view.php?id=1",
+		Categories: []string{"OBS Studio"},
+	})
+
+	r.start(cfg)
+
+	reg := sink.FromContext(ctx)
+	config.OnReload(config.Hook{
+		Name: "rss",
+		Check: func(cfg *config.AppConfig) error {
+			if err := reg.Check(cfg, sink.Routes(cfg.RSS.ForumRoutes, cfg.RSS.ForumChan)); err != nil {
+				return err
+			}
+			return reg.Check(cfg, sink.Routes(cfg.RSS.MantisRoutes, cfg.RSS.MantisChan))
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			r.restart(cfg.RSS)
+		},
+	})
+
+	return ctx
+}
+
+// start starts polling the feeds that have somewhere to be announced to
+func (r *rs) start(cfg config.RSS) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.quit = make(chan struct{})
+	var feeds []string
+	if !r.forum.Empty() && len(cfg.ForumURL) > 0 {
+		feeds = append(feeds, "forum")
+		go r.pollRSS(cfg.ForumURL, r.quit)
 	}
 
-	if len(r.cfg.MantisChan) > 0 && len(r.cfg.MantisURL) > 0 {
-		go r.pollMantis()
+	if !r.mantis.Empty() && len(cfg.MantisURL) > 0 {
+		feeds = append(feeds, "mantis")
+		go r.pollMantis(cfg.MantisURL, r.quit)
 	}
+	track(feeds)
+}
 
-	return ctx
+// track replaces the feeds that are being polled
+func track(feeds []string) {
+	polls.Lock()
+	defer polls.Unlock()
+
+	m := map[string]time.Time{}
+	for _, feed := range feeds {
+		m[feed] = polls.m[feed]
+	}
+	polls.m = m
+}
+
+// fetched records the outcome of fetching the feed
+func fetched(feed string, err error) {
+	if err != nil {
+		d.P("RSS fetch error:", feed, err)
+		fetches.Inc(feed, "error")
+		return
+	}
+
+	now := time.Now()
+	fetches.Inc(feed, "ok")
+	lastSuccess.Set(float64(now.Unix()), feed)
+
+	polls.Lock()
+	if _, ok := polls.m[feed]; ok {
+		polls.m[feed] = now
+	}
+	polls.Unlock()
+}
+
+// LastPolls returns when the feeds being polled were last fetched
+// successfully, the time is zero for the ones that were not yet
+func LastPolls() map[string]time.Time {
+	polls.Lock()
+	defer polls.Unlock()
+
+	ret := make(map[string]time.Time, len(polls.m))
+	for feed, t := range polls.m {
+		ret[feed] = t
+	}
+	return ret
+}
+
+// restart stops the pollers and starts them again with the new routes and
+// feeds
+func (r *rs) restart(cfg config.RSS) {
+	r.mu.Lock()
+	close(r.quit)
+	r.mu.Unlock()
+
+	if err := r.forum.Reset(sink.Routes(cfg.ForumRoutes, cfg.ForumChan)); err != nil {
+		d.P("Could not reset the forum routes", err)
+	}
+	if err := r.mantis.Reset(sink.Routes(cfg.MantisRoutes, cfg.MantisChan)); err != nil {
+		d.P("Could not reset the mantis routes", err)
+	}
+
+	r.start(cfg)
+}
+
+// wait waits between polls, returns false if the poller should stop
+func wait(quit chan struct{}) bool {
+	select {
+	case <-time.After(5 * time.Minute):
+		return true
+	case <-quit:
+		return false
+	}
 }
 
 func seenGUID(id string) (ret bool) {
@@ -120,35 +255,39 @@ func seenGUID(id string) (ret bool) {
 	return
 }
 
-func (r *rs) pollMantis() {
+func (r *rs) pollMantis(url string, quit chan struct{}) {
 	fp := gofeed.NewParser()
 
 	for {
-		feed, err := fp.ParseURL(r.cfg.MantisURL)
-		if err != nil {
-			d.P("RSS fetch error:", err)
-			<-time.After(5 * time.Minute)
-			continue
-		}
+		recovery.Run("rss mantis", func() {
+			feed, err := fp.ParseURL(url)
+			fetched("mantis", err)
+			if err == nil {
+				r.mantisRSSHandler(feed)
+			}
+		})
 
-		r.mantisRSSHandler(feed)
-		<-time.After(5 * time.Minute)
+		if !wait(quit) {
+			return
+		}
 	}
 }
 
-func (r *rs) pollRSS() {
+func (r *rs) pollRSS(url string, quit chan struct{}) {
 	fp := gofeed.NewParser()
 
 	for {
-		feed, err := fp.ParseURL(r.cfg.ForumURL)
-		if err != nil {
-			d.P("RSS fetch error:", err)
-			<-time.After(5 * time.Minute)
-			continue
-		}
+		recovery.Run("rss forum", func() {
+			feed, err := fp.ParseURL(url)
+			fetched("forum", err)
+			if err == nil {
+				r.itemHandler(feed)
+			}
+		})
 
-		r.itemHandler(feed)
-		<-time.After(5 * time.Minute)
+		if !wait(quit) {
+			return
+		}
 	}
 }
 
@@ -197,7 +336,7 @@ func (r *rs) itemHandler(feed *gofeed.Feed) {
 		return
 	}
 
-	var items []string
+	var items []sink.Announcement
 	b := bytes.NewBuffer(nil)
 
 	for _, item := range feed.Items {
@@ -217,11 +356,14 @@ func (r *rs) itemHandler(feed *gofeed.Feed) {
 		}
 
 		b.Reset()
-		r.tpl.Execute(b, "rss", item)
-		items = append(items, b.String())
+		if err := r.tpl.Execute(b, "rss", item); err != nil {
+			d.P("Could not render the template", "rss", err)
+			continue
+		}
+		items = append(items, announcement(b.String(), "rss", "Forum", "forum threads", item))
 	}
 
-	go r.writeLines(r.cfg.ForumChan, items)
+	r.forum.Announce(items...)
 }
 
 func (r *rs) mantisRSSHandler(feed *gofeed.Feed) {
@@ -230,7 +372,7 @@ func (r *rs) mantisRSSHandler(feed *gofeed.Feed) {
 		return
 	}
 
-	var items []string
+	var items []sink.Announcement
 	b := bytes.NewBuffer(nil)
 
 	for _, item := range feed.Items {
@@ -244,29 +386,29 @@ func (r *rs) mantisRSSHandler(feed *gofeed.Feed) {
 		}
 
 		b.Reset()
-		r.tpl.Execute(b, "mantisissue", item)
-		items = append(items, b.String())
+		if err := r.tpl.Execute(b, "mantisissue", item); err != nil {
+			d.P("Could not render the template", "mantisissue", err)
+			continue
+		}
+		items = append(items, announcement(b.String(), "mantisissue", "Mantis", "issues", item))
 	}
 
-	go r.writeLines(r.cfg.MantisChan, items)
+	r.mantis.Announce(items...)
 }
 
-func (r *rs) writeLines(ch string, lines []string) {
-	l := len(lines)
-
-	if l == 0 {
-		return
+func announcement(text, template, source, kind string, item *gofeed.Item) sink.Announcement {
+	ret := sink.Announcement{
+		Text:     text,
+		Source:   source,
+		Title:    item.Title,
+		URL:      item.Link,
+		Kind:     kind,
+		Template: template,
+		Data:     item,
 	}
-
-	if l > 5 {
-		lines = lines[:5]
+	if item.Author != nil {
+		ret.Author = item.Author.Name
 	}
 
-	for _, l := range lines {
-		r.irc.Write(&irc.Message{
-			Command:  irc.PRIVMSG,
-			Params:   []string{ch},
-			Trailing: l,
-		})
-	}
+	return ret
 }
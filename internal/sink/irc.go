@@ -0,0 +1,47 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package sink
+
+import (
+	"github.com/obsproject/obscommits/internal/ircconn"
+)
+
+// ircSink queues the announcements as they are for the channel, bursts of
+// the same kind are summarized by the queue
+type ircSink struct {
+	irc ircconn.Conn
+}
+
+func (s *ircSink) Send(target string, anns []Announcement) {
+	// keep the order of the announcements while grouping them by kind
+	for len(anns) > 0 {
+		kind := anns[0].Kind
+		lines := []string{}
+		for len(anns) > 0 && anns[0].Kind == kind {
+			lines = append(lines, anns[0].Text)
+			anns = anns[1:]
+		}
+
+		if kind == "" {
+			kind = "announcements"
+		}
+		s.irc.Queue(ircconn.Low, target, kind, lines...)
+	}
+}
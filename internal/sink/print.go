@@ -0,0 +1,88 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package sink
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/obsproject/obscommits/internal/ircfmt"
+)
+
+// dryRun is where the payloads of the webhooks are written instead of being
+// posted in the dry run mode
+var dryRun io.Writer
+
+// printMu keeps the lines of the sinks printing at the same time apart
+var printMu sync.Mutex
+
+// Printer prints the announcements instead of delivering them, it stands in
+// for the sinks that are not connected in the dry run mode
+type Printer struct {
+	Name string
+	W    io.Writer
+}
+
+func (p *Printer) Send(target string, anns []Announcement) {
+	name := p.Name
+	if target != "" {
+		name += ":" + target
+	}
+
+	printMu.Lock()
+	defer printMu.Unlock()
+	for _, a := range anns {
+		fmt.Fprintf(p.W, "[%s] %s\n", name, ircfmt.ToANSI(a.Text))
+	}
+}
+
+// printTransport prints the requests of a webhook and pretends they were
+// delivered, the url is left out since it is the secret of the webhook
+type printTransport struct {
+	typ string
+	w   io.Writer
+}
+
+func (t *printTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var b []byte
+	if r.Body != nil {
+		b, _ = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+	}
+
+	printMu.Lock()
+	fmt.Fprintf(t.w, "[%s webhook] %s\n", t.typ, b)
+	printMu.Unlock()
+
+	return &http.Response{
+		Status:     "204 No Content",
+		StatusCode: http.StatusNoContent,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
@@ -0,0 +1,384 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+// Package sink is where announcements end up, IRC is one of the sinks,
+// Discord and Slack incoming webhooks are the others. Announcers do not talk
+// to the sinks directly, they send to a Router built from a list of routes
+// in the config
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/tpl"
+	"golang.org/x/net/context"
+)
+
+// Announcement is a single line to announce along with the structured data
+// it was generated from, sinks that can display more than a line of text
+// make use of the fields
+type Announcement struct {
+	// Text is the line as rendered by the template, it can contain IRC
+	// formatting
+	Text string
+	// Source is where the announcement comes from, like "GitHub" or "Forum"
+	Source string
+	Title  string
+	URL    string
+	Author string
+	// Kind is what is being announced in plural, like "commits", it is used
+	// when a burst of announcements is summarized
+	Kind string
+	// Template and Data are what Text was rendered from, Text is rendered
+	// again for routes that have their own version of the template
+	Template string
+	Data     interface{}
+}
+
+// Sink delivers announcements somewhere, the meaning of target depends on the
+// sink, it is the channel for IRC and optional for the others
+type Sink interface {
+	Send(target string, anns []Announcement)
+}
+
+// Flusher is implemented by the sinks that deliver in the background, Flush
+// delivers what is still waiting and stops the sink, it gives up once the
+// context is done
+type Flusher interface {
+	Flush(ctx context.Context)
+}
+
+type route struct {
+	name   string
+	target string
+}
+
+// Router sends announcements to every sink it was configured with, the sinks
+// are looked up by name so that they can be replaced on reload
+type Router struct {
+	reg *Registry
+
+	mu     sync.RWMutex
+	routes []route
+}
+
+// Registry holds every configured sink by name
+type Registry struct {
+	tpl *tpl.Tpl
+
+	mu    sync.RWMutex
+	sinks map[string]Sink
+	// the webhooks created from the config, they are replaced on reload
+	webhooks map[string]*webhook
+}
+
+var contextKey *int
+
+func init() {
+	contextKey = new(int)
+}
+
+// Init creates the sinks from the config, the IRC connection has to be in
+// the context already
+func Init(ctx context.Context) context.Context {
+	r := &Registry{
+		sinks: map[string]Sink{
+			"irc": &ircSink{irc: ircconn.FromContext(ctx)},
+		},
+		webhooks: map[string]*webhook{},
+		tpl:      tpl.FromContext(ctx),
+	}
+	if config.DryRun() {
+		dryRun = os.Stdout
+	}
+
+	if err := r.checkWebhooks(config.FromContext(ctx).Sinks); err != nil {
+		d.F("Sinks: %v", err)
+	}
+	r.applyWebhooks(nil, config.FromContext(ctx).Sinks)
+
+	config.OnReload(config.Hook{
+		Name: "sinks",
+		Check: func(cfg *config.AppConfig) error {
+			return r.checkWebhooks(cfg.Sinks)
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			r.applyWebhooks(old.Sinks, cfg.Sinks)
+		},
+	})
+
+	return context.WithValue(ctx, contextKey, r)
+}
+
+func (r *Registry) checkWebhooks(sinks map[string]config.Sink) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for name, cfg := range sinks {
+		if _, ok := r.sinks[name]; ok && r.webhooks[name] == nil {
+			return fmt.Errorf("the name of the sink %q is taken", name)
+		}
+		if err := checkWebhook(cfg); err != nil {
+			return fmt.Errorf("sink %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyWebhooks replaces the webhooks whose config changed, the configs
+// have to be valid
+func (r *Registry) applyWebhooks(old, sinks map[string]config.Sink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, w := range r.webhooks {
+		if cfg, ok := sinks[name]; !ok || cfg != old[name] {
+			w.close()
+			delete(r.webhooks, name)
+			delete(r.sinks, name)
+		}
+	}
+
+	for name, cfg := range sinks {
+		if _, ok := r.webhooks[name]; ok {
+			continue
+		}
+
+		w, err := newWebhook(cfg)
+		if err != nil {
+			d.P("Could not create the sink", name, err)
+			continue
+		}
+		r.webhooks[name] = w
+		r.sinks[name] = w
+	}
+}
+
+// Add registers a sink under the name
+func (r *Registry) Add(name string, s Sink) {
+	r.mu.Lock()
+	r.sinks[name] = s
+	r.mu.Unlock()
+}
+
+// Flush flushes every sink that delivers in the background, the sinks are
+// removed so that nothing is sent to them afterwards
+func (r *Registry) Flush(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	r.mu.Lock()
+	for name, s := range r.sinks {
+		f, ok := s.(Flusher)
+		if !ok {
+			continue
+		}
+
+		delete(r.sinks, name)
+		delete(r.webhooks, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Flush(ctx)
+		}()
+	}
+	r.mu.Unlock()
+
+	wg.Wait()
+}
+
+// FromContext returns the registry from the context
+func FromContext(ctx context.Context) *Registry {
+	r, _ := ctx.Value(contextKey).(*Registry)
+	return r
+}
+
+// parse parses the routes, known returns whether there is a sink with the
+// name
+func parse(specs []string, known func(name string) bool) ([]route, error) {
+	var ret []route
+	for _, spec := range specs {
+		name, target := spec, ""
+		if pos := strings.Index(spec, ":"); pos >= 0 {
+			name, target = spec[:pos], spec[pos+1:]
+		}
+
+		if !known(name) {
+			return nil, fmt.Errorf("unknown sink %q in route %q", name, spec)
+		}
+		if name == "irc" && target == "" {
+			return nil, fmt.Errorf("the route %q needs a channel", spec)
+		}
+
+		ret = append(ret, route{name: name, target: target})
+	}
+
+	return ret, nil
+}
+
+func (r *Registry) known(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.sinks[name]
+	return ok
+}
+
+// Router returns a router for the routes, a route is the name of a sink and
+// an optional target separated by a colon, like "irc:#obs-dev"
+func (r *Registry) Router(specs []string) (*Router, error) {
+	routes, err := parse(specs, r.known)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Router{reg: r, routes: routes}, nil
+}
+
+// MustRouter is like Router but stops the program if the routes are invalid
+func (r *Registry) MustRouter(specs []string) *Router {
+	ret, err := r.Router(specs)
+	if err != nil {
+		d.F("Invalid routes: %v", err)
+	}
+
+	return ret
+}
+
+// Check checks the routes against the sinks of the config, it is used
+// before a reloaded config is applied
+func (r *Registry) Check(cfg *config.AppConfig, specs []string) error {
+	_, err := parse(specs, func(name string) bool {
+		if _, ok := cfg.Sinks[name]; ok {
+			return true
+		}
+
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		_, ok := r.sinks[name]
+		return ok && r.webhooks[name] == nil
+	})
+
+	return err
+}
+
+// Routes returns the routes to use, falling back to announcing to the IRC
+// channel if no routes were configured
+func Routes(routes []string, channel string) []string {
+	if len(routes) > 0 || channel == "" {
+		return routes
+	}
+
+	return []string{"irc:" + channel}
+}
+
+// Reset replaces the routes of the router
+func (r *Router) Reset(specs []string) error {
+	routes, err := parse(specs, r.reg.known)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.routes = routes
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Empty returns whether the router has nowhere to send announcements to
+func (r *Router) Empty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.routes) == 0
+}
+
+// Announce sends the announcements to every route
+func (r *Router) Announce(anns ...Announcement) {
+	if len(anns) == 0 {
+		return
+	}
+
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+
+	for _, rt := range routes {
+		rendered := r.render(rt, anns)
+
+		// sending does not block, so the lock can be held while doing it, this
+		// way the sink cannot be closed in the meantime by a reload
+		r.reg.mu.RLock()
+		if s, ok := r.reg.sinks[rt.name]; ok {
+			s.Send(rt.target, rendered)
+		} else {
+			d.P("The sink of the route is gone", rt.name)
+		}
+		r.reg.mu.RUnlock()
+	}
+}
+
+// render renders the announcements again with the templates overridden for
+// the target or the sink of the route
+func (r *Router) render(rt route, anns []Announcement) []Announcement {
+	if r.reg.tpl == nil {
+		return anns
+	}
+
+	var scopes []string
+	for _, scope := range []string{rt.target, rt.name} {
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	var ret []Announcement
+	b := bytes.NewBuffer(nil)
+	for i, a := range anns {
+		if a.Template == "" || !r.reg.tpl.Overridden(a.Template, scopes...) {
+			continue
+		}
+
+		if ret == nil {
+			ret = make([]Announcement, len(anns))
+			copy(ret, anns)
+		}
+
+		b.Reset()
+		if err := r.reg.tpl.ExecuteScoped(b, a.Template, scopes, a.Data); err != nil {
+			d.P("Could not render the template", a.Template, rt.name, err)
+			continue
+		}
+		ret[i].Text = b.String()
+	}
+
+	if ret == nil {
+		return anns
+	}
+
+	return ret
+}
@@ -0,0 +1,262 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package sink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"golang.org/x/net/context"
+)
+
+type recorder struct {
+	target string
+	anns   []Announcement
+}
+
+func (r *recorder) Send(target string, anns []Announcement) {
+	r.target = target
+	r.anns = append(r.anns, anns...)
+}
+
+func TestRouter(t *testing.T) {
+	irc, hook := &recorder{}, &recorder{}
+	reg := &Registry{sinks: map[string]Sink{"irc": irc, "discord": hook}}
+
+	if _, err := reg.Router([]string{"slack"}); err == nil {
+		t.Error("expected an error for an unknown sink")
+	}
+	if _, err := reg.Router([]string{"irc"}); err == nil {
+		t.Error("expected an error for an irc route without a channel")
+	}
+
+	r, err := reg.Router(Routes(nil, "#obs-dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Announce(Announcement{Text: "a"})
+	if irc.target != "#obs-dev" || len(irc.anns) != 1 {
+		t.Errorf("the fallback route was not used: %+v", irc)
+	}
+
+	r, err = reg.Router(Routes([]string{"discord", "irc:#obs"}, "#obs-dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Announce(Announcement{Text: "b"})
+	if irc.target != "#obs" || len(hook.anns) != 1 {
+		t.Errorf("the configured routes were not used: %+v %+v", irc, hook)
+	}
+
+	if r, _ := reg.Router(Routes(nil, "")); !r.Empty() {
+		t.Error("expected an empty router")
+	}
+}
+
+func TestReload(t *testing.T) {
+	irc := &recorder{}
+	reg := &Registry{
+		sinks:    map[string]Sink{"irc": irc},
+		webhooks: map[string]*webhook{},
+	}
+
+	old := map[string]config.Sink{
+		"discord": {Type: "discord", URL: "http://localhost/a"},
+	}
+	reg.applyWebhooks(nil, old)
+	r, err := reg.Router([]string{"discord"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.AppConfig{Sinks: map[string]config.Sink{
+		"slack": {Type: "slack", URL: "http://localhost/b"},
+	}}
+	if err := reg.checkWebhooks(map[string]config.Sink{"irc": cfg.Sinks["slack"]}); err == nil {
+		t.Error("expected an error for a webhook named like the irc sink")
+	}
+	if err := reg.checkWebhooks(map[string]config.Sink{"x": {Type: "irc"}}); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+	if err := reg.Check(cfg, []string{"discord"}); err == nil {
+		t.Error("expected an error for a route to a removed webhook")
+	}
+	if err := reg.Check(cfg, []string{"slack", "irc:#obs"}); err != nil {
+		t.Error(err)
+	}
+
+	reg.applyWebhooks(old, cfg.Sinks)
+	if _, ok := reg.sinks["discord"]; ok {
+		t.Error("the removed webhook is still registered")
+	}
+	if err := r.Reset([]string{"slack", "irc:#obs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reg.sinks["slack"] = &recorder{}
+	r.Announce(Announcement{Text: "a"})
+	if irc.target != "#obs" || len(reg.sinks["slack"].(*recorder).anns) != 1 {
+		t.Errorf("the new routes were not used: %+v", irc)
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	var anns []Announcement
+	for i := 0; i < 12; i++ {
+		anns = append(anns, Announcement{
+			Text:   "\x02bold\x02 \x0304red",
+			Title:  strings.Repeat("x", 300),
+			Source: "GitHub",
+		})
+	}
+
+	ps := formatDiscord(config.Sink{Username: "bot"}, "", anns)
+	if len(ps) != 2 {
+		t.Fatalf("expected 2 payloads, got %d", len(ps))
+	}
+
+	p := ps[0].(*discordPayload)
+	if len(p.Embeds) != maxEmbeds || len(ps[1].(*discordPayload).Embeds) != 2 {
+		t.Errorf("the embeds were not split correctly")
+	}
+	e := p.Embeds[0]
+	if e.Description != "**bold** red" {
+		t.Errorf("the formatting was not stripped: %q", e.Description)
+	}
+	if l := len([]rune(e.Title)); l != maxTitleLen {
+		t.Errorf("the title was not truncated, its length is %d", l)
+	}
+	if e.Footer == nil || e.Footer.Text != "GitHub" || e.Author != nil {
+		t.Errorf("unexpected footer or author: %+v", e)
+	}
+}
+
+func TestSlackPost(t *testing.T) {
+	got := make(chan slackPayload, 1)
+	tries := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries == 1 {
+			w.Header().Set("Retry-After", "0.01")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		var p slackPayload
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &p); err != nil {
+			t.Error(err)
+		}
+		got <- p
+	}))
+	defer srv.Close()
+
+	w, err := newWebhook(config.Sink{Type: "slack", URL: srv.URL, Username: "bot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Send("#general", []Announcement{{Text: "\x02a\x02 < b"}, {Text: "c"}})
+
+	select {
+	case p := <-got:
+		if p.Text != "*a* &lt; b\nc" || p.Channel != "#general" || p.Username != "bot" {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not posted")
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	if _, err := newWebhook(config.Sink{Type: "irc", URL: "http://localhost"}); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+	if _, err := newWebhook(config.Sink{Type: "discord"}); err == nil {
+		t.Error("expected an error for a missing url")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var mu sync.Mutex
+	posted := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		posted++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	w, err := newWebhook(config.Sink{Type: "slack", URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &Registry{
+		sinks:    map[string]Sink{"irc": &recorder{}, "slack": w},
+		webhooks: map[string]*webhook{"slack": w},
+	}
+	for i := 0; i < 3; i++ {
+		w.Send("", []Announcement{{Text: "a"}})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reg.Flush(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if posted != 3 {
+		t.Errorf("expected every payload to be posted, got %d", posted)
+	}
+	if _, ok := reg.sinks["slack"]; ok || reg.sinks["irc"] == nil {
+		t.Error("expected only the flushed sink to be removed")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	b := &strings.Builder{}
+	dryRun = b
+	defer func() { dryRun = nil }()
+
+	// nothing listens there, the payload is printed instead
+	w, err := newWebhook(config.Sink{Type: "Slack", URL: "http://127.0.0.1:1/secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Send("#general", []Announcement{{Text: "\x02a\x02"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w.Flush(ctx)
+
+	p := &Printer{Name: "matrix", W: b}
+	p.Send("!room", []Announcement{{Text: "b"}})
+
+	want := "[slack webhook] {\"text\":\"*a*\",\"channel\":\"#general\"}\n[matrix:!room] b\n"
+	if got := b.String(); got != want || strings.Contains(got, "secret") {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,246 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/ircfmt"
+	"golang.org/x/net/context"
+)
+
+const (
+	// how many payloads can wait to be posted before new ones are dropped
+	queueLen = 100
+	// discord allows at most 10 embeds per message
+	maxEmbeds = 10
+	// the maximum length of the title of a discord embed
+	maxTitleLen = 256
+)
+
+// formatter turns announcements into the JSON payloads of a webhook
+type formatter func(cfg config.Sink, target string, anns []Announcement) []interface{}
+
+// webhook posts the announcements to an incoming webhook in the background,
+// the order of the announcements is kept
+type webhook struct {
+	cfg    config.Sink
+	format formatter
+	client *http.Client
+	queue  chan interface{}
+	// closed once the queue is closed and everything in it was posted
+	done chan struct{}
+}
+
+var formatters = map[string]formatter{
+	"discord": formatDiscord,
+	"slack":   formatSlack,
+}
+
+func checkWebhook(cfg config.Sink) error {
+	if _, ok := formatters[strings.ToLower(cfg.Type)]; !ok {
+		return fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+
+	if cfg.URL == "" {
+		return fmt.Errorf("the url of the webhook is empty")
+	}
+
+	return nil
+}
+
+func newWebhook(cfg config.Sink) (*webhook, error) {
+	if err := checkWebhook(cfg); err != nil {
+		return nil, err
+	}
+
+	f := formatters[strings.ToLower(cfg.Type)]
+	w := &webhook{
+		cfg:    cfg,
+		format: f,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan interface{}, queueLen),
+		done:   make(chan struct{}),
+	}
+	if dryRun != nil {
+		w.client.Transport = &printTransport{typ: strings.ToLower(cfg.Type), w: dryRun}
+	}
+	go w.run()
+
+	return w, nil
+}
+
+func (w *webhook) Send(target string, anns []Announcement) {
+	for _, p := range w.format(w.cfg, target, anns) {
+		select {
+		case w.queue <- p:
+		default:
+			d.P("Webhook queue full, dropping announcement", w.cfg.Type)
+		}
+	}
+}
+
+// close stops the webhook once the waiting payloads are posted, Send must not
+// be called afterwards
+func (w *webhook) close() {
+	close(w.queue)
+}
+
+// Flush posts the payloads that are still waiting and stops the webhook
+func (w *webhook) Flush(ctx context.Context) {
+	w.close()
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		d.P("Gave up on posting to the webhook", w.cfg.Type)
+	}
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+
+	for p := range w.queue {
+		b, err := json.Marshal(p)
+		if err != nil {
+			d.P("Could not marshal webhook payload", err)
+			continue
+		}
+
+		// retry once if we got rate limited
+		for try := 0; try < 2; try++ {
+			retry, err := w.post(b)
+			if err != nil {
+				d.P("Webhook error", w.cfg.Type, err)
+			}
+			if retry == 0 {
+				break
+			}
+			time.Sleep(retry)
+		}
+	}
+}
+
+// post sends the payload, if the webhook asks us to retry later, it returns
+// how long to wait before doing so
+func (w *webhook) post(b []byte) (time.Duration, error) {
+	res, err := w.client.Post(w.cfg.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		// both discord and slack send the number of seconds to wait
+		secs, _ := strconv.ParseFloat(res.Header.Get("Retry-After"), 64)
+		if secs <= 0 {
+			secs = 1
+		}
+		return time.Duration(secs * float64(time.Second)), fmt.Errorf("rate limited")
+	}
+	if res.StatusCode >= 300 {
+		return 0, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return 0, nil
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title,omitempty"`
+	URL         string         `json:"url,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Author      *discordAuthor `json:"author,omitempty"`
+	Footer      *discordFooter `json:"footer,omitempty"`
+}
+
+type discordAuthor struct {
+	Name string `json:"name"`
+}
+
+type discordFooter struct {
+	Text string `json:"text"`
+}
+
+type discordPayload struct {
+	Username string         `json:"username,omitempty"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+// formatDiscord turns every announcement into an embed, the target is not
+// used since the channel is decided by the webhook itself
+func formatDiscord(cfg config.Sink, target string, anns []Announcement) []interface{} {
+	var ret []interface{}
+	var p *discordPayload
+	for _, a := range anns {
+		if p == nil || len(p.Embeds) == maxEmbeds {
+			p = &discordPayload{Username: cfg.Username}
+			ret = append(ret, p)
+		}
+
+		e := discordEmbed{
+			URL:         a.URL,
+			Description: ircfmt.ToDiscord(a.Text),
+		}
+		if a.Title != "" {
+			e.Title = ircfmt.Truncate(a.Title, maxTitleLen, "…")
+		}
+		if a.Author != "" {
+			e.Author = &discordAuthor{Name: a.Author}
+		}
+		if a.Source != "" {
+			e.Footer = &discordFooter{Text: a.Source}
+		}
+		p.Embeds = append(p.Embeds, e)
+	}
+
+	return ret
+}
+
+type slackPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+}
+
+// formatSlack sends every announcement as a line of plain text in a single
+// message, the target overrides the channel of the webhook if set
+func formatSlack(cfg config.Sink, target string, anns []Announcement) []interface{} {
+	lines := make([]string, 0, len(anns))
+	for _, a := range anns {
+		lines = append(lines, ircfmt.ToSlack(a.Text))
+	}
+
+	return []interface{}{&slackPayload{
+		Text:     strings.Join(lines, "\n"),
+		Username: cfg.Username,
+		Channel:  target,
+	}}
+}
@@ -0,0 +1,103 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package tpl
+
+import (
+	"strings"
+
+	"github.com/obsproject/obscommits/internal/commands"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/perms"
+)
+
+func registerCommands(t *Tpl) {
+	commands.Register(commands.Command{
+		Name:        ".tpl",
+		Args:        "<show|set|reset|preview> [name[@scope]] [template]",
+		Description: "Manages the announcement templates. show lists the templates or prints the source of one, set overrides it, reset goes back to the default and preview renders it with the last or a sample payload. The scope is a channel or the name of a sink (\"push@#obs-dev\", \"travis@discord-dev\"), without one the override applies everywhere.",
+		Group:       "Administer templates",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			handleTpl(t, r)
+		},
+	})
+}
+
+func handleTpl(t *Tpl, r *commands.Request) {
+	args := strings.SplitN(r.Args, " ", 3)
+	if len(args) == 0 || args[0] == "" {
+		r.Reply("Usage: ", r.Name, " <show|set|reset|preview> [name[@scope]] [template]")
+		return
+	}
+
+	if args[0] == "show" && len(args) == 1 {
+		r.Reply("Templates: ", strings.Join(t.Names(), " "))
+		return
+	}
+	if len(args) < 2 {
+		r.Reply("Usage: ", r.Name, " ", args[0], " <name[@scope]>")
+		return
+	}
+
+	name, scope := ParseKey(args[1])
+	switch args[0] {
+	case "show":
+		src, overridden, err := t.Source(name, scope)
+		if err != nil {
+			r.Reply(err.Error())
+			return
+		}
+		if overridden {
+			r.Reply("Override of ", args[1], ": ", src)
+		} else {
+			r.Reply("Default of ", name, ": ", src)
+		}
+	case "set":
+		if len(args) < 3 {
+			r.Reply("Usage: ", r.Name, " set <name[@scope]> <template>")
+			return
+		}
+		if err := t.Set(name, scope, args[2]); err != nil {
+			r.Reply("Invalid template: ", err.Error())
+			return
+		}
+		d.P("Template override set", args[1], args[2])
+		r.Reply("Template ", args[1], " set successfully")
+	case "reset":
+		found, err := t.Reset(name, scope)
+		if err != nil {
+			d.P("Could not save the templates", err)
+		}
+		if !found {
+			r.Reply(args[1], " is not overridden")
+			return
+		}
+		r.Reply("Template ", args[1], " reset successfully")
+	case "preview":
+		s, err := t.Preview(name, scope)
+		if err != nil {
+			r.Reply("Could not render: ", err.Error())
+			return
+		}
+		r.Reply(s)
+	default:
+		r.Reply("Unknown subcommand, use show, set, reset or preview")
+	}
+}
@@ -21,33 +21,124 @@ package tpl
 
 import (
 	"bytes"
+	"fmt"
 	"html"
+	"io/ioutil"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
 
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/ircfmt"
+	"github.com/obsproject/obscommits/internal/persist"
 	"golang.org/x/net/context"
 )
 
+// Tpl renders the announcements, the default templates come from the
+// templates file if there is one, otherwise from tplStr, they can be
+// overridden at runtime either everywhere or for a single scope, a scope is
+// a channel or the name of a sink
 type Tpl struct {
 	t *template.Template
 	sync.Mutex
+
+	state *persist.State
+	// overrides is the source of the overrides keyed by name@scope, it is
+	// what gets persisted
+	overrides map[string]string
+	compiled  map[string]*template.Template
+	// samples are the payloads the templates are previewed with, the
+	// announcers register one for every template and they are replaced by
+	// the last real payload
+	samples map[string]interface{}
 }
 
 const tplStr = `
-{{define "push"}}[{{.Repo}}|{{.Author}}] {{truncate .Message 200 "..."}} {{.RepoURL}}/commit/{{truncate .ID 7 ""}}{{end}}
-{{define "pushSkipped"}}[{{.Repo}}|{{.Author}}] Skipping announcement of {{.SkipCount}} commits: {{.RepoURL}}/compare/{{truncate .FromID 7 ""}}...{{truncate .ToID 7 ""}}{{end}}
-{{define "pr"}}[GH PR|{{.Author}}] {{.Title | unescape}} {{.URL | unescape}}{{end}}
-{{define "wiki"}}[GH Wiki|{{.Author}}] {{.Page | unescape}} {{.Action}} {{.URL | unescape}}{{if ne .Action "created"}}/_compare/{{truncate .Sha 7 ""}}%5E...{{truncate .Sha 7 ""}}{{end}}{{end}}
-{{define "issues"}}[GH Issue|{{.Author}}] {{.Title | unescape}} {{.URL | unescape}}{{end}}
-{{define "rss"}}[Forum|{{.Author.Name}}] {{truncate .Title 150 "..." | unescape}} {{.Link}}{{end}}
-{{define "mantisissue"}}[M|{{$c := index .Categories 0}}{{$c}}] {{.Title | unescape}} {{.Link}}{{end}}
-{{define "travis"}}{{$needBold := eq .Status "Passed" "Fixed"}}[CI|{{if $needBold}}{{end}}{{.Status}}{{if $needBold}}{{end}}] {{.Repo}}/{{.Branch}} ({{.Comitter}} - {{truncate .Message 200 "..."}}) {{.URL}}{{end}}
+{{define "push"}}[{{.Repo}}|{{bold .Author}}] {{truncate .Message 200 "..."}} {{.RepoURL}}/commit/{{truncate .ID 7 ""}}{{end}}
+{{define "pushSkipped"}}[{{.Repo}}|{{bold .Author}}] Skipping announcement of {{.SkipCount}} commits: {{.RepoURL}}/compare/{{truncate .FromID 7 ""}}...{{truncate .ToID 7 ""}}{{end}}
+{{define "pr"}}[GH PR|{{bold .Author}}] {{.Title | unescape}} {{.URL | unescape}}{{end}}
+{{define "wiki"}}[GH Wiki|{{bold .Author}}] {{.Page | unescape}} {{.Action}} {{.URL | unescape}}{{if ne .Action "created"}}/_compare/{{truncate .Sha 7 ""}}%5E...{{truncate .Sha 7 ""}}{{end}}{{end}}
+{{define "issues"}}[GH Issue|{{bold .Author}}] {{.Title | unescape}} {{.URL | unescape}}{{end}}
+{{define "rss"}}[Forum|{{bold .Author.Name}}] {{truncate .Title 150 "..." | unescape}} {{.Link}}{{end}}
+{{define "mantisissue"}}[M|{{with .Categories}}{{index . 0 | bold}}{{end}}] {{.Title | unescape}} {{.Link}}{{end}}
+{{define "travis"}}[CI|{{status .Status}}] {{.Repo}}/{{.Branch}} ({{.Comitter}} - {{truncate .Message 200 "..."}}) {{.URL}}{{end}}
 `
 
+var funcs = template.FuncMap{
+	"truncate": ircfmt.Truncate,
+	"trim":     strings.TrimSpace,
+	"unescape": html.UnescapeString,
+	// formatting, like {{bold .Author}} or {{.Status | color "red"}}
+	"bold":      func(s string) string { return ircfmt.Wrap(ircfmt.Bold, s) },
+	"italic":    func(s string) string { return ircfmt.Wrap(ircfmt.Italic, s) },
+	"underline": func(s string) string { return ircfmt.Wrap(ircfmt.Underline, s) },
+	"color":     ircfmt.Colorize,
+	"reset":     func() string { return ircfmt.Reset },
+	"status":    ircfmt.Status,
+	"strip":     ircfmt.Strip,
+}
+
+func init() {
+	// the gob file was decoded into the overrides themselves
+	persist.Register("templates", persist.Schema{
+		Gob: []persist.GobFormat{
+			{Version: 1, New: func() interface{} { return &map[string]string{} }},
+		},
+	})
+}
+
 func Init(ctx context.Context) context.Context {
-	t := &Tpl{}
-	t.init()
+	t := &Tpl{
+		compiled: map[string]*template.Template{},
+		samples:  map[string]interface{}{},
+	}
+
+	overrides := map[string]string{}
+	state, err := persist.New("templates", &overrides)
+	if err != nil {
+		d.F("%v", err)
+	}
+	t.state = state
+	t.overrides = *state.Get().(*map[string]string)
+	state.OnRestore(func() {
+		t.Lock()
+		t.compileOverrides()
+		t.Unlock()
+	})
+
+	src, err := source(config.FromContext(ctx).Templates.Path)
+	if err != nil {
+		d.F("Could not read the templates: %v", err)
+	}
+	if err := t.init(src); err != nil {
+		d.F("Could not parse the templates: %v", err)
+	}
+
+	config.OnReload(config.Hook{
+		Name: "templates",
+		Check: func(cfg *config.AppConfig) error {
+			src, err := source(cfg.Templates.Path)
+			if err != nil {
+				return err
+			}
+
+			_, err = parse(src)
+			return err
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			src, err := source(cfg.Templates.Path)
+			if err == nil {
+				err = t.init(src)
+			}
+			if err != nil {
+				d.P("Could not reload the templates", err)
+			}
+		},
+	})
+
+	registerCommands(t)
 
 	return context.WithValue(ctx, "tpl", t)
 }
@@ -56,29 +147,260 @@ func FromContext(ctx context.Context) *Tpl {
 	return ctx.Value("tpl").(*Tpl)
 }
 
-func (t *Tpl) init() {
+// source returns the source of the default templates
+func source(path string) (string, error) {
+	if path == "" {
+		return tplStr, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func parse(src string) (*template.Template, error) {
+	return template.New("main").Funcs(funcs).Parse(src)
+}
+
+// init replaces the default templates and compiles the overrides against
+// them, overrides that no longer compile are ignored
+func (t *Tpl) init(src string) error {
+	n, err := parse(src)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.t = n
+	t.compileOverrides()
+
+	return nil
+}
+
+// compileOverrides compiles every override again, the lock needs to be held
+// by the caller
+func (t *Tpl) compileOverrides() {
+	t.compiled = map[string]*template.Template{}
+	for key, text := range t.overrides {
+		c, err := t.compile(key, text)
+		if err != nil {
+			d.P("Invalid template override, ignoring it", key, err)
+			continue
+		}
+		t.compiled[key] = c
+	}
+}
+
+// Key returns the key of the template for the scope, an empty scope means
+// every scope
+func Key(name, scope string) string {
+	if scope == "" {
+		return name
+	}
+
+	return name + "@" + scope
+}
+
+// ParseKey is the inverse of Key
+func ParseKey(key string) (name, scope string) {
+	if pos := strings.Index(key, "@"); pos >= 0 {
+		return key[:pos], key[pos+1:]
+	}
+
+	return key, ""
+}
+
+// Execute renders the named template, taking the global overrides into
+// account
+func (t *Tpl) Execute(b *bytes.Buffer, name string, data interface{}) error {
 	t.Lock()
 	defer t.Unlock()
 
-	t.t = template.New("main")
-	t.t.Funcs(template.FuncMap{
-		"truncate": func(s string, l int, endstring string) (ret string) {
-			if len(s) > l {
-				ret = s[0:l-len(endstring)] + endstring
-			} else {
-				ret = s
-			}
-			return
-		},
-		"trim":     strings.TrimSpace,
-		"unescape": html.UnescapeString,
-	})
+	if err := t.execute(b, t.lookup(name, nil), name, data); err != nil {
+		return err
+	}
 
-	t.t = template.Must(t.t.Parse(tplStr))
+	t.samples[name] = data
+	return nil
 }
 
-func (t *Tpl) Execute(b *bytes.Buffer, name string, data interface{}) {
+// Overridden returns whether there is an override of the template for one
+// of the scopes
+func (t *Tpl) Overridden(name string, scopes ...string) bool {
 	t.Lock()
-	t.t.ExecuteTemplate(b, name, data)
-	t.Unlock()
+	defer t.Unlock()
+
+	for _, scope := range scopes {
+		if _, ok := t.compiled[Key(name, scope)]; ok && scope != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExecuteScoped renders the named template with the override of the first
+// scope that has one
+func (t *Tpl) ExecuteScoped(b *bytes.Buffer, name string, scopes []string, data interface{}) error {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.execute(b, t.lookup(name, scopes), name, data)
+}
+
+// lookup returns the template set to use for the name, the lock needs to be
+// held by the caller
+func (t *Tpl) lookup(name string, scopes []string) *template.Template {
+	for _, scope := range append(scopes, "") {
+		if c, ok := t.compiled[Key(name, scope)]; ok {
+			return c
+		}
+	}
+
+	return t.t
+}
+
+func (t *Tpl) execute(b *bytes.Buffer, set *template.Template, name string, data interface{}) error {
+	if set.Lookup(name) == nil {
+		return fmt.Errorf("no template named %q", name)
+	}
+
+	return set.ExecuteTemplate(b, name, data)
+}
+
+// compile parses the override into a copy of the default templates, so that
+// it can use the other templates, the lock needs to be held by the caller
+func (t *Tpl) compile(key, text string) (*template.Template, error) {
+	name, _ := ParseKey(key)
+	if t.t.Lookup(name) == nil {
+		return nil, fmt.Errorf("no template named %q", name)
+	}
+
+	c, err := t.t.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.New(name).Parse(text); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Names returns the names of the templates
+func (t *Tpl) Names() []string {
+	t.Lock()
+	defer t.Unlock()
+
+	var ret []string
+	for _, v := range t.t.Templates() {
+		if name := v.Name(); name != "main" {
+			ret = append(ret, name)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// Source returns the source of the template for the scope and whether it is
+// an override
+func (t *Tpl) Source(name, scope string) (string, bool, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if text, ok := t.overrides[Key(name, scope)]; ok {
+		return text, true, nil
+	}
+
+	v := t.t.Lookup(name)
+	if v == nil || v.Tree == nil {
+		return "", false, fmt.Errorf("no template named %q", name)
+	}
+
+	return v.Tree.Root.String(), false, nil
+}
+
+// Set overrides the template for the scope, the template is rendered with the
+// sample payload so that errors are caught before it is used
+func (t *Tpl) Set(name, scope, text string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	key := Key(name, scope)
+	c, err := t.compile(key, text)
+	if err != nil {
+		return err
+	}
+
+	if data, ok := t.samples[name]; ok {
+		if err := c.ExecuteTemplate(ioutil.Discard, name, data); err != nil {
+			return err
+		}
+	}
+
+	t.compiled[key] = c
+	return t.save(func(m map[string]string) { m[key] = text })
+}
+
+// Reset removes the override of the template for the scope, returns false if
+// there was none
+func (t *Tpl) Reset(name, scope string) (bool, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := Key(name, scope)
+	if _, ok := t.overrides[key]; !ok {
+		return false, nil
+	}
+
+	delete(t.compiled, key)
+	return true, t.save(func(m map[string]string) { delete(m, key) })
+}
+
+// save modifies the persisted overrides, the lock needs to be held by the
+// caller
+func (t *Tpl) save(f func(map[string]string)) error {
+	if t.state == nil {
+		f(t.overrides)
+		return nil
+	}
+
+	t.state.Lock()
+	f(t.overrides)
+	t.state.Unlock()
+
+	return t.state.Save()
+}
+
+// Sample registers the payload used to preview the template until a real
+// one comes along
+func (t *Tpl) Sample(name string, data interface{}) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.samples[name]; !ok {
+		t.samples[name] = data
+	}
+}
+
+// Preview renders the template for the scope with the sample payload
+func (t *Tpl) Preview(name, scope string) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	data, ok := t.samples[name]
+	if !ok {
+		return "", fmt.Errorf("no sample payload for %q", name)
+	}
+
+	b := bytes.NewBuffer(nil)
+	err := t.execute(b, t.lookup(name, []string{scope}), name, data)
+	return b.String(), err
 }
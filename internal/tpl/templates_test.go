@@ -0,0 +1,152 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package tpl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+type sample struct {
+	Repo    string
+	Author  string
+	Message string
+	RepoURL string
+	ID      string
+}
+
+func newTestTpl(t *testing.T) *Tpl {
+	ret := &Tpl{
+		overrides: map[string]string{},
+		compiled:  map[string]*template.Template{},
+		samples:   map[string]interface{}{},
+	}
+	if err := ret.init(tplStr); err != nil {
+		t.Fatal(err)
+	}
+	ret.Sample("push", &sample{
+		Repo:    "obs-studio",
+		Author:  "jp9000",
+		Message: "日本語のコミットメッセージ",
+		RepoURL: "https://github.com/obsproject/obs-studio",
+		ID:      "0123456789abcdef",
+	})
+
+	return ret
+}
+
+func render(t *testing.T, tp *Tpl, scopes ...string) string {
+	b := bytes.NewBuffer(nil)
+	if err := tp.ExecuteScoped(b, "push", scopes, tp.samples["push"]); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
+
+func TestExecute(t *testing.T) {
+	tp := newTestTpl(t)
+	b := bytes.NewBuffer(nil)
+	if err := tp.Execute(b, "nosuchtemplate", nil); err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+	if err := tp.Execute(b, "push", struct{}{}); err == nil {
+		t.Error("expected the error of the template to be returned")
+	}
+
+	want := "[obs-studio|\x02jp9000\x02] 日本語のコミットメッセージ https://github.com/obsproject/obs-studio/commit/0123456"
+	if got := render(t, tp); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	tp := newTestTpl(t)
+
+	if err := tp.Set("push", "", "{{.Repo"); err == nil {
+		t.Error("expected a parse error")
+	}
+	if err := tp.Set("push", "", "{{.NoSuchField}}"); err == nil {
+		t.Error("expected the sample payload to catch the error")
+	}
+	if err := tp.Set("nosuchtemplate", "", "text"); err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+
+	if err := tp.Set("push", "", "global {{.Repo}}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Set("push", "#obs-dev", "channel {{.Author}}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Set("push", "discord", "{{template \"pr\" .}}"); err == nil {
+		t.Error("expected the pr template to fail with the push payload")
+	}
+
+	if got := render(t, tp); got != "global obs-studio" {
+		t.Errorf("the global override was not used: %q", got)
+	}
+	if got := render(t, tp, "#obs-dev", "irc"); got != "channel jp9000" {
+		t.Errorf("the scoped override was not used: %q", got)
+	}
+	if !tp.Overridden("push", "discord", "#obs-dev") || tp.Overridden("push", "#obs") {
+		t.Error("Overridden is wrong")
+	}
+
+	src, overridden, err := tp.Source("push", "#obs-dev")
+	if err != nil || !overridden || src != "channel {{.Author}}" {
+		t.Errorf("unexpected source %q %v %v", src, overridden, err)
+	}
+	if s, err := tp.Preview("push", "#obs"); err != nil || s != "global obs-studio" {
+		t.Errorf("unexpected preview %q %v", s, err)
+	}
+
+	if found, _ := tp.Reset("push", ""); !found {
+		t.Error("the global override was not found")
+	}
+	if found, _ := tp.Reset("push", ""); found {
+		t.Error("the global override was reset twice")
+	}
+	if got := render(t, tp, "#obs"); !strings.HasPrefix(got, "[obs-studio|\x02jp9000\x02]") {
+		t.Errorf("the default was not restored: %q", got)
+	}
+	if got := render(t, tp, "#obs-dev"); got != "channel jp9000" {
+		t.Errorf("the scoped override was reset too: %q", got)
+	}
+
+	src, overridden, err = tp.Source("push", "")
+	if err != nil || overridden || !strings.Contains(src, "{{.Repo}}") {
+		t.Errorf("unexpected default source %q %v %v", src, overridden, err)
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	tp := newTestTpl(t)
+	if err := tp.Set("push", "", `{{color "red" .Repo}}{{reset}} {{italic .Author | underline}} {{status "Broken"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "\x0304obs-studio\x03\x0f \x1f\x1djp9000\x1d\x1f \x02\x0304Broken\x03\x02"
+	if got := render(t, tp); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -22,36 +22,86 @@ package travis
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/obsproject/obscommits/internal/config"
 	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/deliveries"
+	"github.com/obsproject/obscommits/internal/hookmux"
+	"github.com/obsproject/obscommits/internal/sink"
 	"github.com/obsproject/obscommits/internal/tpl"
-	"github.com/sztanpet/sirc"
 	"golang.org/x/net/context"
-	"gopkg.in/sorcix/irc.v1"
 )
 
 type tr struct {
 	cfg config.Travis
-	irc *sirc.IConn
+	out *sink.Router
 	tpl *tpl.Tpl
 }
 
+// buildData is what the template is rendered with
+type buildData struct {
+	Comitter string
+	Message  string
+	URL      string
+	Status   string
+	Repo     string
+	Branch   string
+}
+
+// buildPayload is the part of the payload of a build that is used
+type buildPayload struct {
+	Type       string
+	Status     string `json:"status_message"`
+	Branch     string
+	Message    string
+	Name       string `json:"committer_name"`
+	Email      string `json:"comitter_email"`
+	URL        string `json:"build_url"`
+	Repository struct {
+		Name string
+	}
+}
+
 func Init(ctx context.Context) context.Context {
 	cfg := config.FromContext(ctx).Travis
 	tr := &tr{
 		cfg: cfg,
-		irc: sirc.FromContext(ctx),
+		out: sink.FromContext(ctx).MustRouter(sink.Routes(cfg.Routes, cfg.AnnounceChan)),
 		tpl: tpl.FromContext(ctx),
 	}
+	tr.tpl.Sample("travis", &buildData{
+		Comitter: "jp9000",
+		Message:  "libobs: Fix a crash when the source is removed",
+		URL:      "https://travis-ci.org/obsproject/obs-studio/builds/1",
+		Status:   "Passed",
+		Repo:     "obs-studio",
+		Branch:   "master",
+	})
+
+	reg := sink.FromContext(ctx)
+	config.OnReload(config.Hook{
+		Name: "travis",
+		Check: func(cfg *config.AppConfig) error {
+			return reg.Check(cfg, sink.Routes(cfg.Travis.Routes, cfg.Travis.AnnounceChan))
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			if err := tr.out.Reset(sink.Routes(cfg.Travis.Routes, cfg.Travis.AnnounceChan)); err != nil {
+				d.P("Could not reset the travis routes", err)
+			}
+			hookmux.Move("travis", cfg.Travis.HookPath)
+		},
+	})
 
-	http.HandleFunc(tr.cfg.HookPath, tr.handler)
+	hookmux.Handle("travis", tr.cfg.HookPath, deliveries.Handler("travis", tr.out, tr.process, validate))
 	return ctx
 }
 
-func (s *tr) handler(w http.ResponseWriter, r *http.Request) {
+// process returns the announcement of the delivery, it is sent by the
+// delivery log
+func (s *tr) process(r *http.Request) (string, []sink.Announcement, error) {
 	typ := &struct {
 		Type string
 	}{}
@@ -60,11 +110,17 @@ func (s *tr) handler(w http.ResponseWriter, r *http.Request) {
 
 	switch typ.Type {
 	case "push", "pull_request":
-		s.handleType(r, typ.Type)
-		return
+		anns, err := s.handleType(r, typ.Type)
+		return typ.Type, anns, err
 	}
 
 	d.D("unknown type", typ.Type)
+	return typ.Type, nil, deliveries.ErrIgnored
+}
+
+// validate decodes the payload of the build
+func validate(h http.Header, payload []byte) error {
+	return json.Unmarshal(payload, &buildPayload{})
 }
 
 func parsePayload(r *http.Request, data interface{}) error {
@@ -77,23 +133,11 @@ func parsePayload(r *http.Request, data interface{}) error {
 	return json.Unmarshal([]byte(payload), &data)
 }
 
-func (s *tr) handleType(r *http.Request, typ string) {
-	var data struct {
-		Status     string `json:"status_message"`
-		Branch     string
-		Message    string
-		Name       string `json:"committer_name"`
-		Email      string `json:"comitter_email"`
-		URL        string `json:"build_url"`
-		Repository struct {
-			Name string
-		}
-	}
+func (s *tr) handleType(r *http.Request, typ string) ([]sink.Announcement, error) {
+	var data buildPayload
 
-	err := parsePayload(r, &data)
-	if err != nil {
-		d.P("Error unmarshaling json:", err)
-		return
+	if err := parsePayload(r, &data); err != nil {
+		return nil, err
 	}
 
 	pos := strings.LastIndex(data.Email, "@")
@@ -110,30 +154,26 @@ func (s *tr) handleType(r *http.Request, typ string) {
 	message = strings.TrimSpace(message)
 
 	b := bytes.NewBuffer(nil)
-	s.tpl.Execute(b, "travis", &struct {
-		Comitter string
-		Message  string
-		URL      string
-		Status   string
-		Repo     string
-		Branch   string
-	}{
+	tdata := &buildData{
 		Comitter: comitter,
 		Message:  message,
 		URL:      data.URL,
 		Status:   data.Status,
 		Repo:     data.Repository.Name,
 		Branch:   data.Branch,
-	})
-
-	s.writeLine(b.String())
-}
-
-func (s *tr) writeLine(line string) {
-	m := &irc.Message{
-		Command:  irc.PRIVMSG,
-		Params:   []string{s.cfg.AnnounceChan},
-		Trailing: line,
 	}
-	s.irc.Write(m)
+	if err := s.tpl.Execute(b, "travis", tdata); err != nil {
+		return nil, fmt.Errorf("could not render the template travis: %v", err)
+	}
+
+	return []sink.Announcement{{
+		Text:     b.String(),
+		Source:   "CI " + data.Status,
+		Title:    data.Repository.Name + "/" + data.Branch + ": " + message,
+		URL:      data.URL,
+		Author:   comitter,
+		Kind:     "builds",
+		Template: "travis",
+		Data:     tdata,
+	}}, nil
 }
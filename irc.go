@@ -1,133 +1,231 @@
 package main
 
 import (
-	"archive/zip"
-	"encoding/base64"
-	"io"
-	"math/rand"
-	"net/http"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"os"
-	"regexp"
+	"reflect"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/obsproject/obscommits/internal/accounts"
 	"github.com/obsproject/obscommits/internal/analyzer"
+	"github.com/obsproject/obscommits/internal/audit"
+	"github.com/obsproject/obscommits/internal/commands"
 	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/console"
 	"github.com/obsproject/obscommits/internal/debug"
 	"github.com/obsproject/obscommits/internal/factoids"
-	"github.com/obsproject/obscommits/internal/persist"
-	"github.com/sztanpet/sirc"
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/perms"
+	"github.com/obsproject/obscommits/internal/recovery"
 	"golang.org/x/net/context"
 	"gopkg.in/sorcix/irc.v1"
 )
 
-var (
-	adminState *persist.State
-	admins     map[string]struct{}
-	adminRE    = regexp.MustCompile(`^\.(addadmin|deladmin|raw|downloadstate)(?:\s+(.*))?$`)
-	zippathRE  = regexp.MustCompile(`^[A-Za-z0-9]+$`)
-	downloads  = stateDownload{
-		m: map[string]struct{}{},
-	}
-)
+var accountTracker = accounts.NewTracker()
 
-type stateDownload struct {
-	mu sync.Mutex
-	m  map[string]struct{}
-}
+// how long the audit log waits for a command to reply
+const auditTimeout = time.Minute
 
-func (s *stateDownload) pathValid(path string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func initIRC(ctx context.Context) context.Context {
+	registerCommands(ctx)
 
-	if _, ok := s.m[path]; ok {
-		return true
+	tcfg := config.FromContext(ctx)
+	ircconn.DebuggingEnabled = tcfg.Debug.Debug
+	if config.DryRun() {
+		dialIRC = newConsole(tcfg).Dial
+	}
+	cfg, err := ircConfig(tcfg)
+	if err != nil {
+		d.F("%v", err)
 	}
 
-	return false
-}
+	c := ircconn.Init(cfg, func(c *ircconn.IConn, m *ircconn.Message) bool {
+		// a panic here would stop reading from the server
+		defer recovery.Recover("irc " + m.Command)
+		return handleIRC(ctx, c, m)
+	})
+
+	config.OnReload(config.Hook{
+		Name: "irc",
+		Check: func(cfg *config.AppConfig) error {
+			_, err := ircConfig(cfg)
+			return err
+		},
+		Apply: func(old, cfg *config.AppConfig) {
+			ircconn.DebuggingEnabled = cfg.Debug.Debug
+			reconfigureIRC(c, old, cfg)
+		},
+	})
 
-func (s *stateDownload) addPath(path string) {
-	s.mu.Lock()
-	s.m[path] = struct{}{}
-	s.mu.Unlock()
+	return c.ToContext(ctx)
 }
 
-func (s *stateDownload) delPath(path string) {
-	s.mu.Lock()
-	delete(s.m, path)
-	s.mu.Unlock()
+// dialIRC connects to what the bot talks to instead of the IRC server, like
+// the console in the dry run mode or the server of the tests
+var dialIRC func() (net.Conn, error)
+
+// newConsole says the lines of stdin in the first channel, logged in as the
+// first superadmin, so that every command can be tried
+func newConsole(tcfg *config.AppConfig) *console.Server {
+	channel, account := "#console", ""
+	if len(tcfg.IRC.Channels) > 0 {
+		channel = tcfg.IRC.Channels[0]
+	}
+	if len(tcfg.IRC.SuperAdmins) > 0 {
+		account = tcfg.IRC.SuperAdmins[0]
+	}
+
+	return console.New(os.Stdin, os.Stdout, channel, account)
 }
 
-func initIRC(ctx context.Context) context.Context {
-	adminRE.Longest()
+// ircConfig returns the settings of the connection from the config
+func ircConfig(tcfg *config.AppConfig) (ircconn.Config, error) {
+	cfg := ircconn.Config{
+		Addr:             tcfg.IRC.Addr,
+		Nick:             tcfg.IRC.Nick,
+		User:             tcfg.IRC.Ident,
+		Password:         tcfg.IRC.Password,
+		RealName:         tcfg.Website.BaseURL,
+		SASLMech:         tcfg.IRC.SASLMech,
+		SASLUser:         tcfg.IRC.SASLUser,
+		SASLPassword:     tcfg.IRC.SASLPassword,
+		Services:         tcfg.IRC.Services,
+		ServicesUser:     tcfg.IRC.ServicesUser,
+		ServicesPassword: tcfg.IRC.ServicesPassword,
+		Caps:             accounts.Caps,
+	}
 
-	// handle state downloading
-	http.HandleFunc("/state/", func(w http.ResponseWriter, r *http.Request) {
-		if len(r.URL.Path) < len("/state/")+10 {
-			http.NotFound(w, r)
-			return
-		}
-		zippath := r.URL.Path[len("/state/"):]
-		if zippathRE.MatchString(zippath) == false || downloads.pathValid(zippath) == false {
-			http.NotFound(w, r)
-			return
+	// nothing to log in to, the secrets are not printed either
+	if dialIRC != nil {
+		cfg.Password, cfg.SASLMech, cfg.Services = "", "", ""
+		cfg.Dial = dialIRC
+		return cfg, nil
+	}
+
+	if tcfg.IRC.TLS {
+		cfg.TLS = &tls.Config{InsecureSkipVerify: tcfg.IRC.TLSInsecure}
+		if tcfg.IRC.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(tcfg.IRC.TLSCert, tcfg.IRC.TLSKey)
+			if err != nil {
+				return cfg, fmt.Errorf("unable to load the IRC client certificate: %v", err)
+			}
+			cfg.TLS.Certificates = []tls.Certificate{cert}
 		}
+	}
+
+	return cfg, nil
+}
 
-		f, err := os.Open(zippath)
+// reconfigureIRC reconnects if the settings of the connection changed,
+// otherwise it joins the new channels and parts the removed ones
+func reconfigureIRC(c *ircconn.IConn, old, cfg *config.AppConfig) {
+	o, n := old.IRC, cfg.IRC
+	o.Channels, n.Channels = nil, nil
+	o.SuperAdmins, n.SuperAdmins = nil, nil
+	o.QuitMessage, n.QuitMessage = "", ""
+	if !reflect.DeepEqual(o, n) || old.Website.BaseURL != cfg.Website.BaseURL {
+		ncfg, err := ircConfig(cfg)
 		if err != nil {
-			http.NotFound(w, r)
+			d.P("Could not reconfigure the IRC connection", err)
 			return
 		}
 
-		// cleanup after
-		defer (func() {
-			f.Close()
-			downloads.delPath(zippath)
-			_ = os.Remove(zippath)
-		})()
+		// the channels are joined once connected
+		c.Reconfigure(ncfg)
+		return
+	}
 
-		w.Header().Add("Content-Disposition", "attachment; filename=\"obscommits-backup.zip\"")
-		http.ServeContent(w, r, "obscommits-backup.zip", time.Now(), f)
-	})
+	for _, ch := range cfg.IRC.Channels {
+		if !hasChannel(old.IRC.Channels, ch) {
+			c.Write(&irc.Message{Command: irc.JOIN, Params: []string{ch}})
+		}
+	}
+	for _, ch := range old.IRC.Channels {
+		if !hasChannel(cfg.IRC.Channels, ch) {
+			c.Write(&irc.Message{Command: irc.PART, Params: []string{ch}})
+		}
+	}
+}
 
-	var err error
-	adminState, err = persist.New("admins.state", &map[string]struct{}{
-		"melkor":                       struct{}{},
-		"melkor.lan":                   struct{}{},
-		"sztanpet.users.quakenet.org":  struct{}{},
-		"R1CH.users.quakenet.org":      struct{}{},
-		"Jim.users.quakenet.org":       struct{}{},
-		"Warchamp7.users.quakenet.org": struct{}{},
-		"hwd.users.quakenet.org":       struct{}{},
-		"paibox.users.quakenet.org":    struct{}{},
-		"ThoNohT.users.quakenet.org":   struct{}{},
-		"dodgepong.users.quakenet.org": struct{}{},
-		"Sapiens.users.quakenet.org":   struct{}{},
-	})
-	if err != nil {
-		d.F(err.Error())
+func hasChannel(channels []string, channel string) bool {
+	for _, ch := range channels {
+		if strings.EqualFold(ch, channel) {
+			return true
+		}
 	}
 
-	admins = *adminState.Get().(*map[string]struct{})
+	return false
+}
 
-	tcfg := config.FromContext(ctx)
-	sirc.DebuggingEnabled = tcfg.Debug.Debug
-	cfg := sirc.Config{
-		Addr:     tcfg.IRC.Addr,
-		Nick:     tcfg.IRC.Nick,
-		Password: tcfg.IRC.Password,
-		RealName: tcfg.Website.BaseURL,
-	}
-	c := sirc.Init(cfg, func(c *sirc.IConn, m *irc.Message) bool {
-		return handleIRC(ctx, c, m)
+func registerCommands(ctx context.Context) {
+	commands.Register(commands.Command{
+		Name:        "!help",
+		Args:        "[command]",
+		Description: "Lists the commands, or describes the given command.",
+		Group:       "General",
+		Handler: func(r *commands.Request) {
+			handleHelp(ctx, r)
+		},
+	})
+	commands.Register(commands.Command{
+		Name:        ".grant",
+		Args:        "<role> <account> [#channel]",
+		Description: "Grants the role to the given services account (\"Jim\"), prefix it with host: to match a host instead (\"host:static.example.com\"). With a channel the role only applies to commands sent in that channel. Moderators can grant factoid-editor, only owners can grant moderator and owner, a role in a channel only allows granting in that channel.",
+		Group:       "Administer roles",
+		Role:        perms.Moderator,
+		Handler:     handleGrant,
+	})
+	commands.Register(commands.Command{
+		Name:        ".revoke",
+		Args:        "<role> <account> [#channel]",
+		Description: "Revokes a role that was granted with the same arguments.",
+		Group:       "Administer roles",
+		Role:        perms.Moderator,
+		Handler:     handleGrant,
+	})
+	commands.Register(commands.Command{
+		Name:        ".roles",
+		Args:        "[account]",
+		Description: "Lists the roles of the given account or host, or everyone if omitted.",
+		Group:       "Administer roles",
+		Role:        perms.Moderator,
+		Handler:     handleRoles,
+	})
+	commands.Register(commands.Command{
+		Name:        ".raw",
+		Args:        "<irc-protocol>",
+		Description: "Send everything after the command as-is to the IRC server. Example: \".raw PRIVMSG #obsproject :needs the colons so that space-separated things are not seen as arguments\"",
+		Group:       "Raw irc protocol access",
+		Role:        perms.SuperAdmin,
+		Handler:     handleRaw,
+	})
+	commands.Register(commands.Command{
+		Name:        ".loglevel",
+		Args:        "[subsystem|default] [debug|info|warn|error|reset]",
+		Description: "Lists the log levels of the subsystems or changes the level of one until the bot restarts, reset goes back to the level in the config. The subsystems are the parts of the bot, like github or ircconn.",
+		Group:       "Logging",
+		Role:        perms.Owner,
+		Handler:     handleLoglevel,
+	})
+	commands.Register(commands.Command{
+		Name:        ".reload",
+		Description: "Reads the config file again and applies it without restarting, nothing changes if the new config is invalid. Some settings, like the address of the website, still need a restart.",
+		Group:       "Reload the config",
+		Role:        perms.Owner,
+		Handler: func(r *commands.Request) {
+			handleReload(ctx, r)
+		},
 	})
-
-	return c.ToContext(ctx)
 }
 
-func handleIRC(ctx context.Context, c *sirc.IConn, m *irc.Message) bool {
+func handleIRC(ctx context.Context, c ircconn.Conn, m *ircconn.Message) bool {
+	if accountTracker.Observe(c, m) {
+		return true
+	}
+
 	if m.Command == irc.RPL_WELCOME {
 		cfg := config.FromContext(ctx).IRC
 		for _, ch := range cfg.Channels {
@@ -141,6 +239,9 @@ func handleIRC(ctx context.Context, c *sirc.IConn, m *irc.Message) bool {
 		return false
 	}
 
+	if dispatch(c, m) {
+		return true
+	}
 	if factoids.Handle(c, m) == true {
 		return true
 	}
@@ -148,130 +249,262 @@ func handleIRC(ctx context.Context, c *sirc.IConn, m *irc.Message) bool {
 		return true
 	}
 
-	if m.Prefix != nil && len(m.Prefix.Host) > 0 {
-		adminState.Lock()
-		_, admin := admins[m.Prefix.Host]
-		adminState.Unlock()
-		if !admin {
-			return true
+	return false
+}
+
+// dispatch runs the registered command the message invokes, if the command
+// needs a role, it only runs after the account of the sender is known
+func dispatch(c ircconn.Conn, m *ircconn.Message) bool {
+	cmd, args, ok := commands.Match(m.Trailing)
+	if !ok || m.Prefix == nil {
+		return false
+	}
+
+	r := &commands.Request{
+		Conn: c,
+		Msg:  m,
+		Name: cmd.Name,
+		Args: args,
+	}
+	if cmd.Role == perms.None {
+		cmd.Handler(r)
+		return true
+	}
+
+	if len(m.Prefix.Host) == 0 {
+		return true
+	}
+
+	// the account might only be known after asking the server, so the
+	// command is handled once the lookup finishes
+	accountTracker.Resolve(c, m, func(account string) {
+		id := perms.Identity{
+			Account: account,
+			Host:    m.Prefix.Host,
 		}
-		if factoids.HandleAdmin(c, m) {
-			return true
+		if t := c.Target(m); strings.HasPrefix(t, "#") {
+			id.Channel = t
 		}
 
-		if handleAdmin(ctx, c, m) {
-			return true
+		e := audit.Entry{
+			Time:    time.Now(),
+			Nick:    m.Prefix.Name,
+			Host:    m.Prefix.Host,
+			Account: account,
+			Channel: id.Channel,
+			Command: cmd.Name,
+			Args:    redact(cmd.Name, args),
+		}
+		r.Done = func(outcome string) {
+			e.Outcome = outcome
+			audit.Record(e)
 		}
-	}
 
-	return false
-}
+		// people without any role do not even get an error message, the
+		// attempt is still recorded
+		r.ID = id
+		r.Role = perms.RoleOf(id)
+		if r.Role == perms.None {
+			r.Finish("denied")
+			return
+		}
+		if r.Role < cmd.Role {
+			r.Reply("You need the ", cmd.Role.String(), " role for that")
+			return
+		}
 
-func handleAdmin(ctx context.Context, c *sirc.IConn, m *irc.Message) bool {
-	matches := adminRE.FindStringSubmatch(m.Trailing)
-	d.P(matches, m)
-	if len(matches) == 0 {
-		return false
-	}
-	adminState.Lock()
-	// lifo defer order
-	defer adminState.Save()
-	defer adminState.Unlock()
-
-	host := strings.TrimSpace(matches[2])
-	switch matches[1] {
-	case "addadmin":
-		admins[host] = struct{}{}
-		c.Notice(m, "Added host successfully")
-	case "deladmin":
-		delete(admins, host)
-		c.Notice(m, "Removed host successfully")
-	case "raw":
-		nm := irc.ParseMessage(matches[2])
-		if nm == nil {
-			c.Notice(m, "Could not parse, are you sure you know the irc protocol?")
-		} else {
-			go c.Write(nm)
+		d.P(cmd.Name, m.Prefix, e.Args)
+		if !recovery.Run(cmd.Name, func() { cmd.Handler(r) }) {
+			r.Finish("panicked")
+			r.Reply("Something went wrong, the admins were notified")
+			return
 		}
-	case "downloadstate":
-		// generate random filename
-		r := rand.New(rand.NewSource(time.Now().UnixNano()))
-		u := make([]byte, 32)
-		_, _ = r.Read(u)
-
-		// just save it into the current working directory for now
-		zippath := strings.Map(func(r rune) rune {
-			if strings.IndexRune("+/=", r) < 0 {
-				return r
-			}
-			return -1
-		}, base64.StdEncoding.EncodeToString(u))
+		// the commands that run in the background reply later, the ones that
+		// never reply are recorded after a while
+		time.AfterFunc(auditTimeout, func() {
+			r.Finish("no reply")
+		})
+	})
+
+	return true
+}
 
-		// currently the state is contained in these files
-		paths := []string{"admins.state", "factoids.state", "rss.state", "settings.cfg"}
+func handleHelp(ctx context.Context, r *commands.Request) {
+	url := config.FromContext(ctx).Website.BaseURL + "/#command-help"
 
-		err := generateZip(zippath, paths)
-		if err != nil {
-			c.Notice(m, "Error while generating zip: "+err.Error())
-			return true
+	if name := strings.TrimSpace(r.Args); name != "" {
+		cmd, ok := commands.Lookup(name)
+		if !ok {
+			r.Reply("No such command, see ", url)
+			return
 		}
 
-		downloads.addPath(zippath)
-		go (func() {
-			<-time.After(5 * time.Minute)
-			downloads.delPath(zippath)
-			_ = os.Remove(zippath)
-		})()
+		r.Reply(cmd.Usage())
+		return
+	}
 
-		url := config.FromContext(ctx).Website.BaseURL + "/state/" + zippath
-		c.Notice(m, "Your one-time use URL (expiring in 5 minutes) is: "+url)
+	all := commands.All()
+	names := make([]string, 0, len(all))
+	for _, cmd := range all {
+		names = append(names, cmd.Name)
 	}
+	r.Reply("Commands: ", strings.Join(names, " "), " - !<factoid> [nick] prints a factoid, more at ", url)
+}
 
-	return true
+func handleGrant(r *commands.Request) {
+	// <role> <account|host:host> [#channel]
+	args := strings.Fields(r.Args)
+	if len(args) < 2 || len(args) > 3 {
+		r.Reply("Usage: ", r.Name, " <role> <account|host:host> [#channel]")
+		return
+	}
+
+	role, ok := perms.ParseRole(args[0])
+	if !ok {
+		r.Reply("Unknown role, known roles: factoid-editor, moderator, owner")
+		return
+	}
+	var channel string
+	if len(args) == 3 {
+		channel = args[2]
+	}
+
+	// a role in the channel the command was sent in does not allow granting
+	// roles everywhere or in other channels
+	if !perms.CanGrantIn(r.ID, role, channel) {
+		if channel == "" {
+			r.Reply("You are not allowed to ", r.Name[1:], " the ", role.String(), " role everywhere")
+		} else {
+			r.Reply("You are not allowed to ", r.Name[1:], " the ", role.String(), " role in ", channel)
+		}
+		return
+	}
+
+	if r.Name == ".grant" {
+		perms.Give(args[1], role, channel)
+		r.Reply("Granted ", role.String(), " to ", args[1], " successfully")
+	} else if perms.Take(args[1], role, channel) {
+		r.Reply("Revoked ", role.String(), " from ", args[1], " successfully")
+	} else {
+		r.Reply(args[1], " does not have that role")
+	}
 }
 
-// based on https://golangcode.com/create-zip-files-in-go/
-func generateZip(zippath string, paths []string) error {
-	zf, err := os.Create(zippath)
-	if err != nil {
-		return err
+func handleRoles(r *commands.Request) {
+	lines := perms.Describe(strings.TrimSpace(r.Args))
+	if len(lines) == 0 {
+		r.Reply("No roles found")
+	}
+	for _, line := range lines {
+		r.Reply(line)
 	}
+}
 
-	defer zf.Close()
+// the raw commands whose arguments are secrets
+var secretCommands = map[string]bool{
+	"PASS":         true,
+	"AUTHENTICATE": true,
+	"NICKSERV":     true,
+	"NS":           true,
+}
 
-	zw := zip.NewWriter(zf)
-	defer zw.Close()
+// the services whose private messages are secrets, like the QuakeNet login
+// sent to Q@CServe.quakenet.org
+var secretTargets = map[string]bool{
+	"Q":        true,
+	"NICKSERV": true,
+}
 
-	for _, path := range paths {
-		f, err := os.Open(path)
-		if err != nil {
-			return err
+// redact hides the secrets in the arguments of .raw, so that they are not
+// logged or mirrored
+func redact(name, args string) string {
+	if name != ".raw" {
+		return args
+	}
+
+	m := irc.ParseMessage(args)
+	if m == nil {
+		return args
+	}
+	cmd := strings.ToUpper(m.Command)
+	if secretCommands[cmd] {
+		return m.Command + " [redacted]"
+	}
+	if cmd == irc.PRIVMSG && len(m.Params) > 0 {
+		// services can be addressed as NickServ@services.host too
+		target := strings.SplitN(m.Params[0], "@", 2)[0]
+		if secretTargets[strings.ToUpper(target)] {
+			return m.Command + " " + m.Params[0] + " [redacted]"
 		}
+	}
+	return args
+}
 
-		defer f.Close()
+func handleRaw(r *commands.Request) {
+	nm := irc.ParseMessage(r.Args)
+	if nm == nil {
+		r.Reply("Could not parse, are you sure you know the irc protocol?")
+		return
+	}
 
-		i, err := f.Stat()
-		if err != nil {
-			return err
-		}
+	r.Conn.Send(ircconn.High, nm)
+	r.Finish("sent")
+}
 
-		h, err := zip.FileInfoHeader(i)
-		if err != nil {
-			return err
+func handleLoglevel(r *commands.Request) {
+	args := strings.Fields(r.Args)
+	switch len(args) {
+	case 0:
+		levels := []string{"default=" + d.LevelOf("").String()}
+		for _, sub := range d.Subsystems() {
+			levels = append(levels, sub+"="+d.LevelOf(sub).String())
 		}
+		r.Reply("Log levels: ", strings.Join(levels, " "))
+		return
+	case 2:
+	default:
+		r.Reply("Usage: ", r.Name, " <subsystem|default> <debug|info|warn|error|reset>")
+		return
+	}
 
-		h.Method = zip.Deflate
-		w, err := zw.CreateHeader(h)
-		if err != nil {
-			return err
+	sub := args[0]
+	if sub == "default" {
+		sub = ""
+	}
+	if args[1] == "reset" {
+		if sub == "" {
+			r.Reply("The default level is reset with .reload")
+			return
 		}
+		d.ResetLevel(sub)
+		r.Reply("The level of ", args[0], " is ", d.LevelOf(sub).String(), " again")
+		return
+	}
 
-		// from the file into the zip
-		_, err = io.Copy(w, f)
-		if err != nil {
-			return err
-		}
+	level, ok := d.ParseLevel(args[1])
+	if !ok {
+		r.Reply("Unknown level, known levels: debug, info, warn, error")
+		return
+	}
+	d.SetLevel(sub, level)
+	r.Reply("Set the level of ", args[0], " to ", level.String())
+}
+
+func handleReload(ctx context.Context, r *commands.Request) {
+	restart, err := config.Reload(ctx)
+	if verr, ok := err.(config.ValidationError); ok {
+		r.Reply("The config is invalid, nothing was changed: ", strings.Join(verr, "; "))
+		return
+	}
+	if err != nil {
+		r.Reply("Could not reload the config, nothing was changed: ", err.Error())
+		return
+	}
+
+	if len(restart) > 0 {
+		r.Reply("Reloaded the config, these settings need a restart: ", strings.Join(restart, ", "))
+		return
 	}
 
-	return nil
+	r.Reply("Reloaded the config")
 }
@@ -0,0 +1,314 @@
+/***
+  This file is part of obscommits.
+
+  Copyright (c) 2015 Peter Sztan <sztanpet@gmail.com>
+
+  obscommits is free software; you can redistribute it and/or modify it
+  under the terms of the GNU Lesser General Public License as published by
+  the Free Software Foundation; either version 3 of the License, or
+  (at your option) any later version.
+
+  obscommits is distributed in the hope that it will be useful, but
+  WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+  Lesser General Public License for more details.
+
+  You should have received a copy of the GNU Lesser General Public License
+  along with obscommits; If not, see <http://www.gnu.org/licenses/>.
+***/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/obsproject/obscommits/internal/audit"
+	"github.com/obsproject/obscommits/internal/config"
+	"github.com/obsproject/obscommits/internal/deliveries"
+	"github.com/obsproject/obscommits/internal/factoids"
+	"github.com/obsproject/obscommits/internal/fakeirc"
+	"github.com/obsproject/obscommits/internal/github"
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/perms"
+	"github.com/obsproject/obscommits/internal/persist"
+	"github.com/obsproject/obscommits/internal/recovery"
+	"github.com/obsproject/obscommits/internal/sink"
+	"github.com/obsproject/obscommits/internal/tpl"
+	"golang.org/x/net/context"
+	"gopkg.in/sorcix/irc.v1"
+)
+
+// the bot of the tests, connected to the server, with its files in a
+// temporary directory and the sample config
+var (
+	server  *fakeirc.Server
+	testCtx context.Context
+)
+
+// how long the bot has to answer
+const timeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := ioutil.TempDir("", "obscommits")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := 1
+	if err := startBot(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		code = m.Run()
+		stopBot()
+	}
+
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startBot starts the parts of the bot that IRC and the webhooks need, the
+// same way main does
+func startBot(dir string) error {
+	if err := flag.Set("config", filepath.Join(dir, "settings.cfg")); err != nil {
+		return err
+	}
+	for key, value := range map[string]string{
+		"STORAGE_PATH":      filepath.Join(dir, "state"),
+		"BACKUP_DIR":        filepath.Join(dir, "backups"),
+		"AUDIT_PATH":        filepath.Join(dir, "audit.log"),
+		"DELIVERIES_DIR":    filepath.Join(dir, "deliveries"),
+		"IRC_SUPERADMINS":   "admin",
+		"DEBUG_LOGFILE":     filepath.Join(dir, "debug.txt"),
+		"WEBSITE_BASEURL":   "http://bot.test",
+		"GITHUB_HOOKPATH":   "/github",
+		"FACTOIDS_HOOKPATH": "/",
+	} {
+		os.Setenv("OBSCOMMITS_"+key, value)
+	}
+
+	server = fakeirc.New("irc.test", nil)
+	dialIRC = server.Dial
+
+	ctx := context.Background()
+	ctx = config.Init(ctx)
+	ctx = persist.Init(ctx)
+	ctx = tpl.Init(ctx)
+	ctx = perms.Init(ctx)
+	ctx = initIRC(ctx)
+	ctx = sink.Init(ctx)
+	ctx = recovery.Init(ctx)
+	ctx = factoids.Init(ctx)
+	ctx = deliveries.Init(ctx)
+	ctx = github.Init(ctx)
+	ctx = audit.Init(ctx)
+	testCtx = ctx
+
+	return server.WaitRegistered(timeout)
+}
+
+func stopBot() {
+	ctx, cancel := context.WithTimeout(testCtx, timeout)
+	defer cancel()
+
+	deliveries.Drain(ctx)
+	ircconn.FromContext(testCtx).Quit(ctx, "bye")
+	persist.Close()
+}
+
+func say(t *testing.T, nick, account, text string) {
+	t.Helper()
+	if err := server.Say(nick, account, "#obs-dev", text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect checks the next line the bot says or notices
+func expect(t *testing.T, command, target, text string) {
+	t.Helper()
+	m, err := server.Wait(timeout, irc.PRIVMSG, irc.NOTICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := fmt.Sprintf("%s %s :%s", m.Command, strings.Join(m.Params, " "), m.Trailing)
+	if want := fmt.Sprintf("%s %s :%s", command, target, text); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+// expectNothing checks that the bot does not say anything more
+func expectNothing(t *testing.T) {
+	t.Helper()
+	if m, err := server.Wait(500*time.Millisecond, irc.PRIVMSG, irc.NOTICE); err == nil {
+		t.Fatalf("unexpected line %s", m)
+	}
+}
+
+func TestFactoids(t *testing.T) {
+	// people without a role are ignored
+	say(t, "joe", "", ".add foo not from joe")
+	say(t, "jim", "admin", ".add foo the foo is bar")
+	expect(t, irc.NOTICE, "jim", "Added/Modified successfully")
+
+	say(t, "joe", "", "!foo")
+	expect(t, irc.PRIVMSG, "#obs-dev", "the foo is bar")
+
+	say(t, "jim", "admin", ".addalias bar foo")
+	expect(t, irc.NOTICE, "jim", "Added/Modified alias for foo successfully")
+	// said recently, the alias resolves to the same factoid
+	say(t, "joe", "", "!bar")
+	expectNothing(t)
+
+	say(t, "jim", "admin", ".add baz the baz")
+	expect(t, irc.NOTICE, "jim", "Added/Modified successfully")
+	say(t, "joe", "", "!baz jim")
+	expect(t, irc.PRIVMSG, "#obs-dev", "jim: the baz")
+
+	if f, ok := factoids.Get("bar"); !ok || f.Name != "foo" || f.Text != "the foo is bar" {
+		t.Errorf("unexpected factoid %#v", f)
+	}
+}
+
+func TestGrant(t *testing.T) {
+	say(t, "ann", "ann", ".add qux something")
+	expectNothing(t)
+
+	say(t, "jim", "admin", ".grant factoid-editor ann")
+	expect(t, irc.NOTICE, "jim", "Granted factoid-editor to ann successfully")
+	say(t, "ann", "ann", ".grant moderator bob")
+	expect(t, irc.NOTICE, "ann", "You need the moderator role for that")
+	say(t, "ann", "ann", ".add qux something")
+	expect(t, irc.NOTICE, "ann", "Added/Modified successfully")
+
+	// an owner in one channel can not give out roles elsewhere
+	say(t, "jim", "admin", ".grant owner kim #obs-dev")
+	expect(t, irc.NOTICE, "jim", "Granted owner to kim successfully")
+	say(t, "kim", "kim", ".grant owner kim")
+	expect(t, irc.NOTICE, "kim", "You are not allowed to grant the owner role everywhere")
+	say(t, "kim", "kim", ".revoke factoid-editor ann")
+	expect(t, irc.NOTICE, "kim", "You are not allowed to revoke the factoid-editor role everywhere")
+	say(t, "kim", "kim", ".grant moderator lee #obsproject")
+	expect(t, irc.NOTICE, "kim", "You are not allowed to grant the moderator role in #obsproject")
+	say(t, "kim", "kim", ".grant moderator lee #obs-dev")
+	expect(t, irc.NOTICE, "kim", "Granted moderator to lee successfully")
+}
+
+func TestRaw(t *testing.T) {
+	say(t, "joe", "", ".raw QUIT :from joe")
+	expectNothing(t)
+	say(t, "jim", "admin", ".raw PASS hunter2")
+	expectNothing(t)
+
+	var denied, sent bool
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline) && !(denied && sent); time.Sleep(50 * time.Millisecond) {
+		denied, sent = false, false
+		for _, e := range auditEntries(t) {
+			if strings.Contains(e.Args, "hunter2") {
+				t.Fatalf("the password was recorded %+v", e)
+			}
+			switch {
+			case e.Nick == "joe" && e.Command == ".raw" && e.Outcome == "denied":
+				denied = true
+			case e.Nick == "jim" && e.Args == "PASS [redacted]" && e.Outcome == "sent":
+				sent = true
+			}
+		}
+	}
+	if !denied || !sent {
+		t.Fatalf("expected the denied and the redacted .raw in the audit log, got %+v", auditEntries(t))
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, v := range []struct {
+		name, args, want string
+	}{
+		{".raw", "PASS hunter2", "PASS [redacted]"},
+		{".raw", "authenticate aHVudGVyMg==", "AUTHENTICATE [redacted]"},
+		{".raw", "PRIVMSG NickServ :IDENTIFY jim hunter2", "PRIVMSG NickServ [redacted]"},
+		{".raw", "privmsg nickserv@services.test :IDENTIFY hunter2", "PRIVMSG nickserv@services.test [redacted]"},
+		{".raw", "PRIVMSG Q@CServe.quakenet.org :AUTH jim hunter2", "PRIVMSG Q@CServe.quakenet.org [redacted]"},
+		{".raw", "privmsg q :AUTH jim hunter2", "PRIVMSG q [redacted]"},
+		{".raw", "NICKSERV IDENTIFY hunter2", "NICKSERV [redacted]"},
+		{".raw", "ns identify jim hunter2", "NS [redacted]"},
+		{".raw", "PRIVMSG #obs-dev :hunter2", "PRIVMSG #obs-dev :hunter2"},
+		{".raw", "PRIVMSG Quinn :hunter2", "PRIVMSG Quinn :hunter2"},
+		{".add", "PASS hunter2", "PASS hunter2"},
+	} {
+		if got := redact(v.name, v.args); got != v.want {
+			t.Errorf("redact(%q, %q) = %q, expected %q", v.name, v.args, got, v.want)
+		}
+	}
+}
+
+// auditEntries reads the entries of the audit log
+func auditEntries(t *testing.T) []audit.Entry {
+	t.Helper()
+	f, err := os.Open(config.FromContext(testCtx).Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var es []audit.Entry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e audit.Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+func TestGithubPush(t *testing.T) {
+	payload := `{
+		"ref": "refs/heads/master",
+		"before": "aaa",
+		"repository": {"name": "obs-studio", "url": "https://github.com/obsproject/obs-studio"},
+		"commits": [
+			{"id": "0123456789abcdef", "message": "libobs: Fix the crash\n\nThe details", "url": "https://github.com/obsproject/obs-studio/commit/0123456789abcdef", "author": {"username": "jp9000"}},
+			{"id": "fedcba9876543210", "message": "UI: Add a button", "url": "https://github.com/obsproject/obs-studio/commit/fedcba9876543210", "author": {"username": "RytoEX"}}
+		]
+	}`
+	if code := deliver("push", "72d3162e-cc78-11e3-81ab-4c9367dc0958", payload); code != http.StatusAccepted {
+		t.Fatalf("expected the delivery to be queued, got %d", code)
+	}
+
+	expect(t, irc.PRIVMSG, "#obs-dev", "[obs-studio|\x02jp9000\x02] libobs: Fix the crash https://github.com/obsproject/obs-studio/commit/0123456")
+	expect(t, irc.PRIVMSG, "#obs-dev", "[obs-studio|\x02RytoEX\x02] UI: Add a button https://github.com/obsproject/obs-studio/commit/fedcba9")
+	expectNothing(t)
+
+	// GitHub redelivering it is not announced again
+	if code := deliver("push", "72d3162e-cc78-11e3-81ab-4c9367dc0958", payload); code != http.StatusOK {
+		t.Fatalf("expected the duplicate delivery to be dropped, got %d", code)
+	}
+	expectNothing(t)
+}
+
+// deliver sends the payload to the github webhook like GitHub does and
+// returns the status code
+func deliver(event, id, payload string) int {
+	r := httptest.NewRequest("POST", "/github", strings.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Github-Event", event)
+	r.Header.Set("X-Github-Delivery", id)
+
+	w := httptest.NewRecorder()
+	recovery.Handler(http.DefaultServeMux).ServeHTTP(w, r)
+	return w.Code
+}
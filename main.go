@@ -20,15 +20,30 @@
 package main
 
 import (
+	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/obsproject/obscommits/internal/analyzer"
+	"github.com/obsproject/obscommits/internal/audit"
+	"github.com/obsproject/obscommits/internal/backup"
 	"github.com/obsproject/obscommits/internal/config"
 	"github.com/obsproject/obscommits/internal/debug"
+	"github.com/obsproject/obscommits/internal/deliveries"
 	"github.com/obsproject/obscommits/internal/factoids"
 	"github.com/obsproject/obscommits/internal/github"
+	"github.com/obsproject/obscommits/internal/ircconn"
+	"github.com/obsproject/obscommits/internal/matrix"
+	"github.com/obsproject/obscommits/internal/perms"
+	"github.com/obsproject/obscommits/internal/persist"
+	"github.com/obsproject/obscommits/internal/recovery"
 	"github.com/obsproject/obscommits/internal/rss"
+	"github.com/obsproject/obscommits/internal/sink"
 	"github.com/obsproject/obscommits/internal/tpl"
 	"github.com/obsproject/obscommits/internal/travis"
 	"golang.org/x/net/context"
@@ -36,20 +51,103 @@ import (
 
 func main() {
 	time.Local = time.UTC
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	ctx := context.Background()
 	ctx = config.Init(ctx)
 	ctx = d.Init(ctx)
+	ctx = persist.Init(ctx)
 	ctx = tpl.Init(ctx)
+	ctx = perms.Init(ctx)
 	ctx = initIRC(ctx)
+	ctx = sink.Init(ctx)
+	ctx = recovery.Init(ctx)
 	ctx = analyzer.Init(ctx)
 	ctx = factoids.Init(ctx)
+	ctx = matrix.Init(ctx)
 	ctx = rss.Init(ctx)
+	ctx = deliveries.Init(ctx)
 	ctx = github.Init(ctx)
 	ctx = travis.Init(ctx)
+	ctx = backup.Init(ctx)
+	ctx = audit.Init(ctx)
+	initMonitoring(ctx)
+
+	srv := &http.Server{
+		Addr:    config.FromContext(ctx).Website.Addr,
+		Handler: recovery.Handler(http.DefaultServeMux),
+	}
+	done := make(chan struct{})
+	go handleSignals(ctx, srv, done)
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		d.F("ListenAndServe: %v", err)
+	}
+	<-done
+}
+
+// handleSignals reloads the config on SIGHUP and shuts down on SIGINT and
+// SIGTERM, done is closed once the shutdown finished, a second SIGINT or
+// SIGTERM kills the bot if the shutdown hangs
+func handleSignals(ctx context.Context, srv *http.Server, done chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			d.P("Shutting down on", sig)
+			signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+			shutdown(ctx, srv)
+			close(done)
+			return
+		}
+
+		restart, err := config.Reload(ctx)
+		if err != nil {
+			d.P("Could not reload the config, nothing was changed:", err)
+			continue
+		}
+
+		d.P("Reloaded the config")
+		if len(restart) > 0 {
+			d.P("These settings need a restart:", strings.Join(restart, ", "))
+		}
+	}
+}
+
+// shutdownTimeout is how long the shutdown waits for the HTTP requests and
+// the outgoing messages to finish
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops accepting HTTP requests, delivers what is still waiting to
+// be sent, quits IRC and saves every state
+func shutdown(ctx context.Context, srv *http.Server) {
+	sctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(sctx); err != nil {
+		d.P("Could not wait for the HTTP requests to finish", err)
+	}
+	// the queued webhook deliveries announce before the sinks are flushed
+	deliveries.Drain(sctx)
 
-	cfg := config.FromContext(ctx).Website
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sink.FromContext(ctx).Flush(sctx)
+	}()
+	go func() {
+		defer wg.Done()
+		ircconn.FromContext(ctx).Quit(sctx, config.FromContext(ctx).IRC.QuitMessage)
+	}()
+	wg.Wait()
 
-	if err := http.ListenAndServe(cfg.Addr, nil); err != nil {
-		d.F("ListenAndServe:", err)
+	if err := persist.Close(); err != nil {
+		d.P("Could not save the state", err)
 	}
 }